@@ -1,6 +1,9 @@
 package command
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/czxichen/wstools/common/cli"
 	"github.com/spf13/cobra"
 )
@@ -11,13 +14,38 @@ var Ftp = &cobra.Command{
 	Example: `	下载远程/tmp/main.go文件到./目录下
 	-D -u root -p toor -d /server/Res/scenes.ini -s nima -H  127.0.0.1:21
 	上传文件到/Server/main.go
-	-u root -p toor -s main.go -d /Server/main.go -H 127.0.0.1:21`,
+	-u root -p toor -s main.go -d /Server/main.go -H 127.0.0.1:21
+	使用AUTH TLS加密上传文件
+	-u root -p toor -s main.go -d /Server/main.go -H 127.0.0.1:21 --tls --insecure
+	断点续传,失败后最多重试5次
+	-u root -p toor -s big.iso -d /Server/big.iso -H 127.0.0.1:21 --resume --retry 5
+	列出远程目录
+	-a ls -u root -p toor -d /Server -H 127.0.0.1:21
+	把本地目录同步到远程目录,大小和修改时间相同的文件跳过
+	-a mirror -u root -p toor -s ./Server -d /Server -H 127.0.0.1:21
+	把远程目录同步到本地目录
+	-a mirror -D -u root -p toor -s ./Server -d /Server -H 127.0.0.1:21
+	递归删除远程目录
+	-a rm -r -u root -p toor -d /Server/logs -H 127.0.0.1:21`,
 	Short: "FTP上传下载",
-	Long:  "使用简单的FTP协议实现文件的上传下载",
+	Long:  "使用简单的FTP协议实现文件的上传下载,支持AUTH TLS加密,被动模式优先使用EPSV,被动模式不可用的时候使用主动模式;支持列目录,目录同步和删除",
 	Run:   ftpRun,
 }
 
-var ftpConfig FTPConfig
+var (
+	ftpConfig      FTPConfig
+	ftpServeConfig cli.FTPServerConfig
+	// FtpServe ftp服务
+	FtpServe = &cobra.Command{
+		Use: "serve",
+		Example: `	-d /data/ftp -u root -p toor -l :21
+	-d /data/ftp --users ftp.users --pasv-ports 30000-30100 --cert server.crt --key server.key --log upload.log`,
+		Short: "启动ftp服务",
+		Long: `	启动ftp服务,支持主动和被动模式,指定--cert --key的时候支持AUTH TLS,使用-u -p或者--users指定用户,
+	用户文件每行格式为 user:password:root[:ro],root为空的时候使用-d指定的目录,相对路径以-d为基准,ro表示只读.`,
+		Run: ftpServeRun,
+	}
+)
 
 func init() {
 	Ftp.PersistentFlags().StringVarP(&ftpConfig.Host, "host", "H", "", "指定ftp地址端口,不能为空")
@@ -26,25 +54,105 @@ func init() {
 	Ftp.PersistentFlags().StringVarP(&ftpConfig.Source, "source", "s", "", "指定原始文件路径,不能为空")
 	Ftp.PersistentFlags().StringVarP(&ftpConfig.Destination, "destination", "d", "", "指定目标文件路径,不能为空")
 	Ftp.PersistentFlags().BoolVarP(&ftpConfig.Download, "download", "D", false, "从ftp上下载文件")
+	Ftp.PersistentFlags().BoolVarP(&ftpConfig.TLS, "tls", "", false, "使用AUTH TLS加密控制连接和数据连接")
+	Ftp.PersistentFlags().BoolVarP(&ftpConfig.Insecure, "insecure", "", false, "使用TLS的时候不校验服务端证书")
+	Ftp.PersistentFlags().StringVarP(&ftpConfig.CA, "ca", "", "", "使用TLS的时候校验服务端证书的CA文件")
+	Ftp.PersistentFlags().BoolVarP(&ftpConfig.Active, "active", "", false, "使用主动模式传输数据")
+	Ftp.PersistentFlags().StringVarP(&ftpConfig.Action, "action", "a", "", "指定操作,ls:列出-d指定的远程目录,mirror:同步目录,rm:删除-d指定的远程文件或目录,为空的时候传输单个文件")
+	Ftp.PersistentFlags().BoolVarP(&ftpConfig.Recursive, "recursive", "r", false, "rm的时候递归删除目录")
+	Ftp.PersistentFlags().BoolVarP(&ftpConfig.Resume, "resume", "", false, "目标文件已存在并且比源文件小的时候断点续传")
+	Ftp.PersistentFlags().IntVarP(&ftpConfig.Retry, "retry", "", 0, "传输失败之后重新连接并续传的次数")
+	Ftp.PersistentFlags().BoolVarP(&ftpConfig.Verify, "verify", "", false, "传输完成之后使用XMD5或者HASH校验文件内容,续传的文件总是校验")
+	FtpServe.Flags().StringVarP(&ftpServeConfig.Listen, "listen", "l", ":21", "指定监听地址")
+	FtpServe.Flags().StringVarP(&ftpServeConfig.UsersFile, "users", "", "", "指定用户文件")
+	FtpServe.Flags().BoolVarP(&ftpServeConfig.ReadOnly, "readonly", "", false, "-u指定的用户只读")
+	FtpServe.Flags().StringVarP(&ftpServeConfig.CertFile, "cert", "", "", "指定TLS证书,可以使用wstools rsa生成")
+	FtpServe.Flags().StringVarP(&ftpServeConfig.KeyFile, "key", "", "", "指定TLS私钥")
+	FtpServe.Flags().StringVarP(&ftpServeConfig.PassivePorts, "pasv-ports", "", "", "指定被动模式端口范围,如:30000-30100")
+	FtpServe.Flags().StringVarP(&ftpServeConfig.PublicIP, "pasv-ip", "", "", "指定PASV返回的地址,在NAT后面的时候使用")
+	FtpServe.Flags().StringVarP(&ftpServeConfig.UploadLog, "log", "", "", "指定上传日志文件")
+	Ftp.AddCommand(FtpServe)
+}
+
+func ftpServeRun(cmd *cobra.Command, args []string) {
+	if ftpConfig.Destination == "" {
+		cli.FatalOutput(1, "必须使用-d指定服务目录\n")
+	}
+	ftpServeConfig.Root = ftpConfig.Destination
+	ftpServeConfig.User = ftpConfig.User
+	ftpServeConfig.Passwd = ftpConfig.Passwd
+	if err := cli.FTPServe(&ftpServeConfig); err != nil {
+		cli.FatalOutput(1, "ftp serve error:%s\n", err.Error())
+	}
 }
 
 func ftpRun(cmd *cobra.Command, args []string) {
-	if ftpConfig.Host == "" || ftpConfig.User == "" || ftpConfig.Passwd == "" || ftpConfig.Source == "" || ftpConfig.Destination == "" {
+	if ftpConfig.Host == "" || ftpConfig.User == "" || ftpConfig.Passwd == "" || ftpConfig.Destination == "" {
 		cli.FatalOutput(1, "参数错误\n")
 	}
+	switch ftpConfig.Action {
+	case "", "mirror":
+		if ftpConfig.Source == "" {
+			cli.FatalOutput(1, "参数错误\n")
+		}
+	case "ls", "rm":
+	default:
+		cli.FatalOutput(1, "不支持的操作:%s\n", ftpConfig.Action)
+	}
 
-	conn, err := cli.NewFTP(ftpConfig.Host, ftpConfig.User, ftpConfig.Passwd)
+	opt := &cli.FTPOption{TLS: ftpConfig.TLS, Active: ftpConfig.Active, Resume: ftpConfig.Resume,
+		Retry: ftpConfig.Retry, Verify: ftpConfig.Verify, Output: os.Stdout}
+	if ftpConfig.TLS {
+		tlscfg, err := cli.ClientTLSConfig(ftpConfig.CA, ftpConfig.Insecure)
+		if err != nil {
+			cli.FatalOutput(1, "读取CA文件失败:%s\n", err.Error())
+		}
+		opt.TLSConfig = tlscfg
+	}
+	conn, err := cli.NewFTPWithOption(ftpConfig.Host, ftpConfig.User, ftpConfig.Passwd, opt)
 	if err != nil {
 		cli.FatalOutput(1, "登录失败:%s\n", err.Error())
 	}
+	defer conn.Exit()
 
-	if ftpConfig.Download {
-		err = conn.GetFile(ftpConfig.Source, ftpConfig.Destination)
-	} else {
-		err = conn.PutFile(ftpConfig.Source, ftpConfig.Destination)
-	}
-	if err != nil {
-		cli.FatalOutput(1, "文件传输失败:%s\n", err.Error())
+	switch ftpConfig.Action {
+	case "ls":
+		list, err := conn.List(ftpConfig.Destination)
+		if err != nil {
+			cli.FatalOutput(1, "读取目录失败:%s\n", err.Error())
+		}
+		cli.FTPPrintList(os.Stdout, list)
+	case "rm":
+		if err = cli.FTPRemove(conn, ftpConfig.Destination, ftpConfig.Recursive, os.Stdout); err != nil {
+			cli.FatalOutput(1, "删除失败:%s\n", err.Error())
+		}
+	case "mirror":
+		var result *cli.FTPMirrorResult
+		if ftpConfig.Download {
+			result, err = cli.FTPMirrorDownload(conn, ftpConfig.Destination, ftpConfig.Source, os.Stdout)
+		} else {
+			result, err = cli.FTPMirrorUpload(conn, ftpConfig.Source, ftpConfig.Destination, os.Stdout)
+		}
+		if result != nil {
+			fmt.Printf("传输:%d 跳过:%d 大小:%d\n", len(result.Transfer), result.Skipped, result.Bytes)
+		}
+		if err != nil {
+			cli.FatalOutput(1, "同步失败:%s\n", err.Error())
+		}
+	default:
+		if ftpConfig.Download {
+			err = conn.GetFile(ftpConfig.Source, ftpConfig.Destination)
+		} else {
+			err = conn.PutFile(ftpConfig.Source, ftpConfig.Destination)
+		}
+		if err != nil {
+			cli.FatalOutput(1, "文件传输失败:%s\n", err.Error())
+		}
+		if ftpConfig.Download {
+			fmt.Printf("下载完成:%s -> %s\n", ftpConfig.Destination, ftpConfig.Source)
+		} else {
+			fmt.Printf("上传完成:%s -> %s\n", ftpConfig.Source, ftpConfig.Destination)
+		}
 	}
 }
 
@@ -56,4 +164,13 @@ type FTPConfig struct {
 	Source      string
 	Destination string
 	Download    bool
+	TLS         bool
+	Insecure    bool
+	Active      bool
+	CA          string
+	Action      string
+	Recursive   bool
+	Resume      bool
+	Retry       int
+	Verify      bool
 }
@@ -1,21 +1,96 @@
 package command
 
 import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
 	"github.com/czxichen/wstools/common/cli"
+	conf "github.com/dlintw/goconf"
 	"github.com/spf13/cobra"
 )
 
+// sendmailConfigFile sendmail兼容模式默认读取的配置文件,可以使用-C或者WSTOOLS_MAIL_CONFIG环境变量指定
+const sendmailConfigFile = "/etc/wstools/mail.ini"
+
 // Mail 邮件命令
 var Mail = &cobra.Command{
 	Use: "mail",
 	Example: `	发送邮件
-	-u user -p passwd -H smtp.163.com:25 -f czxichen@163.com -t czxichen@163.com -c "Hello world"`,
+	-u user -p passwd -H smtp.163.com:25 -f czxichen@163.com -t czxichen@163.com -c "Hello world"
+	使用465端口的SMTPS发送邮件
+	-u user -p passwd -H smtp.163.com:465 --tls implicit -f czxichen@163.com -t czxichen@163.com -c "Hello world"
+	同时发送文本和带内嵌图片的html,并抄送
+	-u user -p passwd -H smtp.163.com:25 -f "张三 <czxichen@163.com>" -t czxichen@163.com --cc a@163.com --bcc b@163.com -c "Hello world" --html '<img src="cid:logo.png">' --inline logo.png
+	通过不需要认证的内部中继发送
+	-H relay.local:25 --tls none --auth none -f czxichen@163.com -t czxichen@163.com -c "Hello world"
+	使用DKIM签名
+	-u user -p passwd -H smtp.example.com:25 -f ops@example.com -t czxichen@163.com -c "Hello world" --dkim-selector mail --dkim-key dkim.pem
+	作为sendmail使用,从标准输入读取邮件,从邮件头中读取收件人,服务器配置从/etc/wstools/mail.ini读取
+	--sendmail -t -i -f cron@example.com < message.eml
+	发送失败的时候写入队列,之后使用flush重新发送
+	-u user -p passwd -H smtp.163.com:25 -f czxichen@163.com -t czxichen@163.com -c "Hello world" --spool /var/spool/wstools`,
 	Short: "邮件发送",
-	Long:  "使用smtp协议发送邮件,可以为文本格式或带附件发送",
+	Long:  "使用smtp协议发送邮件,可以为文本格式或带附件发送,支持STARTTLS和SMTPS,支持PLAIN,LOGIN,CRAM-MD5认证",
 	Run:   mailRun,
 }
 
-var mailConfig cli.MailConfig
+var (
+	mailConfig      cli.MailConfig
+	mailSendmail    bool
+	mailBulkConfig  cli.MailBulkConfig
+	mailFlushConfig cli.MailFlushConfig
+	mailFetchConfig cli.MailFetchConfig
+	mailServeConfig cli.MailServerConfig
+	mailRelay       cli.MailConfig
+	// MailServe 接收邮件用于测试
+	MailServe = &cobra.Command{
+		Use: "serve",
+		Example: `	-l :2525 --http :8025 --dir ./mails
+	-l :2525 --http :8025 --dir ./mails -u test -p test --cert server.crt --key server.key --require-tls
+	-l :2525 --dir ./mails --relay smtp.163.com:25 --relay-user user --relay-passwd passwd --relay-match "@example\.com$"`,
+		Short: "启动smtp服务接收邮件,用于测试",
+		Long: `	接收所有邮件并保存为--dir目录下的.eml文件,不会投递给收件人,-u -p指定的时候要求AUTH,指定--cert --key的时候支持STARTTLS.
+	--http指定的时候提供查看邮件的页面和JSON API: GET|DELETE /api/messages, GET|DELETE /api/messages/{id}.
+	--relay指定的时候把匹配--relay-match的收件人转发到上游服务器,--tls --ca --insecure --helo用于连接上游服务器,
+	最多同时转发--relay-concurrency封邮件,临时失败的邮件写入--spool队列,默认为--dir下的spool目录,使用mail flush重新发送.`,
+		Run: mailServeRun,
+	}
+	// MailFetch 收取邮件
+	MailFetch = &cobra.Command{
+		Use: "fetch",
+		Example: `	-u user -p passwd -H imap.163.com:993 --sender reports@example.com --subject-regexp "^日报" --since 2018-06-01 -o ./reports --action seen
+	-u user -p passwd -H imap.163.com:143 --tls starttls --folder Reports --unseen -o ./reports --action move --move-to Archive
+	-u user -p passwd -H pop.163.com:995 --unseen -o ./reports --action seen`,
+		Short: "使用IMAP或者POP3收取邮件",
+		Long: `	按文件夹,发件人,主题正则和日期筛选邮件,每封邮件保存为输出目录下的一个子目录,
+	正文转换为UTF-8保存为body.txt和body.html,附件使用原始文件名保存.
+	IMAP可以标记已读,移动或者删除;POP3没有已读标记,seen把已经收取的邮件记录在输出目录的.pop3_seen文件中.
+	服务端不支持STARTTLS/STLS的时候不会明文登录,必须使用--tls none.`,
+		Run: mailFetchRun,
+	}
+	// MailFlush 发送队列中的邮件
+	MailFlush = &cobra.Command{
+		Use: "flush",
+		Example: `	-u user -p passwd -H smtp.163.com:25 --spool /var/spool/wstools
+	-u user -p passwd -H smtp.163.com:25 --spool /var/spool/wstools --daemon --interval 30s --expire 24h`,
+		Short: "重新发送队列中的邮件",
+		Long:  "重新发送--spool目录中发送失败的邮件,重试间隔从1分钟开始每次翻倍,最长1小时,超过--expire的邮件移动到expired目录,服务端永久拒绝(5xx),证书校验失败,本地配置错误,.eml文件丢失或者尝试超过--max-attempts次的邮件移动到failed目录",
+		Run:   mailFlushRun,
+	}
+	// MailBulk 批量发送
+	MailBulk = &cobra.Command{
+		Use: "bulk",
+		Example: `	-l list.csv -u user -p passwd -H smtp.163.com:25 -f czxichen@163.com -t "{{.email}}" -s "{{.team}} 周报" -C report.tpl --html-path report.html.tpl -a "{{.file}}" --rate 2
+	-l list.json -f czxichen@163.com -s "{{.team}} 周报" -C report.tpl --dryrun ./eml`,
+		Short: "使用模板批量发送邮件",
+		Long: `	从csv或者json文件读取列表,每一行生成一封邮件,使用同一个连接发送.
+	-f -t --cc --bcc --reply-to -s -c -C -a --inline --header 使用text/template模板,--html --html-path 使用html/template模板,
+	模板中使用{{.字段名}}引用每行的字段,没有指定收件人的时候使用to字段,attachments字段中的文件会作为附件追加.`,
+		Run: mailBulkRun,
+	}
+)
 
 func init() {
 	Mail.PersistentFlags().StringVarP(&mailConfig.User, "user", "u", "", "指定登录的用户,不能为空")
@@ -28,11 +103,168 @@ func init() {
 	Mail.PersistentFlags().StringVarP(&mailConfig.ContentPath, "Cpath", "C", "", "用文件内容做邮件内容,不能和-c同时使用")
 	Mail.PersistentFlags().StringVarP(&mailConfig.Attachments, "attachments", "a", "", "指定附件路径,多个附件用','分割")
 	Mail.PersistentFlags().StringVarP(&mailConfig.Type, "type", "T", "plain", "指定邮件格式:plain|html")
+	Mail.PersistentFlags().StringVarP(&mailConfig.Cc, "cc", "", "", "指定抄送地址,多地址使用','分割")
+	Mail.PersistentFlags().StringVarP(&mailConfig.Bcc, "bcc", "", "", "指定密送地址,多地址使用','分割,不会出现在邮件头中")
+	Mail.PersistentFlags().StringVarP(&mailConfig.ReplyTo, "reply-to", "", "", "指定回复地址")
+	Mail.PersistentFlags().StringVarP(&mailConfig.HTML, "html", "", "", "指定html内容,和-c或-C同时使用的时候作为multipart/alternative发送")
+	Mail.PersistentFlags().StringVarP(&mailConfig.HTMLPath, "html-path", "", "", "用文件内容做html内容")
+	Mail.PersistentFlags().StringVarP(&mailConfig.Inline, "inline", "", "", "指定html中内嵌的图片,html中使用cid:文件名引用,多个用','分割")
+	Mail.PersistentFlags().StringArrayVarP(&mailConfig.Header, "header", "", nil, "指定自定义邮件头,格式:'Name: value',可以指定多次")
+	Mail.PersistentFlags().StringVarP(&mailConfig.TLS, "tls", "", "", "指定加密方式:none|starttls|implicit,为空的时候服务端支持STARTTLS就使用")
+	Mail.PersistentFlags().StringVarP(&mailConfig.Auth, "auth", "", "plain", "指定认证方式:plain|login|cram-md5|none")
+	Mail.PersistentFlags().StringVarP(&mailConfig.CA, "ca", "", "", "指定校验服务端证书的CA文件")
+	Mail.PersistentFlags().BoolVarP(&mailConfig.Insecure, "insecure", "", false, "不校验服务端证书")
+	Mail.PersistentFlags().StringVarP(&mailConfig.HeloName, "helo", "", "", "指定EHLO使用的名称,默认使用本机主机名")
+	MailBulk.Flags().StringVarP(&mailBulkConfig.List, "list", "l", "", "指定收件人列表,.json为对象数组,其他按csv解析,第一行为字段名")
+	MailBulk.Flags().Float64VarP(&mailBulkConfig.Rate, "rate", "", 0, "每秒最多发送的邮件数,小于等于0不限制")
+	MailBulk.Flags().StringVarP(&mailBulkConfig.DryRun, "dryrun", "", "", "不发送邮件,把每封邮件写入指定目录下的.eml文件")
+	MailBulk.Flags().StringVarP(&mailBulkConfig.Report, "report", "", "", "把发送结果写入指定的csv文件")
+	Mail.PersistentFlags().StringVarP(&mailConfig.Spool, "spool", "", "", "指定队列目录,发送失败的邮件写入此目录,使用flush重新发送")
+	MailFlush.Flags().DurationVarP(&mailFlushConfig.Expire, "expire", "", 72*time.Hour, "超过指定时间还没有发送成功的邮件不再重试")
+	MailFlush.Flags().BoolVarP(&mailFlushConfig.Daemon, "daemon", "", false, "一直运行,定时检查队列")
+	MailFlush.Flags().DurationVarP(&mailFlushConfig.Interval, "interval", "", time.Minute, "--daemon模式下检查队列的间隔")
+	MailFlush.Flags().IntVarP(&mailFlushConfig.Attempts, "max-attempts", "", 30, "尝试发送超过指定次数的邮件不再重试,0表示不限制")
+	Mail.PersistentFlags().StringVarP(&mailConfig.DKIMSelector, "dkim-selector", "", "", "指定DKIM的selector,不为空的时候对邮件签名")
+	Mail.PersistentFlags().StringVarP(&mailConfig.DKIMDomain, "dkim-domain", "", "", "指定DKIM签名的域名,默认使用发件人地址的域名")
+	Mail.PersistentFlags().StringVarP(&mailConfig.DKIMKey, "dkim-key", "", "", "指定DKIM签名使用的RSA私钥文件,PEM格式")
+	Mail.PersistentFlags().BoolVarP(&mailSendmail, "sendmail", "", false, "sendmail兼容模式,必须紧跟在mail之后,后面的参数按sendmail解析;程序名为sendmail的时候自动使用此模式")
+	MailFetch.Flags().StringVarP(&mailFetchConfig.Output, "output", "o", ".", "指定正文和附件保存的目录")
+	MailFetch.Flags().StringVarP(&mailFetchConfig.Protocol, "protocol", "", "", "指定协议:imap|pop3,默认110和995端口使用pop3,其他使用imap")
+	MailFetch.Flags().StringVarP(&mailFetchConfig.Folder, "folder", "", "INBOX", "指定IMAP文件夹")
+	MailFetch.Flags().StringVarP(&mailFetchConfig.Sender, "sender", "", "", "只收取发件人包含指定字符串的邮件")
+	MailFetch.Flags().StringVarP(&mailFetchConfig.Subject, "subject-regexp", "", "", "只收取主题匹配正则表达式的邮件")
+	MailFetch.Flags().StringVarP(&mailFetchConfig.Since, "since", "", "", "只收取指定日期之后的邮件,包括当天,格式:2006-01-02")
+	MailFetch.Flags().StringVarP(&mailFetchConfig.Before, "before", "", "", "只收取指定日期之前的邮件,不包括当天,格式:2006-01-02")
+	MailFetch.Flags().BoolVarP(&mailFetchConfig.Unseen, "unseen", "", false, "只收取未读的邮件")
+	MailFetch.Flags().StringVarP(&mailFetchConfig.Action, "action", "", "none", "保存之后的操作:none|seen|move|delete")
+	MailFetch.Flags().StringVarP(&mailFetchConfig.MoveTo, "move-to", "", "", "move操作的目标文件夹")
+	MailFetch.Flags().IntVarP(&mailFetchConfig.Limit, "limit", "", 0, "最多收取的邮件数,0不限制")
+	MailServe.Flags().StringVarP(&mailServeConfig.Listen, "listen", "l", ":2525", "指定smtp监听地址")
+	MailServe.Flags().StringVarP(&mailServeConfig.HTTPListen, "http", "", "", "指定HTTP界面和API的监听地址,为空的时候不启动")
+	MailServe.Flags().StringVarP(&mailServeConfig.Dir, "dir", "", "mails", "指定保存邮件的目录")
+	MailServe.Flags().StringVarP(&mailServeConfig.CertFile, "cert", "", "", "指定TLS证书,可以使用wstools rsa生成")
+	MailServe.Flags().StringVarP(&mailServeConfig.KeyFile, "key", "", "", "指定TLS私钥")
+	MailServe.Flags().BoolVarP(&mailServeConfig.RequireTLS, "require-tls", "", false, "要求客户端STARTTLS之后才能认证和发送")
+	MailServe.Flags().Int64VarP(&mailServeConfig.MaxSize, "max-size", "", 25<<20, "单封邮件的最大字节数")
+	MailServe.Flags().StringVarP(&mailRelay.Host, "relay", "", "", "指定上游服务器地址端口,匹配的收件人转发到此服务器")
+	MailServe.Flags().StringVarP(&mailRelay.User, "relay-user", "", "", "指定上游服务器的用户名,为空的时候不认证")
+	MailServe.Flags().StringVarP(&mailRelay.Passwd, "relay-passwd", "", "", "指定上游服务器的密码")
+	MailServe.Flags().StringVarP(&mailServeConfig.RelayMatch, "relay-match", "", ".", "转发收件人地址匹配的正则表达式")
+	MailServe.Flags().IntVarP(&mailServeConfig.MaxRelays, "relay-concurrency", "", 4, "同时转发的最大邮件数")
+	Mail.AddCommand(MailBulk, MailFlush, MailFetch, MailServe)
+}
+
+func mailBulkRun(cmd *cobra.Command, args []string) {
+	if mailBulkConfig.List == "" || mailConfig.From == "" {
+		cli.FatalOutput(1, "参数错误,必须指定-l和-f\n")
+	}
+	results, err := cli.MailBulkRun(&mailConfig, &mailBulkConfig, os.Stdout)
+	if err != nil {
+		cli.FatalOutput(1, "批量发送失败:%s\n", err.Error())
+	}
+	var failed int
+	for _, result := range results {
+		if result.Error != nil {
+			failed++
+		}
+	}
+	fmt.Printf("总数:%d 成功:%d 失败:%d\n", len(results), len(results)-failed, failed)
+	if failed > 0 {
+		os.Exit(2)
+	}
+}
+
+func mailFlushRun(cmd *cobra.Command, args []string) {
+	if mailConfig.Spool == "" {
+		cli.FatalOutput(1, "参数错误,必须指定--spool\n")
+	}
+	mailFlushConfig.Dir = mailConfig.Spool
+	if err := cli.MailFlush(&mailConfig, &mailFlushConfig, os.Stdout); err != nil {
+		cli.FatalOutput(1, "发送队列失败:%s\n", err.Error())
+	}
+}
+
+func mailFetchRun(cmd *cobra.Command, args []string) {
+	if mailConfig.Host == "" || mailConfig.User == "" {
+		cli.FatalOutput(1, "参数错误,必须指定-H和-u\n")
+	}
+	if err := cli.MailFetch(&mailConfig, &mailFetchConfig, os.Stdout); err != nil {
+		cli.FatalOutput(1, "收取邮件失败:%s\n", err.Error())
+	}
+}
 
+func mailServeRun(cmd *cobra.Command, args []string) {
+	mailServeConfig.User = mailConfig.User
+	mailServeConfig.Passwd = mailConfig.Passwd
+	mailRelay.TLS, mailRelay.CA, mailRelay.Insecure = mailConfig.TLS, mailConfig.CA, mailConfig.Insecure
+	mailRelay.HeloName, mailRelay.Auth = mailConfig.HeloName, mailConfig.Auth
+	mailRelay.Spool = mailConfig.Spool
+	if err := cli.MailServe(&mailServeConfig, &mailRelay); err != nil {
+		cli.FatalOutput(1, "mail serve error:%s\n", err.Error())
+	}
 }
 
 func mailRun(cmd *cobra.Command, args []string) {
+	if mailSendmail {
+		cli.FatalOutput(1, "--sendmail必须紧跟在mail之后\n")
+	}
 	if err := cli.MailRun(&mailConfig); err != nil {
 		cli.FatalOutput(1, "Send mail error:%s", err.Error())
 	}
 }
+
+// Sendmail sendmail兼容模式,args为sendmail的命令行参数,退出码使用sysexits.h中的定义
+func Sendmail(args []string) {
+	sm, err := cli.ParseSendmailArgs(args)
+	if err != nil {
+		cli.FatalOutput(64, "sendmail:%s\n", err.Error())
+	}
+	if sm.ConfigFile == "" {
+		if sm.ConfigFile = os.Getenv("WSTOOLS_MAIL_CONFIG"); sm.ConfigFile == "" {
+			sm.ConfigFile = sendmailConfigFile
+		}
+	}
+	if err = loadSendmailConfig(sm.ConfigFile, &mailConfig, sm); err != nil {
+		cli.FatalOutput(78, "sendmail:读取配置文件失败 %s:%s\n", sm.ConfigFile, err.Error())
+	}
+	if err = cli.SendmailRun(&mailConfig, sm, os.Stdin); err != nil {
+		cli.FatalOutput(75, "sendmail:发送失败:%s\n", err.Error())
+	}
+}
+
+// loadSendmailConfig 读取sendmail兼容模式的配置文件,[smtp]为服务器配置,[aliases]为本地用户名对应的地址
+func loadSendmailConfig(path string, mailConfig *cli.MailConfig, sm *cli.SendmailConfig) error {
+	cfg, err := conf.ReadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	for _, opt := range []struct {
+		name  string
+		value *string
+	}{{"host", &mailConfig.Host}, {"user", &mailConfig.User}, {"passwd", &mailConfig.Passwd},
+		{"from", &mailConfig.From}, {"tls", &mailConfig.TLS}, {"auth", &mailConfig.Auth},
+		{"ca", &mailConfig.CA}, {"helo", &mailConfig.HeloName}, {"spool", &mailConfig.Spool}, {"domain", &sm.Domain}} {
+		if value := cfgOpt(cfg, "smtp", opt.name); value != "" {
+			*opt.value = value
+		}
+	}
+	if cfg.HasOption("smtp", "insecure") {
+		if mailConfig.Insecure, err = cfg.GetBool("smtp", "insecure"); err != nil {
+			return err
+		}
+	}
+	if mailConfig.Host == "" {
+		return fmt.Errorf("[smtp]中没有指定host")
+	}
+
+	if cfg.HasSection("aliases") {
+		names, _ := cfg.GetOptions("aliases")
+		sm.Aliases = make(map[string]string, len(names))
+		for _, name := range names {
+			if value, err := cfg.GetRawString("aliases", name); err == nil {
+				sm.Aliases[strings.ToLower(name)] = value
+			}
+		}
+	}
+	return nil
+}
@@ -13,6 +13,7 @@ import (
 
 	"github.com/czxichen/wstools/common/cli"
 	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
 )
 
@@ -59,19 +60,24 @@ func monitorRun(cmd *cobra.Command, args []string) {
 	}()
 
 	setValueFunc()
-	if monitorCfg.Listen != "" {
-		http.Handle(monitorCfg.Prefix, cli.MonitorHandler(gather))
-		if err := http.ListenAndServe(monitorCfg.Listen, nil); err != nil {
+	exportMetrics(&monitorCfg, gather)
+}
+
+// exportMetrics 指定Listen的时候提供pull接口,否则每Interval秒推送到PushGateway
+func exportMetrics(cfg *monitorConfig, gather prometheus.Gatherer) {
+	if cfg.Listen != "" {
+		http.Handle(cfg.Prefix, cli.MonitorHandler(gather))
+		if err := http.ListenAndServe(cfg.Listen, nil); err != nil {
 			fmt.Printf("Listen server error:%s\n", err.Error())
 		}
-	} else if monitorCfg.Endpoint != "" {
-		if monitorCfg.Instance == "" {
-			monitorCfg.Instance = getLocalAddress(monitorCfg.Endpoint)
+	} else if cfg.Endpoint != "" {
+		if cfg.Instance == "" {
+			cfg.Instance = getLocalAddress(cfg.Endpoint)
 		}
-		endpoint := fmt.Sprintf("%s/job/%s/instance/%s", monitorCfg.Endpoint, monitorCfg.JobName, monitorCfg.Instance)
+		endpoint := fmt.Sprintf("%s/job/%s/instance/%s", cfg.Endpoint, cfg.JobName, cfg.Instance)
 		contentType := mime.FormatMediaType("application/vnd.google.protobuf",
 			map[string]string{"encoding": "delimited", "proto": "io.prometheus.client.MetricFamily"})
-		ticker := time.NewTicker(time.Second * time.Duration(monitorCfg.Interval))
+		ticker := time.NewTicker(time.Second * time.Duration(cfg.Interval))
 		defer ticker.Stop()
 		for range ticker.C {
 			family, err := gather.Gather()
@@ -87,6 +93,7 @@ func monitorRun(cmd *cobra.Command, args []string) {
 					if resp.StatusCode != http.StatusAccepted {
 						fmt.Printf("send to %s data error:%s\n", endpoint, resp.Status)
 					}
+					resp.Body.Close()
 				}
 			}
 		}
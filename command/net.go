@@ -1,7 +1,13 @@
 package command
 
 import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
 	"github.com/czxichen/wstools/common/cli"
+	conf "github.com/dlintw/goconf"
 	"github.com/spf13/cobra"
 )
 
@@ -10,23 +16,215 @@ var Net = &cobra.Command{
 	Use: "net",
 	Example: `	并发模式ping测试指定主机的网络连通性
 	-a ping -i www.baidu.com,www.163.com -c 4 -q
+	使用IPv6地址ping
+	-a ping -i ::1 -6
+	每0.2秒ping一次,直到Ctrl-C之后输出统计表格
+	-a ping -i www.baidu.com,www.163.com -c 0 --interval 0.2 --size 1000 -s -q
 	telnet测试指定端口是否开启
-	-a telnet -i www.baidu.com:80`,
+	-a telnet -i www.baidu.com:80
+	扫描网段的端口,只输出开放的端口并读取banner
+	-a scan -i 192.168.1.0/24,www.baidu.com -p 22,80,8000-8100 --concurrency 200 --rate 500 --open --banner
+	扫描结果写入csv文件
+	-a scan -H hosts.txt -p 1-1024 -t 1 --format csv -o result.csv
+	使用TCP SYN探测到目标的路径
+	-a trace -i www.baidu.com --proto tcp -p 443
+	每跳探测10次,统计丢包率和延迟
+	-a mtr -i www.baidu.com --proto icmp -c 10 -t 1
+	检查url的状态码,正文和证书有效期,失败的时候退出码为1,可以用于crontab
+	-a http -i https://www.baidu.com,http://www.163.com --status 200-299 --match "</html>" --max-time 2000 --cert-days 15 -q
+	使用DoT向多个服务器查询记录,比较应答是否一致
+	-a dns -i www.baidu.com,baidu.com --type A,AAAA,MX --server 1.1.1.1,8.8.8.8 --proto tls
+	反向解析
+	-a dns -i 8.8.8.8 --type PTR`,
 	Short: "网络连通性工具",
-	Long:  "网络连通性工具,支持ping|telnet命令",
+	Long:  "网络连通性工具,支持ping|telnet|scan|trace|mtr|http|dns命令,trace和mtr需要root权限",
 	Run:   netRun,
 }
 
-var netConfig cli.NetConfig
+var (
+	netConfig   cli.NetConfig
+	netProbeCfg netProbeConfig
+	// NetProbe 持续探测并导出监控项
+	NetProbe = &cobra.Command{
+		Use: "probe",
+		Example: `	提供pull接口,prometheus从http://host:9115/metrics采集
+	-T probe.ini -l :9115
+	每30秒推送到PushGateway
+	-T probe.ini -e http://192.168.0.128:9091/metrics --push-interval 30`,
+		Short: "持续探测目标并导出Prometheus监控项",
+		Long: `	按照目标文件中每个目标的间隔持续执行ping,tcp,http和dns探测,结果作为Prometheus监控项导出,
+	监控项为probe_success,probe_duration_seconds,probe_loss_ratio,probe_http_status_code,probe_tls_cert_days.
+	目标文件为ini格式,每个section是一个目标,[default]中的选项作为所有目标的默认值,没有指定的选项使用net命令参数的默认值:
+	[default]
+	interval = 30
+	[baidu]
+	type = ping
+	target = www.baidu.com
+	count = 5
+	[ssh]
+	type = tcp
+	target = 192.168.1.2:22
+	[web]
+	type = http
+	target = https://www.baidu.com
+	status = 200-299
+	cert-days = 15
+	[resolve]
+	type = dns
+	target = www.baidu.com
+	record = A
+	server = 1.1.1.1,8.8.8.8
+	type为ping|tcp|http|dns,interval为探测间隔,单位秒;其他选项和net命令的长参数同名,dns的记录类型使用record指定.`,
+		Run: netProbeRun,
+	}
+)
+
+var (
+	netBenchCfg cli.NetBenchConfig
+	// NetBench 吞吐量测试客户端
+	NetBench = &cobra.Command{
+		Use: "bench",
+		Example: `	4个tcp连接测试两个方向的吞吐量,每个方向30秒
+	-H 192.168.1.2 -P 4 -d 30
+	以100Mbit/s的速率测试udp上传的丢包和抖动,结果输出为json
+	-H 192.168.1.2:5201 -u -b 100M --direction up --format json`,
+		Short: "测试到服务端的吞吐量",
+		Long: `	连接wstools net bench serve启动的服务端,测试tcp单连接和多连接的吞吐量,或者udp的吞吐量,抖动和丢包,
+	使用-H指定服务端地址,默认端口为5201;up为客户端发送,down为服务端发送,每个方向每秒输出一次接收方的统计,最后输出汇总,--format json的时候只输出json结果.`,
+		Run: netBenchRun,
+	}
+	// NetBenchServe 吞吐量测试服务端
+	NetBenchServe = &cobra.Command{
+		Use:     "serve",
+		Example: "-l :5201",
+		Short:   "启动吞吐量测试服务",
+		Long:    "启动吞吐量测试服务,tcp和udp使用同一个端口,需要防火墙同时放行;反向udp测试只向控制连接的地址发送,速率不超过--max-bandwidth",
+		Run:     netBenchServeRun,
+	}
+)
+
+var (
+	netForwardCfg cli.NetForwardConfig
+	// NetForward 端口转发
+	NetForward = &cobra.Command{
+		Use: "forward",
+		Example: `	把本机8080端口转发到两个后端,轮询使用
+	-r ":8080->192.168.1.2:80,192.168.1.3:80" --max-conns 1000 --idle 600
+	转发dns的udp端口,同时在8443端口终止tls之后转发到本机的http服务
+	-r "udp://:53->8.8.8.8:53" -r "tls://:8443->127.0.0.1:80" --cert server.crt --key server.key --log forward.log`,
+		Short: "tcp和udp端口转发",
+		Long: `	按照规则转发tcp和udp端口,规则格式为[tcp|udp|tls://]listen->target[,target...],没有协议的时候为tcp,
+	tls在监听端使用--cert和--key终止,到目标使用tcp;多个目标的时候按连接轮询,连接失败的时候尝试下一个目标.
+	每个连接结束的时候输出上下行字节数,--log日志每行格式为:时间 协议 客户端 监听地址 目标 上行字节 下行字节 耗时 结果.`,
+		Run: netForwardRun,
+	}
+)
+
+var (
+	netTransferCfg cli.NetTransferConfig
+	// NetListen 接收net send发送的数据
+	NetListen = &cobra.Command{
+		Use: "listen",
+		Example: `	接收目录,保存到/data/backup
+	-l :9000 -o /data/backup --key 123456
+	接收数据流写入标准输出
+	-l :9000 | tar -x`,
+		Short: "接收wstools net send发送的数据",
+		Long: `	监听tcp端口,接收一个连接发送的数据之后退出;发送的是文件和目录的时候解压到-o指定的目录,默认为当前目录,
+	否则写入-o指定的文件,默认为标准输出;使用--key的时候每一帧使用AES-256-GCM解密和认证,只写入认证通过的数据;数据结束的时候校验sha256,校验结果返回给发送方.`,
+		Run: netListenRun,
+	}
+	// NetSend 发送数据到net listen
+	NetSend = &cobra.Command{
+		Use: "send",
+		Example: `	压缩并加密发送目录和文件
+	-H 192.168.1.2:9000 -z --key 123456 /data/www nginx.conf
+	发送标准输入
+	-H 192.168.1.2:9000 < backup.sql`,
+		Short: "发送标准输入或者文件和目录到wstools net listen",
+		Long: `	连接-H指定的接收方,有参数的时候使用tar格式发送参数中的文件和目录,否则发送标准输入,
+	-z使用gzip压缩,--key使用预共享密钥加密,两端的密钥必须相同;接收方校验失败的时候返回错误.`,
+		Run: netSendRun,
+	}
+)
+
+type netProbeConfig struct {
+	monitorConfig
+	Targets string
+}
 
 func init() {
-	Net.PersistentFlags().StringVarP(&netConfig.Action, "action", "a", "ping", "指定动作只支持ping,telnet两种")
-	Net.PersistentFlags().StringVarP(&netConfig.Host, "ip", "i", "", "指定目标地址,当-a为telnet的时候远程地址必须包含端口,多地址用','分割")
-	Net.PersistentFlags().StringVarP(&netConfig.Hosts, "hosts", "H", "", "文件读取目标地址,按行解析,如果指定-h则此参数无效")
-	Net.PersistentFlags().IntVarP(&netConfig.TimeOut, "timeout", "t", 5, "设置超时时间,使用telnet的时候此参数有效")
-	Net.PersistentFlags().IntVarP(&netConfig.Count, "count", "c", 2, "指定发出ping的次数")
-	Net.PersistentFlags().BoolVarP(&netConfig.Sum, "sum", "s", false, "以统计方式输出结果")
-	Net.PersistentFlags().BoolVarP(&netConfig.Quick, "quick", "q", false, "使用并发模式")
+	Net.Flags().StringVarP(&netConfig.Action, "action", "a", "ping", "指定动作:ping|telnet|scan|trace|mtr|http|dns")
+	Net.Flags().StringVarP(&netConfig.Host, "ip", "i", "", "指定目标地址,当-a为telnet的时候远程地址必须包含端口,多地址用','分割")
+	Net.Flags().StringVarP(&netConfig.Hosts, "hosts", "H", "", "文件读取目标地址,按行解析,如果指定-h则此参数无效")
+	Net.Flags().IntVarP(&netConfig.TimeOut, "timeout", "t", 5, "设置超时时间,单位秒")
+	Net.Flags().IntVarP(&netConfig.Count, "count", "c", 2, "指定发出ping的次数,0持续ping直到Ctrl-C")
+	Net.Flags().BoolVarP(&netConfig.Sum, "sum", "s", false, "以统计方式输出结果,包括延迟的分布,丢包,重复和乱序的响应")
+	Net.Flags().Float64VarP(&netConfig.Interval, "interval", "", 1, "ping的间隔,单位秒")
+	Net.Flags().IntVarP(&netConfig.Size, "size", "", 32, "ping的数据长度")
+	Net.Flags().IntVarP(&netConfig.TTL, "ttl", "", 0, "ping的TTL,0使用系统默认值")
+	Net.Flags().BoolVarP(&netConfig.Quick, "quick", "q", false, "使用并发模式")
+	Net.Flags().BoolVarP(&netConfig.IPv4, "ipv4", "4", false, "只使用IPv4地址")
+	Net.Flags().BoolVarP(&netConfig.IPv6, "ipv6", "6", false, "只使用IPv6地址")
+	Net.Flags().StringVarP(&netConfig.Ports, "ports", "p", "", "scan的端口列表,例如:22,80,8000-8100")
+	Net.Flags().IntVarP(&netConfig.Concurrency, "concurrency", "", 100, "scan的并发数")
+	Net.Flags().Float64VarP(&netConfig.Rate, "rate", "", 0, "scan每秒最多发起的连接数,0不限制")
+	Net.Flags().BoolVarP(&netConfig.Banner, "banner", "", false, "scan读取端口的banner")
+	Net.Flags().BoolVarP(&netConfig.OpenOnly, "open", "", false, "scan只输出开放的端口")
+	Net.Flags().StringVarP(&netConfig.Format, "format", "", "table", "scan,http和dns结果的格式:table|json|csv,只有scan支持csv")
+	Net.Flags().StringVarP(&netConfig.Output, "output", "o", "", "scan结果写入的文件,默认输出到标准输出")
+	Net.Flags().StringVarP(&netConfig.Proto, "proto", "", "udp", "trace和mtr的探测协议:udp|icmp|tcp,udp和tcp的目标端口使用-p指定;dns的传输协议:udp|tcp|tls")
+	Net.Flags().IntVarP(&netConfig.MaxHops, "max-hops", "", 30, "trace和mtr的最大跳数")
+	Net.Flags().IntVarP(&netConfig.Queries, "queries", "", 3, "trace每跳的探测次数")
+	Net.Flags().StringVarP(&netConfig.Method, "method", "", "GET", "http请求的方法")
+	Net.Flags().StringVarP(&netConfig.Status, "status", "", "200-399", "http允许的状态码,例如:200-299,301")
+	Net.Flags().StringVarP(&netConfig.Match, "match", "", "", "http正文需要匹配的正则表达式")
+	Net.Flags().IntVarP(&netConfig.MaxTime, "max-time", "", 0, "http总耗时的上限,单位毫秒,0不检查")
+	Net.Flags().IntVarP(&netConfig.CertDays, "cert-days", "", 0, "http证书剩余有效天数小于此值的时候失败")
+	Net.Flags().StringVarP(&netConfig.CA, "ca", "", "", "http和dns over tls验证服务端证书使用的CA文件")
+	Net.Flags().BoolVarP(&netConfig.Insecure, "insecure", "", false, "http和dns over tls不验证服务端证书")
+	Net.Flags().StringVarP(&netConfig.Type, "type", "", "A", "dns查询的记录类型:A|AAAA|CNAME|MX|TXT|SRV|PTR|NS|SOA,多个类型用','分割")
+	Net.Flags().StringVarP(&netConfig.Server, "server", "", "", "dns服务器,多个服务器用','分割,默认使用/etc/resolv.conf中的服务器")
+	NetProbe.Flags().StringVarP(&netProbeCfg.Targets, "targets", "T", "probe.ini", "探测目标文件")
+	NetProbe.Flags().StringVarP(&netProbeCfg.Listen, "listen", "l", "", "监听地址端口,如果不为空则Endpoint参数不可用")
+	NetProbe.Flags().StringVarP(&netProbeCfg.Prefix, "prefix", "", "/metrics", "指定pull的uri路径,指定Listen时生效")
+	NetProbe.Flags().StringVarP(&netProbeCfg.Endpoint, "endpoint", "e", "", "PushGateway地址:http://127.0.0.1/metrics")
+	NetProbe.Flags().StringVarP(&netProbeCfg.JobName, "job_name", "j", "probe", "设置job名称")
+	NetProbe.Flags().StringVarP(&netProbeCfg.Instance, "instance", "", "", "设置实例名称")
+	NetProbe.Flags().IntVarP(&netProbeCfg.Interval, "push-interval", "", 60, "推送到PushGateway的时间间隔,单位:s")
+	NetBench.Flags().StringVarP(&netBenchCfg.Host, "host", "H", "", "服务端地址,默认端口为5201")
+	NetBench.Flags().StringVarP(&netBenchCfg.Format, "format", "", "table", "结果的格式:table|json")
+	NetBench.Flags().IntVarP(&netBenchCfg.TimeOut, "timeout", "t", 5, "连接服务端的超时时间,单位秒")
+	NetBench.Flags().BoolVarP(&netConfig.IPv4, "ipv4", "4", false, "只使用IPv4地址")
+	NetBench.Flags().BoolVarP(&netConfig.IPv6, "ipv6", "6", false, "只使用IPv6地址")
+	NetBench.Flags().BoolVarP(&netBenchCfg.UDP, "udp", "u", false, "使用udp测试")
+	NetBench.Flags().IntVarP(&netBenchCfg.Streams, "parallel", "P", 1, "tcp并发的连接数")
+	NetBench.Flags().IntVarP(&netBenchCfg.Duration, "duration", "d", 10, "每个方向的测试时间,单位秒")
+	NetBench.Flags().StringVarP(&netBenchCfg.Direction, "direction", "", "both", "测试的方向:up|down|both")
+	NetBench.Flags().StringVarP(&netBenchCfg.Bandwidth, "bandwidth", "b", "1M", "udp的发送速率,单位bit/s,可以使用K,M,G后缀,0不限制")
+	NetBench.Flags().IntVarP(&netBenchCfg.Length, "length", "", 0, "tcp每次写入的字节数或者udp报文的长度,默认tcp为128K,udp为1400")
+	NetBenchServe.Flags().StringVarP(&netBenchCfg.Listen, "listen", "l", ":5201", "指定监听地址")
+	NetBenchServe.Flags().StringVarP(&netBenchCfg.MaxBandwidth, "max-bandwidth", "", "1G", "反向udp测试的最大发送速率,单位bit/s,0不限制")
+	NetBench.AddCommand(NetBenchServe)
+	NetForward.Flags().StringArrayVarP(&netForwardCfg.Rules, "rule", "r", nil, "转发规则,可以指定多次,也可以作为参数")
+	NetForward.Flags().IntVarP(&netForwardCfg.MaxConns, "max-conns", "", 0, "每个规则的最大连接数,udp为最大会话数,0不限制")
+	NetForward.Flags().IntVarP(&netForwardCfg.Idle, "idle", "", 300, "连接空闲超时时间,单位秒,0不超时")
+	NetForward.Flags().StringVarP(&netForwardCfg.CertFile, "cert", "", "", "tls规则使用的证书,可以使用wstools rsa生成")
+	NetForward.Flags().StringVarP(&netForwardCfg.KeyFile, "key", "", "", "tls规则使用的私钥")
+	NetForward.Flags().StringVarP(&netForwardCfg.Log, "log", "", "", "连接日志文件")
+	NetForward.Flags().IntVarP(&netForwardCfg.TimeOut, "timeout", "t", 5, "连接目标的超时时间,单位秒")
+	NetListen.Flags().StringVarP(&netTransferCfg.Listen, "listen", "l", ":9000", "指定监听地址")
+	NetListen.Flags().StringVarP(&netTransferCfg.Output, "output", "o", "", "保存文件的目录或者数据写入的文件,默认为当前目录或者标准输出")
+	NetListen.Flags().StringVarP(&netTransferCfg.Key, "key", "k", "", "预共享密钥,必须和发送方相同")
+	NetListen.Flags().BoolVarP(&netTransferCfg.Progress, "progress", "", true, "在标准错误输出显示进度")
+	NetSend.Flags().StringVarP(&netTransferCfg.Host, "host", "H", "", "接收方地址")
+	NetSend.Flags().IntVarP(&netTransferCfg.TimeOut, "timeout", "t", 5, "连接接收方的超时时间,单位秒")
+	NetSend.Flags().BoolVarP(&netConfig.IPv4, "ipv4", "4", false, "只使用IPv4地址")
+	NetSend.Flags().BoolVarP(&netConfig.IPv6, "ipv6", "6", false, "只使用IPv6地址")
+	NetSend.Flags().BoolVarP(&netTransferCfg.Gzip, "gzip", "z", false, "使用gzip压缩")
+	NetSend.Flags().StringVarP(&netTransferCfg.Key, "key", "k", "", "预共享密钥,不为空的时候加密传输,必须和接收方相同")
+	NetSend.Flags().BoolVarP(&netTransferCfg.Progress, "progress", "", true, "在标准错误输出显示进度")
+	Net.AddCommand(NetProbe, NetBench, NetForward, NetListen, NetSend)
 }
 
 func netRun(cmd *cobra.Command, args []string) {
@@ -34,3 +232,111 @@ func netRun(cmd *cobra.Command, args []string) {
 		cli.FatalOutput(1, "net run error:%s\n", err.Error())
 	}
 }
+
+func netProbeRun(cmd *cobra.Command, args []string) {
+	// 探测结果只通过监控接口导出,两个都没有指定的时候探测没有意义
+	if netProbeCfg.Listen == "" && netProbeCfg.Endpoint == "" {
+		cli.FatalOutput(1, "必须使用-l指定监听地址或者使用-e指定PushGateway地址\n")
+	}
+	targets, err := loadProbeTargets(netProbeCfg.Targets, netConfig)
+	if err != nil {
+		cli.FatalOutput(1, "读取探测目标失败:%s\n", err.Error())
+	}
+	gather, err := cli.NetProbe(targets)
+	if err != nil {
+		cli.FatalOutput(1, "net probe error:%s\n", err.Error())
+	}
+	exportMetrics(&netProbeCfg.monitorConfig, gather)
+}
+
+// loadProbeTargets 读取探测目标文件,section中没有的选项先从[default]中读取,再使用base中的值
+func loadProbeTargets(path string, base cli.NetConfig) ([]*cli.ProbeTarget, error) {
+	cfg, err := conf.ReadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sections := cfg.GetSections()
+	sort.Strings(sections)
+
+	var targets []*cli.ProbeTarget
+	for _, name := range sections {
+		if name == conf.DefaultSection {
+			continue
+		}
+		opt := func(option string) string {
+			if value, err := cfg.GetString(name, option); err == nil {
+				return value
+			}
+			value, _ := cfg.GetString(conf.DefaultSection, option)
+			return value
+		}
+		t := &cli.ProbeTarget{Name: name, Type: strings.ToLower(opt("type")), Target: opt("target"), Interval: 30, Config: base}
+		if t.Type == "" || t.Target == "" {
+			return nil, fmt.Errorf("[%s]必须指定type和target", name)
+		}
+		for _, o := range []struct {
+			name  string
+			value *string
+		}{{"method", &t.Config.Method}, {"status", &t.Config.Status}, {"match", &t.Config.Match}, {"ca", &t.Config.CA},
+			{"record", &t.Config.Type}, {"server", &t.Config.Server}, {"proto", &t.Config.Proto}} {
+			if value := opt(o.name); value != "" {
+				*o.value = value
+			}
+		}
+		for _, o := range []struct {
+			name  string
+			value *int
+		}{{"interval", &t.Interval}, {"timeout", &t.Config.TimeOut}, {"count", &t.Config.Count}, {"size", &t.Config.Size},
+			{"ttl", &t.Config.TTL}, {"max-time", &t.Config.MaxTime}, {"cert-days", &t.Config.CertDays}} {
+			if value := opt(o.name); value != "" {
+				if *o.value, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("[%s]%s不是有效的整数:%s", name, o.name, value)
+				}
+			}
+		}
+		for _, o := range []struct {
+			name  string
+			value *bool
+		}{{"insecure", &t.Config.Insecure}, {"ipv4", &t.Config.IPv4}, {"ipv6", &t.Config.IPv6}} {
+			if value := opt(o.name); value != "" {
+				if *o.value, err = strconv.ParseBool(value); err != nil {
+					return nil, fmt.Errorf("[%s]%s不是有效的布尔值:%s", name, o.name, value)
+				}
+			}
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+func netBenchRun(cmd *cobra.Command, args []string) {
+	if err := cli.NetBench(&netBenchCfg, &netConfig); err != nil {
+		cli.FatalOutput(1, "net bench error:%s\n", err.Error())
+	}
+}
+
+func netBenchServeRun(cmd *cobra.Command, args []string) {
+	if err := cli.NetBenchServe(&netBenchCfg); err != nil {
+		cli.FatalOutput(1, "net bench serve error:%s\n", err.Error())
+	}
+}
+
+func netForwardRun(cmd *cobra.Command, args []string) {
+	netForwardCfg.Rules = append(netForwardCfg.Rules, args...)
+	if err := cli.NetForward(&netForwardCfg); err != nil {
+		cli.FatalOutput(1, "net forward error:%s\n", err.Error())
+	}
+}
+
+func netListenRun(cmd *cobra.Command, args []string) {
+	if err := cli.NetListen(&netTransferCfg); err != nil {
+		cli.FatalOutput(1, "net listen error:%s\n", err.Error())
+	}
+}
+
+func netSendRun(cmd *cobra.Command, args []string) {
+	netTransferCfg.Paths = args
+	if err := cli.NetSend(&netTransferCfg, &netConfig); err != nil {
+		cli.FatalOutput(1, "net send error:%s\n", err.Error())
+	}
+}
@@ -6,9 +6,11 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/czxichen/wstools/common/cli"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 var (
@@ -20,10 +22,40 @@ var (
 	-C iplist -s main.go -d /tmp
 	-c ls -u root -p 123456 -H 192.168.1.2:22
 	-c ls -u root -P id_rsa -H 192.168.0.129:22
-	-u root -p 123456 -H 192.168.1.2:22 -s main.go -d /tmp`,
+	-u root -p 123456 -H 192.168.1.2:22 -s main.go -d /tmp
+	-C iplist -r -s release -d /data/release --delete --dryrun
+	-C iplist -c ls --audit /var/log/wstools
+	-I -u root -P id_rsa -H 192.168.0.129:22 --audit /var/log/wstools`,
 		Run:   sshRun,
 		Short: "使用ssh协议群发命令或发送文件",
-		Long: `	通过ssh协议群发命令,每个命令发送都是新的session,当从文件读取主机地址和账户密码的时候,格式为IP:PORT USERNAME PASSWD,使用空白分割,-u -p -H 参数不生效,当发送文件的时候目标的地址可以是目录,当是目录的时候保存的文件名,保存为发送的文件名称.`,
+		Long: `	通过ssh协议群发命令,每个命令发送都是新的session,当从文件读取主机地址和账户密码的时候,格式为IP:PORT USERNAME PASSWD,使用空白分割,-u -p -H 参数不生效,当发送文件的时候目标的地址可以是目录,当是目录的时候保存的文件名,保存为发送的文件名称.
+	使用-r参数同步目录时,会比较本地和远程的文件列表和md5,只传输有变化的文件并保持文件权限,--delete删除远程多余的文件,--dryrun只输出每个主机要变更的内容.
+	指定--audit参数时,批量命令以json行格式记录命令,主机,用户和时间,-I交互会话以asciinema v2格式记录输出,--audit-input同时记录输入,使用replay子命令回放.`,
+	}
+
+	sshReplayConfig struct {
+		speed float64
+		idle  float64
+	}
+	// SSHReplay 回放审计记录
+	SSHReplay = &cobra.Command{
+		Use: `replay`,
+		Example: `	/var/log/wstools/shell-192.168.0.129_22-20180601-120000-1234.cast --speed 2
+	/var/log/wstools/batch-20180601-120000-1234.jsonl`,
+		Run:   sshReplayRun,
+		Short: "回放ssh审计记录",
+		Long:  `	按时间回放交互会话的.cast文件,或者输出批量命令的.jsonl记录文件.`,
+	}
+
+	sshServeConfig cli.SSHServerConfig
+	// SSHServe ssh服务
+	SSHServe = &cobra.Command{
+		Use: `serve`,
+		Example: `	-l :2222 -u root -p 123456
+	-l :2222 -a authorized_keys -k host.key`,
+		Run:   sshServeRun,
+		Short: "启动ssh服务,支持执行命令,交互shell和sftp",
+		Long:  `	在没有sshd的机器上启动ssh服务,支持执行命令,pty交互shell和sftp,使用-u -p 参数做密码认证,-a 指定authorized_keys做公钥认证,只允许-u指定的用户登录,默认为当前系统用户,主机私钥不存在的时候会自动生成并保存.`,
 	}
 )
 
@@ -35,6 +67,12 @@ type ssh struct {
 	privatekey   string
 	timeout      int
 	hostfile     bool
+	sync         bool
+	delete       bool
+	dryrun       bool
+	interactive  bool
+	audit        string
+	auditInput   bool
 }
 
 func init() {
@@ -49,6 +87,40 @@ func init() {
 	SSH.PersistentFlags().StringVarP(&sshConfig.out, "out", "o", "", `指定结果输出文件,不指定则直接输出到标准输出`)
 	SSH.PersistentFlags().BoolVarP(&sshConfig.hostfile, "hostfile", "f", false, `指定Host从文件读取,指定次参数,-H参数必须是文件路径`)
 	SSH.PersistentFlags().IntVarP(&sshConfig.timeout, "timeout", "t", 30, `指定连接超时时间`)
+	SSH.PersistentFlags().BoolVarP(&sshConfig.sync, "sync", "r", false, `同步目录,-s和-d必须是目录,只发送有变化的文件,本地的符号链接不同步`)
+	SSH.PersistentFlags().BoolVarP(&sshConfig.delete, "delete", "", false, `同步目录时删除远程多余的文件`)
+	SSH.PersistentFlags().BoolVarP(&sshConfig.dryrun, "dryrun", "", false, `同步目录时只输出要变更的内容,不做实际操作`)
+	SSH.PersistentFlags().BoolVarP(&sshConfig.interactive, "interactive", "I", false, `打开交互shell,只能指定一个主机`)
+	SSH.PersistentFlags().StringVarP(&sshConfig.audit, "audit", "", "", `指定审计记录保存目录,为空则不记录`)
+	SSH.PersistentFlags().BoolVarP(&sshConfig.auditInput, "audit-input", "", false, `交互会话同时记录输入,输入中可能包含明文密码`)
+}
+
+func init() {
+	SSHServe.Flags().StringVarP(&sshServeConfig.Listen, "listen", "l", ":2222", `指定监听地址`)
+	SSHServe.Flags().StringVarP(&sshServeConfig.HostKey, "hostkey", "k", "ssh_host_ecdsa_key", `指定主机私钥路径,不存在则自动生成`)
+	SSHServe.Flags().StringVarP(&sshServeConfig.AuthorizedKeys, "authorized", "a", "", `指定authorized_keys文件路径`)
+	SSHServe.Flags().StringVarP(&sshServeConfig.Shell, "shell", "", "", `指定执行命令使用的shell,默认为$SHELL或/bin/sh,windows为cmd.exe`)
+	SSHReplay.Flags().Float64VarP(&sshReplayConfig.speed, "speed", "", 1, `回放倍速`)
+	SSHReplay.Flags().Float64VarP(&sshReplayConfig.idle, "idle", "", 2, `最长的等待时间,单位:s,小于等于0不限制`)
+	SSH.AddCommand(SSHServe, SSHReplay)
+}
+
+func sshReplayRun(cmd *cobra.Command, arg []string) {
+	if len(arg) != 1 {
+		cli.FatalOutput(1, "必须指定要回放的记录文件\n")
+	}
+	idle := time.Duration(sshReplayConfig.idle * float64(time.Second))
+	if err := cli.SSHReplay(arg[0], os.Stdout, sshReplayConfig.speed, idle); err != nil {
+		cli.FatalOutput(1, "回放失败:%s\n", err.Error())
+	}
+}
+
+func sshServeRun(cmd *cobra.Command, arg []string) {
+	sshServeConfig.User = sshConfig.user
+	sshServeConfig.Passwd = sshConfig.passwd
+	if err := cli.SSHServe(&sshServeConfig); err != nil {
+		cli.FatalOutput(1, "ssh serve error:%s\n", err.Error())
+	}
 }
 
 func sshRun(cmd *cobra.Command, arg []string) {
@@ -89,7 +161,7 @@ func sshRun(cmd *cobra.Command, arg []string) {
 		}
 	}
 
-	if sshConfig.cmd == "" && (sshConfig.sfile == "" || sshConfig.dpath == "") {
+	if sshConfig.cmd == "" && !sshConfig.interactive && (sshConfig.sfile == "" || sshConfig.dpath == "") {
 		cli.FatalOutput(1, "参数错误\n")
 	}
 
@@ -116,7 +188,30 @@ func sshRun(cmd *cobra.Command, arg []string) {
 		}
 	}
 
+	var audit *cli.SSHAudit
+	if sshConfig.audit != "" {
+		if audit, err = cli.NewSSHAudit(sshConfig.audit); err != nil {
+			cli.FatalOutput(1, "创建审计目录失败:%s\n", err.Error())
+		}
+		audit.Input = sshConfig.auditInput
+		defer audit.Close()
+	}
+
+	if sshConfig.interactive {
+		if len(conns) != 1 {
+			cli.FatalOutput(1, "交互模式只能指定一个主机\n")
+		}
+		if err = sshInteractive(conns[0], audit); err != nil {
+			cli.FatalOutput(1, "交互会话错误:%s\n", err.Error())
+		}
+		return
+	}
+
 	if sshConfig.cmd != "" {
+		var users = make(map[string]string, len(conns))
+		for _, conn := range conns {
+			users[conn.Host] = conn.User
+		}
 		var retChan = make(chan *cli.SSHResult, 1)
 		clients := cli.InitClients(conns, sshConfig.timeout, output)
 		if len(clients) != 0 {
@@ -132,6 +227,11 @@ func sshRun(cmd *cobra.Command, arg []string) {
 			}()
 			for i := 0; i < len(clients); i++ {
 				ret := <-retChan
+				if audit != nil {
+					if err := audit.Record(ret.Host, users[ret.Host], sshConfig.cmd, ret.Error); err != nil {
+						fmt.Fprintf(output, "[ERROR] 写入审计记录失败:%s\n", err.Error())
+					}
+				}
 				if ret.Error == nil {
 					fmt.Fprintf(output, "---------------------------SUCCESS\t%s---------------------------\n%s\n", ret.Host, ret.Data)
 				} else {
@@ -140,11 +240,40 @@ func sshRun(cmd *cobra.Command, arg []string) {
 			}
 			close(retChan)
 		}
+	} else if sshConfig.sync {
+		opt := &cli.SSHSyncOption{Delete: sshConfig.delete, DryRun: sshConfig.dryrun}
+		cli.SSHBatchSyncDir(conns, sshConfig.timeout, sshConfig.sfile, sshConfig.dpath, opt, output)
 	} else {
 		cli.SSHBatchSendFile(conns, sshConfig.timeout, sshConfig.sfile, sshConfig.dpath, output)
 	}
 }
 
+// sshInteractive 打开交互shell,标准输入是终端的时候切换到raw模式
+func sshInteractive(conn *cli.SSHConnection, audit *cli.SSHAudit) error {
+	auth, err := cli.SSHAuth(conn.Passwd, conn.Keys...)
+	if err != nil {
+		return err
+	}
+	client, err := cli.SSHDial(conn.Host, conn.User, auth, sshConfig.timeout)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if fd := int(os.Stdin.Fd()); terminal.IsTerminal(fd) {
+		state, err := terminal.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer terminal.Restore(fd, state)
+	}
+
+	if audit != nil {
+		return audit.Shell(client, conn.Host, conn.User, os.Stdin, os.Stdout)
+	}
+	return cli.SSHShellCommond(client, os.Stdin, os.Stdout)
+}
+
 // FileLine 按行读取文件
 func FileLine(path string, count int) ([][]string, error) {
 	File, err := os.Open(path)
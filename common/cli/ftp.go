@@ -2,160 +2,584 @@ package cli
 
 import (
 	"bufio"
-	"bytes"
-	"errors"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"net/textproto"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // FTPClient ftp client interface
 type FTPClient interface {
 	PutFile(lpath, rpath string) error
 	GetFile(lpath, rpath string) error
+	List(rpath string) ([]*FTPEntry, error)
+	Mkdir(rpath string) error
+	Delete(rpath string) error
+	RemoveDir(rpath string) error
+	Rename(from, to string) error
+	Size(rpath string) (int64, error)
+	ModTime(rpath string) (time.Time, error)
+	SetModTime(rpath string, t time.Time) error
 	Exit()
 }
 
+// FTPEntry 目录列表中的文件信息
+type FTPEntry struct {
+	Name string
+	Size int64
+	Time time.Time
+	Dir  bool
+}
+
+// FTPOption ftp连接选项
+type FTPOption struct {
+	TLS       bool        // 使用AUTH TLS加密控制连接,并使用PROT P加密数据连接
+	TLSConfig *tls.Config // 为nil的时候使用默认配置
+	Active    bool        // 直接使用主动模式,否则被动模式失败的时候才使用主动模式
+	Timeout   time.Duration
+	Resume    bool      // 目标文件已存在并且比源文件小的时候从断点续传
+	Retry     int       // 传输失败之后重新连接并续传的次数
+	Verify    bool      // 传输完成之后使用XMD5或者HASH校验内容,续传的文件总是校验
+	Output    io.Writer // 重试信息的输出,为nil的时候不输出
+}
+
+var pasvRegexp = regexp.MustCompile(`(\d+),(\d+),(\d+),(\d+),(\d+),(\d+)`)
+
 // NewFTP 创建ftp连接
 func NewFTP(ip, user, pass string) (FTPClient, error) {
-	conn, err := net.Dial("tcp", ip)
+	return NewFTPWithOption(ip, user, pass, nil)
+}
+
+// NewFTPWithOption 使用指定的选项创建ftp连接
+func NewFTPWithOption(ip, user, pass string, opt *FTPOption) (FTPClient, error) {
+	if opt == nil {
+		opt = &FTPOption{}
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = 30 * time.Second
+	}
+
+	host, _, err := net.SplitHostPort(ip)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Fprintf(conn, "USER %s\r\nPASS %s\r\n", user, pass)
-	buf := bufio.NewReader(conn)
-	for {
-		line, _, err := buf.ReadLine()
-		if err != nil {
-			return nil, err
-		}
-		if bytes.HasPrefix(line, []byte("220")) {
-			continue
-		}
-		if bytes.HasPrefix(line, []byte("530")) {
-			fmt.Print(string(line))
-		}
-		if bytes.HasPrefix(line, []byte("230")) {
-			fmt.Printf(string(line))
-			break
-		}
+	login := &ftpLogin{ip: ip, host: host, user: user, pass: pass, opt: opt}
+	if err = login.dial(); err != nil {
+		return nil, err
 	}
-	return &ftpLogin{ip, conn}, nil
+	return login, nil
 }
 
 // ftpLogin ftpLogin
 type ftpLogin struct {
-	ip   string
-	conn net.Conn
+	ip      string
+	host    string
+	user    string
+	pass    string
+	conn    net.Conn
+	text    *textproto.Conn
+	opt     *FTPOption
+	tlscfg  *tls.Config
+	protect bool // 数据连接是否使用tls
+	noEPSV  bool
+	noPASV  bool
+	noMLSD  bool
+	noHash  bool
 }
 
-// PutFile 上传文件
-func (login *ftpLogin) PutFile(lpath, rpath string) error {
-	c, err := login.connection("STOR", rpath)
+// dial 建立控制连接并登录
+func (login *ftpLogin) dial() error {
+	conn, err := net.DialTimeout("tcp", login.ip, login.opt.Timeout)
 	if err != nil {
 		return err
 	}
-	defer c.Close()
+	login.conn, login.text = conn, textproto.NewConn(conn)
+	if err = login.login(login.user, login.pass); err != nil {
+		login.text.Close()
+		return err
+	}
+	return nil
+}
+
+func (login *ftpLogin) login(user, pass string) error {
+	if _, _, err := login.text.ReadResponse(220); err != nil {
+		return err
+	}
+
+	if login.opt.TLS {
+		if _, _, err := login.cmd(234, "AUTH TLS"); err != nil {
+			return err
+		}
+		login.tlscfg = login.opt.TLSConfig
+		if login.tlscfg == nil {
+			login.tlscfg = &tls.Config{}
+		}
+		login.tlscfg = login.tlscfg.Clone()
+		if login.tlscfg.ServerName == "" {
+			login.tlscfg.ServerName = login.host
+		}
+		// 部分服务端要求数据连接复用控制连接的tls会话
+		if login.tlscfg.ClientSessionCache == nil {
+			login.tlscfg.ClientSessionCache = tls.NewLRUClientSessionCache(4)
+		}
+		tlsConn := tls.Client(login.conn, login.tlscfg)
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		login.conn = tlsConn
+		login.text = textproto.NewConn(tlsConn)
+	}
+
+	code, _, err := login.cmd(0, "USER %s", user)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case 230:
+	case 331, 332:
+		if _, _, err = login.cmd(230, "PASS %s", pass); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unexpected reply %d to USER", code)
+	}
+
+	if login.opt.TLS {
+		if _, _, err = login.cmd(200, "PBSZ 0"); err != nil {
+			return err
+		}
+		if _, _, err = login.cmd(200, "PROT P"); err != nil {
+			return err
+		}
+		login.protect = true
+	}
+	_, _, err = login.cmd(200, "TYPE I")
+	return err
+}
+
+// cmd 发送命令并读取完整的响应,支持多行响应;expect为0的时候不检查响应码,
+// 小于10的时候只检查第一位
+func (login *ftpLogin) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	if err := login.text.PrintfLine(format, args...); err != nil {
+		return 0, "", err
+	}
+	return login.text.ReadResponse(expect)
+}
+
+// PutFile 上传文件,开启续传的时候使用APPE从远程文件的大小处继续上传,完成后校验大小,续传的时候同时校验内容
+func (login *ftpLogin) PutFile(lpath, rpath string) error {
+	return login.retry(func(resume bool) error {
+		return login.putFile(lpath, rpath, resume)
+	})
+}
+
+func (login *ftpLogin) putFile(lpath, rpath string, resume bool) error {
 	File, err := os.Open(lpath)
 	if err != nil {
 		return err
 	}
 	defer File.Close()
-	_, err = io.Copy(c, File)
+	info, err := File.Stat()
 	if err != nil {
 		return err
 	}
 
-	buf := make([]byte, 1024)
-	n, err := c.Read(buf)
-	if err == nil {
-		fmt.Print(string(buf[:n]))
+	var offset int64
+	if resume {
+		// 远程文件不存在的时候SIZE返回550,从头上传
+		if size, err := login.Size(rpath); err == nil && size <= info.Size() {
+			offset = size
+		}
 	}
-	return err
+	if offset < info.Size() || info.Size() == 0 {
+		command := "STOR %s"
+		if offset > 0 {
+			if _, err = File.Seek(offset, io.SeekStart); err != nil {
+				return err
+			}
+			command = "APPE %s"
+		}
+		c, err := login.transfer(command, rpath)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(c, File); err == nil {
+			err = login.closeWrite(c)
+		}
+		if err = login.finish(c, err); err != nil {
+			return err
+		}
+	}
+	return login.verify(lpath, rpath, offset > 0)
 }
 
-// GetFile 下载文件
-func (login *ftpLogin) GetFile(lpath, rpath string) error {
-	con, err := login.connection("RETR", rpath)
+// closeWrite 上传完成后半关闭数据连接,并等待服务端关闭;
+// 直接关闭的时候如果还有未读的数据(如tls1.3的session ticket)会发送RST,导致服务端丢失数据
+func (login *ftpLogin) closeWrite(c net.Conn) error {
+	var err error
+	switch conn := c.(type) {
+	case *tls.Conn:
+		err = conn.CloseWrite()
+	case *net.TCPConn:
+		err = conn.CloseWrite()
+	}
 	if err != nil {
 		return err
 	}
+	c.SetReadDeadline(time.Now().Add(login.opt.Timeout))
+	io.Copy(ioutil.Discard, c)
+	return nil
+}
 
-	defer con.Close()
-	File, err := os.Create(lpath)
+// GetFile 下载文件,开启续传的时候使用REST从本地文件的大小处继续下载,完成后校验大小,续传的时候同时校验内容
+func (login *ftpLogin) GetFile(lpath, rpath string) error {
+	return login.retry(func(resume bool) error {
+		return login.getFile(lpath, rpath, resume)
+	})
+}
+
+func (login *ftpLogin) getFile(lpath, rpath string, resume bool) error {
+	// 服务端不支持SIZE的时候size为-1,不做续传;远程文件不存在的时候不创建本地文件
+	size, err := login.Size(rpath)
 	if err != nil {
-		return err
+		if terr, ok := err.(*textproto.Error); !ok || terr.Code == 550 {
+			return err
+		}
+		size = -1
 	}
 
+	flag := os.O_WRONLY | os.O_CREATE
+	if !resume {
+		flag |= os.O_TRUNC
+	}
+	File, err := os.OpenFile(lpath, flag, 0644)
+	if err != nil {
+		return err
+	}
 	defer File.Close()
-	_, err = io.Copy(File, con)
+	var offset int64
+	if resume {
+		info, err := File.Stat()
+		if err != nil {
+			return err
+		}
+		if offset = info.Size(); size < 0 || offset > size {
+			offset = 0
+		}
+	}
+
+	if offset < size || size <= 0 {
+		c, err := login.transferAt(offset, "RETR %s", rpath)
+		if err == errFTPRestUnsupported {
+			offset = 0
+			c, err = login.transferAt(0, "RETR %s", rpath)
+		}
+		if err != nil {
+			return err
+		}
+		if err = File.Truncate(offset); err == nil {
+			if _, err = File.Seek(offset, io.SeekStart); err == nil {
+				_, err = io.Copy(File, c)
+			}
+		}
+		if err = login.finish(c, err); err != nil {
+			return err
+		}
+	}
+	if err = File.Sync(); err != nil {
+		return err
+	}
+	return login.verify(lpath, rpath, offset > 0)
+}
+
+// finish 关闭数据连接并读取传输结果
+func (login *ftpLogin) finish(c net.Conn, err error) error {
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	if _, _, rerr := login.text.ReadResponse(2); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// List 列出目录内容,优先使用MLSD,不支持的时候使用LIST并解析UNIX和DOS格式
+func (login *ftpLogin) List(rpath string) ([]*FTPEntry, error) {
+	if !login.noMLSD {
+		lines, err := login.readLines("MLSD %s", rpath)
+		if err == nil {
+			var list = make([]*FTPEntry, 0, len(lines))
+			for _, line := range lines {
+				if entry := parseMLSD(line); entry != nil {
+					list = append(list, entry)
+				}
+			}
+			return list, nil
+		}
+		if terr, ok := err.(*textproto.Error); !ok || terr.Code < 500 || terr.Code > 504 {
+			return nil, err
+		}
+		login.noMLSD = true
+	}
+
+	lines, err := login.readLines("LIST %s", rpath)
+	if err != nil {
+		return nil, err
+	}
+	var list = make([]*FTPEntry, 0, len(lines))
+	for _, line := range lines {
+		if entry := parseLIST(line); entry != nil {
+			list = append(list, entry)
+		}
+	}
+	return list, nil
+}
+
+// readLines 执行命令并按行读取数据连接返回的内容
+func (login *ftpLogin) readLines(format string, args ...interface{}) ([]string, error) {
+	c, err := login.transfer(format, args...)
 	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	scanner := bufio.NewScanner(c)
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, login.finish(c, scanner.Err())
+}
+
+// Mkdir 创建目录
+func (login *ftpLogin) Mkdir(rpath string) error {
+	_, _, err := login.cmd(257, "MKD %s", rpath)
+	return err
+}
+
+// Delete 删除文件
+func (login *ftpLogin) Delete(rpath string) error {
+	_, _, err := login.cmd(250, "DELE %s", rpath)
+	return err
+}
+
+// RemoveDir 删除空目录
+func (login *ftpLogin) RemoveDir(rpath string) error {
+	_, _, err := login.cmd(250, "RMD %s", rpath)
+	return err
+}
+
+// Rename 重命名文件或目录
+func (login *ftpLogin) Rename(from, to string) error {
+	if _, _, err := login.cmd(350, "RNFR %s", from); err != nil {
 		return err
 	}
+	_, _, err := login.cmd(250, "RNTO %s", to)
+	return err
+}
 
-	buf := make([]byte, 1024)
-	n, err := login.conn.Read(buf)
-	if err == nil {
-		fmt.Print(string(buf[:n]))
+// Size 获取文件大小
+func (login *ftpLogin) Size(rpath string) (int64, error) {
+	_, msg, err := login.cmd(213, "SIZE %s", rpath)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+}
+
+// ModTime 使用MDTM获取文件修改时间
+func (login *ftpLogin) ModTime(rpath string) (time.Time, error) {
+	_, msg, err := login.cmd(213, "MDTM %s", rpath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseFTPTime(strings.TrimSpace(msg))
+}
+
+// SetModTime 设置文件修改时间,优先使用MFMT,不支持的时候使用带时间参数的MDTM
+func (login *ftpLogin) SetModTime(rpath string, t time.Time) error {
+	stamp := t.UTC().Format(ftpTimeLayout)
+	_, _, err := login.cmd(213, "MFMT %s %s", stamp, rpath)
+	if terr, ok := err.(*textproto.Error); ok && terr.Code >= 500 && terr.Code <= 504 {
+		_, _, err = login.cmd(213, "MDTM %s %s", stamp, rpath)
 	}
 	return err
 }
 
-func (login *ftpLogin) connection(status, Pathname string) (net.Conn, error) {
-	buf := make([]byte, 1024)
-	fmt.Fprintln(login.conn, "PASV ")
-	n, err := login.conn.Read(buf)
+// transfer 建立数据连接并发送传输命令,优先使用EPSV,然后PASV,最后使用主动模式
+func (login *ftpLogin) transfer(format string, args ...interface{}) (net.Conn, error) {
+	return login.transferAt(0, format, args...)
+}
+
+// transferAt offset大于0的时候在传输命令之前发送REST,REST必须紧接着传输命令
+func (login *ftpLogin) transferAt(offset int64, format string, args ...interface{}) (net.Conn, error) {
+	if !login.opt.Active {
+		conn, err := login.passive()
+		if err == nil {
+			if err = login.rest(offset); err == nil {
+				_, _, err = login.cmd(1, format, args...)
+			}
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return login.wrapData(conn)
+		}
+		// 服务端不支持被动模式或者数据端口无法连接的时候使用主动模式,控制连接断开的时候主动模式也会返回错误
+	}
+
+	lis, err := login.active()
 	if err != nil {
 		return nil, err
 	}
-	if s := string(buf[:n]); !strings.Contains(s, "227 Entering Passive Mode") {
-		return nil, errors.New(s)
+	defer lis.Close()
+	if err = login.rest(offset); err != nil {
+		return nil, err
+	}
+	if _, _, err = login.cmd(1, format, args...); err != nil {
+		return nil, err
+	}
+	if tcpLis, ok := lis.(*net.TCPListener); ok {
+		tcpLis.SetDeadline(time.Now().Add(login.opt.Timeout))
+	}
+	conn, err := lis.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return login.wrapData(conn)
+}
+
+func (login *ftpLogin) rest(offset int64) error {
+	if offset <= 0 {
+		return nil
+	}
+	_, _, err := login.cmd(350, "REST %d", offset)
+	if terr, ok := err.(*textproto.Error); ok && terr.Code >= 500 {
+		return errFTPRestUnsupported
+	}
+	return err
+}
+
+func (login *ftpLogin) wrapData(conn net.Conn) (net.Conn, error) {
+	if !login.protect {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, login.tlscfg)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// passive 使用被动模式创建数据连接
+func (login *ftpLogin) passive() (net.Conn, error) {
+	var port int
+	if !login.noEPSV {
+		_, msg, err := login.cmd(229, "EPSV")
+		if err == nil {
+			port, err = parseEPSV(msg)
+		}
+		if err != nil {
+			if _, ok := err.(*textproto.Error); !ok {
+				return nil, err
+			}
+			login.noEPSV = true
+		}
+	}
+
+	// PASV 只支持ipv4
+	if port == 0 && !login.noPASV && !strings.Contains(login.host, ":") {
+		_, msg, err := login.cmd(227, "PASV")
+		if err == nil {
+			port, err = parsePASV(msg)
+		}
+		if err != nil {
+			if _, ok := err.(*textproto.Error); !ok {
+				return nil, err
+			}
+			login.noPASV = true
+			return nil, err
+		}
+	}
+	if port == 0 {
+		return nil, &textproto.Error{Code: 502, Msg: "passive mode not supported"}
 	}
-	port := getport(buf[27 : n-3])
-	con, err := net.Dial("tcp", fmt.Sprintf("%s:%d", strings.Split(login.ip, ":")[0], port))
+
+	// 使用控制连接的地址,忽略服务端返回的地址,避免NAT后返回内网地址
+	return net.DialTimeout("tcp", net.JoinHostPort(login.host, strconv.Itoa(port)), login.opt.Timeout)
+}
+
+// active 使用主动模式,在控制连接的本地地址上监听
+func (login *ftpLogin) active() (net.Listener, error) {
+	local, _, err := net.SplitHostPort(login.conn.LocalAddr().String())
 	if err != nil {
 		return nil, err
 	}
-	defer con.Close()
-	fmt.Fprintf(login.conn, "%s %s\r\n", status, Pathname)
-	n, err = login.conn.Read(buf)
+	lis, err := net.Listen("tcp", net.JoinHostPort(local, "0"))
 	if err != nil {
 		return nil, err
 	}
-	if !strings.Contains(string(buf[:n]), "150 Opening data channel") {
-		return nil, errors.New(string(buf[:n-2]))
+	port := lis.Addr().(*net.TCPAddr).Port
+	ip := net.ParseIP(local)
+	if ip4 := ip.To4(); ip4 != nil {
+		_, _, err = login.cmd(200, "PORT %d,%d,%d,%d,%d,%d", ip4[0], ip4[1], ip4[2], ip4[3], port>>8, port&0xff)
+	} else {
+		_, _, err = login.cmd(200, "EPRT |2|%s|%d|", local, port)
+	}
+	if err != nil {
+		lis.Close()
+		return nil, err
 	}
-	return con, nil
+	return lis, nil
 }
 
 // Exit 退出
 func (login *ftpLogin) Exit() {
-	buf := make([]byte, 1024)
-	fmt.Fprintln(login.conn, "QUIT ")
-	n, err := login.conn.Read(buf)
+	_, msg, err := login.cmd(221, "QUIT")
 	if err == nil {
-		fmt.Print(string(buf[:n]))
+		fmt.Println(msg)
 	} else {
 		fmt.Println(err)
 	}
-	if login.conn != nil {
-		login.conn.Close()
+	login.text.Close()
+}
+
+// parseEPSV 解析 229 Entering Extended Passive Mode (|||port|)
+func parseEPSV(msg string) (int, error) {
+	start := strings.Index(msg, "(")
+	end := strings.LastIndex(msg, ")")
+	if start < 0 || end < start+5 {
+		return 0, &textproto.Error{Code: 229, Msg: msg}
+	}
+	fields := strings.Split(msg[start+1:end], msg[start+1:start+2])
+	if len(fields) != 5 {
+		return 0, &textproto.Error{Code: 229, Msg: msg}
+	}
+	port, err := strconv.Atoi(fields[3])
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, &textproto.Error{Code: 229, Msg: msg}
 	}
+	return port, nil
 }
 
-func getport(by []byte) int {
-	s := string(by)
-	list := strings.Split(s, ",")
-	n1, err := strconv.Atoi(list[len(list)-2])
-	if err != nil {
-		return 0
+// parsePASV 解析 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+func parsePASV(msg string) (int, error) {
+	match := pasvRegexp.FindStringSubmatch(msg)
+	if match == nil {
+		return 0, &textproto.Error{Code: 227, Msg: msg}
 	}
-	n2, err := strconv.Atoi(list[len(list)-1])
-	if err != nil {
-		return 0
+	p1, err1 := strconv.Atoi(match[5])
+	p2, err2 := strconv.Atoi(match[6])
+	if err1 != nil || err2 != nil || p1 > 255 || p2 > 255 || p1*256+p2 == 0 {
+		return 0, &textproto.Error{Code: 227, Msg: msg}
 	}
-	return n1*256 + n2
+	return p1*256 + p2, nil
 }
@@ -0,0 +1,298 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ftpTimeLayout = "20060102150405"
+
+// FTPMirrorResult 目录同步结果
+type FTPMirrorResult struct {
+	Transfer []string
+	Skipped  int
+	Bytes    int64
+}
+
+// FTPMirrorUpload 把本地目录递归上传到远程目录,大小相同并且远程修改时间不早于本地的文件不再上传
+func FTPMirrorUpload(c FTPClient, ldir, rdir string, output io.Writer) (*FTPMirrorResult, error) {
+	info, err := os.Stat(ldir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s 不是目录", ldir)
+	}
+	var result = new(FTPMirrorResult)
+	return result, ftpUploadDir(c, ldir, rdir, result, output)
+}
+
+func ftpUploadDir(c FTPClient, ldir, rdir string, result *FTPMirrorResult, output io.Writer) error {
+	infos, err := readDir(ldir)
+	if err != nil {
+		return err
+	}
+
+	// 目录已经存在的时候MKD返回错误,部分服务端对不存在的目录LIST也返回空列表,所以先创建再读取
+	c.Mkdir(rdir)
+	list, err := c.List(rdir)
+	if err != nil {
+		return fmt.Errorf("读取目录%s失败:%s", rdir, err.Error())
+	}
+	var remote = make(map[string]*FTPEntry)
+	for _, entry := range list {
+		remote[entry.Name] = entry
+	}
+
+	for _, info := range infos {
+		lpath := filepath.Join(ldir, info.Name())
+		rpath := path.Join(rdir, info.Name())
+		entry := remote[info.Name()]
+		if info.IsDir() {
+			if entry != nil && !entry.Dir {
+				return fmt.Errorf("%s 已存在并且不是目录", rpath)
+			}
+			if err = ftpUploadDir(c, lpath, rpath, result, output); err != nil {
+				return err
+			}
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		mtime := info.ModTime().Truncate(time.Second)
+		if entry != nil && !entry.Dir && entry.Size == info.Size() && !ftpEntryTime(c, rpath, entry).Before(mtime) {
+			result.Skipped++
+			continue
+		}
+		if err = c.PutFile(lpath, rpath); err != nil {
+			return fmt.Errorf("上传%s失败:%s", lpath, err.Error())
+		}
+		// 服务端不支持设置修改时间的时候使用上传时间,下次比较的时候也不会早于本地时间
+		c.SetModTime(rpath, mtime)
+		result.Transfer = append(result.Transfer, rpath)
+		result.Bytes += info.Size()
+		fmt.Fprintf(output, "上传:%s -> %s\n", lpath, rpath)
+	}
+	return nil
+}
+
+// FTPMirrorDownload 把远程目录递归下载到本地目录,大小和修改时间都相同的文件不再下载
+func FTPMirrorDownload(c FTPClient, rdir, ldir string, output io.Writer) (*FTPMirrorResult, error) {
+	var result = new(FTPMirrorResult)
+	return result, ftpDownloadDir(c, rdir, ldir, result, output)
+}
+
+func ftpDownloadDir(c FTPClient, rdir, ldir string, result *FTPMirrorResult, output io.Writer) error {
+	list, err := c.List(rdir)
+	if err != nil {
+		return fmt.Errorf("读取目录%s失败:%s", rdir, err.Error())
+	}
+	if err = os.MkdirAll(ldir, 0755); err != nil {
+		return err
+	}
+
+	for _, entry := range list {
+		lpath := filepath.Join(ldir, entry.Name)
+		rpath := path.Join(rdir, entry.Name)
+		// 文件名来自服务端,不能写到本地目录之外
+		if rel, err := filepath.Rel(ldir, lpath); err != nil || validEntry(entry) == nil ||
+			rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("服务端返回的文件名不安全:%s", entry.Name)
+		}
+		if entry.Dir {
+			if err = ftpDownloadDir(c, rpath, lpath, result, output); err != nil {
+				return err
+			}
+			continue
+		}
+		if info, err := os.Stat(lpath); err == nil && info.Mode().IsRegular() &&
+			info.Size() == entry.Size && info.ModTime().Truncate(time.Second).Equal(ftpEntryTime(c, rpath, entry)) {
+			result.Skipped++
+			continue
+		}
+		if err = c.GetFile(lpath, rpath); err != nil {
+			return fmt.Errorf("下载%s失败:%s", rpath, err.Error())
+		}
+		if mtime := ftpEntryTime(c, rpath, entry); !mtime.IsZero() {
+			os.Chtimes(lpath, mtime, mtime)
+		}
+		result.Transfer = append(result.Transfer, lpath)
+		result.Bytes += entry.Size
+		fmt.Fprintf(output, "下载:%s -> %s\n", rpath, lpath)
+	}
+	return nil
+}
+
+// ftpEntryTime LIST返回的时间只精确到分钟,秒为0的时候使用MDTM获取精确时间
+func ftpEntryTime(c FTPClient, rpath string, entry *FTPEntry) time.Time {
+	if entry.Time.Second() == 0 {
+		if t, err := c.ModTime(rpath); err == nil {
+			entry.Time = t
+		}
+	}
+	return entry.Time
+}
+
+// FTPRemove 删除远程文件或目录,recursive为true的时候递归删除目录
+func FTPRemove(c FTPClient, rpath string, recursive bool, output io.Writer) error {
+	if err := c.Delete(rpath); err == nil {
+		fmt.Fprintf(output, "删除:%s\n", rpath)
+		return nil
+	}
+	if recursive {
+		list, err := c.List(rpath)
+		if err != nil {
+			return err
+		}
+		for _, entry := range list {
+			child := path.Join(rpath, entry.Name)
+			if entry.Dir {
+				err = FTPRemove(c, child, true, output)
+			} else if err = c.Delete(child); err == nil {
+				fmt.Fprintf(output, "删除:%s\n", child)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.RemoveDir(rpath); err != nil {
+		return err
+	}
+	fmt.Fprintf(output, "删除:%s/\n", rpath)
+	return nil
+}
+
+// FTPPrintList 输出目录列表
+func FTPPrintList(output io.Writer, list []*FTPEntry) {
+	for _, entry := range list {
+		typ := "-"
+		if entry.Dir {
+			typ = "d"
+		}
+		stamp := "-"
+		if !entry.Time.IsZero() {
+			stamp = entry.Time.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(output, "%s %12d %s %s\n", typ, entry.Size, stamp, entry.Name)
+	}
+}
+
+func readDir(dir string) ([]os.FileInfo, error) {
+	File, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer File.Close()
+	return File.Readdir(-1)
+}
+
+// parseMLSD 解析MLSD返回的行: type=file;size=1024;modify=20180101120000; name
+func parseMLSD(line string) *FTPEntry {
+	idx := strings.Index(line, " ")
+	if idx < 0 {
+		return nil
+	}
+	entry := &FTPEntry{Name: line[idx+1:]}
+	for _, fact := range strings.Split(line[:idx], ";") {
+		kv := strings.SplitN(fact, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.ToLower(kv[0]) {
+		case "type":
+			switch strings.ToLower(kv[1]) {
+			case "cdir", "pdir":
+				return nil
+			case "dir":
+				entry.Dir = true
+			}
+		case "size":
+			entry.Size, _ = strconv.ParseInt(kv[1], 10, 64)
+		case "modify":
+			entry.Time, _ = parseFTPTime(kv[1])
+		}
+	}
+	return validEntry(entry)
+}
+
+// parseLIST 解析LIST返回的行,支持UNIX格式:
+// drwxr-xr-x 2 user group 4096 Jan  1 12:00 name
+// 和DOS格式:
+// 01-01-18  12:00PM       <DIR>          name
+func parseLIST(line string) *FTPEntry {
+	fields := strings.Fields(line)
+	if len(fields) >= 4 && len(fields[0]) == 8 && strings.Count(fields[0], "-") == 2 {
+		entry := &FTPEntry{Name: listName(line, 3)}
+		if t, err := time.ParseInLocation("01-02-06 03:04PM", fields[0]+" "+fields[1], time.Local); err == nil {
+			entry.Time = t
+		}
+		if fields[2] == "<DIR>" {
+			entry.Dir = true
+		} else {
+			entry.Size, _ = strconv.ParseInt(fields[2], 10, 64)
+		}
+		return validEntry(entry)
+	}
+
+	if len(fields) < 9 || len(fields[0]) < 10 {
+		return nil
+	}
+	entry := &FTPEntry{Dir: fields[0][0] == 'd', Name: listName(line, 8)}
+	if fields[0][0] == 'l' {
+		// 符号链接: name -> target
+		if idx := strings.Index(entry.Name, " -> "); idx > 0 {
+			entry.Name = entry.Name[:idx]
+		}
+	}
+	entry.Size, _ = strconv.ParseInt(fields[4], 10, 64)
+	stamp := strings.Join(fields[5:8], " ")
+	if strings.Contains(fields[7], ":") {
+		// 最近半年的文件不显示年份
+		t, err := time.ParseInLocation("Jan 2 15:04 2006", stamp+" "+strconv.Itoa(time.Now().Year()), time.Local)
+		if err == nil {
+			if t.After(time.Now().Add(24 * time.Hour)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+			entry.Time = t
+		}
+	} else if t, err := time.ParseInLocation("Jan 2 2006", stamp, time.Local); err == nil {
+		entry.Time = t
+	}
+	return validEntry(entry)
+}
+
+// listName 获取跳过n个字段之后的文件名,保留文件名中的空格
+func listName(line string, n int) string {
+	for i := 0; i < n; i++ {
+		line = strings.TrimLeft(line, " ")
+		if idx := strings.Index(line, " "); idx >= 0 {
+			line = line[idx:]
+		}
+	}
+	return strings.TrimLeft(line, " ")
+}
+
+// validEntry 过滤.和..,以及包含路径分隔符的文件名,避免下载的时候写到目标目录之外
+func validEntry(entry *FTPEntry) *FTPEntry {
+	if entry.Name == "" || entry.Name == "." || entry.Name == ".." ||
+		strings.ContainsAny(entry.Name, `/\`) || entry.Name != filepath.Base(entry.Name) {
+		return nil
+	}
+	return entry
+}
+
+// parseFTPTime 解析MDTM和MLSD使用的UTC时间YYYYMMDDHHMMSS[.sss]
+func parseFTPTime(s string) (time.Time, error) {
+	if idx := strings.Index(s, "."); idx >= 0 {
+		s = s[:idx]
+	}
+	return time.ParseInLocation(ftpTimeLayout, s, time.UTC)
+}
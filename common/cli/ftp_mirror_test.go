@@ -0,0 +1,131 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseMLSD(t *testing.T) {
+	tests := []struct {
+		line  string
+		entry *FTPEntry
+	}{
+		{"type=file;size=1024;modify=20180101120000; a.txt",
+			&FTPEntry{Name: "a.txt", Size: 1024, Time: time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)}},
+		{"Type=DIR;Modify=20180101120000.123;UNIX.mode=0755; my dir",
+			&FTPEntry{Name: "my dir", Dir: true, Time: time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)}},
+		{"type=file;size=10; name;with;semicolons", &FTPEntry{Name: "name;with;semicolons", Size: 10}},
+		{"type=cdir;modify=20180101120000; /home", nil},
+		{"type=pdir;modify=20180101120000; ..", nil},
+		{"type=dir; .", nil},
+		{"type=file;size=unknown;perm=r; odd=name", &FTPEntry{Name: "odd=name"}},
+		{"type=file;size=10;", nil},
+		{"type=file;size=1; ../../.bashrc", nil},
+		{"type=file;size=1; a/../../x", nil},
+		{"type=file;size=1; /etc/cron.d/x", nil},
+		{"type=dir; ..\\..\\windows", nil},
+	}
+	for _, test := range tests {
+		checkFTPEntry(t, "parseMLSD", test.line, parseMLSD(test.line), test.entry)
+	}
+}
+
+func TestParseLIST(t *testing.T) {
+	tests := []struct {
+		line  string
+		entry *FTPEntry
+	}{
+		{"-rw-r--r--    1 user     group        1024 Jan  1  2018 a.txt",
+			&FTPEntry{Name: "a.txt", Size: 1024, Time: time.Date(2018, 1, 1, 0, 0, 0, 0, time.Local)}},
+		{"drwxr-xr-x 2 user group 4096 Dec 31  2017 my  dir",
+			&FTPEntry{Name: "my  dir", Dir: true, Size: 4096, Time: time.Date(2017, 12, 31, 0, 0, 0, 0, time.Local)}},
+		{"lrwxrwxrwx 1 user group 7 Mar  5  2019 link -> target",
+			&FTPEntry{Name: "link", Size: 7, Time: time.Date(2019, 3, 5, 0, 0, 0, 0, time.Local)}},
+		{"01-02-18  03:04PM       <DIR>          dos dir",
+			&FTPEntry{Name: "dos dir", Dir: true, Time: time.Date(2018, 1, 2, 15, 4, 0, 0, time.Local)}},
+		{"01-02-18  09:30AM                 2048 dos.txt",
+			&FTPEntry{Name: "dos.txt", Size: 2048, Time: time.Date(2018, 1, 2, 9, 30, 0, 0, time.Local)}},
+		{"drwxr-xr-x 2 user group 4096 Jan  1  2018 ..", nil},
+		{"total 12", nil},
+		{"-rw-r--r-- 1 user group 1 Jan  1  2018 ../../.bashrc", nil},
+		{"drwxr-xr-x 2 user group 4096 Jan  1  2018 /etc", nil},
+		{"lrwxrwxrwx 1 user group 7 Jan  1  2018 a/b -> target", nil},
+		{"01-02-18  09:30AM                 1 ..\\evil.txt", nil},
+		{"", nil},
+	}
+	for _, test := range tests {
+		checkFTPEntry(t, "parseLIST", test.line, parseLIST(test.line), test.entry)
+	}
+}
+
+// 最近半年的文件LIST不显示年份,使用今年,晚于明天的时候为去年
+func TestParseLISTWithoutYear(t *testing.T) {
+	now := time.Now()
+	for _, test := range []struct {
+		stamp time.Time
+		year  int
+	}{
+		{now.AddDate(0, 0, -1), now.AddDate(0, 0, -1).Year()},
+		{now.AddDate(0, 0, 3), now.AddDate(0, 0, 3).Year() - 1},
+	} {
+		line := "-rw-r--r-- 1 user group 1 " + test.stamp.Format("Jan _2 15:04") + " recent.txt"
+		want := time.Date(test.year, test.stamp.Month(), test.stamp.Day(), test.stamp.Hour(), test.stamp.Minute(), 0, 0, time.Local)
+		checkFTPEntry(t, "parseLIST", line, parseLIST(line), &FTPEntry{Name: "recent.txt", Size: 1, Time: want})
+	}
+}
+
+func checkFTPEntry(t *testing.T, fn, line string, got, want *FTPEntry) {
+	t.Helper()
+	if got == nil || want == nil {
+		if got != want {
+			t.Errorf("%s(%q) = %+v, want %+v", fn, line, got, want)
+		}
+		return
+	}
+	if got.Name != want.Name || got.Size != want.Size || got.Dir != want.Dir || !got.Time.Equal(want.Time) {
+		t.Errorf("%s(%q) = %+v, want %+v", fn, line, *got, *want)
+	}
+}
+
+// mirrorClient 直接返回指定的目录列表,模拟不可信的服务端
+type mirrorClient struct {
+	FTPClient
+	list []*FTPEntry
+	got  []string
+}
+
+func (c *mirrorClient) List(rpath string) ([]*FTPEntry, error) { return c.list, nil }
+
+func (c *mirrorClient) ModTime(rpath string) (time.Time, error) { return time.Time{}, os.ErrNotExist }
+
+func (c *mirrorClient) GetFile(lpath, rpath string) error {
+	c.got = append(c.got, lpath)
+	return ioutil.WriteFile(lpath, []byte(rpath), 0644)
+}
+
+func TestFTPMirrorDownloadRejectsEscape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftp_mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ldir := filepath.Join(dir, "target")
+
+	for _, name := range []string{"../escaped", "a/../../escaped", "/tmp/escaped", ".."} {
+		c := &mirrorClient{list: []*FTPEntry{{Name: name, Size: 1}}}
+		if _, err := FTPMirrorDownload(c, "/", ldir, ioutil.Discard); err == nil || len(c.got) != 0 {
+			t.Errorf("FTPMirrorDownload(%q) = %v, wrote %v", name, err, c.got)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Fatalf("file written outside target: %v", err)
+	}
+
+	c := &mirrorClient{list: []*FTPEntry{{Name: "ok.txt", Size: 1}}}
+	if _, err := FTPMirrorDownload(c, "/", ldir, ioutil.Discard); err != nil || len(c.got) != 1 || c.got[0] != filepath.Join(ldir, "ok.txt") {
+		t.Fatalf("FTPMirrorDownload(ok.txt) = %v, wrote %v", err, c.got)
+	}
+}
@@ -0,0 +1,171 @@
+package cli
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	errFTPRestUnsupported = errors.New("REST not supported")
+	xmd5Regexp            = regexp.MustCompile(`\b[0-9a-fA-F]{32}\b`)
+)
+
+// ftpVerifyError 传输完成之后大小或者校验值不一致,重试的时候需要从头传输
+type ftpVerifyError struct {
+	msg string
+}
+
+func (e *ftpVerifyError) Error() string {
+	return e.msg
+}
+
+// retry 执行传输,失败的时候按1s,2s,4s...最长30s的间隔重新连接并续传
+func (login *ftpLogin) retry(fn func(resume bool) error) error {
+	var err error
+	resume := login.opt.Resume
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			if delay *= 2; delay > 30*time.Second {
+				delay = 30 * time.Second
+			}
+			login.text.Close()
+			if err = login.dial(); err != nil {
+				if attempt >= login.opt.Retry {
+					return err
+				}
+				login.printf("重新连接失败:%s,%s后第%d次重试\n", err.Error(), delay, attempt+1)
+				continue
+			}
+		}
+
+		if err = fn(resume); err == nil || attempt >= login.opt.Retry || !ftpRetryable(err) {
+			return err
+		}
+		login.printf("传输失败:%s,%s后第%d次重试\n", err.Error(), delay, attempt+1)
+		// 已经传输的部分是本次写入的,重试的时候可以续传,校验失败的除外
+		_, mismatch := err.(*ftpVerifyError)
+		resume = !mismatch
+	}
+}
+
+func (login *ftpLogin) printf(format string, args ...interface{}) {
+	if login.opt.Output != nil {
+		fmt.Fprintf(login.opt.Output, format, args...)
+	}
+}
+
+// ftpRetryable 4xx响应和网络错误可以重试,5xx响应和本地文件错误不重试
+func ftpRetryable(err error) bool {
+	switch e := err.(type) {
+	case *textproto.Error:
+		return e.Code < 500
+	case *os.PathError:
+		return false
+	}
+	return true
+}
+
+// verify 校验本地和远程文件的大小,resumed为true或者指定了Verify,并且服务端支持XMD5或者HASH的时候校验文件内容
+func (login *ftpLogin) verify(lpath, rpath string, resumed bool) error {
+	info, err := os.Stat(lpath)
+	if err != nil {
+		return err
+	}
+	size, err := login.Size(rpath)
+	if err == nil && size != info.Size() {
+		return &ftpVerifyError{fmt.Sprintf("size mismatch local:%d remote:%d", info.Size(), size)}
+	}
+	if _, ok := err.(*textproto.Error); err != nil && !ok {
+		return err
+	}
+	// 计算校验值需要读取整个文件,完整传输的文件只校验大小
+	if !resumed && !login.opt.Verify {
+		return nil
+	}
+
+	algo, remote, err := login.remoteHash(rpath)
+	if err != nil || algo == "" {
+		return err
+	}
+	local, err := fileHash(lpath, algo)
+	if err != nil || local == "" {
+		return err
+	}
+	if !strings.EqualFold(local, remote) {
+		return &ftpVerifyError{fmt.Sprintf("%s mismatch local:%s remote:%s", algo, local, remote)}
+	}
+	return nil
+}
+
+// remoteHash 获取远程文件的校验值,优先使用XMD5,然后使用HASH;都不支持的时候algo为空
+func (login *ftpLogin) remoteHash(rpath string) (algo, sum string, err error) {
+	if login.noHash {
+		return "", "", nil
+	}
+	_, msg, err := login.cmd(2, "XMD5 %s", rpath)
+	if err == nil {
+		if sum = xmd5Regexp.FindString(msg); sum != "" {
+			return "MD5", sum, nil
+		}
+	} else if _, ok := err.(*textproto.Error); !ok {
+		return "", "", err
+	}
+
+	// HASH的响应格式: 213 SHA-256 0-1024 hex name
+	_, msg, err = login.cmd(213, "HASH %s", rpath)
+	if err == nil {
+		if fields := strings.Fields(msg); len(fields) >= 3 {
+			return strings.ToUpper(fields[0]), fields[2], nil
+		}
+	} else if _, ok := err.(*textproto.Error); !ok {
+		return "", "", err
+	}
+	login.noHash = true
+	return "", "", nil
+}
+
+// newHash 根据HASH命令使用的算法名称创建hash,不支持的算法返回nil
+func newHash(algo string) hash.Hash {
+	switch strings.ToUpper(algo) {
+	case "MD5":
+		return md5.New()
+	case "SHA-1":
+		return sha1.New()
+	case "SHA-256":
+		return sha256.New()
+	case "SHA-512":
+		return sha512.New()
+	}
+	return nil
+}
+
+// fileHash 计算文件的校验值,不支持的算法返回空
+func fileHash(path, algo string) (string, error) {
+	h := newHash(algo)
+	if h == nil {
+		return "", nil
+	}
+	File, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer File.Close()
+	if _, err = io.Copy(h, File); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,1123 @@
+package cli
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FTPServerConfig ftp服务配置
+type FTPServerConfig struct {
+	Listen       string
+	Root         string // 服务根目录,用户文件中的相对路径也以此为基准
+	User         string // 未指定用户文件的时候使用的用户名和密码
+	Passwd       string
+	ReadOnly     bool
+	UsersFile    string // 用户文件,每行格式: user:password:root[:ro]
+	CertFile     string // 同时指定证书和私钥的时候支持AUTH TLS
+	KeyFile      string
+	PassivePorts string // 被动模式端口范围,如:30000-30100,为空的时候随机分配
+	PublicIP     string // PASV返回的地址,为空的时候使用控制连接的本地地址
+	UploadLog    string // 上传日志文件路径
+	Timeout      time.Duration
+}
+
+// ftpUser 虚拟用户
+type ftpUser struct {
+	name     string
+	passwd   string
+	root     string
+	readOnly bool
+}
+
+type ftpServer struct {
+	cfg       *FTPServerConfig
+	users     map[string]*ftpUser
+	tlscfg    *tls.Config
+	portMin   int
+	portMax   int
+	uploadLog *log.Logger
+}
+
+var errFTPNoDataConn = errors.New("use PORT or PASV first")
+
+// FTPServe 启动ftp服务,支持主动和被动模式,AUTH TLS,虚拟用户和上传日志
+func FTPServe(cfg *FTPServerConfig) error {
+	lis, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+	defer lis.Close()
+	return ftpServe(cfg, lis)
+}
+
+// ftpServe 在已经监听的lis上提供服务
+func ftpServe(cfg *FTPServerConfig, lis net.Listener) error {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Minute
+	}
+	root, err := filepath.Abs(cfg.Root)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(root); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s 不是目录", root)
+	}
+	// 根目录本身是符号链接的时候使用真实路径,realPath按照真实路径检查是否超出根目录
+	if cfg.Root, err = filepath.EvalSymlinks(root); err != nil {
+		return err
+	}
+	root = cfg.Root
+
+	srv := &ftpServer{cfg: cfg}
+	if srv.users, err = loadFTPUsers(cfg); err != nil {
+		return err
+	}
+	if cfg.CertFile != "" && cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		srv.tlscfg = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if cfg.PassivePorts != "" {
+		ports := strings.SplitN(cfg.PassivePorts, "-", 2)
+		srv.portMin, err = strconv.Atoi(ports[0])
+		if err == nil && len(ports) == 2 {
+			srv.portMax, err = strconv.Atoi(ports[1])
+		} else {
+			srv.portMax = srv.portMin
+		}
+		if err != nil || srv.portMin <= 0 || srv.portMax > 65535 || srv.portMin > srv.portMax {
+			return fmt.Errorf("被动模式端口范围错误:%s", cfg.PassivePorts)
+		}
+	}
+	if cfg.UploadLog != "" {
+		File, err := os.OpenFile(cfg.UploadLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer File.Close()
+		srv.uploadLog = log.New(File, "", 0)
+	}
+
+	log.Printf("FTP server listen on %s root:%s\n", lis.Addr(), root)
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.serveConn(conn)
+	}
+}
+
+// loadFTPUsers 读取用户文件,未指定的时候使用配置中的用户名和密码
+func loadFTPUsers(cfg *FTPServerConfig) (map[string]*ftpUser, error) {
+	var users = make(map[string]*ftpUser)
+	if cfg.UsersFile == "" {
+		if cfg.User == "" || cfg.Passwd == "" {
+			return nil, fmt.Errorf("必须指定用户名密码或者用户文件")
+		}
+		users[cfg.User] = &ftpUser{name: cfg.User, passwd: cfg.Passwd, root: cfg.Root, readOnly: cfg.ReadOnly}
+		return users, nil
+	}
+
+	File, err := os.Open(cfg.UsersFile)
+	if err != nil {
+		return nil, err
+	}
+	defer File.Close()
+
+	scanner := bufio.NewScanner(File)
+	for num := 1; scanner.Scan(); num++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, fmt.Errorf("用户文件第%d行格式错误", num)
+		}
+		user := &ftpUser{name: fields[0], passwd: fields[1], root: cfg.Root}
+		if len(fields) > 2 && fields[2] != "" {
+			user.root = fields[2]
+			if !filepath.IsAbs(user.root) {
+				user.root = filepath.Join(cfg.Root, user.root)
+			}
+		}
+		if len(fields) > 3 {
+			user.readOnly = fields[3] == "ro"
+		}
+		if err = os.MkdirAll(user.root, 0755); err != nil {
+			return nil, err
+		}
+		if user.root, err = filepath.EvalSymlinks(user.root); err != nil {
+			return nil, err
+		}
+		users[user.name] = user
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("用户文件中没有用户")
+	}
+	return users, nil
+}
+
+// ftpSession 单个控制连接的状态
+type ftpSession struct {
+	srv     *ftpServer
+	conn    net.Conn
+	text    *textproto.Conn
+	remote  net.IP
+	name    string   // USER指定的用户名
+	user    *ftpUser // 登录成功之后不为空
+	cwd     string
+	tls     bool
+	protect bool
+	pasv    net.Listener
+	port    string // 主动模式的地址
+	rest    int64
+	rnfr    string
+	hash    string // HASH命令使用的算法
+}
+
+type ftpHandler struct {
+	fn    func(s *ftpSession, arg string)
+	auth  bool // 需要登录
+	write bool // 需要写权限
+}
+
+var ftpHandlers = map[string]ftpHandler{
+	"USER": {(*ftpSession).cmdUser, false, false},
+	"PASS": {(*ftpSession).cmdPass, false, false},
+	"AUTH": {(*ftpSession).cmdAuth, false, false},
+	"PBSZ": {(*ftpSession).cmdPbsz, false, false},
+	"PROT": {(*ftpSession).cmdProt, false, false},
+	"FEAT": {(*ftpSession).cmdFeat, false, false},
+	"SYST": {(*ftpSession).cmdSyst, false, false},
+	"OPTS": {(*ftpSession).cmdOpts, false, false},
+	"NOOP": {(*ftpSession).cmdNoop, false, false},
+	"TYPE": {(*ftpSession).cmdType, true, false},
+	"MODE": {(*ftpSession).cmdMode, true, false},
+	"STRU": {(*ftpSession).cmdStru, true, false},
+	"ALLO": {(*ftpSession).cmdAllo, true, false},
+	"ABOR": {(*ftpSession).cmdAbor, true, false},
+	"PWD":  {(*ftpSession).cmdPwd, true, false},
+	"XPWD": {(*ftpSession).cmdPwd, true, false},
+	"CWD":  {(*ftpSession).cmdCwd, true, false},
+	"XCWD": {(*ftpSession).cmdCwd, true, false},
+	"CDUP": {(*ftpSession).cmdCdup, true, false},
+	"XCUP": {(*ftpSession).cmdCdup, true, false},
+	"PASV": {(*ftpSession).cmdPasv, true, false},
+	"EPSV": {(*ftpSession).cmdEpsv, true, false},
+	"PORT": {(*ftpSession).cmdPort, true, false},
+	"EPRT": {(*ftpSession).cmdEprt, true, false},
+	"LIST": {(*ftpSession).cmdList, true, false},
+	"NLST": {(*ftpSession).cmdNlst, true, false},
+	"MLSD": {(*ftpSession).cmdMlsd, true, false},
+	"MLST": {(*ftpSession).cmdMlst, true, false},
+	"SIZE": {(*ftpSession).cmdSize, true, false},
+	"MDTM": {(*ftpSession).cmdMdtm, true, false},
+	"REST": {(*ftpSession).cmdRest, true, false},
+	"RETR": {(*ftpSession).cmdRetr, true, false},
+	"STOR": {(*ftpSession).cmdStor, true, true},
+	"APPE": {(*ftpSession).cmdAppe, true, true},
+	"DELE": {(*ftpSession).cmdDele, true, true},
+	"MKD":  {(*ftpSession).cmdMkd, true, true},
+	"XMKD": {(*ftpSession).cmdMkd, true, true},
+	"RMD":  {(*ftpSession).cmdRmd, true, true},
+	"XRMD": {(*ftpSession).cmdRmd, true, true},
+	"RNFR": {(*ftpSession).cmdRnfr, true, true},
+	"RNTO": {(*ftpSession).cmdRnto, true, true},
+	"MFMT": {(*ftpSession).cmdMfmt, true, true},
+	"XMD5": {(*ftpSession).cmdXmd5, true, false},
+	"HASH": {(*ftpSession).cmdHash, true, false},
+}
+
+func (srv *ftpServer) serveConn(conn net.Conn) {
+	s := &ftpSession{srv: srv, conn: conn, text: textproto.NewConn(conn), cwd: "/", hash: "SHA-256"}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		s.remote = addr.IP
+	}
+	defer func() {
+		s.closePassive()
+		s.text.Close()
+	}()
+
+	s.reply(220, "wstools ftp server ready")
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(srv.cfg.Timeout))
+		line, err := s.text.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg := line, ""
+		if idx := strings.Index(line, " "); idx >= 0 {
+			cmd, arg = line[:idx], line[idx+1:]
+		}
+		cmd = strings.ToUpper(cmd)
+
+		if cmd == "QUIT" {
+			s.reply(221, "Goodbye.")
+			return
+		}
+		handler, ok := ftpHandlers[cmd]
+		switch {
+		case !ok:
+			s.reply(502, "Command not implemented.")
+		case handler.auth && s.user == nil:
+			s.reply(530, "Please login with USER and PASS.")
+		case handler.write && s.user.readOnly:
+			s.reply(550, "Permission denied.")
+		default:
+			handler.fn(s, arg)
+		}
+		// REST只对紧接着的传输命令有效
+		if cmd != "REST" {
+			s.rest = 0
+		}
+	}
+}
+
+func (s *ftpSession) reply(code int, format string, args ...interface{}) {
+	s.text.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+}
+
+// replyError 返回文件操作的错误,不暴露真实路径
+func (s *ftpSession) replyError(err error) {
+	switch {
+	case os.IsNotExist(err):
+		s.reply(550, "No such file or directory.")
+	case os.IsPermission(err):
+		s.reply(550, "Permission denied.")
+	case os.IsExist(err):
+		s.reply(550, "File exists.")
+	default:
+		s.reply(550, "Operation failed.")
+	}
+}
+
+// vpath 把参数转换为以'/'开头的虚拟路径,Clean之后不会超出用户根目录
+func (s *ftpSession) vpath(arg string) string {
+	if arg == "" {
+		return s.cwd
+	}
+	if !strings.HasPrefix(arg, "/") {
+		arg = path.Join(s.cwd, arg)
+	}
+	return path.Clean("/" + arg)
+}
+
+// realPath 获取虚拟路径在本地的实际路径,解析上级目录中的符号链接,
+// 上级目录或者最后一级的链接目标不在用户根目录中的时候返回权限错误
+func (s *ftpSession) realPath(arg string) (string, error) {
+	name := filepath.Join(s.user.root, filepath.FromSlash(s.vpath(arg)))
+	if name == s.user.root {
+		return name, nil
+	}
+	dir, err := evalSymlinks(filepath.Dir(name), 0)
+	if err != nil {
+		return "", err
+	}
+	// 最后一级保持不变,删除和重命名操作的是链接本身
+	name = filepath.Join(dir, filepath.Base(name))
+	target, err := evalSymlinks(name, 0)
+	if err != nil {
+		return "", err
+	}
+	if !s.inRoot(dir) || !s.inRoot(target) {
+		return "", os.ErrPermission
+	}
+	return name, nil
+}
+
+// stat 获取虚拟路径对应的文件信息
+func (s *ftpSession) stat(arg string) (os.FileInfo, error) {
+	name, err := s.realPath(arg)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(name)
+}
+
+func (s *ftpSession) inRoot(name string) bool {
+	rel, err := filepath.Rel(s.user.root, name)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// evalSymlinks 解析路径中的符号链接,不存在的部分保持不变,不存在的链接目标也会被解析
+func evalSymlinks(name string, depth int) (string, error) {
+	if depth > 255 {
+		return "", errors.New("too many levels of symbolic links")
+	}
+	resolved, err := filepath.EvalSymlinks(name)
+	if err == nil || !os.IsNotExist(err) {
+		return resolved, err
+	}
+	parent := filepath.Dir(name)
+	if parent == name {
+		return name, nil
+	}
+	if parent, err = evalSymlinks(parent, depth+1); err != nil {
+		return "", err
+	}
+	name = filepath.Join(parent, filepath.Base(name))
+	link, err := os.Readlink(name)
+	if err != nil {
+		return name, nil
+	}
+	if !filepath.IsAbs(link) {
+		link = filepath.Join(parent, link)
+	}
+	return evalSymlinks(link, depth+1)
+}
+
+func (s *ftpSession) cmdUser(arg string) {
+	s.name, s.user = arg, nil
+	s.reply(331, "Please specify the password.")
+}
+
+func (s *ftpSession) cmdPass(arg string) {
+	user, ok := s.srv.users[s.name]
+	if !ok || subtle.ConstantTimeCompare([]byte(user.passwd), []byte(arg)) != 1 {
+		log.Printf("Login from %s user:%s failed\n", s.conn.RemoteAddr(), s.name)
+		time.Sleep(time.Second)
+		s.reply(530, "Login incorrect.")
+		return
+	}
+	s.user, s.cwd = user, "/"
+	log.Printf("Login from %s user:%s\n", s.conn.RemoteAddr(), s.name)
+	s.reply(230, "Login successful.")
+}
+
+func (s *ftpSession) cmdAuth(arg string) {
+	if s.srv.tlscfg == nil {
+		s.reply(502, "TLS not configured.")
+		return
+	}
+	if s.tls {
+		s.reply(503, "Already using TLS.")
+		return
+	}
+	if mech := strings.ToUpper(arg); mech != "TLS" && mech != "TLS-C" && mech != "SSL" {
+		s.reply(504, "Unsupported mechanism.")
+		return
+	}
+	s.reply(234, "Proceed with negotiation.")
+	tlsConn := tls.Server(s.conn, s.srv.tlscfg)
+	tlsConn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("TLS handshake from %s error:%s\n", s.conn.RemoteAddr(), err.Error())
+		s.conn.Close()
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+	s.conn, s.text, s.tls = tlsConn, textproto.NewConn(tlsConn), true
+}
+
+func (s *ftpSession) cmdPbsz(arg string) {
+	if !s.tls {
+		s.reply(503, "PBSZ requires AUTH.")
+		return
+	}
+	s.reply(200, "PBSZ=0")
+}
+
+func (s *ftpSession) cmdProt(arg string) {
+	switch strings.ToUpper(arg) {
+	case "C":
+		s.protect = false
+		s.reply(200, "PROT now Clear.")
+	case "P":
+		if !s.tls {
+			s.reply(503, "PROT requires AUTH.")
+			return
+		}
+		s.protect = true
+		s.reply(200, "PROT now Private.")
+	default:
+		s.reply(504, "Unsupported protection level.")
+	}
+}
+
+func (s *ftpSession) cmdFeat(arg string) {
+	var algos []string
+	for _, algo := range ftpHashAlgos {
+		if algo == s.hash {
+			algo += "*"
+		}
+		algos = append(algos, algo)
+	}
+	features := []string{"UTF8", "EPSV", "EPRT", "PASV", "SIZE", "MDTM", "MFMT", "REST STREAM",
+		"MLST type*;size*;modify*;", "XMD5", "HASH " + strings.Join(algos, ";")}
+	if s.srv.tlscfg != nil {
+		features = append(features, "AUTH TLS", "PBSZ", "PROT")
+	}
+	s.text.PrintfLine("211-Features:")
+	for _, feature := range features {
+		s.text.PrintfLine(" %s", feature)
+	}
+	s.reply(211, "End")
+}
+
+func (s *ftpSession) cmdSyst(arg string) {
+	s.reply(215, "UNIX Type: L8")
+}
+
+func (s *ftpSession) cmdOpts(arg string) {
+	fields := strings.Fields(strings.ToUpper(arg))
+	switch {
+	case len(fields) == 2 && fields[0] == "UTF8" && fields[1] == "ON":
+		s.reply(200, "Always in UTF8 mode.")
+	case len(fields) == 1 && fields[0] == "HASH":
+		s.reply(200, "%s", s.hash)
+	case len(fields) == 2 && fields[0] == "HASH":
+		if newHash(fields[1]) == nil {
+			s.reply(504, "Unknown algorithm.")
+			return
+		}
+		s.hash = fields[1]
+		s.reply(200, "%s", s.hash)
+	default:
+		s.reply(501, "Option not understood.")
+	}
+}
+
+func (s *ftpSession) cmdNoop(arg string) {
+	s.reply(200, "NOOP ok.")
+}
+
+// cmdType 所有传输都按二进制处理
+func (s *ftpSession) cmdType(arg string) {
+	switch strings.ToUpper(arg) {
+	case "A", "A N":
+		s.reply(200, "Switching to ASCII mode.")
+	case "I", "L 8":
+		s.reply(200, "Switching to Binary mode.")
+	default:
+		s.reply(504, "Unsupported type.")
+	}
+}
+
+func (s *ftpSession) cmdMode(arg string) {
+	if strings.ToUpper(arg) != "S" {
+		s.reply(504, "Only stream mode supported.")
+		return
+	}
+	s.reply(200, "Mode set to S.")
+}
+
+func (s *ftpSession) cmdStru(arg string) {
+	if strings.ToUpper(arg) != "F" {
+		s.reply(504, "Only file structure supported.")
+		return
+	}
+	s.reply(200, "Structure set to F.")
+}
+
+func (s *ftpSession) cmdAllo(arg string) {
+	s.reply(202, "ALLO command ignored.")
+}
+
+func (s *ftpSession) cmdAbor(arg string) {
+	s.closePassive()
+	s.reply(226, "No transfer to abort.")
+}
+
+func (s *ftpSession) cmdPwd(arg string) {
+	s.reply(257, "\"%s\" is the current directory", strings.Replace(s.cwd, "\"", "\"\"", -1))
+}
+
+func (s *ftpSession) cmdCwd(arg string) {
+	info, err := s.stat(arg)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	if !info.IsDir() {
+		s.reply(550, "Not a directory.")
+		return
+	}
+	s.cwd = s.vpath(arg)
+	s.reply(250, "Directory successfully changed.")
+}
+
+func (s *ftpSession) cmdCdup(arg string) {
+	s.cmdCwd("..")
+}
+
+// listenPassive 在控制连接的本地地址上监听被动模式端口
+func (s *ftpSession) listenPassive() (int, error) {
+	s.closePassive()
+	local, _, err := net.SplitHostPort(s.conn.LocalAddr().String())
+	if err != nil {
+		return 0, err
+	}
+	if s.srv.portMin == 0 {
+		s.pasv, err = net.Listen("tcp", net.JoinHostPort(local, "0"))
+	} else {
+		count := s.srv.portMax - s.srv.portMin + 1
+		start := rand.Intn(count)
+		for i := 0; i < count; i++ {
+			port := s.srv.portMin + (start+i)%count
+			if s.pasv, err = net.Listen("tcp", net.JoinHostPort(local, strconv.Itoa(port))); err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	s.port = ""
+	return s.pasv.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (s *ftpSession) closePassive() {
+	if s.pasv != nil {
+		s.pasv.Close()
+		s.pasv = nil
+	}
+}
+
+func (s *ftpSession) cmdPasv(arg string) {
+	ip := net.ParseIP(s.srv.cfg.PublicIP)
+	if ip == nil {
+		local, _, _ := net.SplitHostPort(s.conn.LocalAddr().String())
+		ip = net.ParseIP(local)
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		s.reply(522, "PASV requires IPv4, use EPSV.")
+		return
+	}
+	port, err := s.listenPassive()
+	if err != nil {
+		s.reply(425, "Can't open passive connection.")
+		return
+	}
+	s.reply(227, "Entering Passive Mode (%d,%d,%d,%d,%d,%d).", ip4[0], ip4[1], ip4[2], ip4[3], port>>8, port&0xff)
+}
+
+func (s *ftpSession) cmdEpsv(arg string) {
+	if strings.ToUpper(arg) == "ALL" {
+		s.reply(200, "EPSV ALL ok.")
+		return
+	}
+	port, err := s.listenPassive()
+	if err != nil {
+		s.reply(425, "Can't open passive connection.")
+		return
+	}
+	s.reply(229, "Entering Extended Passive Mode (|||%d|)", port)
+}
+
+func (s *ftpSession) cmdPort(arg string) {
+	fields := strings.Split(arg, ",")
+	if len(fields) != 6 {
+		s.reply(501, "Illegal PORT command.")
+		return
+	}
+	var nums [6]int
+	for i, field := range fields {
+		num, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || num < 0 || num > 255 {
+			s.reply(501, "Illegal PORT command.")
+			return
+		}
+		nums[i] = num
+	}
+	ip := net.IPv4(byte(nums[0]), byte(nums[1]), byte(nums[2]), byte(nums[3]))
+	s.setActive(ip, nums[4]<<8|nums[5])
+}
+
+// cmdEprt 格式: |1|132.235.1.2|6275| 或 |2|::1|6275|
+func (s *ftpSession) cmdEprt(arg string) {
+	if len(arg) < 7 {
+		s.reply(501, "Illegal EPRT command.")
+		return
+	}
+	fields := strings.Split(arg[1:len(arg)-1], arg[:1])
+	if len(fields) != 3 {
+		s.reply(501, "Illegal EPRT command.")
+		return
+	}
+	ip := net.ParseIP(fields[1])
+	port, err := strconv.Atoi(fields[2])
+	if ip == nil || err != nil {
+		s.reply(501, "Illegal EPRT command.")
+		return
+	}
+	s.setActive(ip, port)
+}
+
+// setActive 只允许连接客户端自己的地址,防止被用来扫描其他主机
+func (s *ftpSession) setActive(ip net.IP, port int) {
+	if !ip.Equal(s.remote) || port < 1024 || port > 65535 {
+		s.reply(500, "Illegal PORT address.")
+		return
+	}
+	s.closePassive()
+	s.port = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	s.reply(200, "PORT command successful.")
+}
+
+// dataConn 建立数据连接,被动模式只接受来自控制连接地址的连接
+func (s *ftpSession) dataConn() (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	switch {
+	case s.pasv != nil:
+		lis := s.pasv
+		s.pasv = nil
+		defer lis.Close()
+		if tcpLis, ok := lis.(*net.TCPListener); ok {
+			tcpLis.SetDeadline(time.Now().Add(30 * time.Second))
+		}
+		if conn, err = lis.Accept(); err != nil {
+			return nil, err
+		}
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !addr.IP.Equal(s.remote) {
+			conn.Close()
+			return nil, fmt.Errorf("data connection from %s refused", addr.IP)
+		}
+	case s.port != "":
+		if conn, err = net.DialTimeout("tcp", s.port, 30*time.Second); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errFTPNoDataConn
+	}
+
+	if !s.protect {
+		return conn, nil
+	}
+	tlsConn := tls.Server(conn, s.srv.tlscfg)
+	tlsConn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// transfer 回复150之后建立数据连接并执行fn,完成后回复226
+func (s *ftpSession) transfer(fn func(c net.Conn) error) error {
+	if s.pasv == nil && s.port == "" {
+		s.reply(425, "Use PORT or PASV first.")
+		return errFTPNoDataConn
+	}
+	s.reply(150, "Opening data connection.")
+	c, err := s.dataConn()
+	if err != nil {
+		s.reply(425, "Can't open data connection.")
+		return err
+	}
+	err = fn(c)
+	c.Close()
+	if err != nil {
+		s.reply(426, "Connection closed; transfer aborted.")
+		return err
+	}
+	s.reply(226, "Transfer complete.")
+	return nil
+}
+
+// listArgs 忽略LIST参数中的选项,如:-a -l
+func listArgs(arg string) string {
+	for strings.HasPrefix(arg, "-") {
+		idx := strings.Index(arg, " ")
+		if idx < 0 {
+			return ""
+		}
+		arg = strings.TrimLeft(arg[idx:], " ")
+	}
+	return arg
+}
+
+// readDirInfo 读取目录,如果是文件返回文件本身
+func (s *ftpSession) readDirInfo(arg string) ([]os.FileInfo, error) {
+	name, err := s.realPath(arg)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []os.FileInfo{info}, nil
+	}
+	infos, err := readDir(name)
+	if err != nil {
+		return nil, err
+	}
+	// 跟随符号链接获取目标文件信息,目标不在用户根目录中的时候保持链接本身的信息
+	for i, info := range infos {
+		if info.Mode()&os.ModeSymlink != 0 {
+			link := filepath.Join(name, info.Name())
+			if resolved, err := evalSymlinks(link, 0); err != nil || !s.inRoot(resolved) {
+				continue
+			}
+			if target, err := os.Stat(link); err == nil {
+				infos[i] = target
+			}
+		}
+	}
+	return infos, nil
+}
+
+func (s *ftpSession) sendList(arg string, format func(info os.FileInfo) string) {
+	infos, err := s.readDirInfo(listArgs(arg))
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.transfer(func(c net.Conn) error {
+		w := bufio.NewWriter(c)
+		for _, info := range infos {
+			fmt.Fprintf(w, "%s\r\n", format(info))
+		}
+		return w.Flush()
+	})
+}
+
+func (s *ftpSession) cmdList(arg string) {
+	s.sendList(arg, sftpLongName)
+}
+
+func (s *ftpSession) cmdNlst(arg string) {
+	s.sendList(arg, func(info os.FileInfo) string { return info.Name() })
+}
+
+func (s *ftpSession) cmdMlsd(arg string) {
+	info, err := s.stat(arg)
+	if err == nil && !info.IsDir() {
+		s.reply(501, "Not a directory.")
+		return
+	}
+	s.sendList(arg, func(info os.FileInfo) string { return mlsxFacts(info, info.Name()) })
+}
+
+func (s *ftpSession) cmdMlst(arg string) {
+	info, err := s.stat(arg)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.text.PrintfLine("250-Listing %s", s.vpath(arg))
+	s.text.PrintfLine(" %s", mlsxFacts(info, s.vpath(arg)))
+	s.reply(250, "End")
+}
+
+// mlsxFacts MLSD/MLST的格式: type=file;size=1024;modify=20180101120000;perm=r; name
+func mlsxFacts(info os.FileInfo, name string) string {
+	typ, perm := "file", "adfrw"
+	if info.IsDir() {
+		typ, perm = "dir", "cdeflmp"
+	}
+	return fmt.Sprintf("type=%s;size=%d;modify=%s;perm=%s;UNIX.mode=%04o; %s", typ, info.Size(),
+		info.ModTime().UTC().Format(ftpTimeLayout), perm, info.Mode().Perm(), name)
+}
+
+func (s *ftpSession) cmdSize(arg string) {
+	info, err := s.stat(arg)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	if info.IsDir() {
+		s.reply(550, "Not a regular file.")
+		return
+	}
+	s.reply(213, "%d", info.Size())
+}
+
+// cmdMdtm 获取修改时间,参数为"YYYYMMDDHHMMSS path"的时候设置修改时间
+func (s *ftpSession) cmdMdtm(arg string) {
+	if fields := strings.SplitN(arg, " ", 2); len(fields) == 2 {
+		if _, err := parseFTPTime(fields[0]); err == nil {
+			if s.user.readOnly {
+				s.reply(550, "Permission denied.")
+				return
+			}
+			s.cmdMfmt(arg)
+			return
+		}
+	}
+	info, err := s.stat(arg)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.reply(213, "%s", info.ModTime().UTC().Format(ftpTimeLayout))
+}
+
+func (s *ftpSession) cmdMfmt(arg string) {
+	fields := strings.SplitN(arg, " ", 2)
+	if len(fields) != 2 {
+		s.reply(501, "Syntax error.")
+		return
+	}
+	t, err := parseFTPTime(fields[0])
+	if err != nil {
+		s.reply(501, "Invalid time.")
+		return
+	}
+	name, err := s.realPath(fields[1])
+	if err == nil {
+		err = os.Chtimes(name, t, t)
+	}
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.reply(213, "Modify=%s; %s", fields[0], s.vpath(fields[1]))
+}
+
+var ftpHashAlgos = []string{"SHA-1", "SHA-256", "SHA-512", "MD5"}
+
+func (s *ftpSession) cmdXmd5(arg string) {
+	name, err := s.realPath(arg)
+	var sum string
+	if err == nil {
+		sum, err = fileHash(name, "MD5")
+	}
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.reply(251, "%s", sum)
+}
+
+// cmdHash 响应格式: 213 SHA-256 0-1024 hex name
+func (s *ftpSession) cmdHash(arg string) {
+	name, err := s.realPath(arg)
+	var info os.FileInfo
+	if err == nil {
+		info, err = os.Stat(name)
+	}
+	if err == nil && info.IsDir() {
+		s.reply(553, "Not a regular file.")
+		return
+	}
+	var sum string
+	if err == nil {
+		sum, err = fileHash(name, s.hash)
+	}
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.reply(213, "%s 0-%d %s %s", s.hash, info.Size(), sum, s.vpath(arg))
+}
+
+func (s *ftpSession) cmdRest(arg string) {
+	offset, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || offset < 0 {
+		s.reply(501, "Invalid offset.")
+		return
+	}
+	s.rest = offset
+	s.reply(350, "Restart position accepted (%d).", offset)
+}
+
+func (s *ftpSession) cmdRetr(arg string) {
+	name, err := s.realPath(arg)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	File, err := os.Open(name)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	defer File.Close()
+	if info, err := File.Stat(); err != nil || info.IsDir() {
+		s.reply(550, "Not a regular file.")
+		return
+	}
+	if s.rest > 0 {
+		if _, err = File.Seek(s.rest, io.SeekStart); err != nil {
+			s.replyError(err)
+			return
+		}
+	}
+	s.transfer(func(c net.Conn) error {
+		_, err := io.Copy(c, File)
+		return err
+	})
+}
+
+func (s *ftpSession) cmdStor(arg string) {
+	flag := os.O_WRONLY | os.O_CREATE
+	if s.rest == 0 {
+		flag |= os.O_TRUNC
+	}
+	s.store(arg, flag, s.rest)
+}
+
+func (s *ftpSession) cmdAppe(arg string) {
+	var offset int64
+	if info, err := s.stat(arg); err == nil {
+		offset = info.Size()
+	}
+	s.store(arg, os.O_WRONLY|os.O_CREATE|os.O_APPEND, offset)
+}
+
+// store 接收上传的文件,offset大于0的时候从指定位置续传,APPE的offset只用于记录日志
+func (s *ftpSession) store(arg string, flag int, offset int64) {
+	// 没有数据连接的时候不能先截断文件
+	if s.pasv == nil && s.port == "" {
+		s.reply(425, "Use PORT or PASV first.")
+		return
+	}
+	name, err := s.realPath(arg)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	File, err := os.OpenFile(name, flag, 0644)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	defer File.Close()
+	if offset > 0 && flag&os.O_APPEND == 0 {
+		if err = File.Truncate(offset); err == nil {
+			_, err = File.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			s.replyError(err)
+			return
+		}
+	}
+
+	start := time.Now()
+	var size int64
+	err = s.transfer(func(c net.Conn) error {
+		var err error
+		size, err = io.Copy(File, c)
+		return err
+	})
+	s.logUpload(s.vpath(arg), offset, size, time.Since(start), err)
+}
+
+// logUpload 上传日志格式: 时间 客户端地址 用户 路径 起始位置 大小 耗时 结果
+func (s *ftpSession) logUpload(vpath string, offset, size int64, cost time.Duration, err error) {
+	status := "OK"
+	if err != nil {
+		status = "FAILED:" + err.Error()
+	}
+	log.Printf("Upload from %s user:%s path:%s size:%d %s\n", s.conn.RemoteAddr(), s.user.name, vpath, size, status)
+	if s.srv.uploadLog != nil {
+		s.srv.uploadLog.Printf("%s\t%s\t%s\t%s\t%d\t%d\t%.3f\t%s", time.Now().Format("2006-01-02 15:04:05"),
+			s.remote, s.user.name, vpath, offset, size, cost.Seconds(), status)
+	}
+}
+
+func (s *ftpSession) cmdDele(arg string) {
+	name, err := s.realPath(arg)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	if info, err := os.Lstat(name); err != nil {
+		s.replyError(err)
+		return
+	} else if info.IsDir() {
+		s.reply(550, "Is a directory.")
+		return
+	}
+	if err := os.Remove(name); err != nil {
+		s.replyError(err)
+		return
+	}
+	s.reply(250, "Delete operation successful.")
+}
+
+func (s *ftpSession) cmdMkd(arg string) {
+	name, err := s.realPath(arg)
+	if err == nil {
+		err = os.Mkdir(name, 0755)
+	}
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.reply(257, "\"%s\" created", strings.Replace(s.vpath(arg), "\"", "\"\"", -1))
+}
+
+func (s *ftpSession) cmdRmd(arg string) {
+	if s.vpath(arg) == "/" {
+		s.reply(550, "Permission denied.")
+		return
+	}
+	name, err := s.realPath(arg)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	if info, err := os.Stat(name); err != nil {
+		s.replyError(err)
+		return
+	} else if !info.IsDir() {
+		s.reply(550, "Not a directory.")
+		return
+	}
+	if err := os.Remove(name); err != nil {
+		s.replyError(err)
+		return
+	}
+	s.reply(250, "Remove directory operation successful.")
+}
+
+func (s *ftpSession) cmdRnfr(arg string) {
+	name, err := s.realPath(arg)
+	if err == nil {
+		_, err = os.Lstat(name)
+	}
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.rnfr = name
+	s.reply(350, "Ready for RNTO.")
+}
+
+func (s *ftpSession) cmdRnto(arg string) {
+	from := s.rnfr
+	s.rnfr = ""
+	if from == "" {
+		s.reply(503, "RNFR required first.")
+		return
+	}
+	name, err := s.realPath(arg)
+	if err == nil {
+		err = os.Rename(from, name)
+	}
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.reply(250, "Rename successful.")
+}
@@ -0,0 +1,184 @@
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// startFTPServer 在127.0.0.1的随机端口启动ftp服务,返回服务地址
+func startFTPServer(t *testing.T, root string, readOnly bool) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &FTPServerConfig{Root: root, User: "test", Passwd: "secret", ReadOnly: readOnly, Timeout: 10 * time.Second}
+	go ftpServe(cfg, lis)
+	t.Cleanup(func() { lis.Close() })
+	return lis.Addr().String()
+}
+
+func dialTestFTP(t *testing.T, addr string, resume bool) FTPClient {
+	t.Helper()
+	c, err := NewFTPWithOption(addr, "test", "secret", &FTPOption{Timeout: 5 * time.Second, Resume: resume})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Exit)
+	return c
+}
+
+func TestFTPServeTransfer(t *testing.T) {
+	root, err := ioutil.TempDir("", "ftp_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	local, err := ioutil.TempDir("", "ftp_local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(local)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	src := filepath.Join(local, "src.bin")
+	if err = ioutil.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := dialTestFTP(t, startFTPServer(t, root, false), false)
+
+	// 上传和下载
+	if err = c.Mkdir("/up"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.PutFile(src, "/up/a.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(root, "up", "a.bin")); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("uploaded file = %d bytes, %v", len(got), err)
+	}
+	dst := filepath.Join(local, "dst.bin")
+	if err = c.GetFile(dst, "/up/a.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(dst); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("downloaded file = %d bytes, %v", len(got), err)
+	}
+
+	// MLSD和LIST的结果相同
+	if err = ioutil.WriteFile(filepath.Join(root, "up", "b.txt"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(filepath.Join(root, "up", "sub dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, mlsd := range []bool{true, false} {
+		c.(*ftpLogin).noMLSD = !mlsd
+		entries, err := c.List("/up")
+		if err != nil {
+			t.Fatalf("List(mlsd=%v) = %v", mlsd, err)
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+		if len(entries) != 3 || entries[0].Name != "a.bin" || entries[0].Size != int64(len(data)) ||
+			entries[1].Name != "b.txt" || entries[1].Dir || entries[2].Name != "sub dir" || !entries[2].Dir {
+			for _, entry := range entries {
+				t.Logf("%+v", *entry)
+			}
+			t.Fatalf("List(mlsd=%v) returned wrong entries", mlsd)
+		}
+	}
+
+	// 从断点续传:本地只有前一半的时候继续下载,远程只有前一半的时候继续上传
+	rc := dialTestFTP(t, startFTPServer(t, root, false), true)
+	half := len(data) / 2
+	if err = ioutil.WriteFile(dst, data[:half], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = rc.GetFile(dst, "/up/a.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(dst); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("resumed download = %d bytes, %v", len(got), err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(root, "up", "c.bin"), data[:half], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = rc.PutFile(src, "/up/c.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(root, "up", "c.bin")); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("resumed upload = %d bytes, %v", len(got), err)
+	}
+}
+
+func TestFTPServeReadOnly(t *testing.T) {
+	root, err := ioutil.TempDir("", "ftp_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err = ioutil.WriteFile(filepath.Join(root, "keep.txt"), []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := dialTestFTP(t, startFTPServer(t, root, true), false)
+
+	for name, fn := range map[string]func() error{
+		"put":    func() error { return c.PutFile(filepath.Join(root, "keep.txt"), "/new.txt") },
+		"mkdir":  func() error { return c.Mkdir("/dir") },
+		"delete": func() error { return c.Delete("/keep.txt") },
+		"rename": func() error { return c.Rename("/keep.txt", "/moved.txt") },
+	} {
+		err := fn()
+		if terr, ok := err.(*textproto.Error); !ok || terr.Code != 550 {
+			t.Errorf("%s on read-only server = %v, want 550", name, err)
+		}
+	}
+	names, err := filepath.Glob(filepath.Join(root, "*"))
+	if err != nil || len(names) != 1 || filepath.Base(names[0]) != "keep.txt" {
+		t.Fatalf("root changed: %v, %v", names, err)
+	}
+
+	// 只读用户仍然可以下载
+	dst, err := ioutil.TempFile("", "ftp_download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst.Close()
+	defer os.Remove(dst.Name())
+	if err = c.GetFile(dst.Name(), "/keep.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(dst.Name()); err != nil || string(got) != "keep" {
+		t.Fatalf("downloaded file = %q, %v", got, err)
+	}
+}
+
+// 续传的时候远程已有部分和本地不一致,只有校验内容才能发现
+func TestFTPResumeVerify(t *testing.T) {
+	root, err := ioutil.TempDir("", "ftp_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	src := filepath.Join(root, "src.txt")
+	if err = ioutil.WriteFile(src, []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(root, "dst.txt"), []byte("HELLO"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := dialTestFTP(t, startFTPServer(t, root, false), true)
+	if err = c.PutFile(src, "/dst.txt"); err == nil {
+		t.Fatal("PutFile() = nil, want md5 mismatch")
+	} else if _, ok := err.(*ftpVerifyError); !ok {
+		t.Fatalf("PutFile() = %v, want verify error", err)
+	}
+}
@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"net/textproto"
+	"testing"
+)
+
+func TestParseEPSV(t *testing.T) {
+	tests := map[string]struct {
+		msg  string
+		port int
+	}{
+		"standard":        {"Entering Extended Passive Mode (|||6446|)", 6446},
+		"other delimiter": {"Entering Extended Passive Mode (!!!6446!)", 6446},
+		"trailing text":   {"Entering Extended Passive Mode (|||21000|). Ok", 21000},
+		"max port":        {"(|||65535|)", 65535},
+		"port too large":  {"Entering Extended Passive Mode (|||65536|)", 0},
+		"zero port":       {"Entering Extended Passive Mode (|||0|)", 0},
+		"not a number":    {"Entering Extended Passive Mode (|||port|)", 0},
+		"address ignored": {"Entering Extended Passive Mode (|1|10.0.0.1|6446|)", 6446},
+		"missing fields":  {"Entering Extended Passive Mode (||6446|)", 0},
+		"no parentheses":  {"Entering Extended Passive Mode |||6446|", 0},
+		"empty":           {"(|||)", 0},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			port, err := parseEPSV(test.msg)
+			if port != test.port {
+				t.Fatalf("parseEPSV(%q) = %d, %v, want %d", test.msg, port, err, test.port)
+			}
+			// 格式错误的时候返回229错误,调用方据此切换到PASV
+			if e, ok := err.(*textproto.Error); (test.port == 0) != ok || ok && e.Code != 229 {
+				t.Fatalf("parseEPSV(%q) error = %v", test.msg, err)
+			}
+		})
+	}
+}
+
+func TestParsePASV(t *testing.T) {
+	tests := map[string]struct {
+		msg  string
+		port int
+	}{
+		"standard":            {"Entering Passive Mode (192,168,1,2,19,137)", 19*256 + 137},
+		"without brackets":    {"Entering Passive Mode 10,0,0,1,0,21", 21},
+		"equals form":         {"=127,0,0,1,255,255", 65535},
+		"missing port":        {"Entering Passive Mode (192,168,1,2,19)", 0},
+		"high byte too large": {"Entering Passive Mode (192,168,1,2,256,0)", 0},
+		"low byte too large":  {"Entering Passive Mode (192,168,1,2,0,300)", 0},
+		"zero port":           {"Entering Passive Mode (192,168,1,2,0,0)", 0},
+		"huge number":         {"Entering Passive Mode (1,2,3,4,99999999999999999999,1)", 0},
+		"no numbers":          {"Entering Passive Mode", 0},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			port, err := parsePASV(test.msg)
+			if port != test.port || (err == nil) != (test.port != 0) {
+				t.Fatalf("parsePASV(%q) = %d, %v, want %d", test.msg, port, err, test.port)
+			}
+		})
+	}
+}
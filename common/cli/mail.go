@@ -7,83 +7,248 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
 	"mime/multipart"
 	"mime/quotedprintable"
+	"net"
+	"net/mail"
 	"net/smtp"
 	"net/textproto"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
 const memMaxSize = 10 << 20 // 10MB
 
 // MailRun 发送邮件
 func MailRun(mailConfig *MailConfig) error {
-	if mailConfig.User == "" || mailConfig.Passwd == "" || mailConfig.From == "" || mailConfig.To == "" {
+	if mailConfig.From == "" || (mailConfig.To == "" && mailConfig.Cc == "" && mailConfig.Bcc == "") {
 		return fmt.Errorf("参数错误")
 	}
+	auth, err := MailAuth(mailConfig)
+	if err != nil {
+		return err
+	}
 
+	file, err := mailBuffer(mailConfig)
+	if err != nil {
+		return err
+	}
+	defer closeMailBuffer(file)
+	err = MailSend(mailConfig, auth, mailReader(file))
+	if err == nil || mailConfig.Spool == "" || !mailRetryable(err) {
+		return err
+	}
+	id, serr := MailSpool(mailConfig.Spool, mailConfig, mailReader(file), err)
+	if serr != nil {
+		return fmt.Errorf("%s,写入队列失败:%s", err.Error(), serr.Error())
+	}
+	fmt.Printf("发送失败:%s,已写入队列:%s\n", err.Error(), id)
+	return nil
+}
+
+// mailBuffer 封装邮件内容,超过memMaxSize的时候写入临时文件
+func mailBuffer(mailConfig *MailConfig) (io.ReadWriter, error) {
 	size, err := mailConfig.Len()
 	if err != nil {
-		fmt.Printf("获取邮件大小失败:%s\n", err.Error())
-		return nil
+		return nil, fmt.Errorf("获取邮件大小失败:%s", err.Error())
 	}
 
 	var file io.ReadWriter
 	if size >= memMaxSize {
-		temp := fmt.Sprintf(".%d.tmp", os.Getpid())
-		file, err = os.Create(temp)
+		temp, err := ioutil.TempFile("", ".mail")
 		if err != nil {
-			return fmt.Errorf("创建临时文件失败:%s", err.Error())
+			return nil, fmt.Errorf("创建临时文件失败:%s", err.Error())
 		}
-		defer os.Remove(temp)
+		file = temp
 	} else {
 		file = bytes.NewBuffer(make([]byte, 0, size))
 	}
-	err = mailConfig.Writer(file)
+	if err = mailConfig.Writer(file); err != nil {
+		closeMailBuffer(file)
+		return nil, fmt.Errorf("封装邮件内容失败:%s", err)
+	}
+	return file, nil
+}
+
+// closeMailBuffer 关闭并删除mailBuffer创建的临时文件
+func closeMailBuffer(file io.ReadWriter) {
+	if temp, ok := file.(*os.File); ok {
+		temp.Close()
+		os.Remove(temp.Name())
+	}
+}
+
+// MailAuth 根据配置的认证方式创建smtp.Auth,不需要认证的时候返回nil
+func MailAuth(cfg *MailConfig) (smtp.Auth, error) {
+	mech := strings.ToLower(cfg.Auth)
+	if mech == "none" {
+		return nil, nil
+	}
+	if cfg.User == "" || cfg.Passwd == "" {
+		return nil, fmt.Errorf("参数错误,%s认证需要指定用户名和密码", mech)
+	}
+
+	var auth smtp.Auth
+	switch mech {
+	case "", "plain":
+		auth = smtp.PlainAuth("", cfg.User, cfg.Passwd, strings.Split(cfg.Host, ":")[0])
+	case "login":
+		auth = &loginAuth{user: cfg.User, passwd: cfg.Passwd}
+	case "cram-md5":
+		auth = smtp.CRAMMD5Auth(cfg.User, cfg.Passwd)
+	default:
+		return nil, fmt.Errorf("不支持的认证方式:%s", cfg.Auth)
+	}
+	if strings.ToLower(cfg.TLS) == "none" {
+		auth = &insecureAuth{auth}
+	}
+	return auth, nil
+}
+
+// loginAuth AUTH LOGIN 认证
+type loginAuth struct {
+	user, passwd string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:", "user name":
+		return []byte(a.user), nil
+	case "password:":
+		return []byte(a.passwd), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge:%s", fromServer)
+}
+
+// insecureAuth 明确指定不使用tls的时候,允许PlainAuth在非加密连接上发送密码
+type insecureAuth struct {
+	smtp.Auth
+}
+
+func (a *insecureAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	info := *server
+	info.TLS = true
+	return a.Auth.Start(&info)
+}
+
+// mailDial 连接smtp服务器,implicit使用tls连接,starttls要求服务端必须支持STARTTLS,
+// none不使用tls,为空的时候服务端支持STARTTLS就使用
+func mailDial(msg *MailConfig) (*smtp.Client, error) {
+	host, _, err := net.SplitHostPort(msg.Host)
 	if err != nil {
-		return fmt.Errorf("封装邮件内容失败:%s", err)
+		return nil, err
+	}
+	tlscfg, err := ClientTLSConfig(msg.CA, msg.Insecure)
+	if err != nil {
+		return nil, &mailConfigError{err}
+	}
+	tlscfg.ServerName = host
+
+	mode := strings.ToLower(msg.TLS)
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	switch mode {
+	case "implicit":
+		conn, err = tls.DialWithDialer(dialer, "tcp", msg.Host, tlscfg)
+	case "", "none", "starttls":
+		conn, err = dialer.Dial("tcp", msg.Host)
+	default:
+		return nil, &mailConfigError{fmt.Errorf("不支持的tls模式:%s", msg.TLS)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
 
-	auth := smtp.PlainAuth("", mailConfig.User, mailConfig.Passwd, strings.Split(mailConfig.Host, ":")[0])
-	err = MailSend(mailConfig, auth, file)
-	if c, ok := file.(io.Closer); ok {
-		c.Close()
+	if err = client.Hello(heloName(msg.HeloName)); err != nil {
+		client.Close()
+		return nil, err
+	}
+	if mode == "" || mode == "starttls" {
+		ok, _ := client.Extension("STARTTLS")
+		if ok {
+			err = client.StartTLS(tlscfg)
+		} else if mode == "starttls" {
+			err = &mailConfigError{errors.New("server doesn't support STARTTLS")}
+		}
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
 	}
-	return err
+	return client, nil
+}
+
+// heloName EHLO使用的名称,没有指定的时候使用本机的主机名
+func heloName(name string) string {
+	if name != "" {
+		return name
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	return "localhost"
 }
 
 // MailSend 送邮件
 func MailSend(msg *MailConfig, auth smtp.Auth, body io.Reader) error {
-	to := strings.Split(msg.To, ",")
-	if msg.From == "" || len(to) == 0 {
-		return errors.New("Must specify at least one From address and one To address")
-	}
-	client, err := smtp.Dial(msg.Host)
+	client, err := mailDial(msg)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
-	host := strings.Split(msg.Host, ":")[0]
-	if err = client.Hello(host); err != nil {
-		return err
-	}
-
-	if ok, _ := client.Extension("STARTTLS"); ok {
-		config := &tls.Config{ServerName: host}
-		if err = client.StartTLS(config); err != nil {
+	if auth != nil {
+		if err = client.Auth(auth); err != nil {
+			// 服务端不支持认证或者明文连接拒绝发送密码,不是临时错误
+			if !mailNetError(err) {
+				if _, ok := err.(*textproto.Error); !ok {
+					err = &mailConfigError{err}
+				}
+			}
 			return err
 		}
 	}
+	if err = mailDeliver(client, msg, body); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// mailNetError 连接断开或者超时,可以重试
+func mailNetError(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
 
-	if err = client.Auth(auth); err != nil {
+// mailDeliver 在已经建立的连接上发送一封邮件
+func mailDeliver(client *smtp.Client, msg *MailConfig, body io.Reader) error {
+	to, err := msg.Recipients()
+	if err != nil {
 		return err
 	}
+	from, err := msg.FromAddress()
+	if err != nil || len(to) == 0 {
+		return errors.New("Must specify at least one From address and one To address")
+	}
 
-	if err = client.Mail(msg.From); err != nil {
+	if err = client.Mail(from); err != nil {
 		return err
 	}
 
@@ -106,154 +271,332 @@ func MailSend(msg *MailConfig, auth smtp.Auth, body io.Reader) error {
 	if err != nil {
 		return err
 	}
-
-	err = w.Close()
-	if err != nil {
-		return err
-	}
-
-	return client.Quit()
+	return w.Close()
 }
 
 // MailConfig mail config args
 type MailConfig struct {
 	User, Passwd, Host string
 	From, To, Type     string
+	Cc, Bcc, ReplyTo   string // 多个地址使用','分割,Bcc只用于RCPT,不写入邮件头
 	Subject, Content   string
 	ContentPath        string
+	HTML, HTMLPath     string // html正文,和-c同时指定的时候使用multipart/alternative发送
+	Inline             string // html中使用cid:文件名引用的图片,多个使用','分割
 	Attachments        string
+	Header             []string // 自定义邮件头,格式:Name: value
+	TLS                string   // none|starttls|implicit,为空的时候服务端支持STARTTLS就使用
+	Auth               string   // plain|login|cram-md5|none
+	CA                 string
+	Insecure           bool
+	HeloName           string
+	Spool              string // 发送失败的时候写入的队列目录
+	DKIMSelector       string // 不为空的时候使用DKIMKey签名,rsa-sha256,relaxed/relaxed
+	DKIMDomain         string // 为空的时候使用发件人地址的域名
+	DKIMKey            string
+}
+
+// mailBody 邮件正文,content为空的时候读取path
+type mailBody struct {
+	content, path string
+}
+
+func (b *mailBody) String() string {
+	if b == nil {
+		return ""
+	}
+	return b.content
+}
+
+// partCreator 创建邮件的一个部分,返回写入内容的Writer
+type partCreator func(header textproto.MIMEHeader) (io.Writer, error)
+
+// Recipients 返回所有收件人的地址,包括To,Cc和Bcc
+func (e *MailConfig) Recipients() ([]string, error) {
+	var list []string
+	for _, field := range []string{e.To, e.Cc, e.Bcc} {
+		addrs, err := parseAddressList(field)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			list = append(list, addr.Address)
+		}
+	}
+	return list, nil
+}
+
+// FromAddress 返回发件人的地址,不包含显示名称
+func (e *MailConfig) FromAddress() (string, error) {
+	addr, err := mail.ParseAddress(e.From)
+	if err != nil {
+		return "", err
+	}
+	return addr.Address, nil
+}
+
+func parseAddressList(list string) ([]*mail.Address, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	return mail.ParseAddressList(list)
+}
+
+// formatAddressList 格式化地址,显示名称按RFC 2047编码
+func formatAddressList(list string) (string, error) {
+	addrs, err := parseAddressList(list)
+	if err != nil {
+		return "", err
+	}
+	var values = make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		values = append(values, addr.String())
+	}
+	return strings.Join(values, ",\r\n "), nil
 }
 
 // Headers 返回邮件头信息
 func (e *MailConfig) Headers() (textproto.MIMEHeader, error) {
 	res := make(textproto.MIMEHeader)
-	if _, ok := res["To"]; !ok && len(e.To) > 0 {
-		res.Set("To", e.To)
+	for _, field := range []struct{ name, value string }{{"From", e.From}, {"To", e.To}, {"Cc", e.Cc}, {"Reply-To", e.ReplyTo}} {
+		value, err := formatAddressList(field.value)
+		if err != nil {
+			return nil, fmt.Errorf("%s 地址错误:%s", field.name, err.Error())
+		}
+		if value != "" {
+			res.Set(field.name, value)
+		}
 	}
 
-	if _, ok := res["Subject"]; !ok && e.Subject != "" {
+	if e.Subject != "" {
 		res.Set("Subject", e.Subject)
 	}
+	res.Set("Date", time.Now().Format(time.RFC1123Z))
+	res.Set("Message-ID", messageID(e.From))
+	res.Set("MIME-Version", "1.0")
 
-	if _, ok := res["From"]; !ok {
-		res.Set("From", e.From)
+	for _, line := range e.Header {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("邮件头格式错误:%s", line)
+		}
+		res.Set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
 	}
 	return res, nil
 }
 
-// Writer 写入附件
+func messageID(from string) string {
+	domain := "localhost"
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if idx := strings.LastIndex(addr.Address, "@"); idx >= 0 {
+			domain = addr.Address[idx+1:]
+		}
+	}
+	return fmt.Sprintf("<%d.%d@%s>", time.Now().UnixNano(), os.Getpid(), domain)
+}
+
+// bodies 返回纯文本和html正文,-T html的时候-c和-C指定的是html正文
+func (e *MailConfig) bodies() (text, html *mailBody) {
+	if e.Content != "" || e.ContentPath != "" {
+		text = &mailBody{e.Content, e.ContentPath}
+	}
+	if e.HTML != "" || e.HTMLPath != "" {
+		html = &mailBody{e.HTML, e.HTMLPath}
+	} else if strings.ToLower(e.Type) == "html" {
+		text, html = nil, text
+	}
+	return text, html
+}
+
+// Writer 写入邮件,有附件的时候使用multipart/mixed,同时有文本和html的时候使用multipart/alternative,
+// html有内嵌图片的时候使用multipart/related
 func (e *MailConfig) Writer(datawriter io.Writer) error {
+	if e.DKIMSelector == "" {
+		return e.write(datawriter)
+	}
+	w, err := newDKIMWriter(e, datawriter)
+	if err != nil {
+		return err
+	}
+	if err = e.write(w); err != nil {
+		w.abort()
+		return err
+	}
+	return w.Close()
+}
+
+func (e *MailConfig) write(datawriter io.Writer) error {
 	headers, err := e.Headers()
 	if err != nil {
 		return err
 	}
-	w := multipart.NewWriter(datawriter)
+	create := func(header textproto.MIMEHeader) (io.Writer, error) {
+		for key, value := range header {
+			headers[key] = value
+		}
+		headerToBytes(datawriter, headers)
+		_, err := io.WriteString(datawriter, "\r\n")
+		return datawriter, err
+	}
 
-	headers.Set("Content-Type", "multipart/mixed;\r\n boundary="+w.Boundary())
-	headerToBytes(datawriter, headers)
-	io.WriteString(datawriter, "\r\n")
+	attachments := splitList(e.Attachments)
+	if len(attachments) == 0 {
+		return e.writeBody(create)
+	}
+	w, err := newMultipart(create, "mixed")
+	if err != nil {
+		return err
+	}
+	if err = e.writeBody(w.CreatePart); err != nil {
+		return err
+	}
+	for _, path := range attachments {
+		if err = attach(w, path, false); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
 
-	fmt.Fprintf(datawriter, "--%s\r\n", w.Boundary())
-	header := textproto.MIMEHeader{}
-	if e.Content != "" || e.ContentPath != "" {
-		subWriter := multipart.NewWriter(datawriter)
-		header.Set("Content-Type", fmt.Sprintf("multipart/alternative;\r\n boundary=%s\r\n", subWriter.Boundary()))
-		headerToBytes(datawriter, header)
-		if e.Content != "" {
-			header.Set("Content-Type", fmt.Sprintf("text/%s; charset=UTF-8", e.Type))
-			header.Set("Content-Transfer-Encoding", "quoted-printable")
-			if _, err := subWriter.CreatePart(header); err != nil {
-				return err
-			}
-			qp := quotedprintable.NewWriter(datawriter)
-			if _, err := qp.Write([]byte(e.Content)); err != nil {
-				return err
-			}
-			if err := qp.Close(); err != nil {
-				return err
-			}
-		} else {
-			header.Set("Content-Type", fmt.Sprintf("text/%s; charset=UTF-8", e.Type))
-			header.Set("Content-Transfer-Encoding", "quoted-printable")
-			if _, err := subWriter.CreatePart(header); err != nil {
-				return err
-			}
-			qp := quotedprintable.NewWriter(datawriter)
-			File, err := os.Open(e.ContentPath)
-			if err != nil {
-				return err
-			}
-			defer File.Close()
+func (e *MailConfig) writeBody(create partCreator) error {
+	text, html := e.bodies()
+	switch {
+	case text != nil && html != nil:
+		w, err := newMultipart(create, "alternative")
+		if err != nil {
+			return err
+		}
+		if err = writeText(w.CreatePart, "plain", text); err != nil {
+			return err
+		}
+		if err = e.writeHTML(w.CreatePart, html); err != nil {
+			return err
+		}
+		return w.Close()
+	case html != nil:
+		return e.writeHTML(create, html)
+	case text != nil:
+		return writeText(create, "plain", text)
+	}
+	return writeText(create, "plain", &mailBody{})
+}
 
-			_, err = io.Copy(qp, File)
-			if err != nil {
-				return err
-			}
-			if err := qp.Close(); err != nil {
-				return err
-			}
+func (e *MailConfig) writeHTML(create partCreator, html *mailBody) error {
+	inline := splitList(e.Inline)
+	if len(inline) == 0 {
+		return writeText(create, "html", html)
+	}
+	w, err := newMultipart(create, "related")
+	if err != nil {
+		return err
+	}
+	if err = writeText(w.CreatePart, "html", html); err != nil {
+		return err
+	}
+	for _, path := range inline {
+		if err = attach(w, path, true); err != nil {
+			return err
 		}
-		if err := subWriter.Close(); err != nil {
+	}
+	return w.Close()
+}
+
+// newMultipart 创建multipart类型的部分,返回写入子部分的multipart.Writer
+func newMultipart(create partCreator, subtype string) (*multipart.Writer, error) {
+	boundary := multipart.NewWriter(ioutil.Discard).Boundary()
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", fmt.Sprintf("multipart/%s;\r\n boundary=%s", subtype, boundary))
+	pw, err := create(header)
+	if err != nil {
+		return nil, err
+	}
+	w := multipart.NewWriter(pw)
+	return w, w.SetBoundary(boundary)
+}
+
+// writeText 使用quoted-printable写入正文
+func writeText(create partCreator, typ string, body *mailBody) error {
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", fmt.Sprintf("text/%s; charset=UTF-8", typ))
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	w, err := create(header)
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(w)
+	if body.content != "" || body.path == "" {
+		_, err = io.WriteString(qp, body.content)
+	} else {
+		var File *os.File
+		if File, err = os.Open(body.path); err != nil {
 			return err
 		}
+		_, err = io.Copy(qp, File)
+		File.Close()
 	}
-	if e.Attachments != "" {
-		list := strings.Split(e.Attachments, ",")
-		for _, path := range list {
-			err = attach(w, path)
-			if err != nil {
-				w.Close()
-				return err
-			}
+	if err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func splitList(list string) []string {
+	var result []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
 		}
 	}
-	return nil
+	return result
 }
 
 // Len 获取邮件大小
 func (e *MailConfig) Len() (int64, error) {
-	var l int64
-	if e.Content != "" {
-		l += int64(len(e.Content))
-	} else if e.ContentPath != "" {
-		stat, err := os.Lstat(e.ContentPath)
+	var l = int64(len(e.Content) + len(e.HTML))
+	var files []string
+	for _, path := range []string{e.ContentPath, e.HTMLPath} {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+	files = append(files, splitList(e.Attachments)...)
+	files = append(files, splitList(e.Inline)...)
+	for _, path := range files {
+		stat, err := os.Lstat(path)
 		if err != nil {
 			return 0, err
 		}
 		l += stat.Size()
-	} else {
-		return 0, nil
-	}
-	if e.Attachments != "" {
-		for _, path := range strings.Split(e.Attachments, ",") {
-			stat, err := os.Lstat(path)
-			if err != nil {
-				return 0, err
-			}
-			l += stat.Size()
-		}
 	}
 	return l, nil
-
 }
+
+// encodedHeaders 已经编码或者只包含ASCII的邮件头,不能再做RFC 2047编码
+var encodedHeaders = map[string]bool{"Content-Type": true, "Content-Disposition": true, "From": true, "To": true,
+	"Cc": true, "Reply-To": true, "Message-Id": true, "Date": true, "Content-Id": true}
+
 func headerToBytes(w io.Writer, header textproto.MIMEHeader) {
-	for field, vals := range header {
-		for _, subval := range vals {
+	fields := make([]string, 0, len(header))
+	for field := range header {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		for _, subval := range header[field] {
 			io.WriteString(w, field)
 			io.WriteString(w, ": ")
-			switch {
-			case field == "Content-Type" || field == "Content-Disposition":
-				w.Write([]byte(subval))
-			default:
-				w.Write([]byte(mime.QEncoding.Encode("UTF-8", subval)))
+			if !encodedHeaders[field] {
+				// 编码之后较长的内容拆分为多个encoded-word,每个encoded-word单独一行
+				subval = strings.Replace(mime.QEncoding.Encode("UTF-8", subval), "?= =?", "?=\r\n =?", -1)
 			}
+			io.WriteString(w, subval)
 			io.WriteString(w, "\r\n")
 		}
 	}
 }
 
-// attach 封装附件
-func attach(w *multipart.Writer, filename string) (err error) {
+// attach 封装附件,inline为true的时候作为html内嵌图片,使用cid:文件名引用
+func attach(w *multipart.Writer, filename string, inline bool) (err error) {
 	typ := mime.TypeByExtension(filepath.Ext(filename))
 	var Header = make(textproto.MIMEHeader)
 	if typ != "" {
@@ -262,7 +605,11 @@ func attach(w *multipart.Writer, filename string) (err error) {
 		Header.Set("Content-Type", "application/octet-stream")
 	}
 	basename := filepath.Base(filename)
-	Header.Set("Content-Disposition", fmt.Sprintf("attachment;\r\n filename=\"%s\"", basename))
+	disposition := "attachment"
+	if inline {
+		disposition = "inline"
+	}
+	Header.Set("Content-Disposition", fmt.Sprintf("%s;\r\n filename=\"%s\"", disposition, mime.QEncoding.Encode("UTF-8", basename)))
 	Header.Set("Content-ID", fmt.Sprintf("<%s>", basename))
 	Header.Set("Content-Transfer-Encoding", "base64")
 	File, err := os.Open(filename)
@@ -286,21 +633,26 @@ func base64Wrap(w io.Writer, r io.Reader) error {
 	copy(buffer[MaxLineLength:], "\r\n")
 	var b = make([]byte, maxRaw)
 	for {
-		n, err := r.Read(b)
-		if err != nil {
-			if err == io.EOF {
-				return nil
-			}
-			return err
-		}
+		// 使用ReadFull保证除了最后一行每行都是完整的57字节
+		n, err := io.ReadFull(r, b)
 		if n == maxRaw {
 			base64.StdEncoding.Encode(buffer, b[:n])
-			w.Write(buffer)
-		} else {
-			out := buffer[:base64.StdEncoding.EncodedLen(len(b))]
-			base64.StdEncoding.Encode(out, b)
+			if _, werr := w.Write(buffer); werr != nil {
+				return werr
+			}
+		} else if n > 0 {
+			out := buffer[:base64.StdEncoding.EncodedLen(n)]
+			base64.StdEncoding.Encode(out, b[:n])
 			out = append(out, "\r\n"...)
-			w.Write(out)
+			if _, werr := w.Write(out); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
 		}
 	}
 }
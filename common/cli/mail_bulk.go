@@ -0,0 +1,333 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	htemplate "html/template"
+	"io"
+	"io/ioutil"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	ttemplate "text/template"
+	"time"
+)
+
+// MailBulkConfig 批量发送配置
+type MailBulkConfig struct {
+	List   string  // 收件人列表,.json为对象数组,其他按csv解析,第一行为字段名
+	Rate   float64 // 每秒最多发送的邮件数,小于等于0不限制
+	DryRun string  // 不为空的时候把邮件写入此目录下的.eml文件,不发送
+	Report string  // 发送结果写入的csv文件
+}
+
+// MailBulkResult 单封邮件的发送结果
+type MailBulkResult struct {
+	Index int
+	To    string
+	Error error
+}
+
+// mailTemplates MailConfig中各个字段的模板,html正文使用html/template,其他使用text/template
+type mailTemplates struct {
+	from, to, cc, bcc, replyTo *ttemplate.Template
+	subject, attachments       *ttemplate.Template
+	inline, text               *ttemplate.Template
+	html                       *htemplate.Template
+	header                     []*ttemplate.Template
+}
+
+// MailBulkRun 使用模板为列表中的每一行生成一封邮件,使用同一个smtp连接发送
+func MailBulkRun(tpl *MailConfig, bulk *MailBulkConfig, output io.Writer) ([]*MailBulkResult, error) {
+	rows, err := loadMailRows(bulk.List)
+	if err != nil {
+		return nil, fmt.Errorf("读取收件人列表失败:%s", err.Error())
+	}
+	tpls, err := parseMailTemplates(tpl)
+	if err != nil {
+		return nil, fmt.Errorf("解析模板失败:%s", err.Error())
+	}
+
+	var auth smtp.Auth
+	if bulk.DryRun == "" {
+		if auth, err = MailAuth(tpl); err != nil {
+			return nil, err
+		}
+	} else if err = os.MkdirAll(bulk.DryRun, 0755); err != nil {
+		return nil, err
+	}
+
+	var client *smtp.Client
+	defer func() {
+		if client != nil {
+			client.Quit()
+			client.Close()
+		}
+	}()
+
+	var tick <-chan time.Time
+	if bulk.Rate > 0 && bulk.DryRun == "" {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / bulk.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var results = make([]*MailBulkResult, 0, len(rows))
+	for index, row := range rows {
+		msg, err := tpls.render(tpl, row)
+		result := &MailBulkResult{Index: index + 1, Error: err}
+		if msg != nil {
+			result.To = msg.To
+		}
+		if err == nil {
+			if bulk.DryRun != "" {
+				result.Error = mailWriteEml(msg, filepath.Join(bulk.DryRun, fmt.Sprintf("%04d.eml", index+1)))
+			} else {
+				if tick != nil && index > 0 {
+					<-tick
+				}
+				client, result.Error = mailBulkSend(client, msg, auth)
+			}
+		}
+
+		results = append(results, result)
+		if result.Error == nil {
+			fmt.Fprintf(output, "[SUCCESS] %d %s\n", result.Index, result.To)
+		} else {
+			fmt.Fprintf(output, "[FAILD] %d %s %s\n", result.Index, result.To, result.Error.Error())
+		}
+	}
+
+	if bulk.Report != "" {
+		if err = writeMailReport(bulk.Report, results, bulk.DryRun != ""); err != nil {
+			return results, fmt.Errorf("写入发送报告失败:%s", err.Error())
+		}
+	}
+	return results, nil
+}
+
+// mailBulkSend 使用已有的连接发送,连接不存在或者已经断开的时候重新连接;
+// 服务端拒绝的时候使用RSET重置会话,继续发送下一封
+func mailBulkSend(client *smtp.Client, msg *MailConfig, auth smtp.Auth) (*smtp.Client, error) {
+	body, err := mailBuffer(msg)
+	if err != nil {
+		return client, err
+	}
+	defer closeMailBuffer(body)
+
+	for retry := 0; ; retry++ {
+		if client == nil {
+			if client, err = mailDial(msg); err != nil {
+				return nil, err
+			}
+			if auth != nil {
+				if err = client.Auth(auth); err != nil {
+					client.Close()
+					return nil, err
+				}
+			}
+		}
+
+		err = mailDeliver(client, msg, body)
+		if err == nil {
+			return client, nil
+		}
+		if _, ok := err.(*textproto.Error); ok {
+			client.Reset()
+			return client, err
+		}
+		// 网络错误的时候重新连接一次
+		client.Close()
+		client = nil
+		if retry > 0 {
+			return nil, err
+		}
+	}
+}
+
+// mailWriteEml 把邮件写入.eml文件
+func mailWriteEml(msg *MailConfig, name string) error {
+	File, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer File.Close()
+	// .eml中记录密送地址,方便检查
+	if msg.Bcc != "" {
+		fmt.Fprintf(File, "X-Bcc: %s\r\n", msg.Bcc)
+	}
+	return msg.Writer(File)
+}
+
+func writeMailReport(name string, results []*MailBulkResult, dryRun bool) error {
+	File, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer File.Close()
+
+	w := csv.NewWriter(File)
+	w.Write([]string{"index", "to", "status", "error"})
+	for _, result := range results {
+		status, msg := "sent", ""
+		if dryRun {
+			status = "dryrun"
+		}
+		if result.Error != nil {
+			status, msg = "failed", result.Error.Error()
+		}
+		w.Write([]string{fmt.Sprint(result.Index), result.To, status, msg})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// loadMailRows 读取收件人列表,csv的第一行为字段名
+func loadMailRows(path string) ([]map[string]interface{}, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []map[string]interface{}
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.Unmarshal(buf, &rows)
+		return rows, err
+	}
+
+	records, err := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(buf, []byte("\xef\xbb\xbf")))).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("%s 中没有数据", path)
+	}
+	for _, record := range records[1:] {
+		row := make(map[string]interface{}, len(records[0]))
+		for i, key := range records[0] {
+			if i < len(record) {
+				row[strings.TrimSpace(key)] = record[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// parseMailTemplates 解析模板,-C和--html-path指定的文件内容也作为模板
+func parseMailTemplates(tpl *MailConfig) (*mailTemplates, error) {
+	text, html := tpl.bodies()
+	textSrc, err := bodyContent(text)
+	if err != nil {
+		return nil, err
+	}
+	htmlSrc, err := bodyContent(html)
+	if err != nil {
+		return nil, err
+	}
+
+	// 没有指定收件人的时候使用列表中的to字段
+	to := tpl.To
+	if tpl.To == "" && tpl.Cc == "" && tpl.Bcc == "" {
+		to = "{{.to}}"
+	}
+
+	var tpls = new(mailTemplates)
+	for _, field := range []struct {
+		t    **ttemplate.Template
+		name string
+		text string
+	}{{&tpls.from, "from", tpl.From}, {&tpls.to, "to", to}, {&tpls.cc, "cc", tpl.Cc}, {&tpls.bcc, "bcc", tpl.Bcc},
+		{&tpls.replyTo, "reply-to", tpl.ReplyTo}, {&tpls.subject, "subject", tpl.Subject},
+		{&tpls.attachments, "attachments", tpl.Attachments}, {&tpls.inline, "inline", tpl.Inline}, {&tpls.text, "text", textSrc}} {
+		if *field.t, err = ttemplate.New(field.name).Option("missingkey=error").Parse(field.text); err != nil {
+			return nil, err
+		}
+	}
+	if tpls.html, err = htemplate.New("html").Option("missingkey=error").Parse(htmlSrc); err != nil {
+		return nil, err
+	}
+	for i, line := range tpl.Header {
+		t, err := ttemplate.New(fmt.Sprintf("header%d", i)).Option("missingkey=error").Parse(line)
+		if err != nil {
+			return nil, err
+		}
+		tpls.header = append(tpls.header, t)
+	}
+	if text == nil {
+		tpls.text = nil
+	}
+	if html == nil {
+		tpls.html = nil
+	}
+	return tpls, nil
+}
+
+func bodyContent(body *mailBody) (string, error) {
+	if body == nil || body.content != "" || body.path == "" {
+		return body.String(), nil
+	}
+	buf, err := ioutil.ReadFile(body.path)
+	return string(buf), err
+}
+
+// render 使用一行数据生成邮件配置
+func (tpls *mailTemplates) render(tpl *MailConfig, row map[string]interface{}) (*MailConfig, error) {
+	var msg = *tpl
+	msg.Content, msg.ContentPath, msg.HTML, msg.HTMLPath, msg.Type = "", "", "", "", "plain"
+	msg.Header = nil
+
+	var err error
+	for _, field := range []struct {
+		value *string
+		t     *ttemplate.Template
+	}{{&msg.From, tpls.from}, {&msg.To, tpls.to}, {&msg.Cc, tpls.cc}, {&msg.Bcc, tpls.bcc}, {&msg.ReplyTo, tpls.replyTo},
+		{&msg.Subject, tpls.subject}, {&msg.Attachments, tpls.attachments}, {&msg.Inline, tpls.inline}} {
+		if *field.value, err = executeTemplate(field.t, row); err != nil {
+			return &msg, err
+		}
+		*field.value = strings.TrimSpace(*field.value)
+	}
+	for _, t := range tpls.header {
+		line, err := executeTemplate(t, row)
+		if err != nil {
+			return &msg, err
+		}
+		msg.Header = append(msg.Header, strings.TrimSpace(line))
+	}
+	if tpls.text != nil {
+		if msg.Content, err = executeTemplate(tpls.text, row); err != nil {
+			return &msg, err
+		}
+	}
+	if tpls.html != nil {
+		var buf bytes.Buffer
+		if err = tpls.html.Execute(&buf, row); err != nil {
+			return &msg, err
+		}
+		msg.HTML = buf.String()
+	}
+
+	// 每行数据中的attachments字段追加为附件
+	if value, ok := row["attachments"]; ok {
+		if extra := fmt.Sprint(value); strings.TrimSpace(extra) != "" {
+			msg.Attachments = strings.Trim(msg.Attachments+","+extra, ",")
+		}
+	}
+	if msg.To == "" && msg.Cc == "" && msg.Bcc == "" {
+		return &msg, fmt.Errorf("没有收件人")
+	}
+	return &msg, nil
+}
+
+func executeTemplate(t *ttemplate.Template, row map[string]interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, row); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,265 @@
+package cli
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// dkimSignedHeaders 参与签名的邮件头,邮件中存在的才会写入h=
+var dkimSignedHeaders = []string{"from", "reply-to", "subject", "date", "to", "cc", "message-id",
+	"mime-version", "content-type", "content-transfer-encoding", "list-unsubscribe"}
+
+// loadDKIMKey 读取PEM格式的RSA私钥,支持PKCS#1和PKCS#8
+func loadDKIMKey(path string) (*rsa.PrivateKey, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("%s 不是PEM格式的私钥", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s 不是RSA私钥", path)
+	}
+	return rsaKey, nil
+}
+
+// dkimWriter 缓存邮件头和正文,正文同时计算relaxed规范化之后的hash,Close的时候把DKIM-Signature写在最前面;
+// 正文按照memMaxSize保存在内存或者临时文件中
+type dkimWriter struct {
+	dst              io.Writer
+	key              *rsa.PrivateKey
+	domain, selector string
+	header           bytes.Buffer
+	inBody           bool
+	body             io.ReadWriter
+	bodyHash         hash.Hash
+	canon            *relaxedBody
+}
+
+func newDKIMWriter(e *MailConfig, dst io.Writer) (*dkimWriter, error) {
+	if e.DKIMKey == "" {
+		return nil, errors.New("DKIM签名需要指定私钥文件")
+	}
+	key, err := loadDKIMKey(e.DKIMKey)
+	if err != nil {
+		return nil, fmt.Errorf("读取DKIM私钥失败:%s", err.Error())
+	}
+	domain := e.DKIMDomain
+	if domain == "" {
+		// 默认使用发件人地址的域名
+		from, err := e.FromAddress()
+		if err != nil {
+			return nil, err
+		}
+		domain = from[strings.LastIndexByte(from, '@')+1:]
+	}
+
+	size, err := e.Len()
+	if err != nil {
+		return nil, err
+	}
+	var body io.ReadWriter
+	if size >= memMaxSize {
+		if body, err = ioutil.TempFile("", ".dkim"); err != nil {
+			return nil, fmt.Errorf("创建临时文件失败:%s", err.Error())
+		}
+	} else {
+		body = bytes.NewBuffer(make([]byte, 0, size))
+	}
+
+	w := &dkimWriter{dst: dst, key: key, domain: domain, selector: e.DKIMSelector, body: body, bodyHash: sha256.New()}
+	w.canon = &relaxedBody{w: w.bodyHash}
+	return w, nil
+}
+
+func (w *dkimWriter) Write(p []byte) (int, error) {
+	if w.inBody {
+		w.canon.Write(p)
+		return w.body.Write(p)
+	}
+	// 邮件头和正文之间是一个空行
+	w.header.Write(p)
+	index := bytes.Index(w.header.Bytes(), []byte("\r\n\r\n"))
+	if index < 0 {
+		return len(p), nil
+	}
+	w.inBody = true
+	rest := append([]byte(nil), w.header.Bytes()[index+4:]...)
+	w.header.Truncate(index + 2)
+	w.canon.Write(rest)
+	if _, err := w.body.Write(rest); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close 计算签名,写入DKIM-Signature,邮件头和正文
+func (w *dkimWriter) Close() error {
+	defer closeMailBuffer(w.body)
+	w.canon.Close()
+
+	fields := splitHeaderFields(w.header.String())
+	var names []string
+	var signed bytes.Buffer
+	for _, name := range dkimSignedHeaders {
+		// 同名的邮件头有多个的时候签名最后一个
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.EqualFold(fields[i].name, name) {
+				names = append(names, name)
+				signed.WriteString(relaxedHeader(fields[i].name, fields[i].value))
+				break
+			}
+		}
+	}
+
+	sig := fmt.Sprintf("DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		w.domain, w.selector, time.Now().Unix(), strings.Join(names, ":"), base64.StdEncoding.EncodeToString(w.bodyHash.Sum(nil)))
+	index := strings.IndexByte(sig, ':')
+	signed.WriteString(strings.TrimSuffix(relaxedHeader(sig[:index], sig[index+1:]), "\r\n"))
+
+	sum := sha256.Sum256(signed.Bytes())
+	b, err := rsa.SignPKCS1v15(rand.Reader, w.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(w.dst, sig+foldBase64(base64.StdEncoding.EncodeToString(b))+"\r\n"); err != nil {
+		return err
+	}
+	if _, err = w.dst.Write(w.header.Bytes()); err != nil {
+		return err
+	}
+	if _, err = io.WriteString(w.dst, "\r\n"); err != nil {
+		return err
+	}
+	if _, err = io.Copy(w.dst, mailReader(w.body)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// abort 出错的时候删除临时文件
+func (w *dkimWriter) abort() {
+	closeMailBuffer(w.body)
+}
+
+// foldBase64 签名值每72个字符折行
+func foldBase64(value string) string {
+	var lines []string
+	for len(value) > 72 {
+		lines = append(lines, value[:72])
+		value = value[72:]
+	}
+	return strings.Join(append(lines, value), "\r\n\t")
+}
+
+type headerField struct {
+	name, value string
+}
+
+// splitHeaderFields 拆分邮件头,折叠的续行合并到上一个字段
+func splitHeaderFields(header string) []headerField {
+	var fields []headerField
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].value += line
+			continue
+		}
+		if index := strings.IndexByte(line, ':'); index > 0 {
+			fields = append(fields, headerField{line[:index], line[index+1:]})
+		}
+	}
+	return fields
+}
+
+// relaxedHeader RFC 6376 3.4.2 relaxed邮件头规范化
+func relaxedHeader(name, value string) string {
+	value = strings.Replace(value, "\r\n", "", -1)
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(collapseWSP(value)) + "\r\n"
+}
+
+// collapseWSP 把连续的空格和制表符替换为一个空格
+func collapseWSP(value string) string {
+	var buf = make([]byte, 0, len(value))
+	var space bool
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c == ' ' || c == '\t' {
+			space = true
+			continue
+		} else if space {
+			buf = append(buf, ' ')
+			space = false
+		}
+		buf = append(buf, value[i])
+	}
+	if space {
+		buf = append(buf, ' ')
+	}
+	return string(buf)
+}
+
+// relaxedBody RFC 6376 3.4.4 relaxed正文规范化,结尾的空行在Close之前不会写入
+type relaxedBody struct {
+	w     io.Writer
+	line  []byte
+	blank int
+}
+
+func (r *relaxedBody) Write(p []byte) (int, error) {
+	n := len(p)
+	for {
+		index := bytes.IndexByte(p, '\n')
+		if index < 0 {
+			r.line = append(r.line, p...)
+			return n, nil
+		}
+		r.line = append(r.line, p[:index]...)
+		r.flushLine()
+		p = p[index+1:]
+	}
+}
+
+func (r *relaxedBody) flushLine() {
+	line := strings.TrimRight(collapseWSP(strings.TrimSuffix(string(r.line), "\r")), " ")
+	r.line = r.line[:0]
+	if line == "" {
+		r.blank++
+		return
+	}
+	for ; r.blank > 0; r.blank-- {
+		io.WriteString(r.w, "\r\n")
+	}
+	io.WriteString(r.w, line+"\r\n")
+}
+
+// Close 处理最后一行没有换行的内容,结尾的空行忽略
+func (r *relaxedBody) Close() {
+	if len(r.line) > 0 {
+		r.flushLine()
+	}
+}
@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRelaxedHeader(t *testing.T) {
+	tests := []struct {
+		name, value string
+		want        string
+	}{
+		// RFC 6376 3.4.5
+		{"A", " X\r\n", "a:X\r\n"},
+		{"B ", " Y\t\r\n\tZ  \r\n", "b:Y Z\r\n"},
+		{"Subject", "  Hello \t  World\r\n", "subject:Hello World\r\n"},
+		{"DKIM-Signature", " v=1; b=", "dkim-signature:v=1; b=\r\n"},
+		{"X-Empty", "\r\n", "x-empty:\r\n"},
+	}
+	for _, test := range tests {
+		if got := relaxedHeader(test.name, test.value); got != test.want {
+			t.Errorf("relaxedHeader(%q, %q) = %q, want %q", test.name, test.value, got, test.want)
+		}
+	}
+}
+
+func TestSplitHeaderFields(t *testing.T) {
+	fields := splitHeaderFields("From: a@b.c\r\nSubject: one\r\n two\r\nbroken\r\nTo: d@e.f\r\n")
+	want := []headerField{{"From", " a@b.c\r\n"}, {"Subject", " one\r\n two\r\n"}, {"To", " d@e.f\r\n"}}
+	if len(fields) != len(want) {
+		t.Fatalf("splitHeaderFields = %q, want %q", fields, want)
+	}
+	for i := range want {
+		if fields[i] != want[i] {
+			t.Errorf("splitHeaderFields[%d] = %q, want %q", i, fields[i], want[i])
+		}
+	}
+}
+
+func TestRelaxedBody(t *testing.T) {
+	tests := []struct {
+		parts []string
+		want  string
+	}{
+		// RFC 6376 3.4.5
+		{[]string{" C \r\nD \t E\r\n\r\n\r\n"}, " C\r\nD E\r\n"},
+		{[]string{" C \r", "\nD \t", " E\r\n\r", "\n"}, " C\r\nD E\r\n"},
+		{[]string{"a\r\n\r\nb"}, "a\r\n\r\nb\r\n"},
+		{[]string{"line\n\t\n"}, "line\r\n"},
+		{[]string{"\r\n\r\n"}, ""},
+		{nil, ""},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		body := &relaxedBody{w: &buf}
+		for _, part := range test.parts {
+			body.Write([]byte(part))
+		}
+		body.Close()
+		if got := buf.String(); got != test.want {
+			t.Errorf("relaxedBody(%q) = %q, want %q", test.parts, got, test.want)
+		}
+	}
+}
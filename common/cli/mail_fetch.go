@@ -0,0 +1,367 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html/charset"
+)
+
+// mailWordDecoder 解码RFC 2047编码的邮件头,支持gbk等常见字符集
+var mailWordDecoder = &mime.WordDecoder{CharsetReader: charset.NewReaderLabel}
+
+// MailFetchConfig 收取邮件的配置
+type MailFetchConfig struct {
+	Protocol string // imap|pop3,为空的时候根据端口判断,110和995使用pop3
+	Folder   string // IMAP的文件夹,POP3只支持INBOX
+	Sender   string // 发件人包含的字符串,不区分大小写
+	Subject  string // 主题匹配的正则表达式
+	Since    string // 日期大于等于,格式:2006-01-02
+	Before   string // 日期小于,格式:2006-01-02
+	Unseen   bool   // 只收取未读的邮件
+	Output   string // 正文和附件保存的目录,每封邮件一个子目录
+	Action   string // 保存之后的操作:none|seen|move|delete
+	MoveTo   string // move的目标文件夹
+	Limit    int    // 最多收取的邮件数,小于等于0不限制
+}
+
+// mailbox IMAP和POP3的公共操作,id为IMAP的UID或者POP3的UIDL
+type mailbox interface {
+	Search(cfg *MailFetchConfig, since, before time.Time) ([]string, error)
+	Header(id string) (mail.Header, error)
+	Fetch(id string) ([]byte, error)
+	Seen(id string) error
+	Move(id, folder string) error
+	Delete(id string) error
+	Close() error
+}
+
+// mailFilter 客户端的过滤条件,服务端搜索之后再检查一次
+type mailFilter struct {
+	sender        string
+	subject       *regexp.Regexp
+	since, before time.Time
+}
+
+func (f *mailFilter) match(header mail.Header) bool {
+	if f.sender != "" && !strings.Contains(strings.ToLower(decodeMailHeader(header.Get("From"))), f.sender) {
+		return false
+	}
+	if f.subject != nil && !f.subject.MatchString(decodeMailHeader(header.Get("Subject"))) {
+		return false
+	}
+	if f.since.IsZero() && f.before.IsZero() {
+		return true
+	}
+	date, err := header.Date()
+	if err != nil {
+		return false
+	}
+	return (f.since.IsZero() || !date.Before(f.since)) && (f.before.IsZero() || date.Before(f.before))
+}
+
+// MailFetch 收取邮件,匹配的邮件正文和附件保存到cfg.Output,然后按照cfg.Action处理
+func MailFetch(mailConfig *MailConfig, cfg *MailFetchConfig, output io.Writer) error {
+	var filter = &mailFilter{sender: strings.ToLower(cfg.Sender)}
+	var err error
+	if cfg.Subject != "" {
+		if filter.subject, err = regexp.Compile(cfg.Subject); err != nil {
+			return fmt.Errorf("主题正则表达式错误:%s", err.Error())
+		}
+	}
+	for _, date := range []struct {
+		value string
+		t     *time.Time
+	}{{cfg.Since, &filter.since}, {cfg.Before, &filter.before}} {
+		if date.value == "" {
+			continue
+		}
+		if *date.t, err = time.ParseInLocation("2006-01-02", date.value, time.Local); err != nil {
+			return fmt.Errorf("日期格式错误:%s", date.value)
+		}
+	}
+
+	action := strings.ToLower(cfg.Action)
+	switch action {
+	case "", "none", "seen", "delete":
+	case "move":
+		if cfg.MoveTo == "" {
+			return fmt.Errorf("move需要指定目标文件夹")
+		}
+	default:
+		return fmt.Errorf("不支持的操作:%s", cfg.Action)
+	}
+	if cfg.Folder == "" {
+		cfg.Folder = "INBOX"
+	}
+	if err = os.MkdirAll(cfg.Output, 0755); err != nil {
+		return err
+	}
+
+	box, err := dialMailbox(mailConfig, cfg)
+	if err != nil {
+		return err
+	}
+	defer box.Close()
+
+	ids, err := box.Search(cfg, filter.since, filter.before)
+	if err != nil {
+		return err
+	}
+	var count int
+	for _, id := range ids {
+		if cfg.Limit > 0 && count >= cfg.Limit {
+			break
+		}
+		header, err := box.Header(id)
+		if err != nil {
+			return err
+		}
+		if !filter.match(header) {
+			continue
+		}
+		count++
+
+		subject := decodeMailHeader(header.Get("Subject"))
+		raw, err := box.Fetch(id)
+		if err != nil {
+			return err
+		}
+		dir, err := saveMailMessage(cfg.Output, id, raw)
+		if err != nil {
+			fmt.Fprintf(output, "[FAILD] %s %s %s\n", id, subject, err.Error())
+			continue
+		}
+
+		switch action {
+		case "seen":
+			err = box.Seen(id)
+		case "move":
+			err = box.Move(id, cfg.MoveTo)
+		case "delete":
+			err = box.Delete(id)
+		}
+		if err != nil {
+			fmt.Fprintf(output, "[ERROR] %s %s 已保存到%s,%s失败:%s\n", id, subject, dir, action, err.Error())
+			continue
+		}
+		fmt.Fprintf(output, "[SUCCESS] %s %s -> %s\n", id, subject, dir)
+	}
+	return box.Close()
+}
+
+// dialMailbox 根据协议连接服务器并登录,没有指定--tls的时候993和995端口使用隐式TLS
+func dialMailbox(mailConfig *MailConfig, cfg *MailFetchConfig) (mailbox, error) {
+	host, port, err := net.SplitHostPort(mailConfig.Host)
+	if err != nil {
+		return nil, err
+	}
+	protocol := strings.ToLower(cfg.Protocol)
+	if protocol == "" {
+		protocol = "imap"
+		if port == "110" || port == "995" {
+			protocol = "pop3"
+		}
+	}
+	mode := strings.ToLower(mailConfig.TLS)
+	if mode == "" && (port == "993" || port == "995") {
+		mode = "implicit"
+	}
+
+	tlscfg, err := ClientTLSConfig(mailConfig.CA, mailConfig.Insecure)
+	if err != nil {
+		return nil, err
+	}
+	tlscfg.ServerName = host
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	switch mode {
+	case "implicit":
+		conn, err = tls.DialWithDialer(dialer, "tcp", mailConfig.Host, tlscfg)
+	case "", "none", "starttls":
+		conn, err = dialer.Dial("tcp", mailConfig.Host)
+	default:
+		return nil, fmt.Errorf("不支持的tls模式:%s", mailConfig.TLS)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var box mailbox
+	switch protocol {
+	case "imap":
+		box, err = newIMAPClient(conn, mode, tlscfg, mailConfig.User, mailConfig.Passwd, cfg.Folder)
+	case "pop3":
+		if !strings.EqualFold(cfg.Folder, "INBOX") || strings.ToLower(cfg.Action) == "move" {
+			err = fmt.Errorf("POP3不支持文件夹和move操作")
+		} else {
+			box, err = newPOP3Client(conn, mode, tlscfg, mailConfig.User, mailConfig.Passwd, filepath.Join(cfg.Output, ".pop3_seen"))
+		}
+	default:
+		err = fmt.Errorf("不支持的协议:%s", cfg.Protocol)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return box, nil
+}
+
+// decodeMailHeader 解码RFC 2047编码的邮件头,失败的时候返回原始内容
+func decodeMailHeader(value string) string {
+	if decoded, err := mailWordDecoder.DecodeHeader(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+// saveMailMessage 把邮件的正文和附件保存到dir下以日期和id命名的子目录,正文转换为UTF-8保存为body.txt和body.html
+func saveMailMessage(dir, id string, raw []byte) (string, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "", err
+	}
+	date, err := msg.Header.Date()
+	if err != nil {
+		date = time.Now()
+	}
+	target := filepath.Join(dir, date.Format("20060102-150405")+"-"+safeFileName(id))
+	if err = os.MkdirAll(target, 0755); err != nil {
+		return "", err
+	}
+	var index int
+	return target, walkMailParts(textproto.MIMEHeader(msg.Header), msg.Body, &index, func(part *mailPart) error {
+		return saveMailPart(target, part)
+	})
+}
+
+// mailPart 邮件中的一个非multipart部分,Body已经解码了传输编码,正文部分已经转换为UTF-8
+type mailPart struct {
+	Index     int
+	MediaType string
+	Name      string // 附件文件名,正文为空
+	Header    textproto.MIMEHeader
+	Body      io.Reader
+}
+
+// IsBody 没有文件名的text/plain和text/html作为正文
+func (p *mailPart) IsBody() bool {
+	return p.Name == "" && (p.MediaType == "text/plain" || p.MediaType == "text/html")
+}
+
+// walkMailParts 遍历邮件的所有非multipart部分
+func walkMailParts(header textproto.MIMEHeader, body io.Reader, index *int, fn func(part *mailPart) error) error {
+	*index++
+	mediatype, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediatype, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediatype, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err = walkMailParts(part.Header, part, index, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	// multipart.Reader已经解码了quoted-printable,并且删除了Content-Transfer-Encoding
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	part := &mailPart{Index: *index, MediaType: mediatype, Header: header, Body: body}
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if dparams["filename"] != "" {
+		part.Name = dparams["filename"]
+	} else if params["name"] != "" {
+		part.Name = params["name"]
+	}
+	part.Name = safeFileName(decodeMailHeader(part.Name))
+	if part.Name == "" && disposition == "attachment" {
+		part.Name = fmt.Sprintf("part-%d%s", *index, mailPartExt(mediatype))
+	}
+	if part.IsBody() {
+		if cs := params["charset"]; cs != "" && !strings.EqualFold(cs, "utf-8") {
+			if reader, err := charset.NewReaderLabel(cs, body); err == nil {
+				part.Body = reader
+			}
+		}
+	}
+	return fn(part)
+}
+
+func mailPartExt(mediatype string) string {
+	if mediatype == "message/rfc822" {
+		return ".eml"
+	}
+	if exts, _ := mime.ExtensionsByType(mediatype); len(exts) > 0 {
+		return exts[0]
+	}
+	return ".bin"
+}
+
+// saveMailPart 保存一个部分,同名的文件已经存在的时候加上序号
+func saveMailPart(dir string, part *mailPart) error {
+	name := part.Name
+	switch {
+	case part.IsBody() && part.MediaType == "text/html":
+		name = "body.html"
+	case part.IsBody():
+		name = "body.txt"
+	case name == "":
+		name = fmt.Sprintf("part-%d%s", part.Index, mailPartExt(part.MediaType))
+	}
+	if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+		name = fmt.Sprintf("%d-%s", part.Index, name)
+	}
+
+	File, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(File, part.Body)
+	if cerr := File.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// safeFileName 去掉文件名中的路径,防止写到保存目录之外
+func safeFileName(name string) string {
+	name = filepath.Base(strings.Replace(strings.Replace(name, "\\", "/", -1), "\x00", "", -1))
+	if name == "." || name == ".." || name == "/" {
+		return ""
+	}
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+}
@@ -0,0 +1,313 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imapLiteralRegexp 响应行结尾的{长度},后面跟着指定长度的内容
+var imapLiteralRegexp = regexp.MustCompile(`\{(\d+)\+?\}$`)
+
+// imapResponse 一条响应,literals为响应中按顺序出现的literal内容
+type imapResponse struct {
+	text     string
+	literals [][]byte
+}
+
+// imapClient 只实现收取邮件需要的IMAP4rev1命令
+type imapClient struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	tag     int
+	caps    map[string]bool
+	deleted []string // 标记为删除的邮件,Close的时候执行EXPUNGE
+}
+
+func newIMAPClient(conn net.Conn, mode string, tlscfg *tls.Config, user, passwd, folder string) (*imapClient, error) {
+	c := &imapClient{conn: conn, reader: bufio.NewReader(conn)}
+	greeting, err := c.readResponse()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting.text, "* OK") && !strings.HasPrefix(greeting.text, "* PREAUTH") {
+		return nil, fmt.Errorf("imap: %s", greeting.text)
+	}
+	if err = c.capability(); err != nil {
+		return nil, err
+	}
+
+	if mode == "" || mode == "starttls" {
+		if c.caps["STARTTLS"] {
+			if _, err = c.cmd("STARTTLS"); err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Client(conn, tlscfg)
+			if err = tlsConn.Handshake(); err != nil {
+				return nil, err
+			}
+			c.conn, c.reader = tlsConn, bufio.NewReader(tlsConn)
+			if err = c.capability(); err != nil {
+				return nil, err
+			}
+		} else {
+			// 没有加密的时候不发送密码,明文登录必须使用--tls none
+			return nil, errors.New("server doesn't support STARTTLS, use --tls none to login in plain text")
+		}
+	}
+
+	if !strings.HasPrefix(greeting.text, "* PREAUTH") {
+		if c.caps["LOGINDISABLED"] {
+			return nil, errors.New("imap: 服务端禁止明文登录,请使用--tls")
+		}
+		quser, err := imapQuote(user)
+		if err != nil {
+			return nil, err
+		}
+		qpasswd, err := imapQuote(passwd)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = c.cmd("LOGIN %s %s", quser, qpasswd); err != nil {
+			return nil, err
+		}
+	}
+	qfolder, err := imapQuote(folder)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = c.cmd("SELECT %s", qfolder); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readResponse 读取一条响应,包括其中的literal
+func (c *imapClient) readResponse() (*imapResponse, error) {
+	var resp = new(imapResponse)
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		resp.text += line
+		match := imapLiteralRegexp.FindStringSubmatch(line)
+		if match == nil {
+			return resp, nil
+		}
+		size, err := strconv.Atoi(match[1])
+		if err != nil || size > 1<<30 {
+			return nil, fmt.Errorf("imap: 无效的literal长度:%s", match[1])
+		}
+		literal := make([]byte, size)
+		if _, err = io.ReadFull(c.reader, literal); err != nil {
+			return nil, err
+		}
+		resp.literals = append(resp.literals, literal)
+	}
+}
+
+// cmd 发送命令,返回标签响应之前的所有未标签响应,标签响应不是OK的时候返回错误
+func (c *imapClient) cmd(format string, args ...interface{}) ([]*imapResponse, error) {
+	c.tag++
+	tag := fmt.Sprintf("W%04d", c.tag)
+	c.conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, fmt.Sprintf(format, args...)); err != nil {
+		return nil, err
+	}
+
+	var untagged []*imapResponse
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(resp.text, tag+" ") {
+			status := strings.TrimPrefix(resp.text, tag+" ")
+			if !strings.HasPrefix(strings.ToUpper(status), "OK") {
+				return untagged, fmt.Errorf("imap: %s", status)
+			}
+			return untagged, nil
+		}
+		if strings.HasPrefix(resp.text, "+") {
+			return nil, fmt.Errorf("imap: 不支持的继续请求:%s", resp.text)
+		}
+		untagged = append(untagged, resp)
+	}
+}
+
+func (c *imapClient) capability() error {
+	resps, err := c.cmd("CAPABILITY")
+	if err != nil {
+		return err
+	}
+	c.caps = make(map[string]bool)
+	for _, resp := range resps {
+		if fields := strings.Fields(resp.text); len(fields) > 1 && strings.EqualFold(fields[1], "CAPABILITY") {
+			for _, capability := range fields[2:] {
+				c.caps[strings.ToUpper(capability)] = true
+			}
+		}
+	}
+	return nil
+}
+
+// imapQuote 把字符串转换为IMAP的quoted string,quoted string中不能包含CR,LF和NUL
+func imapQuote(value string) (string, error) {
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return "", errors.New("imap: 用户名,密码,文件夹和发件人中不能包含回车换行")
+	}
+	return `"` + strings.Replace(strings.Replace(value, `\`, `\\`, -1), `"`, `\"`, -1) + `"`, nil
+}
+
+// Search 使用UID SEARCH搜索邮件,日期使用邮件头中的Date
+func (c *imapClient) Search(cfg *MailFetchConfig, since, before time.Time) ([]string, error) {
+	var criteria = []string{"ALL"}
+	if cfg.Unseen {
+		criteria = append(criteria, "UNSEEN")
+	}
+	if cfg.Sender != "" {
+		sender, err := imapQuote(cfg.Sender)
+		if err != nil {
+			return nil, err
+		}
+		criteria = append(criteria, "FROM", sender)
+	}
+	if !since.IsZero() {
+		criteria = append(criteria, "SENTSINCE", since.Format("2-Jan-2006"))
+	}
+	if !before.IsZero() {
+		criteria = append(criteria, "SENTBEFORE", before.Format("2-Jan-2006"))
+	}
+	resps, err := c.cmd("UID SEARCH %s", strings.Join(criteria, " "))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, resp := range resps {
+		if fields := strings.Fields(resp.text); len(fields) > 1 && strings.EqualFold(fields[1], "SEARCH") {
+			ids = append(ids, fields[2:]...)
+		}
+	}
+	return ids, nil
+}
+
+// fetch 获取一封邮件的指定内容,返回第一个literal
+func (c *imapClient) fetch(id, item string) ([]byte, error) {
+	resps, err := c.cmd("UID FETCH %s (%s)", id, item)
+	if err != nil {
+		return nil, err
+	}
+	for _, resp := range resps {
+		if strings.Contains(strings.ToUpper(resp.text), " FETCH ") && len(resp.literals) > 0 {
+			return resp.literals[0], nil
+		}
+	}
+	return nil, fmt.Errorf("imap: 邮件%s不存在", id)
+}
+
+// Header 获取邮件头,使用PEEK不会标记为已读
+func (c *imapClient) Header(id string) (mail.Header, error) {
+	buf, err := c.fetch(id, "BODY.PEEK[HEADER]")
+	if err != nil {
+		return nil, err
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	return msg.Header, nil
+}
+
+// Fetch 获取完整的邮件
+func (c *imapClient) Fetch(id string) ([]byte, error) {
+	return c.fetch(id, "BODY.PEEK[]")
+}
+
+// Seen 标记为已读
+func (c *imapClient) Seen(id string) error {
+	_, err := c.cmd(`UID STORE %s +FLAGS.SILENT (\Seen)`, id)
+	return err
+}
+
+// Move 移动到指定文件夹,服务端不支持MOVE的时候使用COPY之后删除
+func (c *imapClient) Move(id, folder string) error {
+	qfolder, err := imapQuote(folder)
+	if err != nil {
+		return err
+	}
+	if c.caps["MOVE"] {
+		_, err = c.cmd("UID MOVE %s %s", id, qfolder)
+		return err
+	}
+	if _, err = c.cmd("UID COPY %s %s", id, qfolder); err != nil {
+		return err
+	}
+	return c.Delete(id)
+}
+
+// Delete 标记为删除,Close的时候执行EXPUNGE
+func (c *imapClient) Delete(id string) error {
+	_, err := c.cmd(`UID STORE %s +FLAGS.SILENT (\Deleted)`, id)
+	if err == nil {
+		c.deleted = append(c.deleted, id)
+	}
+	return err
+}
+
+// Close 删除标记的邮件并退出,可以重复调用
+func (c *imapClient) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	defer func() {
+		c.conn.Close()
+		c.conn = nil
+	}()
+	err := c.expunge()
+	if _, lerr := c.cmd("LOGOUT"); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// expunge 删除本次标记的邮件,支持UIDPLUS的时候使用UID EXPUNGE,
+// 否则只有文件夹中没有其他客户端标记删除的邮件时才执行EXPUNGE
+func (c *imapClient) expunge() error {
+	if len(c.deleted) == 0 {
+		return nil
+	}
+	if c.caps["UIDPLUS"] {
+		_, err := c.cmd("UID EXPUNGE %s", strings.Join(c.deleted, ","))
+		return err
+	}
+	resps, err := c.cmd("UID SEARCH DELETED")
+	if err != nil {
+		return err
+	}
+	var marked = make(map[string]bool, len(c.deleted))
+	for _, id := range c.deleted {
+		marked[id] = true
+	}
+	for _, resp := range resps {
+		if fields := strings.Fields(resp.text); len(fields) > 1 && strings.EqualFold(fields[1], "SEARCH") {
+			for _, id := range fields[2:] {
+				if !marked[id] {
+					return fmt.Errorf("imap: 服务端不支持UIDPLUS,文件夹中有其他标记为删除的邮件(UID %s),没有执行EXPUNGE,本次的邮件已经标记为删除", id)
+				}
+			}
+		}
+	}
+	_, err = c.cmd("EXPUNGE")
+	return err
+}
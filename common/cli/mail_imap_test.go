@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIMAPQuote(t *testing.T) {
+	for value, want := range map[string]string{
+		"INBOX":       `"INBOX"`,
+		`a "b" c`:     `"a \"b\" c"`,
+		`back\slash`:  `"back\\slash"`,
+		"":            `""`,
+		"x\r\nA LOGO": "",
+		"line\n":      "",
+		"nul\x00":     "",
+	} {
+		got, err := imapQuote(value)
+		if got != want || (err == nil) != (want != "") {
+			t.Errorf("imapQuote(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+}
+
+// imapScript 按顺序应答命令,search为UID SEARCH DELETED返回的UID
+func imapScript(conn net.Conn, search string) <-chan []string {
+	done := make(chan []string, 1)
+	go func() {
+		defer conn.Close()
+		var commands []string
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				done <- commands
+				return
+			}
+			fields := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 2)
+			commands = append(commands, fields[1])
+			if fields[1] == "UID SEARCH DELETED" {
+				fmt.Fprintf(conn, "* SEARCH %s\r\n", search)
+			}
+			fmt.Fprintf(conn, "%s OK done\r\n", fields[0])
+		}
+	}()
+	return done
+}
+
+func TestIMAPCloseExpunge(t *testing.T) {
+	tests := []struct {
+		name     string
+		uidplus  bool
+		search   string
+		ok       bool
+		commands []string
+	}{
+		{"uidplus", true, "", true, []string{"UID EXPUNGE 5,7", "LOGOUT"}},
+		{"only ours", false, "7 5", true, []string{"UID SEARCH DELETED", "EXPUNGE", "LOGOUT"}},
+		{"other client", false, "5 7 9", false, []string{"UID SEARCH DELETED", "LOGOUT"}},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		done := imapScript(server, test.search)
+		c := &imapClient{conn: client, reader: bufio.NewReader(client),
+			caps: map[string]bool{"UIDPLUS": test.uidplus}, deleted: []string{"5", "7"}}
+		err := c.Close()
+		if commands := <-done; (err == nil) != test.ok || !reflect.DeepEqual(commands, test.commands) {
+			t.Errorf("%s: Close() = %v, commands %q, want %q", test.name, err, commands, test.commands)
+		}
+	}
+}
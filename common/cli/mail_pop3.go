@@ -0,0 +1,206 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// pop3Client 只实现收取邮件需要的POP3命令;POP3没有已读标记,已经收取的UIDL记录在seenFile中
+type pop3Client struct {
+	conn     net.Conn
+	text     *textproto.Conn
+	numbers  map[string]string // UIDL对应的邮件序号
+	seenFile string
+	seen     map[string]bool
+}
+
+func newPOP3Client(conn net.Conn, mode string, tlscfg *tls.Config, user, passwd, seenFile string) (*pop3Client, error) {
+	c := &pop3Client{conn: conn, text: textproto.NewConn(conn), seenFile: seenFile}
+	if _, err := c.response(); err != nil {
+		return nil, err
+	}
+
+	if mode == "" || mode == "starttls" {
+		_, err := c.cmd("STLS")
+		if err == nil {
+			tlsConn := tls.Client(conn, tlscfg)
+			if err = tlsConn.Handshake(); err != nil {
+				return nil, err
+			}
+			c.conn, c.text = tlsConn, textproto.NewConn(tlsConn)
+		} else {
+			// 没有加密的时候不发送密码,明文登录必须使用--tls none
+			return nil, errors.New("server doesn't support STLS, use --tls none to login in plain text")
+		}
+	}
+
+	if _, err := c.cmd("USER %s", user); err != nil {
+		return nil, err
+	}
+	if _, err := c.cmd("PASS %s", passwd); err != nil {
+		return nil, err
+	}
+	return c, c.loadSeen()
+}
+
+// response 读取单行响应,-ERR的时候返回错误
+func (c *pop3Client) response() (string, error) {
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(line, "+OK") {
+		return strings.TrimSpace(strings.TrimPrefix(line, "+OK")), nil
+	}
+	return "", fmt.Errorf("pop3: %s", line)
+}
+
+func (c *pop3Client) cmd(format string, args ...interface{}) (string, error) {
+	c.conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	return c.response()
+}
+
+// multiline 发送命令并读取以'.'结束的多行响应
+func (c *pop3Client) multiline(format string, args ...interface{}) ([]byte, error) {
+	if _, err := c.cmd(format, args...); err != nil {
+		return nil, err
+	}
+	return c.text.ReadDotBytes()
+}
+
+func (c *pop3Client) loadSeen() error {
+	c.seen = make(map[string]bool)
+	File, err := os.Open(c.seenFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer File.Close()
+	scanner := bufio.NewScanner(File)
+	for scanner.Scan() {
+		c.seen[strings.TrimSpace(scanner.Text())] = true
+	}
+	return scanner.Err()
+}
+
+// Search 使用UIDL列出邮件,服务端不支持UIDL的时候使用序号;过滤条件在客户端检查
+func (c *pop3Client) Search(cfg *MailFetchConfig, since, before time.Time) ([]string, error) {
+	c.numbers = make(map[string]string)
+	buf, err := c.multiline("UIDL")
+	uidl := err == nil
+	if !uidl {
+		if buf, err = c.multiline("LIST"); err != nil {
+			return nil, err
+		}
+	}
+
+	var ids []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// LIST的第二列是邮件大小,使用序号作为id
+		id := fields[0]
+		if uidl {
+			id = fields[1]
+		}
+		c.numbers[id] = fields[0]
+		if !cfg.Unseen || !c.seen[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (c *pop3Client) number(id string) (string, error) {
+	number, ok := c.numbers[id]
+	if !ok {
+		return "", fmt.Errorf("pop3: 邮件%s不存在", id)
+	}
+	return number, nil
+}
+
+// Header 使用TOP获取邮件头
+func (c *pop3Client) Header(id string) (mail.Header, error) {
+	number, err := c.number(id)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := c.multiline("TOP %s 0", number)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(append(buf, '\n')))
+	if err != nil {
+		return nil, err
+	}
+	return msg.Header, nil
+}
+
+// Fetch 使用RETR获取完整的邮件
+func (c *pop3Client) Fetch(id string) ([]byte, error) {
+	number, err := c.number(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.multiline("RETR %s", number)
+}
+
+// Seen 把UIDL记录到seenFile,--unseen的时候跳过
+func (c *pop3Client) Seen(id string) error {
+	File, err := os.OpenFile(c.seenFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(File, id)
+	if cerr := File.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		c.seen[id] = true
+	}
+	return err
+}
+
+// Move POP3只有一个收件箱,不支持移动
+func (c *pop3Client) Move(id, folder string) error {
+	return errors.New("pop3: 不支持移动邮件")
+}
+
+// Delete 标记删除,QUIT的时候服务端才会真正删除
+func (c *pop3Client) Delete(id string) error {
+	number, err := c.number(id)
+	if err != nil {
+		return err
+	}
+	_, err = c.cmd("DELE %s", number)
+	return err
+}
+
+// Close 发送QUIT,可以重复调用
+func (c *pop3Client) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	defer func() {
+		c.conn.Close()
+		c.conn = nil
+	}()
+	_, err := c.cmd("QUIT")
+	return err
+}
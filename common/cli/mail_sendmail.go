@@ -0,0 +1,317 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"os/user"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// localPartRegexp 不带域名的本地用户名,例如cron发送给root的邮件
+var localPartRegexp = regexp.MustCompile(`^[A-Za-z0-9._+-]+$`)
+
+// SendmailConfig sendmail兼容模式的参数
+type SendmailConfig struct {
+	Extract    bool   // -t 从To,Cc,Bcc邮件头中读取收件人
+	IgnoreDots bool   // -i 单独一行的'.'不作为输入结束
+	From       string // -f 信封发件人
+	FullName   string // -F 邮件中没有From头的时候使用的显示名称
+	ConfigFile string // -C 配置文件
+	Recipients []string
+	Domain     string            // 不带域名的地址使用的域名,为空的时候使用主机名
+	Aliases    map[string]string // 本地用户名对应的地址
+}
+
+// ParseSendmailArgs 解析sendmail的命令行参数,不支持的-o,-B,-N等选项会被忽略
+func ParseSendmailArgs(args []string) (*SendmailConfig, error) {
+	var sm = new(SendmailConfig)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			sm.Recipients = append(sm.Recipients, args[i+1:]...)
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			sm.Recipients = append(sm.Recipients, arg)
+			continue
+		}
+
+		// 选项的值可以紧跟在选项后面,也可以是下一个参数
+		value := func() (string, error) {
+			if len(arg) > 2 {
+				return arg[2:], nil
+			}
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("选项%s缺少参数", arg)
+			}
+			i++
+			return args[i], nil
+		}
+
+		var err error
+		switch arg[1] {
+		case 't':
+			sm.Extract = true
+		case 'i':
+			sm.IgnoreDots = true
+		case 'o':
+			// -oi 等价于 -i,其他-o选项忽略
+			if arg == "-oi" {
+				sm.IgnoreDots = true
+			} else if arg == "-o" {
+				i++
+			}
+		case 'f', 'r':
+			sm.From, err = value()
+		case 'F':
+			sm.FullName, err = value()
+		case 'C':
+			sm.ConfigFile, err = value()
+		case 'b':
+			if arg != "-bm" {
+				return nil, fmt.Errorf("不支持的模式:%s", arg)
+			}
+		case 'B', 'N', 'R', 'V', 'X', 'L', 'O', 'h', 'p', 'q':
+			_, err = value()
+		case 'v', 'm', 'e', 'U', 'n', 'G', 'A':
+		default:
+			return nil, fmt.Errorf("不支持的选项:%s", arg)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sm, nil
+}
+
+// SendmailRun 从input读取RFC 5322格式的邮件,补全缺少的From,Date,Message-ID头,去掉Bcc头之后发送
+func SendmailRun(cfg *MailConfig, sm *SendmailConfig, input io.Reader) error {
+	header, body, err := readSendmailMessage(input, sm.IgnoreDots)
+	if err != nil {
+		return err
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(append(header, '\r', '\n')))
+	if err != nil {
+		return fmt.Errorf("解析邮件头失败:%s", err.Error())
+	}
+
+	var to []string
+	for _, addr := range sm.Recipients {
+		list, err := sm.addresses(addr)
+		if err != nil {
+			return err
+		}
+		to = append(to, list...)
+	}
+	if sm.Extract {
+		for _, key := range []string{"To", "Cc", "Bcc"} {
+			for _, value := range msg.Header[key] {
+				list, err := sm.addresses(value)
+				if err != nil {
+					return fmt.Errorf("解析%s失败:%s", key, err.Error())
+				}
+				to = append(to, list...)
+			}
+		}
+	}
+	if to = uniqueStrings(to); len(to) == 0 {
+		return fmt.Errorf("没有收件人")
+	}
+
+	from, err := sm.envelopeFrom(cfg, msg.Header.Get("From"))
+	if err != nil {
+		return err
+	}
+
+	// 补全邮件头,Bcc只用于RCPT,不能发送给其他收件人
+	var buf bytes.Buffer
+	if msg.Header.Get("From") == "" {
+		fmt.Fprintf(&buf, "From: %s\r\n", (&mail.Address{Name: sm.FullName, Address: from}).String())
+	}
+	if msg.Header.Get("Date") == "" {
+		fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	}
+	if msg.Header.Get("Message-ID") == "" {
+		fmt.Fprintf(&buf, "Message-ID: %s\r\n", messageID(from))
+	}
+	buf.Write(removeHeader(header, "Bcc"))
+	buf.WriteString("\r\n")
+	buf.Write(body)
+
+	send := *cfg
+	send.From, send.To, send.Cc, send.Bcc = from, strings.Join(to, ","), "", ""
+	auth, err := MailAuth(&send)
+	if err != nil {
+		return err
+	}
+	err = MailSend(&send, auth, bytes.NewReader(buf.Bytes()))
+	if err == nil || send.Spool == "" || !mailRetryable(err) {
+		return err
+	}
+	id, serr := MailSpool(send.Spool, &send, bytes.NewReader(buf.Bytes()), err)
+	if serr != nil {
+		return fmt.Errorf("%s,写入队列失败:%s", err.Error(), serr.Error())
+	}
+	fmt.Fprintf(os.Stderr, "发送失败:%s,已写入队列:%s\n", err.Error(), id)
+	return nil
+}
+
+// readSendmailMessage 读取邮件,返回邮件头(每行以\r\n结尾)和正文;没有-i的时候单独一行的'.'表示结束
+func readSendmailMessage(input io.Reader, ignoreDots bool) (header, body []byte, err error) {
+	var buf bytes.Buffer
+	var inHeader = true
+	reader := bufio.NewReader(input)
+	for {
+		line, rerr := reader.ReadString('\n')
+		if rerr != nil && rerr != io.EOF {
+			return nil, nil, rerr
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+		if !ignoreDots && trimmed == "." {
+			break
+		}
+		if inHeader && trimmed == "" && line != "" {
+			inHeader = false
+			header = append([]byte(nil), buf.Bytes()...)
+			buf.Reset()
+		} else if line != "" {
+			if inHeader {
+				// 邮件头统一使用\r\n,正文交给DATA的DotWriter处理
+				line = trimmed + "\r\n"
+			}
+			buf.WriteString(line)
+		}
+		if rerr == io.EOF {
+			break
+		}
+	}
+	if inHeader {
+		return buf.Bytes(), nil, nil
+	}
+	return header, buf.Bytes(), nil
+}
+
+// removeHeader 删除邮件头中指定的字段,包括折叠的续行
+func removeHeader(header []byte, name string) []byte {
+	var res bytes.Buffer
+	var skip bool
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			index := strings.IndexByte(line, ':')
+			skip = index > 0 && strings.EqualFold(strings.TrimSpace(line[:index]), name)
+		}
+		if !skip {
+			res.WriteString(line)
+		}
+	}
+	return res.Bytes()
+}
+
+// addresses 解析地址列表,不带域名的用户名先查找别名,然后补全域名
+func (sm *SendmailConfig) addresses(value string) ([]string, error) {
+	var fields = splitAddressList(value)
+	for i, field := range fields {
+		field = strings.TrimSpace(field)
+		if !localPartRegexp.MatchString(field) {
+			continue
+		}
+		if alias, ok := sm.Aliases[strings.ToLower(field)]; ok {
+			fields[i] = alias
+		} else {
+			fields[i] = field + "@" + sm.domain()
+		}
+	}
+	addrs, err := parseAddressList(strings.Join(fields, ","))
+	if err != nil {
+		return nil, err
+	}
+	var list = make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		list = append(list, addr.Address)
+	}
+	return list, nil
+}
+
+// splitAddressList 按照逗号分割地址列表,引号,尖括号和注释中的逗号不分割,例如"Doe, John" <j@x>
+func splitAddressList(value string) []string {
+	var fields []string
+	var quoted, escaped bool
+	var angle, comment, start int
+	for i, r := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && (quoted || comment > 0):
+			escaped = true
+		case r == '"' && comment == 0:
+			quoted = !quoted
+		case quoted:
+		case r == '(':
+			comment++
+		case r == ')' && comment > 0:
+			comment--
+		case comment > 0:
+		case r == '<':
+			angle++
+		case r == '>' && angle > 0:
+			angle--
+		case r == ',' && angle == 0:
+			fields = append(fields, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(fields, value[start:])
+}
+
+// envelopeFrom 信封发件人依次使用-f,配置中的发件人,邮件的From头,当前用户
+func (sm *SendmailConfig) envelopeFrom(cfg *MailConfig, header string) (string, error) {
+	for _, value := range []string{sm.From, cfg.From, header} {
+		if value == "" {
+			continue
+		}
+		list, err := sm.addresses(value)
+		if err != nil {
+			return "", fmt.Errorf("解析发件人失败:%s", err.Error())
+		}
+		if len(list) > 0 {
+			return list[0], nil
+		}
+	}
+	name := "root"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	list, err := sm.addresses(name)
+	if err != nil || len(list) == 0 {
+		return "", fmt.Errorf("无法确定发件人,请使用-f指定")
+	}
+	return list[0], nil
+}
+
+func (sm *SendmailConfig) domain() string {
+	if sm.Domain != "" {
+		return sm.Domain
+	}
+	return heloName("")
+}
+
+func uniqueStrings(list []string) []string {
+	var res = make([]string, 0, len(list))
+	var seen = make(map[string]bool, len(list))
+	for _, value := range list {
+		if key := strings.ToLower(value); !seen[key] {
+			seen[key] = true
+			res = append(res, value)
+		}
+	}
+	return res
+}
@@ -0,0 +1,541 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// smtpPathRegexp MAIL FROM:<addr> 和 RCPT TO:<addr> 的参数,后面可以跟着SIZE等扩展参数
+var smtpPathRegexp = regexp.MustCompile(`(?i)^(FROM|TO):\s*<([^>]*)>\s*(.*)$`)
+
+// MailServerConfig 邮件接收服务配置
+type MailServerConfig struct {
+	Listen      string
+	HTTPListen  string // HTTP界面和JSON API的监听地址,为空的时候不启动
+	Dir         string // 收到的邮件保存为此目录下的.eml文件
+	User        string // 不为空的时候要求客户端AUTH,HTTP也使用同样的用户名密码
+	Passwd      string
+	CertFile    string // 同时指定证书和私钥的时候支持STARTTLS
+	KeyFile     string
+	RequireTLS  bool           // 要求STARTTLS之后才能AUTH和MAIL
+	RelayMatch  string         // 收件人匹配此正则的时候转发到上游服务器
+	MaxRelays   int            // 同时转发的最大邮件数,超过的时候客户端等待
+	MaxSize     int64          // 单封邮件的最大字节数
+	MaxRcpt     int            // 单封邮件的最多收件人
+	Timeout     time.Duration  // 命令超时时间
+	relayRegexp *regexp.Regexp // RelayMatch编译之后的正则
+}
+
+type mailServer struct {
+	cfg      *MailServerConfig
+	tlscfg   *tls.Config
+	relay    *MailConfig
+	relays   chan struct{} // 限制同时转发的邮件数
+	hostname string
+	seq      uint64
+}
+
+// smtpSession 一个smtp连接的状态
+type smtpSession struct {
+	srv    *mailServer
+	conn   net.Conn
+	text   *textproto.Conn
+	helo   string
+	esmtp  bool
+	tls    bool
+	authed bool
+	from   string
+	to     []string
+}
+
+// MailServe 启动smtp服务,收到的邮件保存为.eml,relay不为nil并且Host不为空的时候转发匹配的收件人
+func MailServe(cfg *MailServerConfig, relay *MailConfig) error {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Minute
+	}
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = 25 << 20
+	}
+	if cfg.MaxRcpt <= 0 {
+		cfg.MaxRcpt = 100
+	}
+	if cfg.MaxRelays <= 0 {
+		cfg.MaxRelays = 4
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return err
+	}
+
+	srv := &mailServer{cfg: cfg, hostname: heloName("")}
+	if cfg.CertFile != "" && cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		srv.tlscfg = &tls.Config{Certificates: []tls.Certificate{cert}}
+	} else if cfg.RequireTLS {
+		return fmt.Errorf("要求STARTTLS的时候必须指定证书和私钥")
+	}
+	if relay != nil && relay.Host != "" {
+		var err error
+		if cfg.relayRegexp, err = regexp.Compile(cfg.RelayMatch); err != nil {
+			return fmt.Errorf("转发收件人正则表达式错误:%s", err.Error())
+		}
+		// 转发失败的邮件写入队列,使用mail flush重新发送
+		if relay.Spool == "" {
+			relay.Spool = filepath.Join(cfg.Dir, "spool")
+		}
+		srv.relay = relay
+		srv.relays = make(chan struct{}, cfg.MaxRelays)
+	}
+
+	lis, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+	defer lis.Close()
+	log.Printf("SMTP server listen on %s dir:%s\n", lis.Addr(), cfg.Dir)
+
+	if cfg.HTTPListen != "" {
+		go func() {
+			log.Printf("HTTP server listen on %s\n", cfg.HTTPListen)
+			if err := mailHTTPServe(cfg); err != nil {
+				log.Printf("HTTP server error:%s\n", err.Error())
+			}
+		}()
+	}
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.serveConn(conn)
+	}
+}
+
+func (srv *mailServer) serveConn(conn net.Conn) {
+	s := &smtpSession{srv: srv, conn: conn, text: textproto.NewConn(conn)}
+	defer func() {
+		s.conn.Close()
+	}()
+
+	s.reply(220, "%s ESMTP wstools", srv.hostname)
+	for {
+		s.conn.SetDeadline(time.Now().Add(srv.cfg.Timeout))
+		line, err := s.text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if index := strings.IndexByte(line, ' '); index > 0 {
+			verb, arg = line[:index], strings.TrimSpace(line[index+1:])
+		}
+		switch strings.ToUpper(verb) {
+		case "HELO", "EHLO":
+			s.hello(strings.ToUpper(verb) == "EHLO", arg)
+		case "STARTTLS":
+			if !s.startTLS() {
+				return
+			}
+		case "AUTH":
+			s.auth(arg)
+		case "MAIL":
+			s.mail(arg)
+		case "RCPT":
+			s.rcpt(arg)
+		case "DATA":
+			if !s.data() {
+				return
+			}
+		case "RSET":
+			s.from, s.to = "", nil
+			s.reply(250, "2.0.0 Ok")
+		case "NOOP":
+			s.reply(250, "2.0.0 Ok")
+		case "VRFY":
+			s.reply(252, "2.5.0 Cannot VRFY user")
+		case "QUIT":
+			s.reply(221, "2.0.0 Bye")
+			return
+		default:
+			s.reply(502, "5.5.2 Command not recognized")
+		}
+	}
+}
+
+func (s *smtpSession) reply(code int, format string, args ...interface{}) {
+	s.text.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+}
+
+func (s *smtpSession) hello(esmtp bool, name string) {
+	if name == "" {
+		s.reply(501, "5.5.4 Syntax: EHLO hostname")
+		return
+	}
+	s.helo, s.esmtp = name, esmtp
+	s.from, s.to = "", nil
+	if !esmtp {
+		s.reply(250, "%s", s.srv.hostname)
+		return
+	}
+	lines := []string{s.srv.hostname, fmt.Sprintf("SIZE %d", s.srv.cfg.MaxSize), "8BITMIME", "ENHANCEDSTATUSCODES"}
+	if s.srv.tlscfg != nil && !s.tls {
+		lines = append(lines, "STARTTLS")
+	}
+	if s.srv.cfg.User != "" && (s.tls || !s.srv.cfg.RequireTLS) {
+		lines = append(lines, "AUTH PLAIN LOGIN")
+	}
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		s.text.PrintfLine("250%s%s", sep, line)
+	}
+}
+
+// startTLS 握手失败的时候返回false,关闭连接
+func (s *smtpSession) startTLS() bool {
+	if s.srv.tlscfg == nil || s.tls {
+		s.reply(502, "5.5.1 STARTTLS not available")
+		return true
+	}
+	s.reply(220, "2.0.0 Ready to start TLS")
+	tlsConn := tls.Server(s.conn, s.srv.tlscfg)
+	tlsConn.SetDeadline(time.Now().Add(s.srv.cfg.Timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("%s STARTTLS failed:%s\n", s.conn.RemoteAddr(), err.Error())
+		return false
+	}
+	// STARTTLS之后需要重新EHLO
+	s.conn, s.text, s.tls = tlsConn, textproto.NewConn(tlsConn), true
+	s.helo, s.from, s.to = "", "", nil
+	return true
+}
+
+// auth 支持PLAIN和LOGIN
+func (s *smtpSession) auth(arg string) {
+	switch {
+	case s.srv.cfg.User == "":
+		s.reply(502, "5.5.1 AUTH not available")
+		return
+	case s.srv.cfg.RequireTLS && !s.tls:
+		s.reply(530, "5.7.0 Must issue a STARTTLS command first")
+		return
+	case s.authed:
+		s.reply(503, "5.5.1 Already authenticated")
+		return
+	}
+
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		s.reply(501, "5.5.4 Syntax: AUTH mechanism")
+		return
+	}
+	var user, passwd string
+	var err error
+	switch strings.ToUpper(fields[0]) {
+	case "PLAIN":
+		resp := ""
+		if len(fields) > 1 {
+			resp = fields[1]
+		} else if resp, err = s.challenge(""); err != nil {
+			return
+		}
+		buf, derr := base64.StdEncoding.DecodeString(resp)
+		parts := strings.Split(string(buf), "\x00")
+		if derr != nil || len(parts) != 3 {
+			s.reply(501, "5.5.2 Invalid AUTH PLAIN response")
+			return
+		}
+		user, passwd = parts[1], parts[2]
+	case "LOGIN":
+		if user, err = s.challenge("Username:"); err != nil {
+			return
+		}
+		if passwd, err = s.challenge("Password:"); err != nil {
+			return
+		}
+		buf, uerr := base64.StdEncoding.DecodeString(user)
+		pbuf, perr := base64.StdEncoding.DecodeString(passwd)
+		if uerr != nil || perr != nil {
+			s.reply(501, "5.5.2 Invalid AUTH LOGIN response")
+			return
+		}
+		user, passwd = string(buf), string(pbuf)
+	default:
+		s.reply(504, "5.5.4 Unrecognized authentication type")
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(user), []byte(s.srv.cfg.User)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(passwd), []byte(s.srv.cfg.Passwd)) != 1 {
+		log.Printf("%s AUTH failed user:%s\n", s.conn.RemoteAddr(), user)
+		s.reply(535, "5.7.8 Authentication credentials invalid")
+		return
+	}
+	s.authed = true
+	s.reply(235, "2.7.0 Authentication successful")
+}
+
+// challenge 发送334并读取客户端的base64响应,客户端发送'*'的时候取消认证
+func (s *smtpSession) challenge(prompt string) (string, error) {
+	s.reply(334, "%s", base64.StdEncoding.EncodeToString([]byte(prompt)))
+	line, err := s.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if line == "*" {
+		s.reply(501, "5.7.0 Authentication cancelled")
+		return "", fmt.Errorf("cancelled")
+	}
+	return strings.TrimSpace(line), nil
+}
+
+func (s *smtpSession) mail(arg string) {
+	switch {
+	case s.helo == "":
+		s.reply(503, "5.5.1 Send HELO/EHLO first")
+		return
+	case s.srv.cfg.RequireTLS && !s.tls:
+		s.reply(530, "5.7.0 Must issue a STARTTLS command first")
+		return
+	case s.srv.cfg.User != "" && !s.authed:
+		s.reply(530, "5.7.0 Authentication required")
+		return
+	case s.from != "":
+		s.reply(503, "5.5.1 Sender already specified")
+		return
+	}
+	match := smtpPathRegexp.FindStringSubmatch(arg)
+	if match == nil || !strings.EqualFold(match[1], "FROM") {
+		s.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+	for _, param := range strings.Fields(match[3]) {
+		var size int64
+		if n, _ := fmt.Sscanf(strings.ToUpper(param), "SIZE=%d", &size); n == 1 && size > s.srv.cfg.MaxSize {
+			s.reply(552, "5.3.4 Message size exceeds fixed limit")
+			return
+		}
+	}
+	// 空地址是退信,保存为<>
+	s.from = match[2]
+	if s.from == "" {
+		s.from = "<>"
+	}
+	s.reply(250, "2.1.0 Ok")
+}
+
+func (s *smtpSession) rcpt(arg string) {
+	if s.from == "" {
+		s.reply(503, "5.5.1 Need MAIL command")
+		return
+	}
+	match := smtpPathRegexp.FindStringSubmatch(arg)
+	if match == nil || !strings.EqualFold(match[1], "TO") || match[2] == "" {
+		s.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+	if len(s.to) >= s.srv.cfg.MaxRcpt {
+		s.reply(452, "4.5.3 Too many recipients")
+		return
+	}
+	s.to = append(s.to, match[2])
+	s.reply(250, "2.1.5 Ok")
+}
+
+// data 读取邮件内容并保存,连接断开的时候返回false
+func (s *smtpSession) data() bool {
+	if s.from == "" || len(s.to) == 0 {
+		s.reply(503, "5.5.1 Need RCPT command")
+		return true
+	}
+	s.reply(354, "End data with <CR><LF>.<CR><LF>")
+
+	id := s.srv.nextID()
+	from, to := s.from, s.to
+	s.from, s.to = "", nil
+	body := &mailDataReader{r: s.text.DotReader()}
+	size, err := s.srv.store(id, s, from, to, body)
+	if body.err != nil {
+		// 读取客户端数据失败,连接已经不可用
+		log.Printf("%s read message failed:%s\n", s.conn.RemoteAddr(), body.err.Error())
+		return false
+	}
+	if err == errMailTooLarge {
+		s.reply(552, "5.3.4 Message size exceeds fixed limit")
+		return true
+	}
+	if err != nil {
+		log.Printf("%s save message failed:%s\n", s.conn.RemoteAddr(), err.Error())
+		s.reply(451, "4.3.0 Error: queue file write error")
+		return true
+	}
+	log.Printf("%s saved %s from:%s to:%s size:%d\n", s.conn.RemoteAddr(), id, from, strings.Join(to, ","), size)
+	if s.srv.relay != nil {
+		// 转发数达到上限的时候等待,不再回复客户端
+		s.srv.relays <- struct{}{}
+		go func() {
+			s.srv.relayMessage(id, from, to)
+			<-s.srv.relays
+		}()
+	}
+	s.reply(250, "2.0.0 Ok: queued as %s", id)
+	return true
+}
+
+var errMailTooLarge = fmt.Errorf("message too large")
+
+// mailDataReader 记录读取客户端数据的错误,和写文件的错误区分开
+type mailDataReader struct {
+	r   io.Reader
+	err error
+}
+
+func (m *mailDataReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	if err != nil && err != io.EOF {
+		m.err = err
+	}
+	return n, err
+}
+
+func (srv *mailServer) nextID() string {
+	return fmt.Sprintf("%s-%d", time.Now().Format("20060102150405.000000"), atomic.AddUint64(&srv.seq, 1))
+}
+
+// envelopeHeader 保存在.eml开头的信封信息,转发的时候跳过
+func envelopeHeader(from string, to []string) string {
+	return fmt.Sprintf("Return-Path: <%s>\r\nX-Envelope-To: %s\r\n", strings.Trim(from, "<>"), strings.Join(to, ", "))
+}
+
+// store 保存邮件,内容超过MaxSize的时候读完剩余的内容后返回errMailTooLarge
+func (srv *mailServer) store(id string, s *smtpSession, from string, to []string, body io.Reader) (int64, error) {
+	name := filepath.Join(srv.cfg.Dir, id+".eml")
+	File, err := os.OpenFile(name+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		io.Copy(ioutil.Discard, body)
+		return 0, err
+	}
+
+	ip, _, _ := net.SplitHostPort(s.conn.RemoteAddr().String())
+	with := "SMTP"
+	if s.esmtp {
+		with = "ESMTP"
+		if s.tls {
+			with += "S"
+		}
+		if s.authed {
+			with += "A"
+		}
+	}
+	w := bufio.NewWriter(File)
+	w.WriteString(envelopeHeader(from, to))
+	fmt.Fprintf(w, "Received: from %s ([%s])\r\n\tby %s (wstools) with %s id %s;\r\n\t%s\r\n",
+		s.helo, ip, srv.hostname, with, id, time.Now().Format(time.RFC1123Z))
+
+	// DotReader返回的内容使用\n换行,保存的时候转换回\r\n
+	size, err := io.Copy(&crlfWriter{w: w}, io.LimitReader(body, srv.cfg.MaxSize+1))
+	if err == nil && size > srv.cfg.MaxSize {
+		io.Copy(ioutil.Discard, body)
+		err = errMailTooLarge
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := File.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(name+".tmp", name)
+	}
+	if err != nil {
+		os.Remove(name + ".tmp")
+	}
+	return size, err
+}
+
+// crlfWriter 把\n转换为\r\n
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c *crlfWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write(bytes.Replace(p, []byte("\n"), []byte("\r\n"), -1)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// relayMessage 把匹配RelayMatch的收件人转发到上游服务器,退信和不匹配的收件人只保存,
+// 临时失败的邮件写入relay.Spool队列
+func (srv *mailServer) relayMessage(id, from string, to []string) {
+	var rcpts []string
+	for _, addr := range to {
+		if srv.cfg.relayRegexp.MatchString(addr) {
+			rcpts = append(rcpts, addr)
+		}
+	}
+	if len(rcpts) == 0 || from == "<>" {
+		return
+	}
+
+	File, err := os.Open(filepath.Join(srv.cfg.Dir, id+".eml"))
+	if err != nil {
+		log.Printf("relay %s failed:%s\n", id, err.Error())
+		return
+	}
+	defer File.Close()
+	offset := int64(len(envelopeHeader(from, to)))
+	if _, err = File.Seek(offset, io.SeekStart); err != nil {
+		log.Printf("relay %s failed:%s\n", id, err.Error())
+		return
+	}
+
+	msg := *srv.relay
+	msg.From, msg.To, msg.Cc, msg.Bcc = from, strings.Join(rcpts, ","), "", ""
+	var auth smtp.Auth
+	if msg.User != "" {
+		if auth, err = MailAuth(&msg); err != nil {
+			log.Printf("relay %s failed:%s\n", id, err.Error())
+			return
+		}
+	}
+	// bufio.Reader没有实现Seek,MailSend不会回到文件开头
+	if err = MailSend(&msg, auth, bufio.NewReader(File)); err == nil {
+		log.Printf("relay %s to %s via %s\n", id, msg.To, msg.Host)
+		return
+	}
+	if !mailRetryable(err) {
+		log.Printf("relay %s to %s failed:%s\n", id, msg.To, err.Error())
+		return
+	}
+	if _, serr := File.Seek(offset, io.SeekStart); serr != nil {
+		log.Printf("relay %s to %s failed:%s, spool failed:%s\n", id, msg.To, err.Error(), serr.Error())
+		return
+	}
+	spoolID, serr := MailSpool(msg.Spool, &msg, File, err)
+	if serr != nil {
+		log.Printf("relay %s to %s failed:%s, spool failed:%s\n", id, msg.To, err.Error(), serr.Error())
+		return
+	}
+	log.Printf("relay %s to %s failed:%s, spooled as %s in %s\n", id, msg.To, err.Error(), spoolID, msg.Spool)
+}
@@ -0,0 +1,341 @@
+package cli
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	htemplate "html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mailIDRegexp 保存的邮件id,防止访问目录之外的文件
+var mailIDRegexp = regexp.MustCompile(`^[0-9.]+-[0-9]+$`)
+
+// mailMessageInfo 保存的邮件摘要
+type mailMessageInfo struct {
+	ID           string    `json:"id"`
+	EnvelopeFrom string    `json:"envelope_from"`
+	EnvelopeTo   []string  `json:"envelope_to"`
+	From         string    `json:"from"`
+	To           string    `json:"to"`
+	Subject      string    `json:"subject"`
+	Received     time.Time `json:"received"`
+	Size         int64     `json:"size"`
+}
+
+// mailMessageDetail 邮件详情,包括正文和附件列表
+type mailMessageDetail struct {
+	mailMessageInfo
+	Headers     map[string][]string   `json:"headers"`
+	Text        string                `json:"text"`
+	HTML        string                `json:"html"`
+	Attachments []*mailAttachmentInfo `json:"attachments"`
+}
+
+type mailAttachmentInfo struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Size  int64  `json:"size"`
+}
+
+type mailHTTPHandler struct {
+	cfg *MailServerConfig
+}
+
+// mailHTTPServe 启动HTTP界面和JSON API:
+//
+//	GET /                              邮件列表
+//	GET /messages/{id}                 查看邮件
+//	GET /messages/{id}.eml             下载原始邮件
+//	GET /messages/{id}/parts/{index}   下载附件
+//	GET|DELETE /api/messages           邮件列表,支持to和subject参数过滤;删除所有邮件
+//	GET|DELETE /api/messages/{id}      邮件详情;删除邮件
+func mailHTTPServe(cfg *MailServerConfig) error {
+	return http.ListenAndServe(cfg.HTTPListen, &mailHTTPHandler{cfg: cfg})
+}
+
+func (h *mailHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.User != "" {
+		user, pass, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(h.cfg.User)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(h.cfg.Passwd)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="wstools mail"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "" && r.Method == "GET":
+		h.index(w, r)
+	case path == "api/messages" && r.Method == "GET":
+		list, err := h.list(r.URL.Query().Get("to"), r.URL.Query().Get("subject"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, list)
+	case path == "api/messages" && r.Method == "DELETE":
+		names, _ := filepath.Glob(filepath.Join(h.cfg.Dir, "*.eml"))
+		for _, name := range names {
+			os.Remove(name)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(path, "api/messages/"):
+		h.apiMessage(w, r, strings.TrimPrefix(path, "api/messages/"))
+	case strings.HasPrefix(path, "messages/") && r.Method == "GET":
+		h.message(w, r, strings.TrimPrefix(path, "messages/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(value)
+}
+
+// emlPath 返回邮件文件的路径,id无效的时候返回空
+func (h *mailHTTPHandler) emlPath(id string) string {
+	if !mailIDRegexp.MatchString(id) {
+		return ""
+	}
+	return filepath.Join(h.cfg.Dir, id+".eml")
+}
+
+func (h *mailHTTPHandler) apiMessage(w http.ResponseWriter, r *http.Request, id string) {
+	name := h.emlPath(id)
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		detail, err := readMailDetail(name)
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, detail)
+	case "DELETE":
+		if err := os.Remove(name); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// message 处理 {id}, {id}.eml 和 {id}/parts/{index}
+func (h *mailHTTPHandler) message(w http.ResponseWriter, r *http.Request, path string) {
+	fields := strings.Split(path, "/")
+	id := strings.TrimSuffix(fields[0], ".eml")
+	name := h.emlPath(id)
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(fields) == 1 && strings.HasSuffix(fields[0], ".eml"):
+		w.Header().Set("Content-Type", "message/rfc822")
+		w.Header().Set("Content-Disposition", "attachment; filename="+id+".eml")
+		http.ServeFile(w, r, name)
+	case len(fields) == 1:
+		detail, err := readMailDetail(name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		mailMessageTemplate.Execute(w, detail)
+	case len(fields) == 3 && fields[1] == "parts":
+		index, err := strconv.Atoi(fields[2])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if err = writeMailPart(w, name, index); err != nil {
+			http.NotFound(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *mailHTTPHandler) index(w http.ResponseWriter, r *http.Request) {
+	list, err := h.list("", "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	mailIndexTemplate.Execute(w, list)
+}
+
+// list 列出保存的邮件,按接收时间倒序,to和subject不为空的时候过滤收件人和主题
+func (h *mailHTTPHandler) list(to, subject string) ([]*mailMessageInfo, error) {
+	names, err := filepath.Glob(filepath.Join(h.cfg.Dir, "*.eml"))
+	if err != nil {
+		return nil, err
+	}
+	var list = make([]*mailMessageInfo, 0, len(names))
+	for _, name := range names {
+		info, _, err := readMailInfo(name)
+		if err != nil {
+			continue
+		}
+		if to != "" && !strings.Contains(strings.ToLower(strings.Join(info.EnvelopeTo, ",")), strings.ToLower(to)) {
+			continue
+		}
+		if subject != "" && !strings.Contains(info.Subject, subject) {
+			continue
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID > list[j].ID })
+	return list, nil
+}
+
+// readMailInfo 读取邮件头,返回摘要和邮件
+func readMailInfo(name string) (*mailMessageInfo, *mail.Message, error) {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	File, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := mail.ReadMessage(bufio.NewReader(File))
+	if err != nil {
+		File.Close()
+		return nil, nil, err
+	}
+	// 调用者读取完正文之后关闭文件
+	msg.Body = struct {
+		io.Reader
+		io.Closer
+	}{msg.Body, File}
+
+	info := &mailMessageInfo{
+		ID:           strings.TrimSuffix(filepath.Base(name), ".eml"),
+		EnvelopeFrom: strings.Trim(msg.Header.Get("Return-Path"), "<>"),
+		From:         decodeMailHeader(msg.Header.Get("From")),
+		To:           decodeMailHeader(msg.Header.Get("To")),
+		Subject:      decodeMailHeader(msg.Header.Get("Subject")),
+		Received:     stat.ModTime(),
+		Size:         stat.Size(),
+	}
+	for _, addr := range strings.Split(msg.Header.Get("X-Envelope-To"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			info.EnvelopeTo = append(info.EnvelopeTo, addr)
+		}
+	}
+	return info, msg, nil
+}
+
+func readMailDetail(name string) (*mailMessageDetail, error) {
+	info, msg, err := readMailInfo(name)
+	if err != nil {
+		return nil, err
+	}
+	defer msg.Body.(io.Closer).Close()
+
+	detail := &mailMessageDetail{mailMessageInfo: *info, Headers: msg.Header, Attachments: []*mailAttachmentInfo{}}
+	var index int
+	err = walkMailParts(textproto.MIMEHeader(msg.Header), msg.Body, &index, func(part *mailPart) error {
+		if part.IsBody() {
+			buf, err := ioutil.ReadAll(part.Body)
+			if part.MediaType == "text/html" && detail.HTML == "" {
+				detail.HTML = string(buf)
+			} else if part.MediaType == "text/plain" && detail.Text == "" {
+				detail.Text = string(buf)
+			}
+			return err
+		}
+		size, err := io.Copy(ioutil.Discard, part.Body)
+		name := part.Name
+		if name == "" {
+			name = "part-" + strconv.Itoa(part.Index) + mailPartExt(part.MediaType)
+		}
+		detail.Attachments = append(detail.Attachments, &mailAttachmentInfo{Index: part.Index, Name: name, Type: part.MediaType, Size: size})
+		return err
+	})
+	return detail, err
+}
+
+// writeMailPart 输出指定序号的附件,总是作为附件下载
+func writeMailPart(w http.ResponseWriter, name string, index int) error {
+	_, msg, err := readMailInfo(name)
+	if err != nil {
+		return err
+	}
+	defer msg.Body.(io.Closer).Close()
+
+	var found bool
+	var counter int
+	err = walkMailParts(textproto.MIMEHeader(msg.Header), msg.Body, &counter, func(part *mailPart) error {
+		if part.Index != index || found {
+			return nil
+		}
+		found = true
+		// 内容来自收到的邮件,总是作为附件下载,避免text/html等类型在页面的域名下执行
+		name := part.Name
+		if name == "" {
+			name = "part-" + strconv.Itoa(part.Index) + mailPartExt(part.MediaType)
+		}
+		w.Header().Set("Content-Type", part.MediaType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		_, err := io.Copy(w, part.Body)
+		return err
+	})
+	if err == nil && !found {
+		err = os.ErrNotExist
+	}
+	return err
+}
+
+var mailIndexTemplate = htemplate.Must(htemplate.New("index").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>wstools mail</title>
+<style>body{font-family:sans-serif}table{border-collapse:collapse;width:100%}td,th{border:1px solid #ccc;padding:4px 8px;text-align:left}</style>
+</head><body>
+<h3>共{{len .}}封邮件</h3>
+<table><tr><th>接收时间</th><th>发件人</th><th>收件人</th><th>主题</th><th>大小</th><th></th></tr>
+{{range .}}<tr><td>{{.Received.Format "2006-01-02 15:04:05"}}</td><td>{{.EnvelopeFrom}}</td><td>{{range $i, $to := .EnvelopeTo}}{{if $i}}, {{end}}{{$to}}{{end}}</td>
+<td><a href="/messages/{{.ID}}">{{.Subject}}</a></td><td>{{.Size}}</td><td><a href="/messages/{{.ID}}.eml">eml</a></td></tr>
+{{end}}</table></body></html>`))
+
+var mailMessageTemplate = htemplate.Must(htemplate.New("message").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Subject}}</title>
+<style>body{font-family:sans-serif}pre{white-space:pre-wrap;border:1px solid #ccc;padding:8px}iframe{width:100%;height:480px;border:1px solid #ccc}</style>
+</head><body>
+<p><a href="/">返回</a> <a href="/messages/{{.ID}}.eml">下载eml</a></p>
+<table>{{range $key, $values := .Headers}}{{range $values}}<tr><th align="left">{{$key}}</th><td>{{.}}</td></tr>{{end}}{{end}}</table>
+{{if .Attachments}}<h4>附件</h4><ul>{{range .Attachments}}<li><a href="/messages/{{$.ID}}/parts/{{.Index}}">{{.Name}}</a> {{.Type}} {{.Size}}</li>{{end}}</ul>{{end}}
+{{if .Text}}<h4>文本</h4><pre>{{.Text}}</pre>{{end}}
+{{if .HTML}}<h4>HTML</h4><iframe sandbox srcdoc="{{.HTML}}"></iframe>{{end}}
+</body></html>`))
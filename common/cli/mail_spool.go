@@ -0,0 +1,302 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// mailSpoolSeq 同一个进程中同时写入队列的时候保证ID不重复
+var mailSpoolSeq uint64
+
+const (
+	mailSpoolBackoff    = time.Minute // 第一次重试的间隔,之后每次翻倍
+	mailSpoolMaxBackoff = time.Hour
+)
+
+// MailSpoolMeta 队列中邮件的元数据,和.eml文件同名,扩展名为.json
+type MailSpoolMeta struct {
+	ID        string    `json:"id"`
+	From      string    `json:"from"`
+	To        []string  `json:"to"`
+	Host      string    `json:"host"`
+	Created   time.Time `json:"created"`
+	NextTry   time.Time `json:"next_try"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+}
+
+// MailFlushConfig 发送队列配置
+type MailFlushConfig struct {
+	Dir      string
+	Expire   time.Duration // 超过这个时间还没有发送成功的邮件移动到expired目录
+	Daemon   bool          // 一直运行,每隔Interval检查一次队列
+	Interval time.Duration
+	Attempts int // 尝试发送超过这个次数的邮件移动到failed目录,小于等于0不限制
+}
+
+// mailConfigError 本地配置错误,比如ca文件无效,tls模式错误,重试也不会成功
+type mailConfigError struct {
+	err error
+}
+
+func (e *mailConfigError) Error() string { return e.err.Error() }
+
+func (e *mailConfigError) Unwrap() error { return e.err }
+
+// mailRetryable 5xx表示服务端永久拒绝,证书校验失败,本地文件不存在或者配置错误的时候重试也不会成功
+func mailRetryable(err error) bool {
+	var terr *textproto.Error
+	if errors.As(err, &terr) {
+		return terr.Code < 500
+	}
+	var (
+		cerr    *mailConfigError
+		rerr    tls.RecordHeaderError
+		unknown x509.UnknownAuthorityError
+		invalid x509.CertificateInvalidError
+		host    x509.HostnameError
+	)
+	if errors.As(err, &cerr) || errors.As(err, &rerr) || errors.As(err, &unknown) ||
+		errors.As(err, &invalid) || errors.As(err, &host) {
+		return false
+	}
+	return !errors.Is(err, os.ErrNotExist) && !errors.Is(err, os.ErrPermission)
+}
+
+// mailReader 返回从头读取邮件内容的Reader,读取之后内容仍然保留,发送失败的时候可以写入队列
+func mailReader(file io.ReadWriter) io.Reader {
+	if buf, ok := file.(*bytes.Buffer); ok {
+		return bytes.NewReader(buf.Bytes())
+	}
+	if seeker, ok := file.(io.Seeker); ok {
+		seeker.Seek(0, io.SeekStart)
+	}
+	return file
+}
+
+// MailSpool 把发送失败的邮件写入队列目录
+func MailSpool(dir string, msg *MailConfig, body io.Reader, sendErr error) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	from, err := msg.FromAddress()
+	if err != nil {
+		return "", err
+	}
+	to, err := msg.Recipients()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	meta := &MailSpoolMeta{ID: fmt.Sprintf("%s-%d-%d", now.Format("20060102150405.000000"), os.Getpid(), atomic.AddUint64(&mailSpoolSeq, 1)),
+		From: from, To: to, Host: msg.Host, Created: now, NextTry: now.Add(mailSpoolBackoff), Attempts: 1}
+	if sendErr != nil {
+		meta.LastError = sendErr.Error()
+	}
+
+	// 先写临时文件再改名,flush不会读到不完整的邮件
+	name := filepath.Join(dir, meta.ID)
+	File, err := os.OpenFile(name+".eml.tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(File, body)
+	if cerr := File.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(name+".eml.tmp", name+".eml")
+	}
+	if err == nil {
+		err = writeSpoolMeta(dir, meta)
+	}
+	if err != nil {
+		os.Remove(name + ".eml.tmp")
+		os.Remove(name + ".eml")
+		return "", err
+	}
+	return meta.ID, nil
+}
+
+func writeSpoolMeta(dir string, meta *MailSpoolMeta) error {
+	buf, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(dir, meta.ID+".json")
+	if err = ioutil.WriteFile(name+".tmp", buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// MailFlush 重新发送队列中到了重试时间的邮件,cfg中的服务器和认证配置用于发送
+func MailFlush(cfg *MailConfig, flush *MailFlushConfig, output io.Writer) error {
+	auth, err := MailAuth(cfg)
+	if err != nil {
+		return err
+	}
+	if flush.Interval <= 0 {
+		flush.Interval = time.Minute
+	}
+
+	lock, err := lockSpool(flush.Dir)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(lock)
+
+	for {
+		if err = mailFlushOnce(cfg, auth, flush, output); err != nil && !flush.Daemon {
+			return err
+		}
+		if !flush.Daemon {
+			return nil
+		}
+		if err != nil {
+			fmt.Fprintf(output, "[ERROR] 读取队列失败:%s\n", err.Error())
+		}
+		time.Sleep(flush.Interval)
+		now := time.Now()
+		os.Chtimes(lock, now, now)
+	}
+}
+
+// lockSpool 防止多个flush同时发送同一封邮件,超过一个小时没有更新的锁文件认为已经失效
+func lockSpool(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	name := filepath.Join(dir, ".flush.lock")
+	for i := 0; i < 2; i++ {
+		File, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			fmt.Fprintf(File, "%d\n", os.Getpid())
+			File.Close()
+			return name, nil
+		}
+		info, serr := os.Stat(name)
+		if !os.IsExist(err) || serr != nil || time.Since(info.ModTime()) < time.Hour {
+			return "", fmt.Errorf("队列正在被其他进程处理:%s", name)
+		}
+		os.Remove(name)
+	}
+	return "", fmt.Errorf("锁定队列失败:%s", name)
+}
+
+func mailFlushOnce(cfg *MailConfig, auth smtp.Auth, flush *MailFlushConfig, output io.Writer) error {
+	metas, err := loadSpool(flush.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, meta := range metas {
+		name := filepath.Join(flush.Dir, meta.ID)
+		if flush.Expire > 0 && time.Since(meta.Created) > flush.Expire {
+			if err = moveSpool(flush.Dir, "expired", meta.ID); err != nil {
+				fmt.Fprintf(output, "[ERROR] %s 移动过期邮件失败:%s\n", meta.ID, err.Error())
+			} else {
+				fmt.Fprintf(output, "[EXPIRED] %s %s 尝试%d次:%s\n", meta.ID, strings.Join(meta.To, ","), meta.Attempts, meta.LastError)
+			}
+			continue
+		}
+		if time.Now().Before(meta.NextTry) {
+			continue
+		}
+
+		err = mailSendSpooled(cfg, auth, meta, name+".eml")
+		if err == nil {
+			os.Remove(name + ".json")
+			os.Remove(name + ".eml")
+			fmt.Fprintf(output, "[SUCCESS] %s %s\n", meta.ID, strings.Join(meta.To, ","))
+			continue
+		}
+
+		meta.Attempts++
+		meta.LastError = err.Error()
+		backoff := mailSpoolBackoff << uint(meta.Attempts-1)
+		if backoff > mailSpoolMaxBackoff || backoff <= 0 {
+			backoff = mailSpoolMaxBackoff
+		}
+		meta.NextTry = time.Now().Add(backoff)
+		if werr := writeSpoolMeta(flush.Dir, meta); werr != nil {
+			fmt.Fprintf(output, "[ERROR] %s 更新元数据失败:%s\n", meta.ID, werr.Error())
+		}
+		// 永久错误或者达到最大尝试次数的时候不再重试,移动到failed目录
+		if !mailRetryable(err) || (flush.Attempts > 0 && meta.Attempts >= flush.Attempts) {
+			if merr := moveSpool(flush.Dir, "failed", meta.ID); merr != nil {
+				fmt.Fprintf(output, "[ERROR] %s 移动失败邮件失败:%s\n", meta.ID, merr.Error())
+			}
+			fmt.Fprintf(output, "[FAILD] %s %s 第%d次:%s,不再重试\n", meta.ID, strings.Join(meta.To, ","), meta.Attempts, err.Error())
+			continue
+		}
+		fmt.Fprintf(output, "[FAILD] %s %s 第%d次:%s,下次重试:%s\n", meta.ID, strings.Join(meta.To, ","),
+			meta.Attempts, err.Error(), meta.NextTry.Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
+
+// moveSpool 把队列中的邮件移动到子目录sub中,.eml已经不存在的时候只移动元数据
+func moveSpool(dir, sub, id string) error {
+	target := filepath.Join(dir, sub)
+	if err := os.MkdirAll(target, 0700); err != nil {
+		return err
+	}
+	name := filepath.Join(dir, id)
+	if err := os.Rename(name+".eml", filepath.Join(target, id+".eml")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(name+".json", filepath.Join(target, id+".json"))
+}
+
+func mailSendSpooled(cfg *MailConfig, auth smtp.Auth, meta *MailSpoolMeta, name string) error {
+	File, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer File.Close()
+
+	msg := *cfg
+	msg.From, msg.To, msg.Cc, msg.Bcc = meta.From, strings.Join(meta.To, ","), "", ""
+	if msg.Host == "" {
+		msg.Host = meta.Host
+	}
+	return MailSend(&msg, auth, File)
+}
+
+// loadSpool 读取队列中的邮件,按创建时间排序
+func loadSpool(dir string) ([]*MailSpoolMeta, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var metas = make([]*MailSpoolMeta, 0, len(names))
+	for _, name := range names {
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var meta MailSpoolMeta
+		if err = json.Unmarshal(buf, &meta); err != nil {
+			return nil, fmt.Errorf("%s:%s", name, err.Error())
+		}
+		metas = append(metas, &meta)
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].Created.Before(metas[j].Created) })
+	return metas, nil
+}
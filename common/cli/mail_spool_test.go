@@ -0,0 +1,85 @@
+package cli
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMailRetryable(t *testing.T) {
+	tests := map[string]struct {
+		err  error
+		want bool
+	}{
+		"temporary reply":  {&textproto.Error{Code: 451, Msg: "try again later"}, true},
+		"rejected":         {&textproto.Error{Code: 550, Msg: "no such user"}, false},
+		"auth failed":      {&textproto.Error{Code: 535, Msg: "authentication failed"}, false},
+		"connect refused":  {&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		"unknown ca":       {x509.UnknownAuthorityError{}, false},
+		"wrapped hostname": {fmt.Errorf("handshake: %w", x509.HostnameError{Host: "smtp.example.com"}), false},
+		"bad ca file":      {&mailConfigError{errors.New("ca.pem 中没有有效的证书")}, false},
+		"missing eml":      {&os.PathError{Op: "open", Path: "a.eml", Err: os.ErrNotExist}, false},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := mailRetryable(test.err); got != test.want {
+				t.Fatalf("mailRetryable(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMailFlushMovesToFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mail_spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 一个端口关闭的服务器,连接失败是临时错误
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := ln.Addr().String()
+	ln.Close()
+
+	created := time.Now().Add(-time.Hour)
+	metas := []*MailSpoolMeta{
+		{ID: "lost", From: "a@example.com", To: []string{"b@example.com"}, Host: host, Created: created, Attempts: 1},
+		{ID: "tired", From: "a@example.com", To: []string{"b@example.com"}, Host: host, Created: created, Attempts: 2},
+		{ID: "retry", From: "a@example.com", To: []string{"b@example.com"}, Host: host, Created: created, Attempts: 1},
+	}
+	for _, meta := range metas {
+		if err = writeSpoolMeta(dir, meta); err != nil {
+			t.Fatal(err)
+		}
+		if meta.ID != "lost" {
+			if err = ioutil.WriteFile(filepath.Join(dir, meta.ID+".eml"), []byte("Subject: test\r\n\r\nbody\r\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	flush := &MailFlushConfig{Dir: dir, Expire: 72 * time.Hour, Attempts: 3}
+	if err = mailFlushOnce(&MailConfig{TLS: "none"}, nil, flush, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"failed/lost.json", "failed/tired.json", "failed/tired.eml", "retry.json", "retry.eml"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	left, err := loadSpool(dir)
+	if err != nil || len(left) != 1 || left[0].ID != "retry" || left[0].Attempts != 2 {
+		t.Fatalf("loadSpool = %+v, %v", left, err)
+	}
+}
@@ -5,15 +5,20 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 // NetConfig net 命令配置
@@ -25,6 +30,35 @@ type NetConfig struct {
 	Quick   bool
 	Count   int
 	TimeOut int
+	IPv4    bool // 只使用IPv4地址
+	IPv6    bool // 只使用IPv6地址
+
+	Interval float64 // ping的间隔,单位秒
+	Size     int     // ping的数据长度
+	TTL      int     // ping的TTL,0使用系统默认值
+
+	Ports       string  // scan的端口列表,例如:22,80,8000-8100
+	Concurrency int     // scan的并发数
+	Rate        float64 // scan每秒最多发起的连接数,小于等于0不限制
+	Banner      bool    // scan的时候读取服务端的banner
+	OpenOnly    bool    // scan只输出开放的端口
+	Format      string  // scan结果的格式:table|json|csv
+	Output      string  // scan结果写入的文件,为空的时候输出到标准输出
+
+	Proto   string // trace和mtr的探测协议:udp|icmp|tcp,dns的传输协议:udp|tcp|tls
+	MaxHops int    // trace和mtr的最大跳数
+	Queries int    // trace每跳的探测次数
+
+	Method   string // http请求的方法
+	Status   string // http允许的状态码,例如:200-299,301
+	Match    string // http正文需要匹配的正则表达式
+	MaxTime  int    // http总耗时的上限,单位毫秒,0不检查
+	CertDays int    // http证书剩余有效天数的下限
+	CA       string // http和dns验证服务端证书的CA文件
+	Insecure bool   // http和dns不验证服务端证书
+
+	Type   string // dns查询的记录类型,多个类型用','分割
+	Server string // dns服务器,多个服务器用','分割,为空的时候使用/etc/resolv.conf中的服务器
 }
 
 // NetRun 运行网络工具
@@ -54,17 +88,42 @@ func NetRun(netConfig *NetConfig) error {
 			return nil
 		}
 	}
-	var data = []byte("abcdefghijklmnopqrstuvwabcdefghi")
+	network, err := netNetwork(netConfig)
+	if err != nil {
+		return err
+	}
 	var wait = new(sync.WaitGroup)
 
 	switch netConfig.Action {
 	case "ping":
+		// count小于等于0的时候持续ping,Ctrl-C停止之后输出统计
+		var stop = make(chan struct{})
+		var sig = make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(sig)
+		go func() {
+			if _, ok := <-sig; ok {
+				close(stop)
+			}
+		}()
+
+		var data = pingData(netConfig.Size)
+		var pingers []*NetPing
+	hosts:
 		for _, host := range list {
-			p, err := NetPingNew(host, 8, data)
+			select {
+			case <-stop:
+				break hosts
+			default:
+			}
+			p, err := NetPingNew(host, network, data)
 			if err != nil {
 				fmt.Printf("Ping %s faild,%s\n", host, err.Error())
 				continue
 			}
+			p.Interval = time.Duration(netConfig.Interval * float64(time.Second))
+			p.Timeout, p.TTL, p.Stop, p.Buffered = netConfig.TimeOut, netConfig.TTL, stop, netConfig.Quick
+			pingers = append(pingers, p)
 			var Ping func(c int) error
 			if netConfig.Sum {
 				Ping = p.PingCount
@@ -86,6 +145,9 @@ func NetRun(netConfig *NetConfig) error {
 			}
 		}
 		wait.Wait()
+		if netConfig.Sum {
+			return writePingStats(os.Stdout, pingers)
+		}
 	case "telnet":
 		for _, host := range list {
 			if netConfig.Quick {
@@ -107,10 +169,54 @@ func NetRun(netConfig *NetConfig) error {
 			}
 		}
 		wait.Wait()
+	case "scan":
+		return NetScan(netConfig, list, network)
+	case "http":
+		return NetHTTP(netConfig, list, network)
+	case "dns":
+		return NetDNS(netConfig, list, network)
+	case "trace", "mtr":
+		Trace := NetTrace
+		if netConfig.Action == "mtr" {
+			Trace = NetMTR
+		}
+		for _, host := range list {
+			if !netConfig.Quick {
+				if err := Trace(netConfig, host, network, os.Stdout); err != nil {
+					fmt.Printf("%s %s error:%s\n", netConfig.Action, host, err.Error())
+				}
+				continue
+			}
+			wait.Add(1)
+			go func(host string) {
+				var buf = bytes.NewBuffer(nil)
+				if err := Trace(netConfig, host, network, buf); err != nil {
+					fmt.Fprintf(buf, "%s %s error:%s\n", netConfig.Action, host, err.Error())
+				}
+				fmt.Println(buf.String())
+				wait.Done()
+			}(host)
+		}
+		wait.Wait()
+	default:
+		return fmt.Errorf("不支持的动作:%s", netConfig.Action)
 	}
 	return nil
 }
 
+// netNetwork 根据-4和-6返回解析地址使用的网络类型:ip|ip4|ip6
+func netNetwork(netConfig *NetConfig) (string, error) {
+	switch {
+	case netConfig.IPv4 && netConfig.IPv6:
+		return "", fmt.Errorf("-4和-6不能同时使用")
+	case netConfig.IPv4:
+		return "ip4", nil
+	case netConfig.IPv6:
+		return "ip6", nil
+	}
+	return "ip", nil
+}
+
 func portIsOpen(ip string, timeout int) bool {
 	con, err := net.DialTimeout("tcp", ip, time.Duration(timeout)*time.Second)
 	if err != nil {
@@ -120,24 +226,28 @@ func portIsOpen(ip string, timeout int) bool {
 	return true
 }
 
-// NetPingNew 创建net ping
-func NetPingNew(addr string, req int, data []byte) (*NetPing, error) {
-	wb, err := marshalMsg(req, data)
+// NetPingNew 创建net ping,network为ip|ip4|ip6,指定解析的地址类型
+func NetPingNew(addr, network string, data []byte) (*NetPing, error) {
+	addr, err := lookup(addr, network)
 	if err != nil {
 		return nil, err
 	}
-	addr, err = lookup(addr)
-	if err != nil {
-		return nil, err
-	}
-	return &NetPing{Data: wb, Addr: addr}, nil
+	id := int(atomic.AddUint32(&pingID, 1) & 0xffff)
+	return &NetPing{Data: data, Addr: addr, ip: net.ParseIP(addr), id: id}, nil
 }
 
-func lookup(host string) (string, error) {
-	addrs, err := net.LookupHost(host)
+func lookup(host, network string) (string, error) {
+	ips, err := net.LookupIP(host)
 	if err != nil {
 		return "", err
 	}
+	var addrs []string
+	for _, ip := range ips {
+		if (network == "ip4" && ip.To4() == nil) || (network == "ip6" && ip.To4() != nil) {
+			continue
+		}
+		addrs = append(addrs, ip.String())
+	}
 	if len(addrs) < 1 {
 		return "", errors.New("unknown host")
 	}
@@ -146,87 +256,249 @@ func lookup(host string) (string, error) {
 	return addrs[rd.Intn(len(addrs))], nil
 }
 
-// marshalMsg 封装消息
-func marshalMsg(req int, data []byte) ([]byte, error) {
-	xid, xseq := os.Getpid()&0xffff, req
-	wm := icmp.Message{
-		Type: ipv4.ICMPTypeEcho, Code: 0,
-		Body: &icmp.Echo{
-			ID: xid, Seq: xseq,
-			Data: data,
-		},
-	}
-	return wm.Marshal(nil)
+// pingData 生成size字节的ping数据
+func pingData(size int) []byte {
+	var data = make([]byte, size)
+	for i := range data {
+		data[i] = "abcdefghijklmnopqrstuvw"[i%23]
+	}
+	return data
 }
 
+// pingID 每个NetPing使用不同的ID,并发ping的时候根据ID和Seq区分响应
+var pingID = uint32(os.Getpid())
+
 // NetPing net ping
 type NetPing struct {
-	conn net.Conn
+	conn *icmp.PacketConn
 	Addr string
 	Data []byte
+	ip   net.IP
+	id   int
+	seq  int
+	// udp 使用非特权的ICMP数据报套接字,内核会把ID改成套接字的端口,并且只投递这个套接字的响应
+	udp bool
+
+	Interval time.Duration // 发送间隔,默认1秒
+	Timeout  int           // 等待响应的超时时间,单位秒,默认3秒
+	TTL      int           // 发送的TTL,0使用系统默认值
+	Stop     <-chan struct{}
+	Stats    *PingStats // PingCount的统计结果
+	Buffered bool       // Ping的结果结束的时候一起输出,并发ping多个主机的时候不会交叉,count为0的时候无效
 }
 
 // Ping ping
 func (p *NetPing) Ping(count int) error {
-	var buf = bytes.NewBuffer(nil)
 	if err := p.Init(); err != nil {
 		return err
 	}
+	defer p.Close()
+	if err := p.setTTL(p.TTL); err != nil {
+		return err
+	}
 
-	fmt.Printf("Start ping from %s\n", p.Addr)
-	for i := 0; i < count; i++ {
-		p.SetDeadline(3)
-		r := sendPingMsg(p.conn, p.Data)
+	var w io.Writer = os.Stdout
+	if p.Buffered && count > 0 {
+		var buf = bytes.NewBuffer(nil)
+		defer func() {
+			fmt.Println(buf.String())
+		}()
+		w = buf
+	}
+	fmt.Fprintf(w, "Start ping from %s\n", p.Addr)
+	for i := 0; count <= 0 || i < count; i++ {
+		if i > 0 && p.sleep(p.interval()) {
+			break
+		}
+		p.SetDeadline(p.timeout())
+		r := p.send()
 		if r.Error != nil {
 			if opt, ok := r.Error.(*net.OpError); ok && opt.Timeout() {
-				fmt.Fprintf(buf, "From %s Reply: TimeOut\n", p.Addr)
-				if err := p.Init(); err != nil {
-					fmt.Fprintf(buf, "Not found remote host\n")
-					break
-				}
+				fmt.Fprintf(w, "From %s Reply: TimeOut\n", p.Addr)
 			} else {
-				fmt.Fprintf(buf, "From %s Reply: %s\n", p.Addr, r.Error)
+				fmt.Fprintf(w, "From %s Reply: %s\n", p.Addr, r.Error)
 			}
 		} else {
-			fmt.Fprintf(buf, "From %s Reply: bytes=32 time=%dms ttl=%d\n", p.Addr, r.Time, r.TTL)
+			fmt.Fprintf(w, "From %s Reply: bytes=%d time=%.2fms ttl=%d\n", p.Addr, len(p.Data), float64(r.Time)/float64(time.Millisecond), r.TTL)
 		}
-		time.Sleep(1e9)
-	}
-	if buf != nil {
-		fmt.Println(string(buf.Bytes()))
 	}
 	return nil
 }
 
-// PingCount ping统计
+// PingCount ping统计,发送和接收分开进行,可以统计重复和乱序的响应,结果保存在p.Stats
 func (p *NetPing) PingCount(count int) error {
+	p.Stats = &PingStats{Addr: p.Addr}
 	if err := p.Init(); err != nil {
 		return err
 	}
+	defer p.Close()
+	if err := p.setTTL(p.TTL); err != nil {
+		return err
+	}
 
-	var times, ttl, errs int
-	for i := 0; i < count; i++ {
-		p.SetDeadline(3)
-		r := sendPingMsg(p.conn, p.Data)
-		if r.Error != nil {
-			errs++
-			continue
+	type request struct {
+		index int
+		at    time.Time
+	}
+	var lock sync.Mutex
+	var sent = make(map[int]request)
+	var received = make(map[int]bool)
+	var last = -1 // 已经收到的最大的请求序号
+	var finished bool
+	var done = make(chan struct{})
+	var replyType icmp.Type = ipv4.ICMPTypeEchoReply
+	if p.ipv6() {
+		replyType = ipv6.ICMPTypeEchoReply
+	}
+
+	go func() {
+		defer close(done)
+		rb := make([]byte, 65535)
+		for {
+			n, ttl, src, err := p.readFrom(rb)
+			if err != nil {
+				return
+			}
+			now := time.Now()
+			rm, err := icmp.ParseMessage(replyType.Protocol(), rb[:n])
+			if err != nil || rm.Type != replyType || !src.Equal(p.ip) {
+				continue
+			}
+			body, ok := rm.Body.(*icmp.Echo)
+			if !ok || (!p.udp && body.ID != p.id) {
+				continue
+			}
+			lock.Lock()
+			if req, ok := sent[body.Seq]; ok {
+				if received[body.Seq] {
+					p.Stats.Dup++
+				} else {
+					received[body.Seq] = true
+					p.Stats.add(now.Sub(req.at), ttl)
+					if req.index < last {
+						p.Stats.Reorder++
+					} else {
+						last = req.index
+					}
+				}
+			}
+			all := finished && p.Stats.Recv == p.Stats.Sent
+			lock.Unlock()
+			if all {
+				return
+			}
+		}
+	}()
+
+	for i := 0; count <= 0 || i < count; i++ {
+		if i > 0 && p.sleep(p.interval()) {
+			break
+		}
+		lock.Lock()
+		at := time.Now()
+		_, err := p.writeEcho()
+		if err == nil {
+			// Seq循环使用的时候清除之前的记录
+			sent[p.seq] = request{i, at}
+			delete(received, p.seq)
+			p.Stats.Sent++
+		}
+		lock.Unlock()
+		if err != nil {
+			p.Stats.Errors++
 		}
-		times += int(r.Time)
-		ttl += int(r.TTL)
-		time.Sleep(1e9)
 	}
-	sucess := count - errs
-	fmt.Printf("From %s Reply:sucess=%d abytes=32 atime=%.2fms attl=%.2f faild=%d\n",
-		p.Addr, sucess, float64(times)/float64(sucess), float64(ttl)/float64(sucess), errs)
+
+	// 等待最后一个请求超时或者所有的响应都已经收到
+	lock.Lock()
+	finished = true
+	deadline := time.Now().Add(time.Duration(p.timeout()) * time.Second)
+	if p.Stats.Recv == p.Stats.Sent {
+		deadline = time.Now()
+	}
+	p.conn.SetReadDeadline(deadline)
+	lock.Unlock()
+	select {
+	case <-done:
+	case <-p.Stop:
+		p.conn.SetReadDeadline(time.Now())
+		<-done
+	}
 	return nil
 }
 
-// Init 初始化Ping
+func (p *NetPing) interval() time.Duration {
+	if p.Interval <= 0 {
+		return time.Second
+	}
+	return p.Interval
+}
+
+func (p *NetPing) timeout() int {
+	if p.Timeout <= 0 {
+		return 3
+	}
+	return p.Timeout
+}
+
+// sleep 等待d,收到停止信号的时候返回true
+func (p *NetPing) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return false
+	case <-p.Stop:
+		return true
+	}
+}
+
+// setTTL 设置发送报文的TTL,IPv6为Hop Limit
+func (p *NetPing) setTTL(ttl int) error {
+	if ttl <= 0 {
+		return nil
+	}
+	if p.ipv6() {
+		return p.conn.IPv6PacketConn().SetHopLimit(ttl)
+	}
+	return p.conn.IPv4PacketConn().SetTTL(ttl)
+}
+
+// Init 初始化Ping,优先使用非特权的ICMP数据报套接字,内核不允许的时候(net.ipv4.ping_group_range)使用原始套接字
 func (p *NetPing) Init() error {
-	conn, err := net.Dial("ip4:icmp", p.Addr)
-	p.conn = conn
-	return err
+	if err := p.listen(false); err != nil {
+		return p.listen(true)
+	}
+	return nil
+}
+
+// listen 打开ICMP套接字,raw为true的时候使用原始套接字,可以收到其他协议的报文引起的ICMP差错报文
+func (p *NetPing) listen(raw bool) error {
+	network, address := "udp4", "0.0.0.0"
+	if raw {
+		network = "ip4:icmp"
+	}
+	if p.ipv6() {
+		network, address = "udp6", "::"
+		if raw {
+			network = "ip6:ipv6-icmp"
+		}
+	}
+	conn, err := icmp.ListenPacket(network, address)
+	if err != nil {
+		return err
+	}
+	if p.ipv6() {
+		conn.IPv6PacketConn().SetControlMessage(ipv6.FlagHopLimit, true)
+	} else {
+		conn.IPv4PacketConn().SetControlMessage(ipv4.FlagTTL, true)
+	}
+	p.conn, p.udp = conn, !raw
+	return nil
+}
+
+func (p *NetPing) ipv6() bool {
+	return p.ip.To4() == nil
 }
 
 // SetDeadline 设置超时时间单位s
@@ -236,53 +508,142 @@ func (p *NetPing) SetDeadline(timeout int) error {
 
 // Close 关闭远程连接
 func (p *NetPing) Close() error {
-	return p.conn.Close()
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.Close()
+	p.conn = nil
+	return err
 }
 
 // reply 响应信息
 type reply struct {
-	Time  int64
+	Time  time.Duration
 	TTL   uint8
 	Error error
 }
 
-func sendPingMsg(c net.Conn, data []byte) *reply {
+// send 发送一个echo请求并等待对应的响应,直到超时
+func (p *NetPing) send() *reply {
 	rep := new(reply)
 	start := time.Now()
-	if _, rep.Error = c.Write(data); rep.Error != nil {
+	replyType, err := p.writeEcho()
+	if err != nil {
+		rep.Error = err
 		return rep
 	}
-
 	rb := make([]byte, 1500)
-	var n int
-	n, rep.Error = c.Read(rb)
-	if rep.Error != nil {
-		return rep
+	for {
+		n, ttl, src, err := p.readFrom(rb)
+		if err != nil {
+			rep.Error = err
+			return rep
+		}
+		rm, err := icmp.ParseMessage(replyType.Protocol(), rb[:n])
+		if err != nil {
+			continue
+		}
+		switch body := rm.Body.(type) {
+		case *icmp.Echo:
+			// 原始套接字会收到所有的ICMP报文,包括其他进程和发往本机的请求
+			if rm.Type != replyType || !src.Equal(p.ip) || !p.match(body.ID, body.Seq) {
+				continue
+			}
+			return &reply{time.Since(start), uint8(ttl), nil}
+		case *icmp.DstUnreach:
+			if p.quoted(body.Data) {
+				rep.Error = fmt.Errorf("Destination Unreachable from %s", src)
+				return rep
+			}
+		case *icmp.TimeExceeded:
+			if p.quoted(body.Data) {
+				rep.Error = fmt.Errorf("Time Exceeded from %s", src)
+				return rep
+			}
+		}
+	}
+}
+
+// writeEcho 使用下一个Seq发送echo请求,返回对应的响应类型
+func (p *NetPing) writeEcho() (icmp.Type, error) {
+	p.seq = (p.seq + 1) & 0xffff
+	var typ, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if p.ipv6() {
+		typ, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
 	}
+	wm := icmp.Message{Type: typ, Code: 0, Body: &icmp.Echo{ID: p.id, Seq: p.seq, Data: p.Data}}
+	wb, err := wm.Marshal(nil)
+	if err != nil {
+		return replyType, err
+	}
+	var dst net.Addr = &net.IPAddr{IP: p.ip}
+	if p.udp {
+		dst = &net.UDPAddr{IP: p.ip}
+	}
+	_, err = p.conn.WriteTo(wb, dst)
+	return replyType, err
+}
 
-	duration := time.Now().Sub(start)
-	ttl := uint8(rb[8])
-	rb = func(b []byte) []byte {
-		if len(b) < 20 {
-			return b
+// readFrom 读取ICMP报文,同时返回IP头中的TTL
+func (p *NetPing) readFrom(b []byte) (n, ttl int, src net.IP, err error) {
+	var addr net.Addr
+	if p.ipv6() {
+		var cm *ipv6.ControlMessage
+		if n, cm, addr, err = p.conn.IPv6PacketConn().ReadFrom(b); cm != nil {
+			ttl = cm.HopLimit
+		}
+	} else {
+		var cm *ipv4.ControlMessage
+		if n, cm, addr, err = p.conn.IPv4PacketConn().ReadFrom(b); cm != nil {
+			ttl = cm.TTL
 		}
-		hdrlen := int(b[0]&0x0f) << 2
-		return b[hdrlen:]
-	}(rb)
-	var rm *icmp.Message
-	rm, rep.Error = icmp.ParseMessage(1, rb[:n])
-	if rep.Error != nil {
-		return rep
 	}
+	switch addr := addr.(type) {
+	case *net.IPAddr:
+		src = addr.IP
+	case *net.UDPAddr:
+		src = addr.IP
+	}
+	return
+}
 
-	switch rm.Type {
-	case ipv4.ICMPTypeEchoReply:
-		t := int64(duration / time.Millisecond)
-		rep = &reply{t, ttl, nil}
-	case ipv4.ICMPTypeDestinationUnreachable:
-		rep.Error = errors.New("Destination Unreachable")
-	default:
-		rep.Error = fmt.Errorf("Not ICMPTypeEchoReply %v", rm)
+// match 检查响应的ID和Seq,数据报套接字的ID已经被内核修改,只检查Seq
+func (p *NetPing) match(id, seq int) bool {
+	return seq == p.seq && (p.udp || id == p.id)
+}
+
+// quoted 检查差错报文是否由本NetPing的请求引起
+func (p *NetPing) quoted(data []byte) bool {
+	dst, id, seq, ok := quotedEcho(data, p.ipv6())
+	return ok && dst.Equal(p.ip) && p.match(id, seq)
+}
+
+// quotedEcho 解析ICMP差错报文中携带的echo请求,返回目标地址,ID和Seq
+func quotedEcho(data []byte, v6 bool) (dst net.IP, id, seq int, ok bool) {
+	dst, proto, b, ok := quotedPacket(data, v6)
+	if !ok || (proto != 1 && proto != 58) {
+		return nil, 0, 0, false
+	}
+	return dst, int(b[4])<<8 | int(b[5]), int(b[6])<<8 | int(b[7]), true
+}
+
+// quotedPacket 解析ICMP差错报文中携带的原始IP头,返回目标地址,协议和至少8字节的上层报文
+func quotedPacket(data []byte, v6 bool) (dst net.IP, proto int, payload []byte, ok bool) {
+	var hdrlen int
+	if v6 {
+		if len(data) < ipv6.HeaderLen+8 {
+			return nil, 0, nil, false
+		}
+		hdrlen, proto, dst = ipv6.HeaderLen, int(data[6]), net.IP(data[24:40])
+	} else {
+		if len(data) < ipv4.HeaderLen {
+			return nil, 0, nil, false
+		}
+		hdrlen = int(data[0]&0x0f) << 2
+		if len(data) < hdrlen+8 {
+			return nil, 0, nil, false
+		}
+		proto, dst = int(data[9]), net.IP(data[16:20])
 	}
-	return rep
+	return dst, proto, data[hdrlen:], true
 }
@@ -0,0 +1,648 @@
+package cli
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// benchPort 服务端的默认端口
+	benchPort = "5201"
+	// benchHeaderSize udp报文头的长度: 会话ID,序号,发送时间
+	benchHeaderSize = 24
+	// benchHello 反向udp测试的时候客户端发送的报文序号,服务端根据这个报文得到客户端的地址
+	benchHello = ^uint64(0)
+)
+
+// NetBenchConfig 吞吐量测试的参数
+type NetBenchConfig struct {
+	Host      string // 服务端地址,没有端口的时候使用5201
+	Format    string // 结果的格式:table|json
+	TimeOut   int    // 连接服务端的超时时间,单位秒
+	Listen    string // serve监听的地址,tcp和udp使用同一个端口
+	UDP       bool   // 使用udp测试
+	Streams   int    // tcp并发的连接数,udp只使用一个流
+	Duration  int    // 每个方向的测试时间,单位秒
+	Direction string // up:客户端发送|down:服务端发送|both:先up再down
+	Bandwidth string // udp的发送速率,单位bit/s,可以使用K,M,G后缀,0不限制
+	Length    int    // tcp每次写入的字节数或者udp报文的长度,0使用默认值
+
+	MaxBandwidth string // serve反向udp测试的最大发送速率,客户端要求的速率更高或者不限制的时候使用这个速率
+}
+
+// BenchInterval 接收方一段时间内的统计,时间单位为秒,udp的时候统计报文数,丢包,乱序和抖动
+type BenchInterval struct {
+	Start      float64 `json:"start"`
+	End        float64 `json:"end"`
+	Bytes      int64   `json:"bytes"`
+	BitsPerSec float64 `json:"bits_per_second"`
+	Packets    int64   `json:"packets,omitempty"`
+	Lost       int64   `json:"lost,omitempty"`
+	Loss       float64 `json:"loss_percent,omitempty"`
+	OutOfOrder int64   `json:"out_of_order,omitempty"`
+	Jitter     float64 `json:"jitter_ms,omitempty"`
+}
+
+// BenchResult 一个方向的测试结果
+type BenchResult struct {
+	Direction string           `json:"direction"` // up|down
+	Proto     string           `json:"proto"`
+	Streams   int              `json:"streams"`
+	Intervals []*BenchInterval `json:"intervals"`
+	Summary   *BenchInterval   `json:"summary"`
+}
+
+// benchMessage 控制连接上的消息,每行一个json
+type benchMessage struct {
+	Cmd       string         `json:"cmd"` // test|stream|accept|start|interval|sent|result|error
+	ID        uint64         `json:"id,omitempty"`
+	UDP       bool           `json:"udp,omitempty"`
+	Streams   int            `json:"streams,omitempty"`
+	Duration  int            `json:"duration,omitempty"`
+	Reverse   bool           `json:"reverse,omitempty"`
+	Bandwidth float64        `json:"bandwidth,omitempty"`
+	Length    int            `json:"length,omitempty"`
+	Sent      int64          `json:"sent,omitempty"`
+	Interval  *BenchInterval `json:"interval,omitempty"`
+	Result    *BenchResult   `json:"result,omitempty"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// NetBench 连接benchConfig.Host指定的服务端,按照benchConfig.Direction测试每个方向的吞吐量,netConfig指定使用的地址类型
+func NetBench(benchConfig *NetBenchConfig, netConfig *NetConfig) error {
+	addr := benchConfig.Host
+	if addr == "" {
+		return fmt.Errorf("必须使用-H指定服务端地址")
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), benchPort)
+	}
+	network, err := netNetwork(netConfig)
+	if err != nil {
+		return err
+	}
+	var directions []bool
+	switch strings.ToLower(benchConfig.Direction) {
+	case "up":
+		directions = []bool{false}
+	case "down":
+		directions = []bool{true}
+	case "", "both":
+		directions = []bool{false, true}
+	default:
+		return fmt.Errorf("不支持的方向:%s", benchConfig.Direction)
+	}
+	format := strings.ToLower(benchConfig.Format)
+	switch format {
+	case "", "table", "json":
+	default:
+		return fmt.Errorf("bench不支持的输出格式:%s", benchConfig.Format)
+	}
+	bandwidth, err := parseBandwidth(benchConfig.Bandwidth)
+	if err != nil {
+		return err
+	}
+
+	req := &benchMessage{Cmd: "test", UDP: benchConfig.UDP, Streams: benchConfig.Streams,
+		Duration: benchConfig.Duration, Bandwidth: bandwidth, Length: benchConfig.Length}
+	if req.Streams <= 0 || req.UDP {
+		req.Streams = 1
+	}
+	if req.Duration <= 0 {
+		req.Duration = 10
+	}
+	if req.Length <= 0 {
+		req.Length = 128 << 10
+		if req.UDP {
+			req.Length = 1400
+		}
+	}
+	if err = checkBenchRequest(req); err != nil {
+		return err
+	}
+
+	dialer := &net.Dialer{Timeout: time.Duration(benchConfig.TimeOut) * time.Second}
+	network = strings.TrimPrefix(network, "ip")
+	var results []*BenchResult
+	for _, reverse := range directions {
+		req.Reverse = reverse
+		req.ID = rand.New(rand.NewSource(time.Now().UnixNano())).Uint64()
+		direction := benchDirection(reverse)
+		report := func(i *BenchInterval) {}
+		if format != "json" {
+			fmt.Printf("Connecting to %s, %s, %d streams, %d seconds, %s\n", addr, benchProto(req.UDP), req.Streams, req.Duration, direction)
+			report = func(i *BenchInterval) {
+				fmt.Printf("[%4s] %s\n", direction, benchIntervalText(i, req.UDP))
+			}
+		}
+		result, err := benchRun(dialer, network, addr, req, report)
+		if err != nil {
+			return fmt.Errorf("%s测试失败:%s", direction, err.Error())
+		}
+		if format != "json" {
+			fmt.Printf("[%4s] %s  summary\n\n", direction, benchIntervalText(result.Summary, req.UDP))
+		}
+		results = append(results, result)
+	}
+
+	if format == "json" {
+		buf, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", buf)
+		return nil
+	}
+	return writeBenchResults(os.Stdout, results)
+}
+
+// benchRun 执行一个方向的测试,接收方每秒的统计通过report输出
+func benchRun(dialer *net.Dialer, network, addr string, req *benchMessage, report func(*BenchInterval)) (*BenchResult, error) {
+	conn, err := dialer.Dial("tcp"+network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+	if err = enc.Encode(req); err != nil {
+		return nil, err
+	}
+	if _, err = readBenchMessage(dec, "accept"); err != nil {
+		return nil, err
+	}
+
+	var conns []net.Conn
+	var udp net.Conn
+	var started = make(chan struct{})
+	if req.UDP {
+		if udp, err = dialer.Dial("udp"+network, addr); err != nil {
+			return nil, err
+		}
+		defer udp.Close()
+		if req.Reverse {
+			go benchSendHello(udp, req.ID, started)
+		}
+	} else {
+		for i := 0; i < req.Streams; i++ {
+			c, err := dialer.Dial("tcp"+network, addr)
+			if err != nil {
+				return nil, err
+			}
+			defer c.Close()
+			if err = json.NewEncoder(c).Encode(&benchMessage{Cmd: "stream", ID: req.ID}); err != nil {
+				return nil, err
+			}
+			conns = append(conns, c)
+		}
+	}
+	_, err = readBenchMessage(dec, "start")
+	close(started)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	until := start.Add(time.Duration(req.Duration) * time.Second)
+	if !req.Reverse {
+		// 客户端发送,服务端每秒返回统计,结束之后返回结果
+		go func() {
+			if req.UDP {
+				write := func(b []byte) error {
+					_, err := udp.Write(b)
+					return err
+				}
+				enc.Encode(&benchMessage{Cmd: "sent", Sent: benchSendUDP(write, req.ID, req.Length, req.Bandwidth, until)})
+			} else {
+				benchSendTCP(conns, req.Length, until)
+			}
+		}()
+		conn.SetReadDeadline(until.Add(30 * time.Second))
+		for {
+			msg, err := readBenchMessage(dec, "")
+			if err != nil {
+				return nil, err
+			}
+			switch msg.Cmd {
+			case "interval":
+				if msg.Interval != nil {
+					report(msg.Interval)
+				}
+			case "result":
+				if msg.Result == nil || msg.Result.Summary == nil {
+					return nil, errors.New("服务端返回的结果为空")
+				}
+				return msg.Result, nil
+			}
+		}
+	}
+
+	// 服务端发送,客户端统计
+	result := &BenchResult{Direction: benchDirection(req.Reverse), Proto: benchProto(req.UDP), Streams: req.Streams}
+	counter := newBenchCounter(req.UDP)
+	counter.begin(start)
+	done, reported := make(chan struct{}), make(chan struct{})
+	go func() {
+		counter.report(done, until, func(i *BenchInterval) {
+			result.Intervals = append(result.Intervals, i)
+			report(i)
+		})
+		close(reported)
+	}()
+	var sent int64 = -1
+	if req.UDP {
+		var received = make(chan struct{})
+		go func() {
+			defer close(received)
+			buf := make([]byte, 65536)
+			for {
+				n, err := udp.Read(buf)
+				if err != nil {
+					return
+				}
+				counter.addDatagram(buf[:n], req.ID)
+			}
+		}()
+		var sentCh = make(chan int64, 1)
+		go func() {
+			if msg, err := readBenchMessage(dec, "sent"); err == nil {
+				sentCh <- msg.Sent
+			}
+		}()
+		sent = counter.waitUDP(sentCh, until)
+		udp.SetReadDeadline(time.Now())
+		<-received
+	} else {
+		counter.receiveTCP(conns, until.Add(30*time.Second))
+	}
+	close(done)
+	<-reported
+	result.Summary = counter.summary(sent)
+	// 把结果发送给服务端用于记录日志
+	enc.Encode(&benchMessage{Cmd: "result", Result: result})
+	return result, nil
+}
+
+// benchSendHello 每100毫秒发送一个hello报文,直到started关闭
+func benchSendHello(conn net.Conn, id uint64, started <-chan struct{}) {
+	buf := make([]byte, benchHeaderSize)
+	binary.BigEndian.PutUint64(buf, id)
+	binary.BigEndian.PutUint64(buf[8:], benchHello)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		conn.Write(buf)
+		select {
+		case <-ticker.C:
+		case <-started:
+			return
+		}
+	}
+}
+
+// benchSendTCP 每个连接持续写入直到until,然后关闭连接
+func benchSendTCP(conns []net.Conn, length int, until time.Time) {
+	buf := make([]byte, length)
+	var wait sync.WaitGroup
+	for _, conn := range conns {
+		wait.Add(1)
+		go func(conn net.Conn) {
+			defer wait.Done()
+			conn.SetWriteDeadline(until)
+			for {
+				if _, err := conn.Write(buf); err != nil {
+					break
+				}
+			}
+			conn.Close()
+		}(conn)
+	}
+	wait.Wait()
+}
+
+// benchSendUDP 按照bandwidth的速率发送udp报文直到until,bandwidth为0的时候不限速,返回发送的报文数
+func benchSendUDP(write func([]byte) error, id uint64, length int, bandwidth float64, until time.Time) int64 {
+	buf := make([]byte, length)
+	binary.BigEndian.PutUint64(buf, id)
+	var gap time.Duration
+	if bandwidth > 0 {
+		gap = time.Duration(float64(length*8) / bandwidth * float64(time.Second))
+	}
+	start := time.Now()
+	var seq int64
+	for now := start; now.Before(until); now = time.Now() {
+		// 发送超前的时候等待,落后的时候连续发送
+		if next := start.Add(time.Duration(seq) * gap); next.After(now) {
+			time.Sleep(next.Sub(now))
+			continue
+		}
+		binary.BigEndian.PutUint64(buf[8:], uint64(seq))
+		binary.BigEndian.PutUint64(buf[16:], uint64(time.Now().UnixNano()))
+		if err := write(buf); err != nil {
+			break
+		}
+		seq++
+	}
+	return seq
+}
+
+// benchCounter 接收方的统计
+type benchCounter struct {
+	lock       sync.Mutex
+	udp        bool
+	start      time.Time
+	last       time.Time // 最后收到数据的时间
+	bytes      int64
+	packets    int64
+	maxSeq     int64
+	outOfOrder int64
+	jitter     float64 // RFC 3550的抖动,单位秒
+	transit    float64 // 上一个报文的传输时间,包括两端的时钟差
+	mark       BenchInterval
+	markSeq    int64
+}
+
+func newBenchCounter(udp bool) *benchCounter {
+	return &benchCounter{udp: udp, maxSeq: -1, markSeq: -1}
+}
+
+// begin 设置测试开始的时间
+func (c *benchCounter) begin(start time.Time) {
+	c.lock.Lock()
+	c.start = start
+	c.lock.Unlock()
+}
+
+func (c *benchCounter) addBytes(n int) {
+	c.lock.Lock()
+	c.bytes += int64(n)
+	c.last = time.Now()
+	c.lock.Unlock()
+}
+
+// addDatagram 统计一个udp报文,不是当前会话的报文和hello报文忽略
+func (c *benchCounter) addDatagram(b []byte, id uint64) {
+	now := time.Now()
+	if len(b) < benchHeaderSize || binary.BigEndian.Uint64(b) != id {
+		return
+	}
+	seq := binary.BigEndian.Uint64(b[8:])
+	if seq == benchHello {
+		return
+	}
+	transit := float64(now.UnixNano()-int64(binary.BigEndian.Uint64(b[16:]))) / float64(time.Second)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.bytes += int64(len(b))
+	c.packets++
+	c.last = now
+	if int64(seq) > c.maxSeq {
+		c.maxSeq = int64(seq)
+	} else {
+		c.outOfOrder++
+	}
+	if c.packets > 1 {
+		c.jitter += (math.Abs(transit-c.transit) - c.jitter) / 16
+	}
+	c.transit = transit
+}
+
+// receiveTCP 读取所有的连接直到对方关闭或者超过deadline
+func (c *benchCounter) receiveTCP(conns []net.Conn, deadline time.Time) {
+	var wait sync.WaitGroup
+	for _, conn := range conns {
+		wait.Add(1)
+		go func(conn net.Conn) {
+			defer wait.Done()
+			conn.SetReadDeadline(deadline)
+			buf := make([]byte, 128<<10)
+			for {
+				n, err := conn.Read(buf)
+				if n > 0 {
+					c.addBytes(n)
+				}
+				if err != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+	wait.Wait()
+}
+
+// waitUDP 等待发送方发送完成,收到所有的报文或者再等待1秒之后返回发送的报文数,发送方没有返回的时候为-1
+func (c *benchCounter) waitUDP(sent <-chan int64, until time.Time) int64 {
+	timer := time.NewTimer(time.Until(until) + 10*time.Second)
+	defer timer.Stop()
+	var n int64
+	select {
+	case n = <-sent:
+	case <-timer.C:
+		return -1
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		c.lock.Lock()
+		all := c.packets >= n
+		c.lock.Unlock()
+		if all {
+			break
+		}
+	}
+	return n
+}
+
+// report 每秒调用一次fn,done关闭或者超过until之后返回,最后不足一秒的部分只计入汇总
+func (c *benchCounter) report(done <-chan struct{}, until time.Time, fn func(*BenchInterval)) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if now.After(until.Add(500 * time.Millisecond)) {
+				return
+			}
+			fn(c.interval(now))
+		case <-done:
+			return
+		}
+	}
+}
+
+// interval 返回上一次统计到now之间的统计
+func (c *benchCounter) interval(now time.Time) *BenchInterval {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	i := &BenchInterval{Start: c.mark.End, End: now.Sub(c.start).Seconds(), Bytes: c.bytes - c.mark.Bytes}
+	if c.udp {
+		i.Packets = c.packets - c.mark.Packets
+		i.OutOfOrder = c.outOfOrder - c.mark.OutOfOrder
+		i.Jitter = c.jitter * 1000
+		if i.Lost = c.maxSeq - c.markSeq - i.Packets; i.Lost < 0 {
+			i.Lost = 0
+		}
+	}
+	i.finish()
+	c.mark = BenchInterval{End: i.End, Bytes: c.bytes, Packets: c.packets, OutOfOrder: c.outOfOrder}
+	c.markSeq = c.maxSeq
+	return i
+}
+
+// summary 返回整个测试的统计,sent为udp发送方发送的报文数,小于0的时候按照收到的最大序号计算
+func (c *benchCounter) summary(sent int64) *BenchInterval {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	i := &BenchInterval{Bytes: c.bytes}
+	if !c.last.IsZero() {
+		i.End = c.last.Sub(c.start).Seconds()
+	}
+	if c.udp {
+		if sent < 0 {
+			sent = c.maxSeq + 1
+		}
+		i.Packets, i.OutOfOrder, i.Jitter = c.packets, c.outOfOrder, c.jitter*1000
+		if i.Lost = sent - c.packets; i.Lost < 0 {
+			i.Lost = 0
+		}
+	}
+	i.finish()
+	return i
+}
+
+// finish 计算速率和丢包率
+func (i *BenchInterval) finish() {
+	if i.End > i.Start {
+		i.BitsPerSec = float64(i.Bytes) * 8 / (i.End - i.Start)
+	}
+	if total := i.Packets + i.Lost; total > 0 {
+		i.Loss = float64(i.Lost) * 100 / float64(total)
+	}
+}
+
+// readBenchMessage 读取一个消息,对方返回错误或者消息不是cmd的时候返回错误,cmd为空的时候不检查
+func readBenchMessage(dec *json.Decoder, cmd string) (*benchMessage, error) {
+	msg := new(benchMessage)
+	if err := dec.Decode(msg); err != nil {
+		return nil, err
+	}
+	if msg.Cmd == "error" {
+		return nil, errors.New(msg.Error)
+	}
+	if cmd != "" && msg.Cmd != cmd {
+		return nil, fmt.Errorf("意外的消息:%s", msg.Cmd)
+	}
+	return msg, nil
+}
+
+// checkBenchRequest 检查测试参数的范围
+func checkBenchRequest(req *benchMessage) error {
+	switch {
+	case req.Streams < 1 || req.Streams > 128:
+		return fmt.Errorf("并发连接数必须在1-128之间")
+	case req.UDP && req.Streams != 1:
+		return fmt.Errorf("udp只支持一个流")
+	case req.Duration < 1 || req.Duration > 3600:
+		return fmt.Errorf("测试时间必须在1-3600秒之间")
+	case req.UDP && (req.Length < benchHeaderSize || req.Length > 65507):
+		return fmt.Errorf("udp报文长度必须在%d-65507之间", benchHeaderSize)
+	case !req.UDP && (req.Length < 1 || req.Length > 16<<20):
+		return fmt.Errorf("tcp写入长度必须在1-16M之间")
+	case req.Bandwidth < 0:
+		return fmt.Errorf("无效的速率")
+	}
+	return nil
+}
+
+// parseBandwidth 解析速率,K,M,G后缀按照1000换算
+func parseBandwidth(value string) (float64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	var unit float64 = 1
+	switch value[len(value)-1] {
+	case 'K', 'k':
+		unit = 1e3
+	case 'M', 'm':
+		unit = 1e6
+	case 'G', 'g':
+		unit = 1e9
+	}
+	if unit > 1 {
+		value = value[:len(value)-1]
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("无效的速率:%s", value)
+	}
+	return n * unit, nil
+}
+
+func benchDirection(reverse bool) string {
+	if reverse {
+		return "down"
+	}
+	return "up"
+}
+
+func benchProto(udp bool) string {
+	if udp {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// benchIntervalText 一行文本格式的统计
+func benchIntervalText(i *BenchInterval, udp bool) string {
+	text := fmt.Sprintf("%6.2f-%-6.2f sec  %12s  %16s", i.Start, i.End, formatBytes(i.Bytes), formatBits(i.BitsPerSec))
+	if udp {
+		text += fmt.Sprintf("  jitter=%.3fms lost=%d/%d (%.2f%%) out-of-order=%d", i.Jitter, i.Lost, i.Packets+i.Lost, i.Loss, i.OutOfOrder)
+	}
+	return text
+}
+
+func writeBenchResults(w io.Writer, results []*BenchResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DIRECTION\tPROTO\tSTREAMS\tSECONDS\tTRANSFER\tBITRATE\tJITTER\tLOST/TOTAL\tOUT-OF-ORDER")
+	for _, r := range results {
+		s := r.Summary
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%.2f\t%s\t%s\t", r.Direction, r.Proto, r.Streams, s.End-s.Start, formatBytes(s.Bytes), formatBits(s.BitsPerSec))
+		if r.Proto == "udp" {
+			fmt.Fprintf(tw, "%.3fms\t%d/%d (%.2f%%)\t%d\n", s.Jitter, s.Lost, s.Packets+s.Lost, s.Loss, s.OutOfOrder)
+		} else {
+			fmt.Fprint(tw, "-\t-\t-\n")
+		}
+	}
+	return tw.Flush()
+}
+
+// formatBytes 按照1024换算字节数
+func formatBytes(n int64) string {
+	units := []string{"Bytes", "KBytes", "MBytes", "GBytes", "TBytes"}
+	v, i := float64(n), 0
+	for ; v >= 1024 && i < len(units)-1; i++ {
+		v /= 1024
+	}
+	return fmt.Sprintf("%.2f %s", v, units[i])
+}
+
+// formatBits 按照1000换算比特率
+func formatBits(bps float64) string {
+	units := []string{"bits/sec", "Kbits/sec", "Mbits/sec", "Gbits/sec", "Tbits/sec"}
+	i := 0
+	for ; bps >= 1000 && i < len(units)-1; i++ {
+		bps /= 1000
+	}
+	return fmt.Sprintf("%.2f %s", bps, units[i])
+}
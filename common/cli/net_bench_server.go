@@ -0,0 +1,259 @@
+package cli
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchServer 吞吐量测试服务,tcp端口接收控制连接和数据连接,同一个udp端口收发udp报文
+type benchServer struct {
+	udp          net.PacketConn
+	maxBandwidth float64
+	lock         sync.Mutex
+	sessions     map[uint64]*benchSession
+}
+
+// benchSession 一个测试会话
+type benchSession struct {
+	streams chan net.Conn // tcp数据连接
+	host    net.IP        // 控制连接的客户端地址,只接受这个地址发送的udp握手报文
+	peer    chan net.Addr // 反向udp测试的时候客户端的地址
+	counter *benchCounter
+}
+
+// benchConn 读取的时候先读取json解码器中缓存的数据
+type benchConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *benchConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// NetBenchServe 启动吞吐量测试服务,监听benchConfig.Listen
+func NetBenchServe(benchConfig *NetBenchConfig) error {
+	maxBandwidth, err := parseBandwidth(benchConfig.MaxBandwidth)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", benchConfig.Listen)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	udp, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer udp.Close()
+
+	s := &benchServer{udp: udp, maxBandwidth: maxBandwidth, sessions: make(map[uint64]*benchSession)}
+	go s.readUDP()
+	fmt.Printf("bench server listen on %s\n", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// readUDP 按照报文中的会话ID分发udp报文
+func (s *benchServer) readUDP() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < benchHeaderSize {
+			continue
+		}
+		id := binary.BigEndian.Uint64(buf)
+		s.lock.Lock()
+		session := s.sessions[id]
+		s.lock.Unlock()
+		if session == nil {
+			continue
+		}
+		if binary.BigEndian.Uint64(buf[8:]) == benchHello {
+			// 伪造源地址的握手报文会让服务端向第三方发送数据
+			if udpAddr, ok := addr.(*net.UDPAddr); !ok || !udpAddr.IP.Equal(session.host) {
+				continue
+			}
+			select {
+			case session.peer <- addr:
+			default:
+			}
+			continue
+		}
+		session.counter.addDatagram(buf[:n], id)
+	}
+}
+
+func (s *benchServer) handle(conn net.Conn) {
+	dec := json.NewDecoder(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	msg := new(benchMessage)
+	if err := dec.Decode(msg); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch msg.Cmd {
+	case "test":
+		s.test(conn, dec, msg)
+		conn.Close()
+	case "stream":
+		s.lock.Lock()
+		session := s.sessions[msg.ID]
+		s.lock.Unlock()
+		if session == nil {
+			conn.Close()
+			return
+		}
+		select {
+		case session.streams <- &benchConn{Conn: conn, r: io.MultiReader(dec.Buffered(), conn)}:
+		default:
+			conn.Close()
+		}
+	default:
+		conn.Close()
+	}
+}
+
+// test 执行一个方向的测试,服务端接收的时候每秒把统计发送给客户端
+func (s *benchServer) test(conn net.Conn, dec *json.Decoder, req *benchMessage) {
+	enc := json.NewEncoder(conn)
+	fail := func(format string, v ...interface{}) {
+		err := fmt.Sprintf(format, v...)
+		enc.Encode(&benchMessage{Cmd: "error", Error: err})
+		fmt.Printf("%s %s error:%s\n", time.Now().Format("2006-01-02 15:04:05"), conn.RemoteAddr(), err)
+	}
+	if err := checkBenchRequest(req); err != nil {
+		fail("%s", err.Error())
+		return
+	}
+	session := &benchSession{streams: make(chan net.Conn, req.Streams), peer: make(chan net.Addr, 1), counter: newBenchCounter(req.UDP)}
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		session.host = tcpAddr.IP
+	}
+	if req.UDP && req.Reverse && s.maxBandwidth > 0 && (req.Bandwidth == 0 || req.Bandwidth > s.maxBandwidth) {
+		req.Bandwidth = s.maxBandwidth
+	}
+	s.lock.Lock()
+	_, exists := s.sessions[req.ID]
+	if !exists {
+		s.sessions[req.ID] = session
+	}
+	s.lock.Unlock()
+	if exists {
+		fail("会话ID重复")
+		return
+	}
+	defer func() {
+		s.lock.Lock()
+		delete(s.sessions, req.ID)
+		s.lock.Unlock()
+		for {
+			select {
+			case c := <-session.streams:
+				c.Close()
+			default:
+				return
+			}
+		}
+	}()
+	if err := enc.Encode(&benchMessage{Cmd: "accept"}); err != nil {
+		return
+	}
+
+	var conns []net.Conn
+	var peer net.Addr
+	timer := time.NewTimer(10 * time.Second)
+	defer timer.Stop()
+	if !req.UDP {
+		for len(conns) < req.Streams {
+			select {
+			case c := <-session.streams:
+				defer c.Close()
+				conns = append(conns, c)
+			case <-timer.C:
+				fail("等待数据连接超时")
+				return
+			}
+		}
+	} else if req.Reverse {
+		select {
+		case peer = <-session.peer:
+		case <-timer.C:
+			fail("等待udp报文超时")
+			return
+		}
+	}
+
+	start := time.Now()
+	until := start.Add(time.Duration(req.Duration) * time.Second)
+	session.counter.begin(start)
+	if err := enc.Encode(&benchMessage{Cmd: "start"}); err != nil {
+		return
+	}
+
+	result := &BenchResult{Direction: benchDirection(req.Reverse), Proto: benchProto(req.UDP), Streams: req.Streams}
+	if req.Reverse {
+		// 服务端发送,客户端统计之后返回结果
+		if req.UDP {
+			write := func(b []byte) error {
+				_, err := s.udp.WriteTo(b, peer)
+				return err
+			}
+			enc.Encode(&benchMessage{Cmd: "sent", Sent: benchSendUDP(write, req.ID, req.Length, req.Bandwidth, until)})
+		} else {
+			benchSendTCP(conns, req.Length, until)
+		}
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		msg, err := readBenchMessage(dec, "result")
+		if err != nil || msg.Result == nil || msg.Result.Summary == nil {
+			fmt.Printf("%s %s %s %s streams=%d 没有收到客户端的结果\n", time.Now().Format("2006-01-02 15:04:05"),
+				conn.RemoteAddr(), result.Proto, result.Direction, result.Streams)
+			return
+		}
+		result.Summary = msg.Result.Summary
+	} else {
+		done, reported := make(chan struct{}), make(chan struct{})
+		go func() {
+			session.counter.report(done, until, func(i *BenchInterval) {
+				result.Intervals = append(result.Intervals, i)
+				enc.Encode(&benchMessage{Cmd: "interval", Interval: i})
+			})
+			close(reported)
+		}()
+		var sent int64 = -1
+		if req.UDP {
+			var sentCh = make(chan int64, 1)
+			go func() {
+				if msg, err := readBenchMessage(dec, "sent"); err == nil {
+					sentCh <- msg.Sent
+				}
+			}()
+			sent = session.counter.waitUDP(sentCh, until)
+		} else {
+			session.counter.receiveTCP(conns, until.Add(30*time.Second))
+		}
+		close(done)
+		<-reported
+		result.Summary = session.counter.summary(sent)
+		enc.Encode(&benchMessage{Cmd: "result", Result: result})
+	}
+	fmt.Printf("%s %s %s %s streams=%d %s\n", time.Now().Format("2006-01-02 15:04:05"), conn.RemoteAddr(),
+		result.Proto, result.Direction, result.Streams, strings.TrimSpace(benchIntervalText(result.Summary, req.UDP)))
+}
@@ -0,0 +1,457 @@
+package cli
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var dnsTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"TXT":   dnsmessage.TypeTXT,
+	"SRV":   dnsmessage.TypeSRV,
+	"PTR":   dnsmessage.TypePTR,
+	"NS":    dnsmessage.TypeNS,
+	"SOA":   dnsmessage.TypeSOA,
+}
+
+var dnsRCodes = map[dnsmessage.RCode]string{
+	dnsmessage.RCodeSuccess:        "NOERROR",
+	dnsmessage.RCodeFormatError:    "FORMERR",
+	dnsmessage.RCodeServerFailure:  "SERVFAIL",
+	dnsmessage.RCodeNameError:      "NXDOMAIN",
+	dnsmessage.RCodeNotImplemented: "NOTIMP",
+	dnsmessage.RCodeRefused:        "REFUSED",
+}
+
+// DNSRecord 一条资源记录
+type DNSRecord struct {
+	Name string `json:"name"`
+	TTL  uint32 `json:"ttl"`
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+// NetDNSResult 一次查询的结果,没有应答的时候Authority中一般为SOA记录
+type NetDNSResult struct {
+	Server    string       `json:"server"`
+	Proto     string       `json:"proto"`
+	Name      string       `json:"name"`
+	Type      string       `json:"type"`
+	RCode     string       `json:"rcode"`
+	Time      float64      `json:"time_ms"`
+	Answers   []*DNSRecord `json:"answers"`
+	Authority []*DNSRecord `json:"authority,omitempty"`
+	Error     string       `json:"error,omitempty"`
+}
+
+// dnsClient 向一个服务器发送查询
+type dnsClient struct {
+	server  string
+	proto   string // udp|tcp|tls
+	network string // 4|6|空
+	tlscfg  *tls.Config
+	timeout time.Duration
+}
+
+// NetDNS 向netConfig.Server中的每个服务器查询list中的名称,多个服务器的时候比较应答是否一致
+func NetDNS(netConfig *NetConfig, list []string, network string) error {
+	clients, err := newDNSClients(netConfig, network)
+	if err != nil {
+		return err
+	}
+	var types []string
+	for _, typ := range strings.Split(strings.ToUpper(netConfig.Type), ",") {
+		if typ = strings.TrimSpace(typ); typ == "" {
+			continue
+		}
+		if _, ok := dnsTypes[typ]; !ok {
+			return fmt.Errorf("不支持的记录类型:%s", typ)
+		}
+		types = append(types, typ)
+	}
+	if len(types) == 0 {
+		types = []string{"A"}
+	}
+	format := strings.ToLower(netConfig.Format)
+	switch format {
+	case "", "table", "json":
+	default:
+		return fmt.Errorf("dns不支持的输出格式:%s", netConfig.Format)
+	}
+
+	// results[名称和类型][服务器]
+	var results = make([][]*NetDNSResult, len(list)*len(types))
+	var wait sync.WaitGroup
+	for i, name := range list {
+		for j, typ := range types {
+			index := i*len(types) + j
+			results[index] = make([]*NetDNSResult, len(clients))
+			for k, client := range clients {
+				if !netConfig.Quick {
+					results[index][k] = client.query(name, typ)
+					continue
+				}
+				wait.Add(1)
+				go func(result []*NetDNSResult, k int, client *dnsClient, name, typ string) {
+					result[k] = client.query(name, typ)
+					wait.Done()
+				}(results[index], k, client, name, typ)
+			}
+		}
+	}
+	wait.Wait()
+
+	var faild int
+	for _, group := range results {
+		for _, result := range group {
+			if result.Error != "" {
+				faild++
+			}
+		}
+	}
+	if format == "json" {
+		buf, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", buf)
+	} else {
+		for _, group := range results {
+			printDNSResults(group)
+		}
+	}
+	if faild > 0 {
+		return fmt.Errorf("%d个查询失败", faild)
+	}
+	return nil
+}
+
+// newDNSClients 为netConfig.Server中的每个服务器创建dnsClient
+func newDNSClients(netConfig *NetConfig, network string) ([]*dnsClient, error) {
+	proto := strings.ToLower(netConfig.Proto)
+	var port = "53"
+	switch proto {
+	case "", "udp":
+		proto = "udp"
+	case "tcp":
+	case "tls":
+		port = "853"
+	default:
+		return nil, fmt.Errorf("dns不支持的协议:%s", netConfig.Proto)
+	}
+	servers := strings.Split(netConfig.Server, ",")
+	if netConfig.Server == "" {
+		servers = systemNameServers()
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("没有找到系统的DNS服务器,请使用--server指定")
+		}
+	}
+	tlscfg, err := ClientTLSConfig(netConfig.CA, netConfig.Insecure)
+	if err != nil {
+		return nil, err
+	}
+	var clients []*dnsClient
+	for _, server := range servers {
+		if server = strings.TrimSpace(server); server == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), port)
+		}
+		clients = append(clients, &dnsClient{server: server, proto: proto, tlscfg: tlscfg,
+			network: strings.TrimPrefix(network, "ip"), timeout: time.Duration(netConfig.TimeOut) * time.Second})
+	}
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("没有指定DNS服务器")
+	}
+	return clients, nil
+}
+
+// systemNameServers 读取/etc/resolv.conf中的nameserver
+func systemNameServers() []string {
+	File, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	defer File.Close()
+	var servers []string
+	scanner := bufio.NewScanner(File)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 1 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+func printDNSResults(group []*NetDNSResult) {
+	for _, r := range group {
+		if r.Error != "" {
+			fmt.Printf(";; %s %s %s %s error:%s\n", r.Server, r.Proto, r.Name, r.Type, r.Error)
+			continue
+		}
+		fmt.Printf(";; %s %s %s %s %s %.2fms\n", r.Server, r.Proto, r.Name, r.Type, r.RCode, r.Time)
+		for _, records := range [][]*DNSRecord{r.Answers, r.Authority} {
+			for _, record := range records {
+				fmt.Printf("%s\t%d\t%s\t%s\n", record.Name, record.TTL, record.Type, record.Data)
+			}
+		}
+	}
+	if len(group) < 2 {
+		fmt.Println()
+		return
+	}
+
+	// 忽略TTL和顺序,比较所有服务器的应答
+	var same = true
+	var first string
+	for i, r := range group {
+		var data []string
+		for _, record := range r.Answers {
+			data = append(data, record.Type+" "+record.Data)
+		}
+		sort.Strings(data)
+		key := r.RCode + "|" + r.Error + "|" + strings.Join(data, ",")
+		if i == 0 {
+			first = key
+		} else if key != first {
+			same = false
+		}
+	}
+	if same {
+		fmt.Printf("[SAME] %s %s 所有服务器的应答一致\n\n", group[0].Name, group[0].Type)
+	} else {
+		fmt.Printf("[DIFF] %s %s 服务器的应答不一致\n\n", group[0].Name, group[0].Type)
+	}
+}
+
+// query 发送查询,UDP应答被截断的时候使用TCP重新查询
+func (c *dnsClient) query(name, typ string) *NetDNSResult {
+	result := &NetDNSResult{Server: c.server, Proto: c.proto, Name: name, Type: typ}
+	qtype := dnsTypes[typ]
+	if qtype == dnsmessage.TypePTR {
+		if ip := net.ParseIP(name); ip != nil {
+			name = reverseName(ip)
+		}
+	}
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	// 并发查询的时候每个查询使用不同的随机ID
+	var idBuf [2]byte
+	if _, err := rand.Read(idBuf[:]); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	id := binary.BigEndian.Uint16(idBuf[:])
+	req, err := buildDNSQuery(id, name, qtype)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	start := time.Now()
+	resp, err := c.exchange(c.proto, req)
+	var parser dnsmessage.Parser
+	var header dnsmessage.Header
+	if err == nil {
+		header, err = parser.Start(resp)
+		if err == nil && header.ID != id {
+			err = errors.New("应答的ID不匹配")
+		}
+		if err == nil && header.Truncated && c.proto == "udp" {
+			result.Proto = "udp+tcp"
+			if resp, err = c.exchange("tcp", req); err == nil {
+				header, err = parser.Start(resp)
+			}
+		}
+	}
+	result.Time = float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.RCode = dnsRCodes[header.RCode]
+	if result.RCode == "" {
+		result.RCode = "RCODE" + strconv.Itoa(int(header.RCode))
+	}
+	if err = parser.SkipAllQuestions(); err == nil {
+		if result.Answers, err = parseDNSRecords(parser.AnswerHeader, parser.Answer, parser.SkipAnswer); err == nil {
+			result.Authority, err = parseDNSRecords(parser.AuthorityHeader, parser.Authority, parser.SkipAuthority)
+		}
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// exchange 发送查询报文并读取应答,TCP和TLS使用2字节的长度前缀
+func (c *dnsClient) exchange(proto string, req []byte) ([]byte, error) {
+	dialer := &net.Dialer{Timeout: c.timeout}
+	var conn net.Conn
+	var err error
+	switch proto {
+	case "tls":
+		tlscfg := c.tlscfg.Clone()
+		tlscfg.ServerName, _, _ = net.SplitHostPort(c.server)
+		conn, err = tls.DialWithDialer(dialer, "tcp"+c.network, c.server, tlscfg)
+	default:
+		conn, err = dialer.Dial(proto+c.network, c.server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	if proto == "udp" {
+		if _, err = conn.Write(req); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			// ID不匹配的报文可能是之前查询的迟到应答或者伪造的应答,丢弃之后继续等待到超时
+			if n >= 2 && buf[0] == req[0] && buf[1] == req[1] {
+				return buf[:n], nil
+			}
+		}
+	}
+	buf := make([]byte, 2+len(req))
+	binary.BigEndian.PutUint16(buf, uint16(len(req)))
+	copy(buf[2:], req)
+	if _, err = conn.Write(buf); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(buf[:2]))
+	_, err = io.ReadFull(conn, resp)
+	return resp, err
+}
+
+func buildDNSQuery(id uint16, name string, qtype dnsmessage.Type) ([]byte, error) {
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err = b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err = b.Question(dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	if err = b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	// EDNS0,允许UDP应答超过512字节
+	var opt dnsmessage.ResourceHeader
+	if err = opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	if err = b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// parseDNSRecords 读取一个区段的所有记录,不支持的类型跳过内容
+func parseDNSRecords(header func() (dnsmessage.ResourceHeader, error), body func() (dnsmessage.Resource, error), skip func() error) ([]*DNSRecord, error) {
+	var records []*DNSRecord
+	for {
+		h, err := header()
+		if err == dnsmessage.ErrSectionDone {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		record := &DNSRecord{Name: h.Name.String(), TTL: h.TTL, Type: "TYPE" + strconv.Itoa(int(h.Type))}
+		for name, typ := range dnsTypes {
+			if typ == h.Type {
+				record.Type = name
+			}
+		}
+		if strings.HasPrefix(record.Type, "TYPE") {
+			record.Data = fmt.Sprintf(`\# %d`, h.Length)
+			if err = skip(); err != nil {
+				return records, err
+			}
+			records = append(records, record)
+			continue
+		}
+		resource, err := body()
+		if err != nil {
+			return records, err
+		}
+		record.Data = dnsRecordData(resource.Body)
+		records = append(records, record)
+	}
+}
+
+func dnsRecordData(body dnsmessage.ResourceBody) string {
+	switch r := body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(r.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(r.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		return r.CNAME.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", r.Pref, r.MX)
+	case *dnsmessage.TXTResource:
+		var txt = make([]string, len(r.TXT))
+		for i, s := range r.TXT {
+			txt[i] = strconv.Quote(s)
+		}
+		return strings.Join(txt, " ")
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", r.Priority, r.Weight, r.Port, r.Target)
+	case *dnsmessage.PTRResource:
+		return r.PTR.String()
+	case *dnsmessage.NSResource:
+		return r.NS.String()
+	case *dnsmessage.SOAResource:
+		return fmt.Sprintf("%s %s %d %d %d %d %d", r.NS, r.MBox, r.Serial, r.Refresh, r.Retry, r.Expire, r.MinTTL)
+	}
+	return ""
+}
+
+// reverseName 返回PTR查询使用的in-addr.arpa或者ip6.arpa名称
+func reverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	var buf strings.Builder
+	for i := len(ip) - 1; i >= 0; i-- {
+		fmt.Fprintf(&buf, "%x.%x.", ip[i]&0x0f, ip[i]>>4)
+	}
+	buf.WriteString("ip6.arpa.")
+	return buf.String()
+}
@@ -0,0 +1,104 @@
+package cli
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestReverseName(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"8.8.4.4", "4.4.8.8.in-addr.arpa."},
+		{"192.168.1.20", "20.1.168.192.in-addr.arpa."},
+		{"::ffff:10.0.0.1", "1.0.0.10.in-addr.arpa."},
+		{"2001:db8::567:89ab", "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+		{"::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa."},
+	}
+	for _, test := range tests {
+		if got := reverseName(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("reverseName(%s) = %s, want %s", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestParseDNSRecords(t *testing.T) {
+	name := dnsName("example.com.")
+	header := func(typ dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: typ, Class: dnsmessage.ClassINET, TTL: 300}
+	}
+	tests := []struct {
+		build func(b *dnsmessage.Builder) error
+		want  *DNSRecord
+	}{
+		{func(b *dnsmessage.Builder) error {
+			return b.AResource(header(dnsmessage.TypeA), dnsmessage.AResource{A: [4]byte{93, 184, 216, 34}})
+		}, &DNSRecord{"example.com.", 300, "A", "93.184.216.34"}},
+		{func(b *dnsmessage.Builder) error {
+			var aaaa [16]byte
+			copy(aaaa[:], net.ParseIP("2001:db8::1"))
+			return b.AAAAResource(header(dnsmessage.TypeAAAA), dnsmessage.AAAAResource{AAAA: aaaa})
+		}, &DNSRecord{"example.com.", 300, "AAAA", "2001:db8::1"}},
+		{func(b *dnsmessage.Builder) error {
+			return b.MXResource(header(dnsmessage.TypeMX), dnsmessage.MXResource{Pref: 10, MX: dnsName("mail.example.com.")})
+		}, &DNSRecord{"example.com.", 300, "MX", "10 mail.example.com."}},
+		{func(b *dnsmessage.Builder) error {
+			return b.TXTResource(header(dnsmessage.TypeTXT), dnsmessage.TXTResource{TXT: []string{"v=spf1 -all", `a "b"`}})
+		}, &DNSRecord{"example.com.", 300, "TXT", `"v=spf1 -all" "a \"b\""`}},
+		{func(b *dnsmessage.Builder) error {
+			return b.SRVResource(header(dnsmessage.TypeSRV), dnsmessage.SRVResource{Priority: 1, Weight: 5, Port: 5060, Target: dnsName("sip.example.com.")})
+		}, &DNSRecord{"example.com.", 300, "SRV", "1 5 5060 sip.example.com."}},
+		{func(b *dnsmessage.Builder) error {
+			return b.SOAResource(header(dnsmessage.TypeSOA), dnsmessage.SOAResource{NS: dnsName("ns.example.com."),
+				MBox: dnsName("admin.example.com."), Serial: 1, Refresh: 2, Retry: 3, Expire: 4, MinTTL: 5})
+		}, &DNSRecord{"example.com.", 300, "SOA", "ns.example.com. admin.example.com. 1 2 3 4 5"}},
+	}
+	for _, test := range tests {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+		b.StartAnswers()
+		if err := test.build(&b); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := b.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := parseAnswers(msg)
+		if err != nil || len(records) != 1 || !reflect.DeepEqual(records[0], test.want) {
+			t.Errorf("parseDNSRecords = %+v, %v, want %+v", records, err, test.want)
+		}
+	}
+
+	// 不支持的类型跳过内容,只输出长度,之后的记录正常解析
+	msg := []byte{0, 0, 0x80, 0, 0, 0, 0, 2, 0, 0, 0, 0,
+		0, 0, 99, 0, 1, 0, 0, 0, 60, 0, 3, 'a', 'b', 'c',
+		0, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1}
+	records, err := parseAnswers(msg)
+	want := []*DNSRecord{{".", 60, "TYPE99", `\# 3`}, {".", 60, "A", "127.0.0.1"}}
+	if err != nil || !reflect.DeepEqual(records, want) {
+		t.Errorf("parseDNSRecords = %+v, %v, want %+v", records, err, want)
+	}
+}
+
+func parseAnswers(msg []byte) ([]*DNSRecord, error) {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(msg); err != nil {
+		return nil, err
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	return parseDNSRecords(parser.AnswerHeader, parser.Answer, parser.SkipAnswer)
+}
+
+func dnsName(name string) dnsmessage.Name {
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
@@ -0,0 +1,356 @@
+package cli
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NetForwardConfig 端口转发的参数
+type NetForwardConfig struct {
+	Rules    []string // 转发规则:[tcp|udp|tls://]listen->target[,target...],多个目标的时候轮询
+	MaxConns int      // 每个规则的最大连接数,udp为最大会话数,0不限制
+	Idle     int      // 两个方向都没有数据的时候关闭连接,单位秒,0不超时,udp会话默认300秒
+	CertFile string   // tls规则使用的证书和私钥,可以使用wstools rsa生成
+	KeyFile  string
+	Log      string // 连接日志文件
+	TimeOut  int    // 连接目标的超时时间,单位秒
+}
+
+// forwardRule 一条转发规则
+type forwardRule struct {
+	proto   string // tcp|udp|tls,tls在监听端终止,到目标使用tcp
+	listen  string
+	targets []string
+	next    uint32 // 轮询的下一个目标
+	conns   int32  // 当前的连接数
+}
+
+type forwarder struct {
+	cfg    *NetForwardConfig
+	tlscfg *tls.Config
+	dialer *net.Dialer
+	idle   time.Duration
+	log    *log.Logger
+}
+
+// NetForward 按照规则转发tcp和udp端口,任意一个监听失败的时候返回
+func NetForward(cfg *NetForwardConfig) error {
+	if len(cfg.Rules) == 0 {
+		return fmt.Errorf("必须指定转发规则")
+	}
+	var rules []*forwardRule
+	var useTLS bool
+	for _, value := range cfg.Rules {
+		rule, err := parseForwardRule(value)
+		if err != nil {
+			return err
+		}
+		useTLS = useTLS || rule.proto == "tls"
+		rules = append(rules, rule)
+	}
+
+	f := &forwarder{cfg: cfg, dialer: &net.Dialer{Timeout: time.Duration(cfg.TimeOut) * time.Second},
+		idle: time.Duration(cfg.Idle) * time.Second}
+	if useTLS {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return fmt.Errorf("tls规则必须指定证书和私钥")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		f.tlscfg = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if cfg.Log != "" {
+		File, err := os.OpenFile(cfg.Log, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer File.Close()
+		f.log = log.New(File, "", 0)
+	}
+
+	// 先打开所有的监听,有失败的时候直接返回
+	var serves []func() error
+	for _, rule := range rules {
+		rule := rule
+		if rule.proto == "udp" {
+			conn, err := net.ListenPacket("udp", rule.listen)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			serves = append(serves, func() error { return f.serveUDP(rule, conn) })
+		} else {
+			ln, err := net.Listen("tcp", rule.listen)
+			if err != nil {
+				return err
+			}
+			if rule.proto == "tls" {
+				ln = tls.NewListener(ln, f.tlscfg)
+			}
+			defer ln.Close()
+			serves = append(serves, func() error { return f.serveTCP(rule, ln) })
+		}
+		log.Printf("Forward %s://%s -> %s\n", rule.proto, rule.listen, strings.Join(rule.targets, ","))
+	}
+	var errs = make(chan error, len(serves))
+	for _, serve := range serves {
+		go func(serve func() error) {
+			errs <- serve()
+		}(serve)
+	}
+	return <-errs
+}
+
+// parseForwardRule 解析转发规则,没有协议前缀的时候为tcp
+func parseForwardRule(value string) (*forwardRule, error) {
+	rule := &forwardRule{proto: "tcp"}
+	if i := strings.Index(value, "://"); i >= 0 {
+		rule.proto, value = strings.ToLower(value[:i]), value[i+3:]
+	}
+	switch rule.proto {
+	case "tcp", "udp", "tls":
+	default:
+		return nil, fmt.Errorf("不支持的协议:%s", rule.proto)
+	}
+	parts := strings.SplitN(value, "->", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("转发规则格式错误:%s", value)
+	}
+	rule.listen = strings.TrimSpace(parts[0])
+	if _, _, err := net.SplitHostPort(rule.listen); err != nil {
+		return nil, fmt.Errorf("监听地址错误:%s", rule.listen)
+	}
+	for _, target := range strings.Split(parts[1], ",") {
+		if target = strings.TrimSpace(target); target == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return nil, fmt.Errorf("目标地址错误:%s", target)
+		}
+		rule.targets = append(rule.targets, target)
+	}
+	if len(rule.targets) == 0 {
+		return nil, fmt.Errorf("转发规则没有目标:%s", value)
+	}
+	return rule, nil
+}
+
+// acquire 增加规则的连接数,超过最大连接数的时候返回false
+func (f *forwarder) acquire(rule *forwardRule) bool {
+	if n := atomic.AddInt32(&rule.conns, 1); f.cfg.MaxConns > 0 && int(n) > f.cfg.MaxConns {
+		atomic.AddInt32(&rule.conns, -1)
+		return false
+	}
+	return true
+}
+
+func (f *forwarder) release(rule *forwardRule) {
+	atomic.AddInt32(&rule.conns, -1)
+}
+
+// dial 从轮询的下一个目标开始依次连接,返回第一个连接成功的目标
+func (f *forwarder) dial(network string, rule *forwardRule) (net.Conn, string, error) {
+	start := int(atomic.AddUint32(&rule.next, 1) - 1)
+	var err error
+	for i := range rule.targets {
+		target := rule.targets[(start+i)%len(rule.targets)]
+		var conn net.Conn
+		if conn, err = f.dialer.Dial(network, target); err == nil {
+			return conn, target, nil
+		}
+		log.Printf("Forward %s://%s connect %s error:%s\n", rule.proto, rule.listen, target, err.Error())
+	}
+	return nil, "", err
+}
+
+// logConn 连接日志格式: 时间 协议 客户端地址 监听地址 目标地址 上行字节数 下行字节数 耗时 结果
+func (f *forwarder) logConn(rule *forwardRule, client net.Addr, target string, up, down int64, cost time.Duration, err error) {
+	status := "OK"
+	if err != nil {
+		status = "FAILED:" + err.Error()
+	}
+	log.Printf("Forward %s %s -> %s -> %s up:%d down:%d time:%.3fs %s\n", rule.proto, client, rule.listen, target, up, down, cost.Seconds(), status)
+	if f.log != nil {
+		f.log.Printf("%s\t%s\t%s\t%s\t%s\t%d\t%d\t%.3f\t%s", time.Now().Format("2006-01-02 15:04:05"),
+			rule.proto, client, rule.listen, target, up, down, cost.Seconds(), status)
+	}
+}
+
+func (f *forwarder) serveTCP(rule *forwardRule, ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		if !f.acquire(rule) {
+			f.logConn(rule, conn.RemoteAddr(), "-", 0, 0, 0, errors.New("超过最大连接数"))
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer f.release(rule)
+			f.handleTCP(rule, conn)
+		}()
+	}
+}
+
+func (f *forwarder) handleTCP(rule *forwardRule, conn net.Conn) {
+	start := time.Now()
+	defer conn.Close()
+	target, addr, err := f.dial("tcp", rule)
+	if err != nil {
+		f.logConn(rule, conn.RemoteAddr(), "-", 0, 0, time.Since(start), err)
+		return
+	}
+	defer target.Close()
+
+	var up, down int64
+	var upErr, downErr error
+	var active = time.Now().UnixNano()
+	var wait sync.WaitGroup
+	wait.Add(1)
+	go func() {
+		up, upErr = f.copy(target, conn, &active)
+		wait.Done()
+	}()
+	down, downErr = f.copy(conn, target, &active)
+	wait.Wait()
+	// 一个方向出错的时候会关闭连接,另一个方向的错误为连接已关闭
+	if upErr == nil || (errors.Is(upErr, net.ErrClosed) && downErr != nil) {
+		upErr = downErr
+	}
+	f.logConn(rule, conn.RemoteAddr(), addr, up, down, time.Since(start), upErr)
+}
+
+// copy 从src复制到dst,src结束的时候关闭dst的写入,出错或者两个方向都空闲超时的时候关闭两个连接
+func (f *forwarder) copy(dst, src net.Conn, active *int64) (int64, error) {
+	buf := make([]byte, 32<<10)
+	var written int64
+	for {
+		if f.idle > 0 {
+			src.SetReadDeadline(time.Now().Add(f.idle))
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			atomic.StoreInt64(active, time.Now().UnixNano())
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				src.Close()
+				return written, werr
+			}
+			written += int64(n)
+		}
+		if err == io.EOF {
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			} else {
+				dst.Close()
+			}
+			return written, nil
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// 另一个方向还有数据的时候继续等待
+				if time.Since(time.Unix(0, atomic.LoadInt64(active))) < f.idle {
+					continue
+				}
+				err = errors.New("空闲超时")
+			}
+			src.Close()
+			dst.Close()
+			return written, err
+		}
+	}
+}
+
+// udpSession 一个客户端地址的udp会话
+type udpSession struct {
+	client net.Addr
+	conn   net.Conn
+	target string
+	start  time.Time
+	up     int64
+	down   int64
+	active int64
+}
+
+// serveUDP 每个客户端地址使用一个连接到目标的套接字,目标的响应通过监听的套接字返回给客户端
+func (f *forwarder) serveUDP(rule *forwardRule, pc net.PacketConn) error {
+	idle := f.idle
+	if idle <= 0 {
+		idle = 300 * time.Second
+	}
+	var lock sync.Mutex
+	var sessions = make(map[string]*udpSession)
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		s := sessions[addr.String()]
+		lock.Unlock()
+		if s == nil {
+			if !f.acquire(rule) {
+				continue
+			}
+			conn, target, err := f.dial("udp", rule)
+			if err != nil {
+				f.release(rule)
+				f.logConn(rule, addr, "-", 0, 0, 0, err)
+				continue
+			}
+			s = &udpSession{client: addr, conn: conn, target: target, start: time.Now()}
+			lock.Lock()
+			sessions[addr.String()] = s
+			lock.Unlock()
+			go func(s *udpSession) {
+				err := f.replyUDP(pc, s, idle)
+				lock.Lock()
+				delete(sessions, s.client.String())
+				lock.Unlock()
+				s.conn.Close()
+				f.release(rule)
+				f.logConn(rule, s.client, s.target, atomic.LoadInt64(&s.up), atomic.LoadInt64(&s.down), time.Since(s.start), err)
+			}(s)
+		}
+		atomic.StoreInt64(&s.active, time.Now().UnixNano())
+		if _, err = s.conn.Write(buf[:n]); err == nil {
+			atomic.AddInt64(&s.up, int64(n))
+		}
+	}
+}
+
+// replyUDP 把目标的响应返回给客户端,会话空闲超时的时候返回nil
+func (f *forwarder) replyUDP(pc net.PacketConn, s *udpSession, idle time.Duration) error {
+	buf := make([]byte, 65536)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(idle))
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if time.Since(time.Unix(0, atomic.LoadInt64(&s.active))) < idle {
+					continue
+				}
+				return nil
+			}
+			return err
+		}
+		atomic.StoreInt64(&s.active, time.Now().UnixNano())
+		if _, err = pc.WriteTo(buf[:n], s.client); err != nil {
+			return err
+		}
+		atomic.AddInt64(&s.down, int64(n))
+	}
+}
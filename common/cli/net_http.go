@@ -0,0 +1,258 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCheckBody 检查正文的时候最多读取的字节数
+const maxCheckBody = 10 << 20
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS1.0",
+	tls.VersionTLS11: "TLS1.1",
+	tls.VersionTLS12: "TLS1.2",
+	tls.VersionTLS13: "TLS1.3",
+}
+
+// NetHTTPResult 一个url的检查结果,时间单位为毫秒
+type NetHTTPResult struct {
+	URL     string   `json:"url"`
+	Status  int      `json:"status"`
+	Size    int64    `json:"size"`
+	DNS     float64  `json:"dns_ms"`
+	Connect float64  `json:"connect_ms"`
+	TLS     float64  `json:"tls_ms"`
+	TTFB    float64  `json:"ttfb_ms"`
+	Total   float64  `json:"total_ms"`
+	Match   *bool    `json:"match,omitempty"`
+	Cert    *TLSInfo `json:"tls,omitempty"`
+	Errors  []string `json:"errors,omitempty"` // 请求错误或者不满足的检查条件
+}
+
+// TLSInfo TLS连接和服务端证书的信息
+type TLSInfo struct {
+	Version  string    `json:"version"`
+	Cipher   string    `json:"cipher"`
+	Subject  string    `json:"subject"`
+	Issuer   string    `json:"issuer"`
+	SANs     []string  `json:"sans"`
+	NotAfter time.Time `json:"not_after"`
+	Days     int       `json:"days"`
+}
+
+// httpChecker 检查条件
+type httpChecker struct {
+	client   *http.Client
+	method   string
+	status   map[int]bool
+	match    *regexp.Regexp
+	maxTime  time.Duration
+	certDays int
+}
+
+// NetHTTP 请求list中的url,检查状态码,正文,耗时和证书有效期,有检查失败的时候返回错误
+func NetHTTP(netConfig *NetConfig, list []string, network string) error {
+	checker, err := newHTTPChecker(netConfig, network)
+	if err != nil {
+		return err
+	}
+	format := strings.ToLower(netConfig.Format)
+	switch format {
+	case "", "table", "json":
+	default:
+		return fmt.Errorf("http不支持的输出格式:%s", netConfig.Format)
+	}
+
+	var results = make([]*NetHTTPResult, len(list))
+	var wait sync.WaitGroup
+	for i, url := range list {
+		if !strings.Contains(url, "://") {
+			url = "http://" + url
+		}
+		if !netConfig.Quick {
+			results[i] = checker.check(url)
+			continue
+		}
+		wait.Add(1)
+		go func(i int, url string) {
+			results[i] = checker.check(url)
+			wait.Done()
+		}(i, url)
+	}
+	wait.Wait()
+
+	var faild int
+	for _, result := range results {
+		if len(result.Errors) > 0 {
+			faild++
+		}
+	}
+	if format == "json" {
+		buf, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", buf)
+	} else {
+		for _, result := range results {
+			printHTTPResult(result)
+		}
+	}
+	if faild > 0 {
+		return fmt.Errorf("%d/%d个url检查失败", faild, len(results))
+	}
+	return nil
+}
+
+func newHTTPChecker(netConfig *NetConfig, network string) (*httpChecker, error) {
+	codes, err := parseIntList(netConfig.Status, 100, 999)
+	if err != nil {
+		return nil, err
+	}
+	checker := &httpChecker{method: strings.ToUpper(netConfig.Method), status: make(map[int]bool),
+		maxTime: time.Duration(netConfig.MaxTime) * time.Millisecond, certDays: netConfig.CertDays}
+	for _, code := range codes {
+		checker.status[code] = true
+	}
+	if netConfig.Match != "" {
+		if checker.match, err = regexp.Compile(netConfig.Match); err != nil {
+			return nil, fmt.Errorf("正文正则表达式错误:%s", err.Error())
+		}
+	}
+	if checker.method == "" {
+		checker.method = "GET"
+	}
+
+	tlscfg, err := ClientTLSConfig(netConfig.CA, netConfig.Insecure)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: time.Duration(netConfig.TimeOut) * time.Second}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp"+strings.TrimPrefix(network, "ip"), addr)
+		},
+		TLSClientConfig:   tlscfg,
+		DisableKeepAlives: true,
+	}
+	checker.client = &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(netConfig.TimeOut) * time.Second,
+		// 不跟随跳转,检查的是url本身的响应
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return checker, nil
+}
+
+// check 请求url并记录各个阶段的耗时
+func (c *httpChecker) check(url string) *NetHTTPResult {
+	result := &NetHTTPResult{URL: url}
+	req, err := http.NewRequest(c.method, url, nil)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+	req.Header.Set("User-Agent", "wstools")
+
+	var start, dnsStart, connectStart, tlsStart time.Time
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:              func(httptrace.DNSDoneInfo) { result.DNS = ms(time.Since(dnsStart)) },
+		ConnectStart:         func(string, string) { connectStart = time.Now() },
+		ConnectDone:          func(string, string, error) { result.Connect = ms(time.Since(connectStart)) },
+		TLSHandshakeStart:    func() { tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { result.TLS = ms(time.Since(tlsStart)) },
+		GotFirstResponseByte: func() { result.TTFB = ms(time.Since(start)) },
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	start = time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		result.Total = ms(time.Since(start))
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+	defer resp.Body.Close()
+
+	var body []byte
+	if c.match != nil {
+		body, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxCheckBody))
+		result.Size = int64(len(body))
+	} else {
+		result.Size, err = io.Copy(ioutil.Discard, resp.Body)
+	}
+	result.Total = ms(time.Since(start))
+	result.Status = resp.StatusCode
+	if err != nil {
+		result.Errors = append(result.Errors, "读取正文失败:"+err.Error())
+	}
+
+	if !c.status[resp.StatusCode] {
+		result.Errors = append(result.Errors, fmt.Sprintf("状态码%d不符合要求", resp.StatusCode))
+	}
+	if c.match != nil {
+		match := c.match.Match(body)
+		result.Match = &match
+		if !match {
+			result.Errors = append(result.Errors, "正文不匹配")
+		}
+	}
+	if c.maxTime > 0 && result.Total > ms(c.maxTime) {
+		result.Errors = append(result.Errors, fmt.Sprintf("总耗时超过%dms", c.maxTime/time.Millisecond))
+	}
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		cert := resp.TLS.PeerCertificates[0]
+		result.Cert = &TLSInfo{
+			Version:  tlsVersions[resp.TLS.Version],
+			Cipher:   tls.CipherSuiteName(resp.TLS.CipherSuite),
+			Subject:  cert.Subject.String(),
+			Issuer:   cert.Issuer.String(),
+			SANs:     cert.DNSNames,
+			NotAfter: cert.NotAfter,
+			Days:     int(time.Until(cert.NotAfter).Hours() / 24),
+		}
+		for _, ip := range cert.IPAddresses {
+			result.Cert.SANs = append(result.Cert.SANs, ip.String())
+		}
+		if time.Now().After(cert.NotAfter) {
+			result.Errors = append(result.Errors, "证书已经过期")
+		} else if result.Cert.Days < c.certDays {
+			result.Errors = append(result.Errors, fmt.Sprintf("证书%d天后过期", result.Cert.Days))
+		}
+	}
+	return result
+}
+
+func printHTTPResult(r *NetHTTPResult) {
+	mark := "[SUCCESS]"
+	if len(r.Errors) > 0 {
+		mark = "[FAILD]"
+	}
+	fmt.Printf("%s %s status=%d size=%d dns=%.2fms connect=%.2fms tls=%.2fms ttfb=%.2fms total=%.2fms\n",
+		mark, r.URL, r.Status, r.Size, r.DNS, r.Connect, r.TLS, r.TTFB, r.Total)
+	if r.Cert != nil {
+		fmt.Printf("\ttls=%s cipher=%s subject=%s issuer=%s\n", r.Cert.Version, r.Cert.Cipher, r.Cert.Subject, r.Cert.Issuer)
+		fmt.Printf("\tsan=%s expire=%s days=%d\n", strings.Join(r.Cert.SANs, ","), r.Cert.NotAfter.Format("2006-01-02 15:04:05"), r.Cert.Days)
+	}
+	for _, err := range r.Errors {
+		fmt.Printf("\terror:%s\n", err)
+	}
+}
@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// PingStats PingCount的统计信息
+type PingStats struct {
+	Addr    string
+	Sent    int // 发送的请求数
+	Recv    int // 收到的响应数,不包括重复的响应
+	Dup     int // 重复的响应数
+	Reorder int // 比后发送的请求晚到达的响应数
+	Errors  int // 发送失败的请求数
+	RTTs    []time.Duration
+	ttl     int
+}
+
+func (s *PingStats) add(rtt time.Duration, ttl int) {
+	s.Recv++
+	s.RTTs = append(s.RTTs, rtt)
+	s.ttl += ttl
+}
+
+// Loss 丢包率,百分比
+func (s *PingStats) Loss() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+	return float64(s.Sent-s.Recv) * 100 / float64(s.Sent)
+}
+
+// Summary 返回最小,平均,最大延迟和标准差
+func (s *PingStats) Summary() (min, avg, max, stddev time.Duration) {
+	if len(s.RTTs) == 0 {
+		return
+	}
+	var sum, squares float64
+	min = s.RTTs[0]
+	for _, rtt := range s.RTTs {
+		if rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+		sum += float64(rtt)
+	}
+	mean := sum / float64(len(s.RTTs))
+	for _, rtt := range s.RTTs {
+		squares += (float64(rtt) - mean) * (float64(rtt) - mean)
+	}
+	return min, time.Duration(mean), max, time.Duration(math.Sqrt(squares / float64(len(s.RTTs))))
+}
+
+// Percentile 返回延迟的百分位数,使用最近排名法
+func (s *PingStats) Percentile(p float64) time.Duration {
+	if len(s.RTTs) == 0 {
+		return 0
+	}
+	rtts := make([]time.Duration, len(s.RTTs))
+	copy(rtts, s.RTTs)
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	index := int(math.Ceil(p/100*float64(len(rtts)))) - 1
+	if index < 0 {
+		index = 0
+	}
+	return rtts[index]
+}
+
+// writePingStats 以表格输出所有主机的统计信息,延迟单位为毫秒
+func writePingStats(w io.Writer, pingers []*NetPing) error {
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 2, 64)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tSENT\tRECV\tLOSS%\tDUP\tREORDER\tMIN\tAVG\tMAX\tSTDDEV\tP50\tP95\tP99\tTTL")
+	for _, p := range pingers {
+		s := p.Stats
+		if s == nil {
+			continue
+		}
+		if s.Recv == 0 {
+			fmt.Fprintf(tw, "%s\t%d\t0\t%.1f\t%d\t%d\t-\t-\t-\t-\t-\t-\t-\t-\n", s.Addr, s.Sent, s.Loss(), s.Dup, s.Reorder)
+			continue
+		}
+		min, avg, max, stddev := s.Summary()
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%.0f\n", s.Addr, s.Sent, s.Recv, s.Loss(), s.Dup, s.Reorder,
+			ms(min), ms(avg), ms(max), ms(stddev), ms(s.Percentile(50)), ms(s.Percentile(95)), ms(s.Percentile(99)), float64(s.ttl)/float64(s.Recv))
+	}
+	return tw.Flush()
+}
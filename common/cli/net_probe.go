@@ -0,0 +1,219 @@
+package cli
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ProbeTarget probe的一个探测目标
+type ProbeTarget struct {
+	Name     string
+	Type     string    // ping|tcp|http|dns
+	Target   string    // ping为主机,tcp为host:port,http为url,dns为查询的名称
+	Interval int       // 探测间隔,单位秒
+	Config   NetConfig // 探测使用的参数,含义和net命令的参数相同,dns使用Config.Type作为记录类型
+}
+
+// probeResult 一次探测的结果
+type probeResult struct {
+	success  bool
+	duration time.Duration
+	loss     float64 // ping的丢包率,0-1
+	status   int     // http的状态码
+	cert     *TLSInfo
+	err      string
+}
+
+// probeMetrics probe导出的监控项,标签为name,type,target
+type probeMetrics struct {
+	success  *prometheus.GaugeVec
+	duration *prometheus.GaugeVec
+	loss     *prometheus.GaugeVec
+	status   *prometheus.GaugeVec
+	certDays *prometheus.GaugeVec
+}
+
+// NetProbe 按照每个目标的间隔持续探测,返回记录探测结果的Gatherer
+func NetProbe(targets []*ProbeTarget) (prometheus.Gatherer, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("没有探测目标")
+	}
+	var probes = make([]func() *probeResult, len(targets))
+	for i, t := range targets {
+		probe, err := newProbe(t)
+		if err != nil {
+			return nil, fmt.Errorf("[%s]%s", t.Name, err.Error())
+		}
+		probes[i] = probe
+	}
+
+	reg := prometheus.NewRegistry()
+	newGauge := func(name, help string) *prometheus.GaugeVec {
+		gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: "probe", Name: name, Help: help},
+			[]string{"name", "type", "target"})
+		reg.MustRegister(gauge)
+		return gauge
+	}
+	m := &probeMetrics{
+		success:  newGauge("success", "探测是否成功,1成功,0失败"),
+		duration: newGauge("duration_seconds", "探测耗时,ping为平均延迟,tcp为连接耗时,http为总耗时,dns为最慢的服务器的查询耗时"),
+		loss:     newGauge("loss_ratio", "ping的丢包率,0-1"),
+		status:   newGauge("http_status_code", "http响应的状态码"),
+		certDays: newGauge("tls_cert_days", "http服务端证书的剩余有效天数"),
+	}
+	for i, t := range targets {
+		go m.run(t, probes[i])
+	}
+	return reg, nil
+}
+
+// run 按照间隔执行探测并更新监控项,探测状态变化的时候输出日志
+func (m *probeMetrics) run(t *ProbeTarget, probe func() *probeResult) {
+	labels := prometheus.Labels{"name": t.Name, "type": t.Type, "target": t.Target}
+	interval := time.Duration(t.Interval) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var failed bool
+	for {
+		r := probe()
+		if r.success {
+			m.success.With(labels).Set(1)
+		} else {
+			m.success.With(labels).Set(0)
+		}
+		m.duration.With(labels).Set(r.duration.Seconds())
+		switch t.Type {
+		case "ping":
+			m.loss.With(labels).Set(r.loss)
+		case "http":
+			m.status.With(labels).Set(float64(r.status))
+			if r.cert != nil {
+				m.certDays.With(labels).Set(float64(r.cert.Days))
+			}
+		}
+
+		if !r.success && !failed {
+			fmt.Printf("%s [FAILD] %s %s %s:%s\n", time.Now().Format("2006-01-02 15:04:05"), t.Name, t.Type, t.Target, r.err)
+		} else if r.success && failed {
+			fmt.Printf("%s [SUCCESS] %s %s %s\n", time.Now().Format("2006-01-02 15:04:05"), t.Name, t.Type, t.Target)
+		}
+		failed = !r.success
+		<-ticker.C
+	}
+}
+
+// newProbe 根据探测类型创建探测函数,参数错误的时候返回错误
+func newProbe(t *ProbeTarget) (func() *probeResult, error) {
+	cfg := &t.Config
+	network, err := netNetwork(cfg)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(cfg.TimeOut) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	switch t.Type {
+	case "ping":
+		count := cfg.Count
+		if count <= 0 {
+			count = 3
+		}
+		data := pingData(cfg.Size)
+		return func() *probeResult {
+			p, err := NetPingNew(t.Target, network, data)
+			if err != nil {
+				return &probeResult{loss: 1, err: err.Error()}
+			}
+			p.Interval = time.Duration(cfg.Interval * float64(time.Second))
+			p.Timeout, p.TTL = cfg.TimeOut, cfg.TTL
+			if err = p.PingCount(count); err != nil {
+				return &probeResult{loss: 1, err: err.Error()}
+			}
+			r := &probeResult{success: p.Stats.Recv > 0, loss: p.Stats.Loss() / 100}
+			if r.success {
+				_, r.duration, _, _ = p.Stats.Summary()
+			} else {
+				r.err = fmt.Sprintf("%d个请求都没有响应", p.Stats.Sent)
+			}
+			return r
+		}, nil
+	case "tcp":
+		host, port, err := net.SplitHostPort(t.Target)
+		if err != nil {
+			return nil, err
+		}
+		portNum, err := strconv.Atoi(port)
+		if err != nil || portNum < 1 || portNum > 65535 {
+			return nil, fmt.Errorf("无效的端口:%s", port)
+		}
+		return func() *probeResult {
+			s := scanPort("tcp"+strings.TrimPrefix(network, "ip"), host, portNum, timeout, false)
+			r := &probeResult{success: s.State == "open", duration: time.Duration(s.Latency * float64(time.Millisecond))}
+			if !r.success {
+				r.err = s.State
+				if s.Error != "" {
+					r.err = s.Error
+				}
+			}
+			return r
+		}, nil
+	case "http":
+		checker, err := newHTTPChecker(cfg, network)
+		if err != nil {
+			return nil, err
+		}
+		url := t.Target
+		if !strings.Contains(url, "://") {
+			url = "http://" + url
+		}
+		return func() *probeResult {
+			h := checker.check(url)
+			return &probeResult{success: len(h.Errors) == 0, duration: time.Duration(h.Total * float64(time.Millisecond)),
+				status: h.Status, cert: h.Cert, err: strings.Join(h.Errors, ";")}
+		}, nil
+	case "dns":
+		clients, err := newDNSClients(cfg, network)
+		if err != nil {
+			return nil, err
+		}
+		typ := strings.ToUpper(strings.TrimSpace(cfg.Type))
+		if typ == "" {
+			typ = "A"
+		}
+		if _, ok := dnsTypes[typ]; !ok {
+			return nil, fmt.Errorf("不支持的记录类型:%s", typ)
+		}
+		// 所有服务器都返回了应答才算成功
+		return func() *probeResult {
+			r := &probeResult{success: true}
+			var errs []string
+			for _, client := range clients {
+				d := client.query(t.Target, typ)
+				if elapsed := time.Duration(d.Time * float64(time.Millisecond)); elapsed > r.duration {
+					r.duration = elapsed
+				}
+				switch {
+				case d.Error != "":
+					errs = append(errs, client.server+" "+d.Error)
+				case d.RCode != "NOERROR":
+					errs = append(errs, client.server+" "+d.RCode)
+				case len(d.Answers) == 0:
+					errs = append(errs, client.server+" 没有应答记录")
+				}
+			}
+			r.success, r.err = len(errs) == 0, strings.Join(errs, ";")
+			return r
+		}, nil
+	}
+	return nil, fmt.Errorf("不支持的探测类型:%s", t.Type)
+}
@@ -0,0 +1,296 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+)
+
+// maxScanHosts 单个网段最多展开的地址数
+const maxScanHosts = 1 << 16
+
+// maxScanJobs 一次扫描最多的主机和端口组合数,结果排序之后输出,需要保存在内存中
+const maxScanJobs = 1 << 20
+
+// NetScanResult 一个端口的扫描结果
+type NetScanResult struct {
+	Host    string  `json:"host"`
+	Port    int     `json:"port"`
+	State   string  `json:"state"` // open|closed|filtered
+	Latency float64 `json:"latency_ms"`
+	Banner  string  `json:"banner,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// NetScan 扫描list中的主机和网段的端口,结果按照netConfig.Format写入netConfig.Output
+func NetScan(netConfig *NetConfig, list []string, network string) error {
+	ports, err := parsePorts(netConfig.Ports)
+	if err != nil {
+		return err
+	}
+	if len(ports) == 0 {
+		return fmt.Errorf("scan需要使用--ports指定端口")
+	}
+	hosts, err := expandScanHosts(list)
+	if err != nil {
+		return err
+	}
+	if len(hosts)*len(ports) > maxScanJobs {
+		return fmt.Errorf("%d个主机%d个端口超过了%d个扫描任务,请减少网段或者端口", len(hosts), len(ports), maxScanJobs)
+	}
+	format := strings.ToLower(netConfig.Format)
+	switch format {
+	case "", "table", "json", "csv":
+	default:
+		return fmt.Errorf("不支持的输出格式:%s", netConfig.Format)
+	}
+
+	var output io.Writer = os.Stdout
+	if netConfig.Output != "" {
+		File, err := os.Create(netConfig.Output)
+		if err != nil {
+			return err
+		}
+		defer File.Close()
+		output = File
+	}
+
+	concurrency := netConfig.Concurrency
+	if concurrency <= 0 {
+		concurrency = 100
+	}
+	timeout := time.Duration(netConfig.TimeOut) * time.Second
+	var tick <-chan time.Time
+	if netConfig.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / netConfig.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	type job struct {
+		host string
+		port int
+	}
+	var jobs = make(chan job)
+	// 只保存需要输出的结果,其他的只计数
+	var results = make([]*NetScanResult, 0)
+	var count = make(map[string]int)
+	var lock sync.Mutex
+	var wait sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for j := range jobs {
+				result := scanPort("tcp"+strings.TrimPrefix(network, "ip"), j.host, j.port, timeout, netConfig.Banner)
+				lock.Lock()
+				count[result.State]++
+				if !netConfig.OpenOnly || result.State == "open" {
+					results = append(results, result)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	start := time.Now()
+	for _, host := range hosts {
+		for _, port := range ports {
+			if tick != nil {
+				<-tick
+			}
+			jobs <- job{host, port}
+		}
+	}
+	close(jobs)
+	wait.Wait()
+
+	sortScanResults(results)
+	if err = writeScanResults(output, format, results); err != nil {
+		return err
+	}
+	if format == "" || format == "table" || netConfig.Output != "" {
+		fmt.Printf("扫描%d个主机%d个端口,open=%d closed=%d filtered=%d,用时%s\n", len(hosts), len(ports),
+			count["open"], count["closed"], count["filtered"], time.Since(start).Truncate(time.Millisecond))
+	}
+	return nil
+}
+
+// scanPort 使用TCP连接检查端口,拒绝连接为closed,超时或者不可达为filtered
+func scanPort(network, host string, port int, timeout time.Duration, banner bool) *NetScanResult {
+	result := &NetScanResult{Host: host, Port: port}
+	start := time.Now()
+	conn, err := net.DialTimeout(network, net.JoinHostPort(host, strconv.Itoa(port)), timeout)
+	result.Latency = float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		result.State = "filtered"
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			result.State = "closed"
+		} else if opErr, ok := err.(*net.OpError); !ok || !opErr.Timeout() {
+			result.Error = err.Error()
+		}
+		return result
+	}
+	defer conn.Close()
+	result.State = "open"
+	if banner {
+		result.Banner = readBanner(conn, timeout)
+	}
+	return result
+}
+
+// readBanner 读取服务端连接之后主动发送的第一行内容,最多等待2秒
+func readBanner(conn net.Conn, timeout time.Duration) string {
+	if timeout <= 0 || timeout > 2*time.Second {
+		timeout = 2 * time.Second
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 512)
+	n, _ := io.ReadAtLeast(conn, buf, 1)
+	line := buf[:n]
+	if index := bytes.IndexAny(line, "\r\n"); index >= 0 {
+		line = line[:index]
+	}
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == utf8.RuneError {
+			return '.'
+		}
+		return r
+	}, string(line))
+}
+
+// parsePorts 解析端口列表,例如:22,80,8000-8100
+func parsePorts(value string) ([]int, error) {
+	return parseIntList(value, 1, 65535)
+}
+
+// parseIntList 解析逗号分割的数字和范围,去掉重复的数字
+func parseIntList(value string, min, max int) ([]int, error) {
+	var list []int
+	var exists = make(map[int]bool)
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		from, to := field, field
+		if index := strings.Index(field, "-"); index > 0 {
+			from, to = field[:index], field[index+1:]
+		}
+		start, err1 := strconv.Atoi(strings.TrimSpace(from))
+		end, err2 := strconv.Atoi(strings.TrimSpace(to))
+		if err1 != nil || err2 != nil || start < min || end > max || start > end {
+			return nil, fmt.Errorf("格式错误:%s,范围%d-%d", field, min, max)
+		}
+		for i := start; i <= end; i++ {
+			if !exists[i] {
+				exists[i] = true
+				list = append(list, i)
+			}
+		}
+	}
+	return list, nil
+}
+
+// expandScanHosts 展开CIDR网段,IPv4网段去掉网络地址和广播地址,主机名保持不变
+func expandScanHosts(list []string) ([]string, error) {
+	var hosts []string
+	for _, host := range list {
+		if host = strings.TrimSpace(host); host == "" {
+			continue
+		}
+		if !strings.Contains(host, "/") {
+			hosts = append(hosts, host)
+			continue
+		}
+		ip, ipnet, err := net.ParseCIDR(host)
+		if err != nil {
+			return nil, err
+		}
+		ones, bits := ipnet.Mask.Size()
+		if bits-ones > 16 {
+			return nil, fmt.Errorf("网段%s超过%d个地址", host, maxScanHosts)
+		}
+		size := 1 << uint(bits-ones)
+		base := ipnet.IP.To16()
+		if ip.To4() != nil {
+			base = ipnet.IP.To4()
+		}
+		for i := 0; i < size; i++ {
+			if ip.To4() != nil && size > 2 && (i == 0 || i == size-1) {
+				continue
+			}
+			hosts = append(hosts, addIP(base, uint32(i)).String())
+		}
+	}
+	return hosts, nil
+}
+
+// addIP 返回ip加上n之后的地址
+func addIP(ip net.IP, n uint32) net.IP {
+	result := make(net.IP, len(ip))
+	copy(result, ip)
+	tail := result[len(result)-4:]
+	binary.BigEndian.PutUint32(tail, binary.BigEndian.Uint32(tail)+n)
+	return result
+}
+
+// sortScanResults 按照主机和端口排序,IP地址按照数值排序
+func sortScanResults(results []*NetScanResult) {
+	key := func(host string) []byte {
+		if ip := net.ParseIP(host); ip != nil {
+			return append([]byte{0}, ip.To16()...)
+		}
+		return append([]byte{1}, host...)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Host != results[j].Host {
+			return bytes.Compare(key(results[i].Host), key(results[j].Host)) < 0
+		}
+		return results[i].Port < results[j].Port
+	})
+}
+
+func writeScanResults(w io.Writer, format string, results []*NetScanResult) error {
+	switch format {
+	case "json":
+		buf, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", buf)
+		return err
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"host", "port", "state", "latency_ms", "banner", "error"})
+		for _, r := range results {
+			cw.Write([]string{r.Host, strconv.Itoa(r.Port), r.State, strconv.FormatFloat(r.Latency, 'f', 2, 64), r.Banner, r.Error})
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "HOST\tPORT\tSTATE\tLATENCY\tBANNER")
+		for _, r := range results {
+			banner := r.Banner
+			if r.Error != "" {
+				banner = r.Error
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%.2fms\t%s\n", r.Host, r.Port, r.State, r.Latency, banner)
+		}
+		return tw.Flush()
+	}
+}
@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseIntList(t *testing.T) {
+	tests := []struct {
+		value    string
+		min, max int
+		want     []int
+		ok       bool
+	}{
+		{"22", 1, 65535, []int{22}, true},
+		{"22,80, 443", 1, 65535, []int{22, 80, 443}, true},
+		{"8000-8003", 1, 65535, []int{8000, 8001, 8002, 8003}, true},
+		// 重复的数字只保留第一次出现的位置
+		{"80,79-81,80", 1, 65535, []int{80, 79, 81}, true},
+		{" 1 - 2 ,,", 1, 65535, []int{1, 2}, true},
+		{"65535", 1, 65535, []int{65535}, true},
+		{"", 1, 65535, nil, true},
+		{"0", 1, 65535, nil, false},
+		{"65530-65536", 1, 65535, nil, false},
+		{"100-90", 1, 65535, nil, false},
+		{"-5", 1, 65535, nil, false},
+		{"http", 1, 65535, nil, false},
+		{"1-2-3", 1, 65535, nil, false},
+		{"200-204,301", 100, 999, []int{200, 201, 202, 203, 204, 301}, true},
+		{"99", 100, 999, nil, false},
+	}
+	for _, test := range tests {
+		got, err := parseIntList(test.value, test.min, test.max)
+		if (err == nil) != test.ok || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseIntList(%q, %d, %d) = %v, %v, want %v, ok=%v", test.value, test.min, test.max, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestExpandScanHosts(t *testing.T) {
+	tests := []struct {
+		list []string
+		want []string
+		ok   bool
+	}{
+		{[]string{"www.baidu.com", " 10.0.0.1 ", ""}, []string{"www.baidu.com", "10.0.0.1"}, true},
+		{[]string{"192.168.1.0/30"}, []string{"192.168.1.1", "192.168.1.2"}, true},
+		{[]string{"192.168.1.77/30"}, []string{"192.168.1.77", "192.168.1.78"}, true},
+		{[]string{"10.0.0.0/31"}, []string{"10.0.0.0", "10.0.0.1"}, true},
+		{[]string{"10.0.0.5/32"}, []string{"10.0.0.5"}, true},
+		{[]string{"fd00::/126"}, []string{"fd00::", "fd00::1", "fd00::2", "fd00::3"}, true},
+		{[]string{"10.0.0.0/8"}, nil, false},
+		{[]string{"10.0.0.0/33"}, nil, false},
+	}
+	for _, test := range tests {
+		got, err := expandScanHosts(test.list)
+		if (err == nil) != test.ok || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("expandScanHosts(%q) = %v, %v, want %v, ok=%v", test.list, got, err, test.want, test.ok)
+		}
+	}
+
+	// 512个地址,去掉网络地址和广播地址
+	got, err := expandScanHosts([]string{"10.0.0.255/23"})
+	if err != nil || len(got) != 510 || got[0] != "10.0.0.1" || got[509] != "10.0.1.254" {
+		t.Errorf("expandScanHosts(10.0.0.255/23) = %d hosts, %v", len(got), err)
+	}
+}
@@ -0,0 +1,368 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// traceReply 一次探测的结果,超时的时候为nil
+type traceReply struct {
+	Addr    net.IP
+	RTT     time.Duration
+	Reached bool // 目标主机响应
+	Unreach bool // 中间路由返回不可达,不需要继续探测
+}
+
+// netTracer 发送指定TTL的探测报文,使用原始ICMP套接字接收超时和不可达报文
+type netTracer struct {
+	*NetPing
+	proto   string // udp|icmp|tcp
+	port    int
+	timeout time.Duration
+	local   int // 当前探测的本地端口
+	dport   int // 当前探测的目标端口
+	maxHops int
+	queries int // trace每跳的探测次数
+}
+
+func newNetTracer(host, network string, netConfig *NetConfig) (*netTracer, error) {
+	p, err := NetPingNew(host, network, []byte("abcdefghijklmnopqrstuvwabcdefghi"))
+	if err != nil {
+		return nil, err
+	}
+	// netConfig在多个主机的探测之间共享,默认值只保存在netTracer中
+	t := &netTracer{NetPing: p, proto: strings.ToLower(netConfig.Proto), timeout: time.Duration(netConfig.TimeOut) * time.Second,
+		maxHops: netConfig.MaxHops, queries: netConfig.Queries}
+	ports, err := parsePorts(netConfig.Ports)
+	if err != nil {
+		return nil, err
+	}
+	switch t.proto {
+	case "", "udp":
+		t.proto, t.port = "udp", 33434
+	case "tcp":
+		if !tcpTraceSupported {
+			return nil, fmt.Errorf("当前系统不支持tcp探测")
+		}
+		t.port = 80
+	case "icmp":
+	default:
+		return nil, fmt.Errorf("不支持的协议:%s", netConfig.Proto)
+	}
+	if len(ports) > 0 {
+		t.port = ports[0]
+	}
+	if t.timeout <= 0 {
+		t.timeout = 3 * time.Second
+	}
+	if t.maxHops <= 0 || t.maxHops > 255 {
+		t.maxHops = 30
+	}
+	if t.queries <= 0 {
+		t.queries = 3
+	}
+	if err = p.listen(true); err != nil {
+		return nil, fmt.Errorf("接收ICMP报文需要root权限:%s", err.Error())
+	}
+	return t, nil
+}
+
+func (t *netTracer) header(netConfig *NetConfig) string {
+	var port string
+	if t.proto != "icmp" {
+		port = ":" + strconv.Itoa(t.port)
+	}
+	return fmt.Sprintf("%s to %s (%s%s), %d hops max, %s\n", netConfig.Action, t.Addr, t.Addr, port, t.maxHops, t.proto)
+}
+
+func (t *netTracer) network() string {
+	if t.ipv6() {
+		return "6"
+	}
+	return "4"
+}
+
+// probe 发送一个TTL为ttl的探测报文
+func (t *netTracer) probe(ttl int) *traceReply {
+	switch t.proto {
+	case "icmp":
+		return t.probeICMP(ttl)
+	case "tcp":
+		return t.probeTCP(ttl)
+	default:
+		return t.probeUDP(ttl)
+	}
+}
+
+func (t *netTracer) probeICMP(ttl int) *traceReply {
+	err := t.setTTL(ttl)
+	start := time.Now()
+	if err == nil {
+		_, err = t.writeEcho()
+	}
+	if err != nil {
+		return nil
+	}
+	return t.wait(start)
+}
+
+// probeUDP 每次探测使用新的套接字,目标端口依次加1
+func (t *netTracer) probeUDP(ttl int) *traceReply {
+	conn, err := net.ListenPacket("udp"+t.network(), ":0")
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	if t.ipv6() {
+		err = ipv6.NewPacketConn(conn).SetHopLimit(ttl)
+	} else {
+		err = ipv4.NewPacketConn(conn).SetTTL(ttl)
+	}
+	if err != nil {
+		return nil
+	}
+	t.seq++
+	t.local, t.dport = conn.LocalAddr().(*net.UDPAddr).Port, t.port+t.seq-1
+	if t.dport > 65535 {
+		t.seq, t.dport = 1, t.port
+	}
+	start := time.Now()
+	if _, err = conn.WriteTo(t.Data, &net.UDPAddr{IP: t.ip, Port: t.dport}); err != nil {
+		return nil
+	}
+	return t.wait(start)
+}
+
+// probeTCP 发起TTL为ttl的连接,连接成功或者被拒绝表示到达目标
+func (t *netTracer) probeTCP(ttl int) *traceReply {
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+	ready := make(chan int, 1)
+	done := make(chan error, 1)
+	dialer := &net.Dialer{Control: tcpTraceControl(ttl, ready)}
+	start := time.Now()
+	// 先设置ICMP读取的超时时间,连接结束的时候再提前结束读取,避免提前结束的设置被覆盖
+	t.conn.SetReadDeadline(start.Add(t.timeout))
+	var rtt time.Duration
+	go func() {
+		conn, err := dialer.DialContext(ctx, "tcp"+t.network(), net.JoinHostPort(t.Addr, strconv.Itoa(t.port)))
+		rtt = time.Since(start)
+		if err == nil {
+			conn.Close()
+		}
+		// 结束正在等待的ICMP读取
+		t.conn.SetReadDeadline(time.Now())
+		done <- err
+	}()
+
+	select {
+	case t.local = <-ready:
+	case <-done:
+		return nil
+	}
+	t.dport = t.port
+	if r := t.read(start); r != nil {
+		cancel()
+		<-done
+		return r
+	}
+	if err := <-done; err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+		return &traceReply{Addr: t.ip, RTT: rtt, Reached: true}
+	}
+	return nil
+}
+
+// wait 等待当前探测对应的ICMP报文,超时返回nil
+func (t *netTracer) wait(start time.Time) *traceReply {
+	t.conn.SetReadDeadline(start.Add(t.timeout))
+	return t.read(start)
+}
+
+// read 读取当前探测对应的ICMP报文,直到读取的超时时间
+func (t *netTracer) read(start time.Time) *traceReply {
+	var replyType icmp.Type = ipv4.ICMPTypeEchoReply
+	if t.ipv6() {
+		replyType = ipv6.ICMPTypeEchoReply
+	}
+	rb := make([]byte, 1500)
+	for {
+		n, _, src, err := t.readFrom(rb)
+		if err != nil {
+			return nil
+		}
+		rm, err := icmp.ParseMessage(replyType.Protocol(), rb[:n])
+		if err != nil {
+			continue
+		}
+		r := &traceReply{Addr: src, RTT: time.Since(start)}
+		switch body := rm.Body.(type) {
+		case *icmp.Echo:
+			if t.proto == "icmp" && rm.Type == replyType && src.Equal(t.ip) && t.match(body.ID, body.Seq) {
+				r.Reached = true
+				return r
+			}
+		case *icmp.TimeExceeded:
+			if t.ours(body.Data) {
+				return r
+			}
+		case *icmp.DstUnreach:
+			if t.ours(body.Data) {
+				// UDP探测到达目标的时候返回端口不可达
+				r.Reached = src.Equal(t.ip)
+				r.Unreach = !r.Reached
+				return r
+			}
+		}
+	}
+}
+
+// ours 检查差错报文是否由当前的探测报文引起
+func (t *netTracer) ours(data []byte) bool {
+	if t.proto == "icmp" {
+		return t.quoted(data)
+	}
+	dst, proto, b, ok := quotedPacket(data, t.ipv6())
+	if !ok || !dst.Equal(t.ip) {
+		return false
+	}
+	if (t.proto == "udp" && proto != 17) || (t.proto == "tcp" && proto != 6) {
+		return false
+	}
+	return int(b[0])<<8|int(b[1]) == t.local && int(b[2])<<8|int(b[3]) == t.dport
+}
+
+// NetTrace 逐跳探测到host的路径,每跳发送netConfig.Queries个探测报文
+func NetTrace(netConfig *NetConfig, host, network string, output io.Writer) error {
+	t, err := newNetTracer(host, network, netConfig)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+
+	fmt.Fprint(output, t.header(netConfig))
+	for ttl := 1; ttl <= t.maxHops; ttl++ {
+		fmt.Fprintf(output, "%2d ", ttl)
+		var last net.IP
+		var stop bool
+		for i := 0; i < t.queries; i++ {
+			r := t.probe(ttl)
+			if r == nil {
+				fmt.Fprint(output, " *")
+				continue
+			}
+			if !r.Addr.Equal(last) {
+				fmt.Fprintf(output, " %s", r.Addr)
+				last = r.Addr
+			}
+			fmt.Fprintf(output, "  %.3fms", float64(r.RTT)/float64(time.Millisecond))
+			if r.Unreach {
+				fmt.Fprint(output, " !U")
+			}
+			stop = stop || r.Reached || r.Unreach
+		}
+		fmt.Fprintln(output)
+		if stop {
+			break
+		}
+	}
+	return nil
+}
+
+// mtrHop 一跳的统计信息
+type mtrHop struct {
+	addrs                  []string
+	sent, recv             int
+	last, best, worst, sum time.Duration
+	jitter                 time.Duration // 相邻两次RTT差值的累计
+}
+
+func (h *mtrHop) add(r *traceReply) {
+	h.sent++
+	if r == nil {
+		return
+	}
+	var exists bool
+	for _, addr := range h.addrs {
+		exists = exists || addr == r.Addr.String()
+	}
+	if !exists {
+		h.addrs = append(h.addrs, r.Addr.String())
+	}
+	if h.recv > 0 {
+		h.jitter += time.Duration(math.Abs(float64(r.RTT - h.last)))
+	}
+	if h.recv == 0 || r.RTT < h.best {
+		h.best = r.RTT
+	}
+	if r.RTT > h.worst {
+		h.worst = r.RTT
+	}
+	h.recv++
+	h.last = r.RTT
+	h.sum += r.RTT
+}
+
+// NetMTR 重复netConfig.Count轮逐跳探测,输出每跳的丢包率和延迟统计
+func NetMTR(netConfig *NetConfig, host, network string, output io.Writer) error {
+	if netConfig.Count <= 0 {
+		return fmt.Errorf("mtr的探测轮数-c必须大于0")
+	}
+	t, err := newNetTracer(host, network, netConfig)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+
+	hops := make([]*mtrHop, t.maxHops)
+	for i := range hops {
+		hops[i] = new(mtrHop)
+	}
+	last := t.maxHops
+	for c := 0; c < netConfig.Count; c++ {
+		if c > 0 {
+			time.Sleep(time.Second)
+		}
+		for ttl := 1; ttl <= last; ttl++ {
+			r := t.probe(ttl)
+			hops[ttl-1].add(r)
+			if r != nil && (r.Reached || r.Unreach) {
+				last = ttl
+				break
+			}
+		}
+	}
+
+	fmt.Fprint(output, t.header(netConfig))
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 2, 64)
+	}
+	tw := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOP\tADDRESS\tLOSS%\tSENT\tRECV\tLAST\tAVG\tBEST\tWORST\tJITTER")
+	for i, h := range hops[:last] {
+		if h.recv == 0 {
+			fmt.Fprintf(tw, "%d\t???\t100.0\t%d\t0\t-\t-\t-\t-\t-\n", i+1, h.sent)
+			continue
+		}
+		var jitter time.Duration
+		if h.recv > 1 {
+			jitter = h.jitter / time.Duration(h.recv-1)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%.1f\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n", i+1, strings.Join(h.addrs, ","),
+			float64(h.sent-h.recv)*100/float64(h.sent), h.sent, h.recv, ms(h.last),
+			ms(h.sum/time.Duration(h.recv)), ms(h.best), ms(h.worst), ms(jitter))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,44 @@
+package cli
+
+import (
+	"syscall"
+)
+
+// tcpTraceSupported 当前系统支持tcp探测
+const tcpTraceSupported = true
+
+// tcpTraceControl 连接之前设置TTL并绑定本地端口,把端口发送到ready,用于匹配ICMP差错报文
+func tcpTraceControl(ttl int, ready chan<- int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			var sa syscall.Sockaddr
+			if network == "tcp6" {
+				err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+				sa = &syscall.SockaddrInet6{}
+			} else {
+				err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+				sa = &syscall.SockaddrInet4{}
+			}
+			if err != nil {
+				return
+			}
+			if err = syscall.Bind(int(fd), sa); err != nil {
+				return
+			}
+			if sa, err = syscall.Getsockname(int(fd)); err != nil {
+				return
+			}
+			switch sa := sa.(type) {
+			case *syscall.SockaddrInet4:
+				ready <- sa.Port
+			case *syscall.SockaddrInet6:
+				ready <- sa.Port
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
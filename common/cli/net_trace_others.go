@@ -0,0 +1,18 @@
+// +build !linux
+
+package cli
+
+import (
+	"errors"
+	"syscall"
+)
+
+// tcpTraceSupported tcp探测需要在连接之前绑定本地端口和设置TTL,只在linux上实现
+const tcpTraceSupported = false
+
+// tcpTraceControl tcp探测只支持linux
+func tcpTraceControl(ttl int, ready chan<- int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("tcp trace只支持linux")
+	}
+}
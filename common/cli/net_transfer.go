@@ -0,0 +1,625 @@
+package cli
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	transferMagic    = "WSNT"
+	transferVersion  = 2
+	transferMaxFrame = 64 << 10
+	transferFinal    = 1 << 31 // 帧长度的最高位表示最后一帧,最后一帧的内容为原始数据的sha256
+
+	transferGzip    = 1 << 0 // 数据使用gzip压缩
+	transferTar     = 1 << 1 // 数据为tar格式的文件和目录
+	transferEncrypt = 1 << 2 // 数据使用预共享密钥加密
+)
+
+// NetTransferConfig listen和send的参数
+type NetTransferConfig struct {
+	Host     string   // send连接的接收方地址
+	TimeOut  int      // send连接接收方的超时时间,单位秒
+	Listen   string   // listen监听的地址
+	Output   string   // listen保存文件的目录或者数据写入的文件,为空的时候分别为当前目录和标准输出
+	Paths    []string // send发送的文件和目录,为空的时候发送标准输入
+	Gzip     bool     // send使用gzip压缩
+	Key      string   // 预共享密钥,不为空的时候每一帧使用AES-256-GCM加密和认证,两端必须相同
+	Progress bool     // 在标准错误输出显示进度
+}
+
+// 传输格式: 头部 magic(4) version(1) flags(1) [salt(16) check(8)]
+// 之后是长度(4)+数据的帧,长度的最高位表示最后一帧,最后一帧的内容是原始数据的sha256;接收方校验之后返回一行结果
+// 数据依次经过tar打包,gzip压缩和分帧;加密的时候每一帧单独使用AES-GCM加密,nonce为帧的序号,
+// 附加数据为帧的长度,接收方只使用认证通过的数据,帧不能被修改,重排或者截断
+
+// NetSend 把cfg.Host作为接收方,发送标准输入或者cfg.Paths中的文件和目录,netConfig指定使用的地址类型
+func NetSend(cfg *NetTransferConfig, netConfig *NetConfig) error {
+	addr := cfg.Host
+	if addr == "" {
+		return fmt.Errorf("必须使用-H指定接收方地址")
+	}
+	network, err := netNetwork(netConfig)
+	if err != nil {
+		return err
+	}
+	var total int64
+	if len(cfg.Paths) > 0 {
+		if total, err = transferSize(cfg.Paths); err != nil {
+			return err
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp"+strings.TrimPrefix(network, "ip"), addr, time.Duration(cfg.TimeOut)*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var flags byte
+	if cfg.Gzip {
+		flags |= transferGzip
+	}
+	if len(cfg.Paths) > 0 {
+		flags |= transferTar
+	}
+	bw := bufio.NewWriterSize(conn, transferMaxFrame+4)
+	fw := &frameWriter{w: bw}
+	var extra []byte
+	if cfg.Key != "" {
+		flags |= transferEncrypt
+		extra = make([]byte, 16)
+		if _, err = io.ReadFull(rand.Reader, extra); err != nil {
+			return err
+		}
+		aead, check, err := transferCipher(cfg.Key, extra)
+		if err != nil {
+			return err
+		}
+		extra = append(extra, check...)
+		fw.aead = aead
+	}
+	bw.Write(append([]byte{transferMagic[0], transferMagic[1], transferMagic[2], transferMagic[3], transferVersion, flags}, extra...))
+
+	// 缓存之后再分帧,避免tar和gzip的小块写入产生很多小帧
+	buffer := bufio.NewWriterSize(fw, transferMaxFrame)
+	var w io.Writer = buffer
+	var gz *gzip.Writer
+	if cfg.Gzip {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	sum := sha256.New()
+	w = io.MultiWriter(w, sum)
+	progress := newTransferProgress("send", total, cfg.Progress)
+	if len(cfg.Paths) == 0 {
+		_, err = io.Copy(w, io.TeeReader(os.Stdin, progress))
+	} else {
+		err = writeTar(w, cfg.Paths, progress)
+	}
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = buffer.Flush()
+	}
+	if err == nil {
+		err = fw.Close(sum.Sum(nil))
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	progress.finish()
+	if err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Minute))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("没有收到接收方的校验结果:%s", err.Error())
+	}
+	if line = strings.TrimSpace(line); line != "OK" {
+		return fmt.Errorf("接收方返回:%s", line)
+	}
+	fmt.Fprintf(os.Stderr, "[SUCCESS] sha256 %x\n", sum.Sum(nil))
+	return nil
+}
+
+// NetListen 监听cfg.Listen,接收一个连接的数据,校验之后退出
+func NetListen(cfg *NetTransferConfig) error {
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "listen on %s\n", ln.Addr())
+	conn, err := ln.Accept()
+	ln.Close()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	fmt.Fprintf(os.Stderr, "connection from %s\n", conn.RemoteAddr())
+
+	digest, err := receiveTransfer(conn, cfg)
+	if err != nil {
+		fmt.Fprintf(conn, "FAILD:%s\n", err.Error())
+		return err
+	}
+	fmt.Fprint(conn, "OK\n")
+	fmt.Fprintf(os.Stderr, "[SUCCESS] sha256 %x\n", digest)
+	return nil
+}
+
+// receiveTransfer 读取头部,解密解压之后写入cfg.Output,返回校验通过的sha256
+func receiveTransfer(conn net.Conn, cfg *NetTransferConfig) ([]byte, error) {
+	r := bufio.NewReaderSize(conn, transferMaxFrame+4)
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != transferMagic {
+		return nil, errors.New("不是wstools net send发送的数据")
+	}
+	if header[4] != transferVersion {
+		return nil, fmt.Errorf("不支持的版本:%d", header[4])
+	}
+	flags := header[5]
+
+	fr := &frameReader{r: r}
+	if flags&transferEncrypt != 0 {
+		extra := make([]byte, 24)
+		if _, err := io.ReadFull(r, extra); err != nil {
+			return nil, err
+		}
+		if cfg.Key == "" {
+			return nil, errors.New("发送方使用了加密,需要使用--key指定密钥")
+		}
+		aead, check, err := transferCipher(cfg.Key, extra[:16])
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(check, extra[16:]) {
+			return nil, errors.New("密钥错误")
+		}
+		fr.aead = aead
+	} else if cfg.Key != "" {
+		return nil, errors.New("发送方没有使用密钥加密")
+	}
+	var src io.Reader = fr
+	if flags&transferGzip != 0 {
+		gz, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, err
+		}
+		src = gz
+	}
+	sum := sha256.New()
+	src = io.TeeReader(src, sum)
+
+	var err error
+	var created string // 写入的单个文件,接收失败的时候删除
+	progress := newTransferProgress("receive", 0, cfg.Progress)
+	data := io.TeeReader(src, progress)
+	if flags&transferTar != 0 {
+		dir := cfg.Output
+		if dir == "" {
+			dir = "."
+		}
+		err = extractTar(data, dir)
+	} else if cfg.Output != "" {
+		var File *os.File
+		if File, err = os.Create(cfg.Output); err == nil {
+			created = cfg.Output
+			_, err = io.Copy(File, data)
+			if cerr := File.Close(); err == nil {
+				err = cerr
+			}
+		}
+	} else {
+		_, err = io.Copy(os.Stdout, data)
+	}
+	// 读取剩余的数据直到最后一帧,tar结尾的填充和gzip的结尾也需要计算校验值
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, src)
+	}
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, fr)
+	}
+	progress.finish()
+	if err == nil && !hmac.Equal(fr.digest, sum.Sum(nil)) {
+		err = errors.New("校验失败,数据不完整或者被修改")
+	}
+	if err != nil {
+		if created != "" {
+			os.Remove(created)
+		}
+		return nil, err
+	}
+	return fr.digest, nil
+}
+
+// transferCipher 使用密钥和salt生成AES-256-GCM的密钥,check用于接收方检查密钥是否一致
+func transferCipher(key string, salt []byte) (cipher.AEAD, []byte, error) {
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write(salt)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	block, err := aes.NewCipher(derive("encrypt"))
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, derive("check")[:8], nil
+}
+
+// transferNonce 帧序号作为GCM的nonce,同一个连接中不会重复
+func transferNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+// frameWriter 把数据分成带长度的帧,aead不为nil的时候加密每一帧
+type frameWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	seq  uint64
+}
+
+func (f *frameWriter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		n := len(b)
+		if n > transferMaxFrame {
+			n = transferMaxFrame
+		}
+		if err := f.writeFrame(b[:n], false); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close 写入最后一帧,内容为原始数据的sha256
+func (f *frameWriter) Close(digest []byte) error {
+	return f.writeFrame(digest, true)
+}
+
+func (f *frameWriter) writeFrame(data []byte, final bool) error {
+	size := uint32(len(data))
+	if f.aead != nil {
+		size += uint32(f.aead.Overhead())
+	}
+	if final {
+		size |= transferFinal
+	}
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], size)
+	if f.aead != nil {
+		data = f.aead.Seal(nil, transferNonce(f.aead, f.seq), data, header[:])
+		f.seq++
+	}
+	if _, err := f.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := f.w.Write(data)
+	return err
+}
+
+// frameReader 读取帧中的数据,aead不为nil的时候只返回认证通过的数据,读到最后一帧的时候返回io.EOF
+type frameReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	seq    uint64
+	buf    []byte
+	data   []byte // 当前帧中还没有读取的数据
+	digest []byte // 最后一帧中的sha256
+}
+
+func (f *frameReader) Read(b []byte) (int, error) {
+	for len(f.data) == 0 {
+		if f.digest != nil {
+			return 0, io.EOF
+		}
+		if err := f.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func (f *frameReader) readFrame() error {
+	var header [4]byte
+	if _, err := io.ReadFull(f.r, header[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	final := size&transferFinal != 0
+	size &^= transferFinal
+	limit := uint32(transferMaxFrame)
+	if f.aead != nil {
+		limit += uint32(f.aead.Overhead())
+	}
+	if size > limit {
+		return errors.New("帧长度错误")
+	}
+	if f.buf == nil {
+		f.buf = make([]byte, limit)
+	}
+	data := f.buf[:size]
+	if _, err := io.ReadFull(f.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if f.aead != nil {
+		var err error
+		if data, err = f.aead.Open(data[:0], transferNonce(f.aead, f.seq), data, header[:]); err != nil {
+			return errors.New("解密失败,数据被修改")
+		}
+		f.seq++
+	}
+	if final {
+		if len(data) != sha256.Size {
+			return errors.New("最后一帧长度错误")
+		}
+		f.digest = append([]byte(nil), data...)
+		return nil
+	}
+	f.data = data
+	return nil
+}
+
+// transferSize 计算paths中普通文件的总大小
+func transferSize(paths []string) (int64, error) {
+	var total int64
+	for _, root := range paths {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				total += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+// writeTar 把paths打包写入w,包中的路径相对于每个参数的上级目录,文件内容的字节数记录到progress
+func writeTar(w io.Writer, paths []string, progress io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, root := range paths {
+		root = filepath.Clean(root)
+		base := filepath.Dir(root)
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			mode := info.Mode()
+			if mode&(os.ModeSocket|os.ModeNamedPipe|os.ModeDevice) != 0 {
+				return nil
+			}
+			name, err := filepath.Rel(base, path)
+			if err != nil {
+				return err
+			}
+			var link string
+			if mode&os.ModeSymlink != 0 {
+				if link, err = os.Readlink(path); err != nil {
+					return err
+				}
+			}
+			hdr, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			hdr.Name = filepath.ToSlash(name)
+			if info.IsDir() {
+				hdr.Name += "/"
+			}
+			if err = tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if !mode.IsRegular() {
+				return nil
+			}
+			File, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer File.Close()
+			_, err = io.Copy(tw, io.TeeReader(File, progress))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// extractTar 解压到dir,拒绝绝对路径和上级目录,符号链接只能指向dir中的路径,不会通过已经存在的符号链接写入
+func extractTar(r io.Reader, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("非法的路径:%s", hdr.Name)
+		}
+		if name == "." {
+			continue
+		}
+		if err = extractParent(dir, name); err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		// 目标是符号链接的时候先删除链接,不写入链接指向的文件
+		if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			if err = os.Remove(target); err != nil {
+				return err
+			}
+		}
+		perm := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.Mkdir(target, perm|0700); err != nil && !os.IsExist(err) {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			File, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(File, tr)
+			if cerr := File.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+			os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+		case tar.TypeSymlink:
+			link := path.Join(path.Dir(name), filepath.ToSlash(hdr.Linkname))
+			if filepath.IsAbs(hdr.Linkname) || link == ".." || strings.HasPrefix(link, "../") {
+				fmt.Fprintf(os.Stderr, "跳过指向目录外的符号链接:%s -> %s\n", hdr.Name, hdr.Linkname)
+				continue
+			}
+			os.Remove(target)
+			if err = os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// extractParent 创建name在dir中的上级目录,上级目录中有符号链接的时候返回错误,
+// 多个链接组合起来可能指向dir之外,例如b/c -> ..和d -> b/c/..
+func extractParent(dir, name string) error {
+	parts := strings.Split(name, "/")
+	current := dir
+	for _, part := range parts[:len(parts)-1] {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			if err = os.Mkdir(current, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("路径中包含符号链接:%s", name)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("路径中包含非目录:%s", name)
+		}
+	}
+	return nil
+}
+
+// transferProgress 每0.5秒在标准错误输出显示传输的字节数和速率
+type transferProgress struct {
+	action string
+	total  int64
+	n      int64
+	start  time.Time
+	done   chan struct{}
+	exited chan struct{}
+}
+
+func newTransferProgress(action string, total int64, show bool) *transferProgress {
+	p := &transferProgress{action: action, total: total, start: time.Now(), done: make(chan struct{}), exited: make(chan struct{})}
+	if show {
+		go p.run()
+	} else {
+		close(p.exited)
+	}
+	return p
+}
+
+func (p *transferProgress) Write(b []byte) (int, error) {
+	atomic.AddInt64(&p.n, int64(len(b)))
+	return len(b), nil
+}
+
+func (p *transferProgress) run() {
+	defer close(p.exited)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.print("\r")
+		case <-p.done:
+			p.print("\n")
+			return
+		}
+	}
+}
+
+func (p *transferProgress) print(end string) {
+	n := atomic.LoadInt64(&p.n)
+	line := fmt.Sprintf("%s %s", p.action, formatBytes(n))
+	if p.total > 0 {
+		line += fmt.Sprintf("/%s %.1f%%", formatBytes(p.total), float64(n)*100/float64(p.total))
+	}
+	if elapsed := time.Since(p.start).Seconds(); elapsed > 0 {
+		line += fmt.Sprintf(" %s/s", formatBytes(int64(float64(n)/elapsed)))
+	}
+	fmt.Fprintf(os.Stderr, "\r%-60s%s", line, end)
+}
+
+// finish 停止显示进度
+func (p *transferProgress) finish() {
+	close(p.done)
+	<-p.exited
+}
@@ -0,0 +1,553 @@
+package cli
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// sftp v3 协议的报文类型
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpFstat    = 8
+	sftpSetstat  = 9
+	sftpFsetstat = 10
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRmdir    = 15
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpReadlink = 19
+	sftpSymlink  = 20
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+)
+
+// sftp 状态码
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpBadMessage       = 5
+	sftpOpUnsupported    = 8
+)
+
+// sftp 文件属性标记
+const (
+	sftpAttrSize        = 0x00000001
+	sftpAttrUIDGID      = 0x00000002
+	sftpAttrPermissions = 0x00000004
+	sftpAttrACModTime   = 0x00000008
+	sftpAttrExtended    = 0x80000000
+)
+
+// sftp 打开文件的标记
+const (
+	sftpFlagRead   = 0x00000001
+	sftpFlagWrite  = 0x00000002
+	sftpFlagAppend = 0x00000004
+	sftpFlagCreate = 0x00000008
+	sftpFlagTrunc  = 0x00000010
+	sftpFlagExcl   = 0x00000020
+)
+
+const sftpMaxPacket = 256 << 10
+
+var errSFTPBadMessage = errors.New("bad sftp message")
+
+// sftpServer sftp服务端状态
+type sftpServer struct {
+	rw      io.ReadWriter
+	home    string // 相对路径的起始目录,和exec,shell的工作目录相同
+	handles map[string]interface{}
+	appends map[string]bool // 使用SSH_FXF_APPEND打开的文件,写入的时候忽略offset追加到结尾
+	next    int
+}
+
+// sftpDir 打开的目录
+type sftpDir struct {
+	path string
+	file *os.File
+}
+
+// SFTPServe 在rw上提供sftp服务,直到连接关闭;相对路径从home开始,home为空的时候使用当前目录
+func SFTPServe(rw io.ReadWriter, home string) error {
+	s := &sftpServer{rw: rw, home: filepath.ToSlash(home), handles: make(map[string]interface{}), appends: make(map[string]bool)}
+	defer func() {
+		for _, h := range s.handles {
+			if c, ok := h.(io.Closer); ok {
+				c.Close()
+			} else if dir, ok := h.(*sftpDir); ok {
+				dir.file.Close()
+			}
+		}
+	}()
+
+	for {
+		typ, data, err := s.readPacket()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if typ == sftpInit {
+			if err = s.writePacket(sftpVersion, uint32(3)); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(data) < 4 {
+			return errSFTPBadMessage
+		}
+		id := binary.BigEndian.Uint32(data)
+		if err = s.handle(typ, id, &sftpBuffer{data: data[4:], home: s.home}); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *sftpServer) readPacket() (byte, []byte, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(s.rw, head[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(head[:4])
+	if length < 1 || length > sftpMaxPacket {
+		return 0, nil, errSFTPBadMessage
+	}
+	data := make([]byte, length-1)
+	_, err := io.ReadFull(s.rw, data)
+	return head[4], data, err
+}
+
+// writePacket 封装报文,fields支持uint32,uint64,string,[]byte,[]os.FileInfo,sftpFileAttrs
+func (s *sftpServer) writePacket(typ byte, fields ...interface{}) error {
+	buf := []byte{0, 0, 0, 0, typ}
+	for _, field := range fields {
+		buf = sftpMarshal(buf, field)
+	}
+	binary.BigEndian.PutUint32(buf, uint32(len(buf)-4))
+	_, err := s.rw.Write(buf)
+	return err
+}
+
+func (s *sftpServer) status(id uint32, err error) error {
+	code, msg := uint32(sftpOK), "Success"
+	switch {
+	case err == nil:
+	case err == io.EOF:
+		code, msg = sftpEOF, "EOF"
+	case err == errSFTPBadMessage:
+		code, msg = sftpBadMessage, err.Error()
+	case os.IsNotExist(err):
+		code, msg = sftpNoSuchFile, err.Error()
+	case os.IsPermission(err):
+		code, msg = sftpPermissionDenied, err.Error()
+	default:
+		code, msg = sftpFailure, err.Error()
+	}
+	return s.writePacket(sftpStatus, id, code, msg, "")
+}
+
+func (s *sftpServer) addHandle(h interface{}) string {
+	s.next++
+	name := strconv.Itoa(s.next)
+	s.handles[name] = h
+	return name
+}
+
+func (s *sftpServer) handle(typ byte, id uint32, buf *sftpBuffer) error {
+	switch typ {
+	case sftpOpen:
+		name, pflags := buf.path(), buf.uint32()
+		attrs := buf.attrs()
+		if buf.err != nil {
+			return s.status(id, buf.err)
+		}
+		var flag int
+		switch {
+		case pflags&sftpFlagRead != 0 && pflags&sftpFlagWrite != 0:
+			flag = os.O_RDWR
+		case pflags&sftpFlagWrite != 0:
+			flag = os.O_WRONLY
+		default:
+			flag = os.O_RDONLY
+		}
+		if pflags&sftpFlagAppend != 0 {
+			flag |= os.O_APPEND
+		}
+		if pflags&sftpFlagCreate != 0 {
+			flag |= os.O_CREATE
+		}
+		if pflags&sftpFlagTrunc != 0 {
+			flag |= os.O_TRUNC
+		}
+		if pflags&sftpFlagExcl != 0 {
+			flag |= os.O_EXCL
+		}
+		mode := os.FileMode(0644)
+		if attrs.flags&sftpAttrPermissions != 0 {
+			mode = os.FileMode(attrs.perm).Perm()
+		}
+		File, err := os.OpenFile(name, flag, mode)
+		if err != nil {
+			return s.status(id, err)
+		}
+		handle := s.addHandle(File)
+		if flag&os.O_APPEND != 0 {
+			s.appends[handle] = true
+		}
+		return s.writePacket(sftpHandle, id, handle)
+	case sftpOpendir:
+		name := buf.path()
+		File, err := os.Open(name)
+		if err != nil {
+			return s.status(id, err)
+		}
+		return s.writePacket(sftpHandle, id, s.addHandle(&sftpDir{path: name, file: File}))
+	case sftpClose:
+		name := buf.string()
+		h, ok := s.handles[name]
+		if !ok {
+			return s.status(id, os.ErrInvalid)
+		}
+		delete(s.handles, name)
+		delete(s.appends, name)
+		var err error
+		switch h := h.(type) {
+		case *os.File:
+			err = h.Close()
+		case *sftpDir:
+			err = h.file.Close()
+		}
+		return s.status(id, err)
+	case sftpRead:
+		File, ok := s.handles[buf.string()].(*os.File)
+		offset, length := buf.uint64(), buf.uint32()
+		if !ok {
+			return s.status(id, os.ErrInvalid)
+		}
+		if length > sftpMaxPacket-1024 {
+			length = sftpMaxPacket - 1024
+		}
+		data := make([]byte, length)
+		n, err := File.ReadAt(data, int64(offset))
+		if n == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return s.status(id, err)
+		}
+		return s.writePacket(sftpData, id, data[:n])
+	case sftpWrite:
+		handle := buf.string()
+		File, ok := s.handles[handle].(*os.File)
+		offset, data := buf.uint64(), buf.bytes()
+		if !ok {
+			return s.status(id, os.ErrInvalid)
+		}
+		var err error
+		if s.appends[handle] {
+			// O_APPEND打开的文件不能使用WriteAt
+			_, err = File.Write(data)
+		} else {
+			_, err = File.WriteAt(data, int64(offset))
+		}
+		return s.status(id, err)
+	case sftpReaddir:
+		dir, ok := s.handles[buf.string()].(*sftpDir)
+		if !ok {
+			return s.status(id, os.ErrInvalid)
+		}
+		infos, err := dir.file.Readdir(128)
+		if len(infos) == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return s.status(id, err)
+		}
+		return s.writePacket(sftpName, id, uint32(len(infos)), infos)
+	case sftpStat, sftpLstat:
+		var info os.FileInfo
+		var err error
+		if typ == sftpStat {
+			info, err = os.Stat(buf.path())
+		} else {
+			info, err = os.Lstat(buf.path())
+		}
+		if err != nil {
+			return s.status(id, err)
+		}
+		return s.writePacket(sftpAttrs, id, sftpFileAttrs{info})
+	case sftpFstat:
+		File, ok := s.handles[buf.string()].(*os.File)
+		if !ok {
+			return s.status(id, os.ErrInvalid)
+		}
+		info, err := File.Stat()
+		if err != nil {
+			return s.status(id, err)
+		}
+		return s.writePacket(sftpAttrs, id, sftpFileAttrs{info})
+	case sftpSetstat, sftpFsetstat:
+		var name string
+		if typ == sftpSetstat {
+			name = buf.path()
+		} else {
+			File, ok := s.handles[buf.string()].(*os.File)
+			if !ok {
+				return s.status(id, os.ErrInvalid)
+			}
+			name = File.Name()
+		}
+		return s.status(id, sftpSetAttrs(name, buf.attrs()))
+	case sftpRemove:
+		return s.status(id, os.Remove(buf.path()))
+	case sftpMkdir:
+		name := buf.path()
+		attrs := buf.attrs()
+		mode := os.FileMode(0755)
+		if attrs.flags&sftpAttrPermissions != 0 {
+			mode = os.FileMode(attrs.perm).Perm()
+		}
+		return s.status(id, os.Mkdir(name, mode))
+	case sftpRmdir:
+		return s.status(id, os.Remove(buf.path()))
+	case sftpRename:
+		oldName, newName := buf.path(), buf.path()
+		if _, err := os.Lstat(newName); err == nil {
+			return s.status(id, os.ErrExist)
+		}
+		return s.status(id, os.Rename(oldName, newName))
+	case sftpRealpath:
+		name := buf.path()
+		abs, err := filepath.Abs(filepath.FromSlash(name))
+		if err != nil {
+			return s.status(id, err)
+		}
+		abs = filepath.ToSlash(abs)
+		return s.writePacket(sftpName, id, uint32(1), abs, abs, uint32(0))
+	case sftpReadlink:
+		name, err := os.Readlink(buf.path())
+		if err != nil {
+			return s.status(id, err)
+		}
+		return s.writePacket(sftpName, id, uint32(1), name, name, uint32(0))
+	case sftpSymlink:
+		// OpenSSH 实现的参数顺序为 targetpath, linkpath
+		// 链接的目标保持原样,可以是相对路径
+		target, link := buf.string(), buf.path()
+		return s.status(id, os.Symlink(target, link))
+	default:
+		return s.writePacket(sftpStatus, id, uint32(sftpOpUnsupported), "Unsupported operation", "")
+	}
+}
+
+// sftpSetAttrs 修改文件属性
+func sftpSetAttrs(name string, attrs sftpAttributes) error {
+	if attrs.flags&sftpAttrSize != 0 {
+		if err := os.Truncate(name, int64(attrs.size)); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&sftpAttrPermissions != 0 {
+		if err := os.Chmod(name, os.FileMode(attrs.perm).Perm()); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&sftpAttrUIDGID != 0 {
+		if err := os.Chown(name, int(attrs.uid), int(attrs.gid)); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&sftpAttrACModTime != 0 {
+		return os.Chtimes(name, time.Unix(int64(attrs.atime), 0), time.Unix(int64(attrs.mtime), 0))
+	}
+	return nil
+}
+
+// sftpFileAttrs 用来序列化文件属性
+type sftpFileAttrs struct {
+	os.FileInfo
+}
+
+// sftpAttributes 解析后的文件属性
+type sftpAttributes struct {
+	flags        uint32
+	size         uint64
+	uid, gid     uint32
+	perm         uint32
+	atime, mtime uint32
+}
+
+func sftpMarshal(buf []byte, field interface{}) []byte {
+	switch v := field.(type) {
+	case uint32:
+		return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	case uint64:
+		buf = sftpMarshal(buf, uint32(v>>32))
+		return sftpMarshal(buf, uint32(v))
+	case string:
+		buf = sftpMarshal(buf, uint32(len(v)))
+		return append(buf, v...)
+	case []byte:
+		buf = sftpMarshal(buf, uint32(len(v)))
+		return append(buf, v...)
+	case []os.FileInfo:
+		for _, info := range v {
+			buf = sftpMarshal(buf, info.Name())
+			buf = sftpMarshal(buf, sftpLongName(info))
+			buf = sftpMarshal(buf, sftpFileAttrs{info})
+		}
+		return buf
+	case sftpFileAttrs:
+		flags := uint32(sftpAttrSize | sftpAttrPermissions | sftpAttrACModTime)
+		mtime := uint32(v.ModTime().Unix())
+		buf = sftpMarshal(buf, flags)
+		buf = sftpMarshal(buf, uint64(v.Size()))
+		buf = sftpMarshal(buf, sftpFileMode(v.Mode()))
+		buf = sftpMarshal(buf, mtime)
+		return sftpMarshal(buf, mtime)
+	}
+	panic(fmt.Sprintf("sftp: unsupported field type %T", field))
+}
+
+// sftpFileMode 转换为posix的文件模式
+func sftpFileMode(mode os.FileMode) uint32 {
+	perm := uint32(mode.Perm())
+	switch {
+	case mode.IsDir():
+		perm |= 0040000
+	case mode&os.ModeSymlink != 0:
+		perm |= 0120000
+	case mode&os.ModeNamedPipe != 0:
+		perm |= 0010000
+	case mode&os.ModeSocket != 0:
+		perm |= 0140000
+	case mode&os.ModeDevice != 0:
+		if mode&os.ModeCharDevice != 0 {
+			perm |= 0020000
+		} else {
+			perm |= 0060000
+		}
+	default:
+		perm |= 0100000
+	}
+	if mode&os.ModeSetuid != 0 {
+		perm |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		perm |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		perm |= 01000
+	}
+	return perm
+}
+
+// sftpLongName 类似ls -l的输出格式
+func sftpLongName(info os.FileInfo) string {
+	mode := []byte(info.Mode().Perm().String())
+	switch {
+	case info.IsDir():
+		mode[0] = 'd'
+	case info.Mode()&os.ModeSymlink != 0:
+		mode[0] = 'l'
+	}
+	layout := "Jan _2 15:04"
+	if time.Since(info.ModTime()) > 180*24*time.Hour {
+		layout = "Jan _2  2006"
+	}
+	return fmt.Sprintf("%s    1 0        0        %8d %s %s", mode, info.Size(), info.ModTime().Format(layout), info.Name())
+}
+
+// sftpBuffer 解析请求报文
+type sftpBuffer struct {
+	data []byte
+	home string
+	err  error
+}
+
+func (b *sftpBuffer) uint32() uint32 {
+	if len(b.data) < 4 {
+		b.err = errSFTPBadMessage
+		return 0
+	}
+	v := binary.BigEndian.Uint32(b.data)
+	b.data = b.data[4:]
+	return v
+}
+
+func (b *sftpBuffer) uint64() uint64 {
+	return uint64(b.uint32())<<32 | uint64(b.uint32())
+}
+
+func (b *sftpBuffer) bytes() []byte {
+	n := b.uint32()
+	if uint32(len(b.data)) < n {
+		b.err = errSFTPBadMessage
+		return nil
+	}
+	v := b.data[:n]
+	b.data = b.data[n:]
+	return v
+}
+
+func (b *sftpBuffer) string() string {
+	return string(b.bytes())
+}
+
+// path 读取路径参数,相对路径转换为home下的路径
+func (b *sftpBuffer) path() string {
+	name := b.string()
+	if b.home != "" && !path.IsAbs(name) {
+		name = path.Join(b.home, name)
+	}
+	return path.Clean(name)
+}
+
+func (b *sftpBuffer) attrs() sftpAttributes {
+	var attrs sftpAttributes
+	attrs.flags = b.uint32()
+	if attrs.flags&sftpAttrSize != 0 {
+		attrs.size = b.uint64()
+	}
+	if attrs.flags&sftpAttrUIDGID != 0 {
+		attrs.uid, attrs.gid = b.uint32(), b.uint32()
+	}
+	if attrs.flags&sftpAttrPermissions != 0 {
+		attrs.perm = b.uint32()
+	}
+	if attrs.flags&sftpAttrACModTime != 0 {
+		attrs.atime, attrs.mtime = b.uint32(), b.uint32()
+	}
+	if attrs.flags&sftpAttrExtended != 0 {
+		count := b.uint32()
+		for i := uint32(0); i < count && b.err == nil; i++ {
+			b.bytes()
+			b.bytes()
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,188 @@
+package cli
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// sftpTestClient 通过管道和SFTPServe交换报文
+type sftpTestClient struct {
+	t  *testing.T
+	r  io.Reader
+	w  io.Writer
+	id uint32
+}
+
+func newSFTPTestClient(t *testing.T, home string) (*sftpTestClient, func()) {
+	clientR, serverW := io.Pipe()
+	serverR, clientW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- SFTPServe(struct {
+			io.Reader
+			io.Writer
+		}{serverR, serverW}, home)
+		serverW.Close()
+	}()
+	c := &sftpTestClient{t: t, r: clientR, w: clientW}
+	if typ, buf := c.send(sftpInit, uint32(3)); typ != sftpVersion || buf.uint32() != 3 {
+		t.Fatalf("init = %d", typ)
+	}
+	return c, func() {
+		clientW.Close()
+		if err := <-done; err != nil {
+			t.Errorf("SFTPServe = %v", err)
+		}
+	}
+}
+
+// send 发送一个请求并读取应答,init之外的请求自动加上id
+func (c *sftpTestClient) send(typ byte, fields ...interface{}) (byte, *sftpBuffer) {
+	c.t.Helper()
+	buf := []byte{0, 0, 0, 0, typ}
+	if typ != sftpInit {
+		c.id++
+		buf = sftpMarshal(buf, c.id)
+	}
+	for _, field := range fields {
+		buf = sftpMarshal(buf, field)
+	}
+	binary.BigEndian.PutUint32(buf, uint32(len(buf)-4))
+	if _, err := c.w.Write(buf); err != nil {
+		c.t.Fatal(err)
+	}
+
+	var head [5]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	data := make([]byte, binary.BigEndian.Uint32(head[:4])-1)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		c.t.Fatal(err)
+	}
+	reply := &sftpBuffer{data: data}
+	if head[4] != sftpVersion && reply.uint32() != c.id {
+		c.t.Fatalf("reply id mismatch")
+	}
+	return head[4], reply
+}
+
+func (c *sftpTestClient) status(typ byte, buf *sftpBuffer) uint32 {
+	c.t.Helper()
+	if typ != sftpStatus {
+		c.t.Fatalf("reply type = %d, want status", typ)
+	}
+	return buf.uint32()
+}
+
+func (c *sftpTestClient) handle(typ byte, buf *sftpBuffer) string {
+	c.t.Helper()
+	if typ != sftpHandle {
+		c.t.Fatalf("reply type = %d, want handle, status %d", typ, buf.uint32())
+	}
+	return buf.string()
+}
+
+func (c *sftpTestClient) realpath(name string) string {
+	c.t.Helper()
+	typ, buf := c.send(sftpRealpath, name)
+	if typ != sftpName || buf.uint32() != 1 {
+		c.t.Fatalf("realpath(%q) reply type = %d", name, typ)
+	}
+	return buf.string()
+}
+
+func TestSFTPServe(t *testing.T) {
+	home, err := ioutil.TempDir("", "sftp_home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	if home, err = filepath.EvalSymlinks(home); err != nil {
+		t.Fatal(err)
+	}
+	slashHome := filepath.ToSlash(home)
+
+	c, closeFn := newSFTPTestClient(t, home)
+	defer closeFn()
+
+	// 相对路径从home开始,和exec,shell的工作目录一致
+	for name, want := range map[string]string{
+		".":              slashHome,
+		"":               slashHome,
+		"sub/../a.txt":   slashHome + "/a.txt",
+		"/tmp/../etc/./": "/etc",
+	} {
+		if got := c.realpath(name); got != want {
+			t.Errorf("realpath(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	// 写入相对路径的文件
+	h := c.handle(c.send(sftpOpen, "a.txt", uint32(sftpFlagWrite|sftpFlagCreate|sftpFlagTrunc), uint32(0)))
+	if code := c.status(c.send(sftpWrite, h, uint64(0), []byte("hello"))); code != sftpOK {
+		t.Fatalf("write status = %d", code)
+	}
+	if code := c.status(c.send(sftpClose, h)); code != sftpOK {
+		t.Fatalf("close status = %d", code)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(home, "a.txt")); err != nil || string(data) != "hello" {
+		t.Fatalf("a.txt = %q, %v", data, err)
+	}
+
+	// 追加模式忽略offset
+	h = c.handle(c.send(sftpOpen, "a.txt", uint32(sftpFlagWrite|sftpFlagAppend), uint32(0)))
+	if code := c.status(c.send(sftpWrite, h, uint64(0), []byte(" world"))); code != sftpOK {
+		t.Fatalf("append status = %d", code)
+	}
+	c.status(c.send(sftpClose, h))
+
+	// 使用绝对路径读取
+	h = c.handle(c.send(sftpOpen, slashHome+"/a.txt", uint32(sftpFlagRead), uint32(0)))
+	typ, buf := c.send(sftpRead, h, uint64(0), uint32(1024))
+	if typ != sftpData {
+		t.Fatalf("read reply type = %d", typ)
+	}
+	if data := string(buf.bytes()); data != "hello world" {
+		t.Fatalf("read = %q", data)
+	}
+	if code := c.status(c.send(sftpRead, h, uint64(11), uint32(1024))); code != sftpEOF {
+		t.Fatalf("read at end status = %d, want EOF", code)
+	}
+	c.status(c.send(sftpClose, h))
+
+	if code := c.status(c.send(sftpMkdir, "sub", uint32(0))); code != sftpOK {
+		t.Fatalf("mkdir status = %d", code)
+	}
+	if code := c.status(c.send(sftpStat, "missing.txt")); code != sftpNoSuchFile {
+		t.Fatalf("stat missing status = %d", code)
+	}
+
+	// 读取目录直到EOF
+	h = c.handle(c.send(sftpOpendir, "."))
+	var names []string
+	for {
+		typ, buf := c.send(sftpReaddir, h)
+		if typ == sftpStatus {
+			if code := buf.uint32(); code != sftpEOF {
+				t.Fatalf("readdir status = %d", code)
+			}
+			break
+		}
+		for n := buf.uint32(); n > 0; n-- {
+			names = append(names, buf.string())
+			buf.string()
+			buf.attrs()
+		}
+	}
+	c.status(c.send(sftpClose, h))
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "a.txt" || names[1] != "sub" {
+		t.Fatalf("readdir = %v", names)
+	}
+}
@@ -0,0 +1,257 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHAudit ssh操作审计,批量命令记录为json行,交互会话记录为asciinema v2格式
+type SSHAudit struct {
+	Dir      string
+	Operator string // 本地执行操作的用户
+	Input    bool   // 记录交互会话的输入,输入中可能包含sudo和su的密码,默认只记录输出
+
+	lock  sync.Mutex
+	batch *os.File
+	enc   *json.Encoder
+}
+
+// SSHAuditRecord 批量命令的审计记录
+type SSHAuditRecord struct {
+	Time     time.Time `json:"time"`
+	Host     string    `json:"host"`
+	User     string    `json:"user"`
+	Operator string    `json:"operator"`
+	Command  string    `json:"command"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// asciicastHeader asciinema v2 文件头
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// NewSSHAudit 创建审计记录,dir不存在的时候自动创建
+func NewSSHAudit(dir string) (*SSHAudit, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	operator := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		operator = u.Username
+	}
+	return &SSHAudit{Dir: dir, Operator: operator}, nil
+}
+
+// Record 记录一条批量执行的命令,首次调用的时候创建记录文件
+func (a *SSHAudit) Record(host, user, command string, err error) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.batch == nil {
+		File, err := os.OpenFile(a.fileName("batch", ".jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		a.batch = File
+		a.enc = json.NewEncoder(File)
+	}
+	record := &SSHAuditRecord{Time: time.Now(), Host: host, User: user,
+		Operator: a.Operator, Command: command, Success: err == nil}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	return a.enc.Encode(record)
+}
+
+// Shell 使用SSHShellCommond执行交互会话,并以asciinema v2格式记录输出,Input为true的时候同时记录输入
+func (a *SSHAudit) Shell(cli *ssh.Client, host, user string, read io.Reader, output io.Writer) error {
+	File, err := os.OpenFile(a.fileName("shell-"+sanitizeName(host), ".cast"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer File.Close()
+
+	// SSHShellCommond 申请的终端大小为320x80
+	rec, err := newAsciicast(File, 320, 80, fmt.Sprintf("%s@%s", user, host))
+	if err != nil {
+		return err
+	}
+	// 审计记录写入失败的时候不打开会话
+	if err = a.Record(host, user, "<interactive shell> "+File.Name(), nil); err != nil {
+		return err
+	}
+	if a.Input {
+		read = &asciicastReader{rec, read}
+	}
+	return SSHShellCommond(cli, read, &asciicastWriter{rec, output})
+}
+
+// Close 关闭审计记录文件
+func (a *SSHAudit) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.batch == nil {
+		return nil
+	}
+	err := a.batch.Close()
+	a.batch = nil
+	return err
+}
+
+func (a *SSHAudit) fileName(prefix, ext string) string {
+	name := fmt.Sprintf("%s-%s-%d%s", prefix, time.Now().Format("20060102-150405"), os.Getpid(), ext)
+	return filepath.Join(a.Dir, name)
+}
+
+func sanitizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ':' || r == '/' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// asciicast asciinema v2 记录
+type asciicast struct {
+	lock  sync.Mutex
+	start time.Time
+	w     io.Writer
+}
+
+func newAsciicast(w io.Writer, width, height int, title string) (*asciicast, error) {
+	start := time.Now()
+	header := asciicastHeader{Version: 2, Width: width, Height: height, Timestamp: start.Unix(),
+		Title: title, Env: map[string]string{"TERM": "xterm", "SHELL": "/bin/sh"}}
+	buf, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fmt.Fprintf(w, "%s\n", buf); err != nil {
+		return nil, err
+	}
+	return &asciicast{start: start, w: w}, nil
+}
+
+// event 写入一条事件,typ为o表示输出,i表示输入
+func (c *asciicast) event(typ string, data []byte) error {
+	buf, err := json.Marshal([]interface{}{time.Since(c.start).Seconds(), typ, string(data)})
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, err = fmt.Fprintf(c.w, "%s\n", buf)
+	return err
+}
+
+type asciicastReader struct {
+	rec *asciicast
+	r   io.Reader
+}
+
+func (r *asciicastReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		// 记录失败的时候不再转发输入,会话随之结束
+		if rerr := r.rec.event("i", p[:n]); rerr != nil {
+			return 0, rerr
+		}
+	}
+	return n, err
+}
+
+type asciicastWriter struct {
+	rec *asciicast
+	w   io.Writer
+}
+
+func (w *asciicastWriter) Write(p []byte) (int, error) {
+	if err := w.rec.event("o", p); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// SSHReplay 回放审计记录,.cast文件按时间回放,speed为回放倍速,maxIdle大于0的时候限制最长等待时间;其他文件按json行输出批量记录
+func SSHReplay(path string, output io.Writer, speed float64, maxIdle time.Duration) error {
+	File, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer File.Close()
+
+	scanner := bufio.NewScanner(File)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	if filepath.Ext(path) != ".cast" {
+		for scanner.Scan() {
+			var record SSHAuditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				return err
+			}
+			status := "SUCCESS"
+			if !record.Success {
+				status = "FAILD"
+			}
+			fmt.Fprintf(output, "%s\t%s\t%s@%s\t%s\t%s\t%s\n", record.Time.Format("2006-01-02 15:04:05"),
+				record.Operator, record.User, record.Host, status, record.Command, record.Error)
+		}
+		return scanner.Err()
+	}
+
+	if !scanner.Scan() {
+		return fmt.Errorf("empty cast file")
+	}
+	var header asciicastHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return err
+	}
+	if header.Version != 2 {
+		return fmt.Errorf("unsupported asciicast version:%d", header.Version)
+	}
+	if speed <= 0 {
+		speed = 1
+	}
+
+	var last float64
+	for scanner.Scan() {
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return err
+		}
+		if len(event) != 3 {
+			continue
+		}
+		ts, _ := event[0].(float64)
+		typ, _ := event[1].(string)
+		data, _ := event[2].(string)
+		if typ != "o" {
+			continue
+		}
+		wait := time.Duration((ts - last) / speed * float64(time.Second))
+		if maxIdle > 0 && wait > maxIdle {
+			wait = maxIdle
+		}
+		time.Sleep(wait)
+		last = ts
+		io.WriteString(output, data)
+	}
+	return scanner.Err()
+}
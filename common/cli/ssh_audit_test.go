@@ -0,0 +1,51 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 审计记录写不进去的时候不能打开会话,cli为nil,执行到SSHShellCommond会panic
+func TestSSHAuditShellFailClosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh_audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	audit, err := NewSSHAudit(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	File, err := os.Create(filepath.Join(dir, "closed.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	File.Close()
+	audit.batch, audit.enc = File, json.NewEncoder(File)
+
+	if err = audit.Shell(nil, "10.0.0.1:22", "root", strings.NewReader(""), ioutil.Discard); err == nil {
+		t.Fatal("Shell() = nil, want record error")
+	}
+}
+
+type failWriter struct{}
+
+func (failWriter) Write(p []byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestAsciicastWriterFailClosed(t *testing.T) {
+	var output bytes.Buffer
+	rec := &asciicast{w: failWriter{}}
+	if n, err := (&asciicastWriter{rec, &output}).Write([]byte("secret")); n != 0 || err == nil || output.Len() != 0 {
+		t.Fatalf("Write() = %d, %v, output %q", n, err, output.String())
+	}
+	if n, err := (&asciicastReader{rec, strings.NewReader("ls\n")}).Read(make([]byte, 8)); n != 0 || err == nil {
+		t.Fatalf("Read() = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,345 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"runtime"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var errPtyUnsupported = errors.New("pty unsupported")
+
+// sshTTY 伪终端
+type sshTTY interface {
+	io.ReadWriteCloser
+	Resize(columns, rows uint32) error
+}
+
+// SSHServerConfig ssh服务配置
+type SSHServerConfig struct {
+	Listen         string
+	HostKey        string // 主机私钥路径,不存在的时候自动生成并保存
+	AuthorizedKeys string // authorized_keys 文件路径
+	User           string // 允许登录的用户名,为空的时候使用当前系统用户
+	Passwd         string
+	Shell          string
+}
+
+// SSHServe 启动ssh服务,支持执行命令,pty交互和sftp
+func SSHServe(cfg *SSHServerConfig) error {
+	config, err := sshServerConfig(cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.Shell == "" {
+		cfg.Shell = defaultShell()
+	}
+
+	lis, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+	defer lis.Close()
+	log.Printf("SSH server listen on %s\n", lis.Addr())
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		go sshServeConn(conn, config, cfg.Shell)
+	}
+}
+
+func sshServerConfig(cfg *SSHServerConfig) (*ssh.ServerConfig, error) {
+	if cfg.Passwd == "" && cfg.AuthorizedKeys == "" {
+		return nil, fmt.Errorf("必须指定密码或者authorized_keys文件")
+	}
+	if cfg.User == "" {
+		// 所有会话都以当前进程的身份运行,不能允许任意用户名登录
+		current, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("获取当前用户失败,需要使用-u指定登录用户:%s", err.Error())
+		}
+		cfg.User = current.Username
+	}
+
+	config := &ssh.ServerConfig{}
+	if cfg.Passwd != "" {
+		config.PasswordCallback = func(meta ssh.ConnMetadata, passwd []byte) (*ssh.Permissions, error) {
+			if meta.User() == cfg.User &&
+				subtle.ConstantTimeCompare(passwd, []byte(cfg.Passwd)) == 1 {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %s", meta.User())
+		}
+	}
+
+	if cfg.AuthorizedKeys != "" {
+		keys, err := loadAuthorizedKeys(cfg.AuthorizedKeys)
+		if err != nil {
+			return nil, err
+		}
+		config.PublicKeyCallback = func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if meta.User() == cfg.User && keys[string(key.Marshal())] {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %s", meta.User())
+		}
+	}
+
+	signer, err := loadHostKey(cfg.HostKey)
+	if err != nil {
+		return nil, err
+	}
+	config.AddHostKey(signer)
+	return config, nil
+}
+
+// loadHostKey 读取主机私钥,文件不存在的时候创建新的私钥并保存
+func loadHostKey(path string) (ssh.Signer, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err == nil {
+		return ssh.ParsePrivateKey(buf)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// 使用ecdsa,新版本的openssh默认不再接受ssh-rsa签名的主机私钥
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	buf = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err = ioutil.WriteFile(path, buf, 0600); err != nil {
+		return nil, err
+	}
+	log.Printf("Generate host key:%s\n", path)
+	return ssh.NewSignerFromKey(key)
+}
+
+func loadAuthorizedKeys(path string) (map[string]bool, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool)
+	for len(bytes.TrimSpace(buf)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(buf)
+		if err != nil {
+			return nil, err
+		}
+		keys[string(key.Marshal())] = true
+		buf = rest
+	}
+	return keys, nil
+}
+
+func sshServeConn(conn net.Conn, config *ssh.ServerConfig, shell string) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		log.Printf("Handshake from %s error:%s\n", conn.RemoteAddr(), err.Error())
+		return
+	}
+	log.Printf("Login from %s user:%s\n", sconn.RemoteAddr(), sconn.User())
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChan.Accept()
+		if err != nil {
+			log.Printf("Accept channel error:%s\n", err.Error())
+			continue
+		}
+		go sshServeSession(channel, requests, shell, sconn.User())
+	}
+	log.Printf("Logout from %s user:%s\n", sconn.RemoteAddr(), sconn.User())
+}
+
+// sshSession 一个session的状态
+type sshSession struct {
+	channel ssh.Channel
+	shell   string
+	env     []string
+	pty     *sshPtyRequest
+	tty     sshTTY
+	once    sync.Once
+}
+
+// sshPtyRequest pty-req 请求内容
+type sshPtyRequest struct {
+	Term          string
+	Columns, Rows uint32
+	Width, Height uint32
+	Modes         string
+}
+
+// sshWindowChange window-change 请求内容
+type sshWindowChange struct {
+	Columns, Rows uint32
+	Width, Height uint32
+}
+
+func sshServeSession(channel ssh.Channel, requests <-chan *ssh.Request, shell, user string) {
+	s := &sshSession{channel: channel, shell: shell, env: append(os.Environ(), "USER="+user)}
+	for req := range requests {
+		var ok bool
+		switch req.Type {
+		case "env":
+			var kv struct{ Name, Value string }
+			if ssh.Unmarshal(req.Payload, &kv) == nil {
+				s.env = append(s.env, kv.Name+"="+kv.Value)
+				ok = true
+			}
+		case "pty-req":
+			var pty sshPtyRequest
+			if ssh.Unmarshal(req.Payload, &pty) == nil {
+				s.pty = &pty
+				s.env = append(s.env, "TERM="+pty.Term)
+				ok = true
+			}
+		case "window-change":
+			var win sshWindowChange
+			if ssh.Unmarshal(req.Payload, &win) == nil && s.tty != nil {
+				s.tty.Resize(win.Columns, win.Rows)
+				ok = true
+			}
+		case "shell":
+			ok = s.start(nil)
+		case "exec":
+			var cmd struct{ Command string }
+			if ssh.Unmarshal(req.Payload, &cmd) == nil {
+				ok = s.start(shellCommand(s.shell, cmd.Command))
+			}
+		case "subsystem":
+			var sub struct{ Name string }
+			if ssh.Unmarshal(req.Payload, &sub) == nil && sub.Name == "sftp" {
+				ok = true
+				go func() {
+					home, _ := os.UserHomeDir()
+					err := SFTPServe(channel, home)
+					s.exit(exitCode(err))
+				}()
+			}
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+	if s.tty != nil {
+		s.tty.Close()
+	}
+}
+
+// start 执行命令,args为nil的时候启动交互shell
+func (s *sshSession) start(args []string) bool {
+	if args == nil {
+		args = []string{s.shell}
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = s.env
+	if home, err := os.UserHomeDir(); err == nil {
+		cmd.Dir = home
+	}
+
+	if s.pty != nil {
+		tty, err := startPty(cmd, s.pty.Columns, s.pty.Rows)
+		if err == nil {
+			s.tty = tty
+			go io.Copy(tty, s.channel)
+			go func() {
+				io.Copy(s.channel, tty)
+				s.exit(exitCode(cmd.Wait()))
+			}()
+			return true
+		}
+		if err != errPtyUnsupported {
+			log.Printf("Start pty error:%s\n", err.Error())
+			return false
+		}
+		// 不支持pty的系统使用管道执行
+	}
+
+	cmd.Stdout = s.channel
+	cmd.Stderr = s.channel.Stderr()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return false
+	}
+	if err = cmd.Start(); err != nil {
+		log.Printf("Start command error:%s\n", err.Error())
+		return false
+	}
+	go func() {
+		io.Copy(stdin, s.channel)
+		stdin.Close()
+	}()
+	go func() {
+		s.exit(exitCode(cmd.Wait()))
+	}()
+	return true
+}
+
+// exit 发送退出状态并关闭channel
+func (s *sshSession) exit(code uint32) {
+	s.once.Do(func() {
+		var status = make([]byte, 4)
+		binary.BigEndian.PutUint32(status, code)
+		s.channel.SendRequest("exit-status", false, status)
+		s.channel.Close()
+	})
+}
+
+func exitCode(err error) uint32 {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if code := exitErr.ExitCode(); code > 0 {
+			return uint32(code)
+		}
+	}
+	return 1
+}
+
+func defaultShell() string {
+	if runtime.GOOS == "windows" {
+		return "cmd.exe"
+	}
+	if shell := os.Getenv("SHELL"); shell != "" {
+		return shell
+	}
+	return "/bin/sh"
+}
+
+func shellCommand(shell, command string) []string {
+	if runtime.GOOS == "windows" {
+		return []string{shell, "/C", command}
+	}
+	return []string{shell, "-c", command}
+}
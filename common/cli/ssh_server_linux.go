@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// ptyFile linux 伪终端主设备
+type ptyFile struct {
+	*os.File
+}
+
+// Resize 修改终端大小
+func (p *ptyFile) Resize(columns, rows uint32) error {
+	ws := struct{ Row, Col, X, Y uint16 }{uint16(rows), uint16(columns), 0, 0}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, p.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// startPty 在新的伪终端中启动命令
+func startPty(cmd *exec.Cmd, columns, rows uint32) (sshTTY, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var unlock int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		master.Close()
+		return nil, errno
+	}
+	var index uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&index))); errno != 0 {
+		master.Close()
+		return nil, errno
+	}
+
+	slave, err := os.OpenFile("/dev/pts/"+strconv.Itoa(int(index)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	defer slave.Close()
+
+	tty := &ptyFile{master}
+	if columns > 0 && rows > 0 {
+		tty.Resize(columns, rows)
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	if err = cmd.Start(); err != nil {
+		master.Close()
+		return nil, err
+	}
+	return tty, nil
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package cli
+
+import (
+	"os/exec"
+)
+
+// startPty 当前系统不支持pty,使用管道方式执行
+func startPty(cmd *exec.Cmd, columns, rows uint32) (sshTTY, error) {
+	return nil, errPtyUnsupported
+}
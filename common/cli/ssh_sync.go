@@ -0,0 +1,466 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/czxichen/command"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHSyncOption 目录同步选项
+type SSHSyncOption struct {
+	Delete bool // 删除远程多余的文件
+	DryRun bool // 只输出要变更的内容,不做实际操作
+}
+
+// SSHSyncResult 单个主机的同步结果
+type SSHSyncResult struct {
+	Host    string
+	Add     []string
+	Modify  []string
+	Chmod   []string
+	Delete  []string
+	Ignored []string // 本地的符号链接和特殊文件,不同步,远程同名的文件保持不变
+	Skipped int
+}
+
+// syncEntry 文件信息
+type syncEntry struct {
+	dir  bool
+	link bool        // 符号链接,本地的特殊文件也标记为link,不比较内容
+	mode os.FileMode // unix的权限位,包括setuid,setgid和sticky,和chmod的参数相同
+	md5  string
+}
+
+// SSHBatchSyncDir 批量同步目录
+func SSHBatchSyncDir(conns []*SSHConnection, timeout int, srcPath, dstPath string, opt *SSHSyncOption, output io.Writer) {
+	local, err := localSyncList(srcPath)
+	if err != nil {
+		fmt.Fprintf(output, "[ERROR] 读取本地目录失败:%s\n", err.Error())
+		return
+	}
+
+	clients := InitClients(conns, timeout, output)
+	if len(clients) == 0 {
+		return
+	}
+
+	type syncRet struct {
+		result *SSHSyncResult
+		err    error
+	}
+	var resultChan = make(chan syncRet, 1)
+	for host, cli := range clients {
+		go func(host string, client *CMDClient) {
+			ret, err := sshSyncDir(client.Client, local, srcPath, dstPath, opt)
+			if ret == nil {
+				ret = &SSHSyncResult{}
+			}
+			ret.Host = host
+			client.Client.Close()
+			resultChan <- syncRet{ret, err}
+		}(host, cli)
+	}
+
+	for i := 0; i < len(clients); i++ {
+		ret := <-resultChan
+		if opt.DryRun || ret.err == nil {
+			printSyncResult(output, ret.result, opt.DryRun)
+		}
+		if ret.err == nil {
+			fmt.Fprintf(output, "[INFO] 同步成功:%s\n", ret.result.Host)
+		} else {
+			fmt.Fprintf(output, "[ERROR] 同步失败:%s %v\n", ret.result.Host, ret.err)
+		}
+	}
+	close(resultChan)
+}
+
+// SSHSyncDir 把本地目录同步到远程目录,通过比较文件列表和md5只传输有差异的文件
+func SSHSyncDir(cli *ssh.Client, srcPath, dstPath string, opt *SSHSyncOption) (*SSHSyncResult, error) {
+	local, err := localSyncList(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	return sshSyncDir(cli, local, srcPath, dstPath, opt)
+}
+
+func sshSyncDir(cli *ssh.Client, local map[string]*syncEntry, srcPath, dstPath string, opt *SSHSyncOption) (*SSHSyncResult, error) {
+	if opt == nil {
+		opt = &SSHSyncOption{}
+	}
+
+	remote, err := remoteSyncList(cli, dstPath)
+	if err != nil {
+		return nil, err
+	}
+
+	result, mkdirs := syncDiff(local, remote, opt.Delete)
+	if opt.DryRun {
+		return result, nil
+	}
+
+	var cmd = bytes.NewBuffer(nil)
+	for _, name := range result.Delete {
+		fmt.Fprintf(cmd, "rm -rf %s\n", shellQuote(path.Join(dstPath, name)))
+	}
+	fmt.Fprintf(cmd, "mkdir -p %s\n", shellQuote(dstPath))
+	for _, name := range mkdirs {
+		fmt.Fprintf(cmd, "mkdir -p %s && chmod %o %s\n", shellQuote(path.Join(dstPath, name)),
+			local[name].mode, shellQuote(path.Join(dstPath, name)))
+	}
+	if _, err = sshRunScript(cli, cmd.String()); err != nil {
+		return result, err
+	}
+
+	cmd.Reset()
+	for _, list := range [][]string{result.Add, result.Modify} {
+		for _, name := range list {
+			dst := path.Join(dstPath, name)
+			if err = sshSendFileMode(cli, filepath.Join(srcPath, filepath.FromSlash(name)), dst, local[name].mode); err != nil {
+				return result, fmt.Errorf("发送文件%s失败:%s", name, err.Error())
+			}
+			// scp覆盖已存在的文件时不会修改权限
+			fmt.Fprintf(cmd, "chmod %o %s\n", local[name].mode, shellQuote(dst))
+		}
+	}
+	for _, name := range result.Chmod {
+		fmt.Fprintf(cmd, "chmod %o %s\n", local[name].mode, shellQuote(path.Join(dstPath, name)))
+	}
+	if cmd.Len() > 0 {
+		_, err = sshRunScript(cli, cmd.String())
+	}
+	return result, err
+}
+
+// syncDiff 比较本地和远程的文件列表,返回同步结果和需要创建的目录,del为true的时候删除远程多余的文件
+func syncDiff(local, remote map[string]*syncEntry, del bool) (*SSHSyncResult, []string) {
+	var result = new(SSHSyncResult)
+	var mkdirs []string
+	for _, name := range sortedKeys(local) {
+		lentry := local[name]
+		rentry, ok := remote[name]
+		switch {
+		case lentry.link:
+			result.Ignored = append(result.Ignored, name)
+		case !ok:
+			if lentry.dir {
+				mkdirs = append(mkdirs, name)
+			} else {
+				result.Add = append(result.Add, name)
+			}
+		case rentry.link || lentry.dir != rentry.dir:
+			// 类型不同或者远程是符号链接的时候先删除远程的再重新创建,不能通过链接写到目录外
+			result.Delete = append(result.Delete, name)
+			if lentry.dir {
+				mkdirs = append(mkdirs, name)
+			} else {
+				result.Add = append(result.Add, name)
+			}
+		case !lentry.dir && lentry.md5 != rentry.md5:
+			result.Modify = append(result.Modify, name)
+		case lentry.mode != rentry.mode:
+			result.Chmod = append(result.Chmod, name)
+		default:
+			result.Skipped++
+		}
+	}
+
+	if del {
+		for _, name := range sortedKeys(remote) {
+			if _, ok := local[name]; ok {
+				continue
+			}
+			// 父目录已经删除的不需要重复删除,本地忽略的目录链接下的文件保持不变
+			if parentDeleted(result.Delete, name) || parentDeleted(result.Ignored, name) {
+				continue
+			}
+			result.Delete = append(result.Delete, name)
+		}
+	}
+	return result, mkdirs
+}
+
+// localSyncList 获取本地目录的文件列表,key为使用'/'分割的相对路径
+func localSyncList(root string) (map[string]*syncEntry, error) {
+	root = filepath.Clean(root)
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s 不是目录", root)
+	}
+
+	var list = make(map[string]*syncEntry)
+	err = filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			list[rel] = &syncEntry{dir: true, mode: unixMode(info.Mode())}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			list[rel] = &syncEntry{link: true}
+			return nil
+		}
+		File, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		list[rel] = &syncEntry{mode: unixMode(info.Mode()), md5: command.ReadMd5(File)}
+		File.Close()
+		return nil
+	})
+	return list, err
+}
+
+// unixMode 把FileMode转换为unix的权限位,和远程find -printf %m或者stat的结果比较
+func unixMode(mode os.FileMode) os.FileMode {
+	m := mode.Perm()
+	if mode&os.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= 01000
+	}
+	return m
+}
+
+// remoteSyncListScript 输出远程目录的文件列表,每条记录为"类型\t权限\t路径"并以NUL结尾,空记录之后是md5的输出.
+// 优先使用GNU find -printf,不支持的时候使用stat -c(GNU,busybox)或者stat -f(BSD)
+const remoteSyncListScript = `if find . -maxdepth 0 -printf '' >/dev/null 2>&1; then
+	find . -mindepth 1 \( -type d -o -type f -o -type l \) -printf '%y\t%m\t%P\0'
+elif stat -c %a . >/dev/null 2>&1 || stat -f %Lp . >/dev/null 2>&1; then
+	find . ! -name . \( -type d -o -type f -o -type l \) -exec sh -c 'for f do
+		if [ -L "$f" ]; then t=l; elif [ -d "$f" ]; then t=d; else t=f; fi
+		m=$(stat -c %a "$f" 2>/dev/null || stat -f %Lp "$f")
+		printf "%s\t%s\t%s\0" "$t" "$m" "${f#./}"
+	done' sh {} +
+else
+	echo "远程主机的find不支持-printf,也没有可用的stat命令" >&2
+	exit 1
+fi
+printf '\0'
+if command -v md5sum >/dev/null 2>&1; then
+	find . -type f -exec md5sum {} +
+elif command -v md5 >/dev/null 2>&1; then
+	find . -type f -exec md5 -r {} +
+else
+	echo "远程主机没有md5sum或者md5命令" >&2
+	exit 1
+fi`
+
+// remoteSyncList 获取远程目录的文件列表,目录不存在的时候返回空列表
+func remoteSyncList(cli *ssh.Client, root string) (map[string]*syncEntry, error) {
+	quoted := shellQuote(root)
+	out, err := sshRunScript(cli, "[ -d "+quoted+" ] || exit 0\ncd "+quoted+"\n"+remoteSyncListScript)
+	if err != nil {
+		return nil, fmt.Errorf("获取远程文件列表失败:%s", err.Error())
+	}
+	if len(out) == 0 {
+		return make(map[string]*syncEntry), nil
+	}
+	return parseRemoteSyncList(out)
+}
+
+// parseRemoteSyncList 解析remoteSyncListScript的输出
+func parseRemoteSyncList(out []byte) (map[string]*syncEntry, error) {
+	var list = make(map[string]*syncEntry)
+	for {
+		idx := bytes.IndexByte(out, 0)
+		if idx < 0 {
+			return nil, fmt.Errorf("远程文件列表格式错误")
+		}
+		record := string(out[:idx])
+		out = out[idx+1:]
+		if record == "" {
+			break
+		}
+		fields := strings.SplitN(record, "\t", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("远程文件列表格式错误:%q", record)
+		}
+		mode, err := strconv.ParseUint(fields[1], 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("远程文件列表格式错误:%q", record)
+		}
+		list[fields[2]] = &syncEntry{dir: fields[0] == "d", link: fields[0] == "l", mode: os.FileMode(mode) & 07777}
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		name, sum, ok := parseMD5Line(line)
+		if !ok {
+			continue
+		}
+		if entry, ok := list[name]; ok && !entry.dir && !entry.link {
+			entry.md5 = sum
+		}
+	}
+	return list, nil
+}
+
+// parseMD5Line 解析md5sum或者md5 -r的一行输出,路径以./开头,返回去掉./的路径.
+// md5sum对包含'\'或者换行的文件名转义,并且在行首加上'\'
+func parseMD5Line(line string) (string, string, bool) {
+	escaped := strings.HasPrefix(line, `\`)
+	if escaped {
+		line = line[1:]
+	}
+	if len(line) < 32+3 {
+		return "", "", false
+	}
+	sum, rest := strings.ToLower(line[:32]), line[32:]
+	if _, err := hex.DecodeString(sum); err != nil || rest[0] != ' ' {
+		return "", "", false
+	}
+	// md5sum为两个空格或者空格加'*',md5 -r为一个空格
+	rest = rest[1:]
+	if strings.HasPrefix(rest, " ") || strings.HasPrefix(rest, "*") {
+		rest = rest[1:]
+	}
+	if !strings.HasPrefix(rest, "./") {
+		return "", "", false
+	}
+	name := rest[2:]
+	if escaped {
+		var buf strings.Builder
+		for i := 0; i < len(name); i++ {
+			if name[i] != '\\' {
+				buf.WriteByte(name[i])
+				continue
+			}
+			if i++; i == len(name) {
+				return "", "", false
+			}
+			switch name[i] {
+			case '\\':
+				buf.WriteByte('\\')
+			case 'n':
+				buf.WriteByte('\n')
+			case 'r':
+				buf.WriteByte('\r')
+			default:
+				return "", "", false
+			}
+		}
+		name = buf.String()
+	}
+	return name, sum, true
+}
+
+// sshSendFileMode 使用scp协议发送文件并指定文件权限
+func sshSendFileMode(cli *ssh.Client, srcPath, dstPath string, mode os.FileMode) error {
+	File, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer File.Close()
+
+	session, err := cli.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	stat, err := File.Stat()
+	if err != nil {
+		return err
+	}
+	dstFile, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	go func() {
+		fmt.Fprintf(dstFile, "C%04o %d %s\n", mode.Perm(), stat.Size(), filepath.Base(dstPath))
+		io.CopyN(dstFile, File, stat.Size())
+		fmt.Fprint(dstFile, "\x00")
+		dstFile.Close()
+	}()
+	return session.Run(fmt.Sprintf("/usr/bin/scp -qrt %s", shellQuote(dstPath)))
+}
+
+// sshRunScript 执行shell脚本返回标准输出,出错的时候错误信息包含标准错误输出
+func sshRunScript(cli *ssh.Client, script string) ([]byte, error) {
+	session, err := cli.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	// stdout和stderr不能使用同一个bytes.Buffer,并发ReadFrom会互相覆盖数据
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err = session.Run("set -e\n" + script); err != nil {
+		return nil, fmt.Errorf("%s %s", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func printSyncResult(output io.Writer, result *SSHSyncResult, dryRun bool) {
+	if dryRun {
+		fmt.Fprintf(output, "---------------------------DRYRUN\t%s---------------------------\n", result.Host)
+	}
+	for _, name := range result.Delete {
+		fmt.Fprintf(output, "删除:%s\n", name)
+	}
+	for _, name := range result.Add {
+		fmt.Fprintf(output, "增加:%s\n", name)
+	}
+	for _, name := range result.Modify {
+		fmt.Fprintf(output, "修改:%s\n", name)
+	}
+	for _, name := range result.Chmod {
+		fmt.Fprintf(output, "权限:%s\n", name)
+	}
+	for _, name := range result.Ignored {
+		fmt.Fprintf(output, "忽略:%s\n", name)
+	}
+	fmt.Fprintf(output, "Host:%s 增加:%d 修改:%d 权限:%d 删除:%d 忽略:%d 未变化:%d\n", result.Host,
+		len(result.Add), len(result.Modify), len(result.Chmod), len(result.Delete), len(result.Ignored), result.Skipped)
+}
+
+func parentDeleted(deleted []string, name string) bool {
+	for _, dir := range deleted {
+		if strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]*syncEntry) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// shellQuote 使用单引号转义shell参数
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
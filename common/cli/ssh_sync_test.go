@@ -0,0 +1,167 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestParseMD5Line(t *testing.T) {
+	const sum = "d41d8cd98f00b204e9800998ecf8427e"
+	tests := map[string]struct {
+		line, name string
+		ok         bool
+	}{
+		"md5sum":          {sum + "  ./a.txt", "a.txt", true},
+		"binary mode":     {sum + " *./dir/b.bin", "dir/b.bin", true},
+		"bsd md5 -r":      {sum + " ./c d.txt", "c d.txt", true},
+		"leading space":   {sum + "  ./ x", " x", true},
+		"upper case":      {"D41D8CD98F00B204E9800998ECF8427E  ./a", "a", true},
+		"escaped newline": {`\` + sum + `  ./new\nline`, "new\nline", true},
+		"escaped slash":   {`\` + sum + `  ./back\\slash`, `back\slash`, true},
+		"bad escape":      {`\` + sum + `  ./bad\x`, "", false},
+		"trailing escape": {`\` + sum + `  ./bad\`, "", false},
+		"not relative":    {sum + "  /etc/passwd", "", false},
+		"not hex":         {"z41d8cd98f00b204e9800998ecf8427e  ./a", "", false},
+		"empty":           {"", "", false},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, gotSum, ok := parseMD5Line(test.line)
+			if ok != test.ok || got != test.name || ok && gotSum != sum {
+				t.Fatalf("parseMD5Line(%q) = %q, %q, %v, want %q, %v", test.line, got, gotSum, ok, test.name, test.ok)
+			}
+		})
+	}
+}
+
+func TestParentDeleted(t *testing.T) {
+	deleted := []string{"a", "b/c"}
+	for name, want := range map[string]bool{
+		"a/x":     true,
+		"a/x/y":   true,
+		"b/c/d":   true,
+		"a":       false,
+		"ab/x":    false,
+		"b/x":     false,
+		"b/cd/x":  false,
+		"other/a": false,
+	} {
+		if got := parentDeleted(deleted, name); got != want {
+			t.Errorf("parentDeleted(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestSyncDiff(t *testing.T) {
+	file := func(md5 string, mode os.FileMode) *syncEntry { return &syncEntry{md5: md5, mode: mode} }
+	dir := &syncEntry{dir: true, mode: 0755}
+	link := &syncEntry{link: true}
+	local := map[string]*syncEntry{
+		"same":         file("1", 0644),
+		"changed":      file("2", 0644),
+		"mode":         file("3", 0755),
+		"new":          file("4", 0644),
+		"newdir":       dir,
+		"newdir/f":     file("5", 0644),
+		"was_dir":      file("6", 0644),
+		"was_file":     dir,
+		"remote_link":  file("7", 0644),
+		"local_link":   link,
+		"keep/sub":     file("8", 0644),
+		"keep":         dir,
+		"local_dirlnk": link,
+	}
+	remote := map[string]*syncEntry{
+		"same":             file("1", 0644),
+		"changed":          file("x", 0644),
+		"mode":             file("3", 0644),
+		"was_dir":          dir,
+		"was_dir/child":    file("9", 0644),
+		"was_file":         file("6", 0644),
+		"remote_link":      link,
+		"local_link":       file("a", 0644),
+		"keep":             dir,
+		"keep/sub":         file("8", 0644),
+		"keep/extra":       file("b", 0644),
+		"gone":             dir,
+		"gone/f":           file("c", 0644),
+		"local_dirlnk":     dir,
+		"local_dirlnk/old": file("d", 0644),
+	}
+
+	result, mkdirs := syncDiff(local, remote, true)
+	want := &SSHSyncResult{
+		Add:     []string{"new", "newdir/f", "remote_link", "was_dir"},
+		Modify:  []string{"changed"},
+		Chmod:   []string{"mode"},
+		Delete:  []string{"remote_link", "was_dir", "was_file", "gone", "keep/extra"},
+		Ignored: []string{"local_dirlnk", "local_link"},
+		Skipped: 3,
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("syncDiff() = %+v\nwant %+v", result, want)
+	}
+	if wantDirs := []string{"newdir", "was_file"}; !reflect.DeepEqual(mkdirs, wantDirs) {
+		t.Errorf("mkdirs = %v, want %v", mkdirs, wantDirs)
+	}
+
+	// 不删除的时候只有类型不同的需要删除
+	result, _ = syncDiff(local, remote, false)
+	if wantDel := []string{"remote_link", "was_dir", "was_file"}; !reflect.DeepEqual(result.Delete, wantDel) {
+		t.Errorf("syncDiff(del=false).Delete = %v, want %v", result.Delete, wantDel)
+	}
+}
+
+// 在本机执行远程列表脚本,结果应该和本地列表相同
+func TestRemoteSyncListScript(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("需要sh")
+	}
+	if _, err := exec.LookPath("md5sum"); err != nil {
+		t.Skip("需要md5sum")
+	}
+	root, err := ioutil.TempDir("", "ssh_sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for name, data := range map[string]string{"a.txt": "a", "sub dir/b.txt": "b", "new\nline": "c", `back\slash`: "d", "tab\tname": "e"} {
+		name = filepath.Join(root, name)
+		if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(name, []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Symlink("a.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command("sh", "-c", "set -e\ncd "+shellQuote(root)+"\n"+remoteSyncListScript).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := parseRemoteSyncList(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := localSyncList(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 本地的符号链接不读取权限
+	remote["link"].mode = 0
+	if !reflect.DeepEqual(remote, local) {
+		for name, entry := range remote {
+			t.Logf("remote %q %+v, local %+v", name, *entry, local[name])
+		}
+		t.Fatal("remote list differs from local list")
+	}
+}
@@ -1,7 +1,10 @@
 package cli
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"os"
 )
 
@@ -10,3 +13,20 @@ func FatalOutput(code int, format string, v ...interface{}) {
 	fmt.Fprintf(os.Stderr, format, v...)
 	os.Exit(code)
 }
+
+// ClientTLSConfig 创建客户端tls配置,ca不为空的时候使用指定的CA校验服务端证书
+func ClientTLSConfig(ca string, insecure bool) (*tls.Config, error) {
+	var tlscfg = &tls.Config{InsecureSkipVerify: insecure}
+	if ca != "" {
+		buf, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("%s 中没有有效的证书", ca)
+		}
+		tlscfg.RootCAs = pool
+	}
+	return tlscfg, nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/czxichen/wstools/command"
 	"github.com/spf13/cobra"
@@ -32,6 +33,15 @@ var rootCMD = &cobra.Command{
 }
 
 func main() {
+	// 作为sendmail调用的时候,参数按sendmail的格式解析
+	if filepath.Base(os.Args[0]) == "sendmail" {
+		command.Sendmail(os.Args[1:])
+		return
+	}
+	if len(os.Args) > 2 && os.Args[1] == "mail" && os.Args[2] == "--sendmail" {
+		command.Sendmail(os.Args[3:])
+		return
+	}
 	command.HelpFunc(rootCMD)
 	rootCMD.AddCommand(version, command.Compress, command.Md5sum, command.Net, command.Deploy,
 		command.Find, command.Compare, command.Ftp, command.RSA, command.Tail, command.Watchdog,